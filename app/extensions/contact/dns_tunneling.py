@@ -6,6 +6,7 @@ from plugins.sandcat.app.utility.base_extension import Extension
 GOCAT_PLUGIN = 'gocat'
 PACKAGE_NAME = 'contact'
 FILE_NAME = 'dns_tunneling.go'
+UTIL_FILE_NAME = 'dns_tunneling_util.go'
 DOMAIN_CONFIG = 'app.contact.dns.domain'
 TEXT_TO_REPLACE = r'{DNS_TUNNELING_C2_DOMAIN}'
 
@@ -16,7 +17,7 @@ def load():
 
 class DnsTunneling(Extension):
     def __init__(self):
-        super().__init__([(FILE_NAME, PACKAGE_NAME)],
+        super().__init__([(FILE_NAME, PACKAGE_NAME), (UTIL_FILE_NAME, PACKAGE_NAME)],
                          dependencies=['github.com/miekg/dns'],
                          file_hooks={FILE_NAME: self.hook_set_custom_domain})
 
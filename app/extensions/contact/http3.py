@@ -0,0 +1,12 @@
+from plugins.sandcat.app.utility.base_extension import Extension
+
+
+def load():
+    return Http3()
+
+
+class Http3(Extension):
+
+    def __init__(self):
+        super().__init__([('http3_transport.go', 'contact')],
+                         dependencies=['github.com/quic-go/quic-go/http3'])
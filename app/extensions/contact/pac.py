@@ -0,0 +1,12 @@
+from plugins.sandcat.app.utility.base_extension import Extension
+
+
+def load():
+    return Pac()
+
+
+class Pac(Extension):
+
+    def __init__(self):
+        super().__init__([('pac_evaluator.go', 'contact')],
+                         dependencies=['github.com/dop251/goja'])
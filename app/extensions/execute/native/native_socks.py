@@ -0,0 +1,16 @@
+from plugins.sandcat.app.utility.base_extension import Extension
+
+
+def load():
+    return NativeSocksExecutor()
+
+
+class NativeSocksExecutor(Extension):
+
+    def __init__(self):
+        super().__init__([
+            ('native.go', 'execute/native'),
+            ('*', 'execute/native/socks'),
+            ('util.go', 'execute/native/util'),
+        ])
+        self.dependencies = []
@@ -0,0 +1,12 @@
+from plugins.sandcat.app.utility.base_extension import Extension
+
+
+def load():
+    return ProxyTcp()
+
+
+class ProxyTcp(Extension):
+
+    def __init__(self):
+        super().__init__([('proxy_tcp.go', 'proxy')])
+        self.dependencies = []
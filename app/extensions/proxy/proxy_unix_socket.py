@@ -0,0 +1,12 @@
+from plugins.sandcat.app.utility.base_extension import Extension
+
+
+def load():
+    return ProxyUnixSocket()
+
+
+class ProxyUnixSocket(Extension):
+
+    def __init__(self):
+        super().__init__([('proxy_unix_socket.go', 'proxy')])
+        self.dependencies = []
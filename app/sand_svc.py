@@ -10,7 +10,8 @@ from shutil import which
 
 from app.utility.base_service import BaseService
 
-default_flag_params = ('server', 'group', 'listenP2P', 'c2', 'includeProxyPeers', 'userAgent')
+default_flag_params = ('server', 'group', 'listenP2P', 'c2', 'includeProxyPeers', 'userAgent', 'c2Config',
+                       'httpProfile', 'p2pKey', 'mdnsConfig')
 library_flag_params = ('runOnInit',)
 gocat_variants = dict(
     basic=set(),
@@ -127,6 +128,9 @@ class SandService(BaseService):
                     if encoded_info and xor_key:
                         ldflags.append('-X github.com/mitre/gocat/proxy.%s=%s' % ('encodedReceivers', encoded_info))
                         ldflags.append('-X github.com/mitre/gocat/proxy.%s=%s' % ('receiverKey', xor_key))
+                elif param == 'p2pKey':
+                    sanitized = self.file_svc.sanitize_ldflag_value(param, value)
+                    ldflags.append('-X github.com/mitre/gocat/p2pauth.%s=%s' % ('sharedKey', sanitized))
                 else:
                     sanitized = self.file_svc.sanitize_ldflag_value(param, value)
                     ldflags.append('-X main.%s=%s' % (param, sanitized))
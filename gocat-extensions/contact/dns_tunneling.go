@@ -3,16 +3,19 @@ package contact
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mitre/gocat/output"
@@ -27,6 +30,12 @@ const (
 	MIN_MESSAGE_ID = 10000000
 	MAX_MESSAGE_ID = 99999999
 	MAX_UPLOAD_CHUNK_SIZE = 31 // DNS label is 63 characters max, so 31 bytes in hex reaches 62 characters.
+	DEFAULT_DNS_ENCODING = "hex"
+	DEFAULT_DATA_LABELS = 1
+	DEFAULT_DNS_TRANSPORT = DNS_TRANSPORT_UDP
+	DEFAULT_MAX_RETRIES = 3
+	DEFAULT_WINDOW_SIZE = 1
+	DEFAULT_MAX_TXT_FETCHES = 65536
 
 	BEACON_UPLOAD_TYPE = "be"
 	INSTRUCTION_DOWNLOAD_TYPE = "id"
@@ -42,12 +51,37 @@ type DnsTunneling struct {
 	resolver *net.Resolver
 	resolverContext context.Context
 	dnsServerAddr string
+	baseDomain string
+	encoding *dnsLabelEncoding // encoding for data labels in query names
+	dataLabels int // number of data labels per query name
+	ednsBufferSize uint16 // advertised EDNS0 UDP buffer size. EDNS0 is disabled if set to 0.
+	transport string // one of udp, tcp, tls, or https
+	tlsServerName string // server name to send via SNI for DNS-over-TLS and DNS-over-HTTPS
+	dohUrl string // DNS-over-HTTPS endpoint
+	httpClient *http.Client // client for DNS-over-HTTPS requests
+	maxRetries int // number of times to retry a failed query
+	queryTimeout time.Duration // timeout for each individual query
+	windowSize int // max number of data chunk queries in flight at once
+	maxTxtFetches int // max number of TXT queries when fetching a single response
+	indexedTxt bool // whether TXT chunks are fetched by index, which requires server support
 }
 
 func init() {
-	CommunicationChannels["DnsTunneling"] = &DnsTunneling{
+	CommunicationChannels["DnsTunneling"] = newDnsTunneling(BASE_DOMAIN)
+}
+
+func newDnsTunneling(baseDomain string) *DnsTunneling {
+	return &DnsTunneling{
 		name: "DnsTunneling",
 		resolverContext: context.Background(),
+		baseDomain: baseDomain,
+		encoding: dnsLabelEncodings[DEFAULT_DNS_ENCODING],
+		dataLabels: DEFAULT_DATA_LABELS,
+		transport: DEFAULT_DNS_TRANSPORT,
+		maxRetries: DEFAULT_MAX_RETRIES,
+		queryTimeout: time.Second * time.Duration(TIMEOUT_SECONDS),
+		windowSize: DEFAULT_WINDOW_SIZE,
+		maxTxtFetches: DEFAULT_MAX_TXT_FETCHES,
 	}
 }
 
@@ -127,9 +161,123 @@ func (d* DnsTunneling) C2RequirementsMet(profile map[string]interface{}, criteri
 	if d.resolver == nil {
 		d.setResolver()
 	}
+	if err := d.applyConfig(criteria); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Invalid DNS tunneling config: %s", err.Error()))
+		return false, nil
+	}
     return true, nil
 }
 
+// Applies optional DNS tunneling settings from the contact config:
+//	dnsEncoding: encoding for data labels (hex, base32, or base36). Encodings other than hex require server support.
+//	dnsDataLabels: number of data labels per query, capped by the 253-character query name limit. Requires server
+//		support for more than one label.
+//	dnsEdnsBufferSize: EDNS0 UDP buffer size to advertise, allowing larger TXT responses
+//	dnsTransport: transport for DNS queries (udp, tcp, tls, or https)
+//	dnsDohUrl: DNS-over-HTTPS endpoint. Defaults to https://[server address]/dns-query
+//	dnsTlsServerName: server name to send via SNI for DNS-over-TLS and DNS-over-HTTPS
+//	dnsMaxRetries: number of times to retry a failed query before giving up on the message
+//	dnsQueryTimeout: timeout for each query, as a duration (e.g. 500ms) or number of seconds
+//	dnsWindowSize: max number of queries in flight at once when sending data, or when fetching indexed TXT chunks
+//	dnsMaxTxtFetches: max number of TXT queries when fetching a single response
+//	dnsIndexedTxt: whether to fetch TXT chunks by index, with retries and windowing. Requires server support.
+func (d* DnsTunneling) applyConfig(criteria map[string]string) error {
+	if encodingName, ok := criteria["dnsEncoding"]; ok && len(encodingName) > 0 {
+		encoding, err := getDnsLabelEncoding(encodingName)
+		if err != nil {
+			return err
+		}
+		d.encoding = encoding
+	}
+	if dataLabelsStr, ok := criteria["dnsDataLabels"]; ok && len(dataLabelsStr) > 0 {
+		dataLabels, err := strconv.Atoi(dataLabelsStr)
+		if err != nil || dataLabels < 1 {
+			return errors.New(fmt.Sprintf("Invalid number of data labels: %s", dataLabelsStr))
+		}
+		d.dataLabels = dataLabels
+	}
+	if bufferSizeStr, ok := criteria["dnsEdnsBufferSize"]; ok && len(bufferSizeStr) > 0 {
+		bufferSize, err := strconv.ParseUint(bufferSizeStr, 10, 16)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid EDNS0 buffer size: %s", bufferSizeStr))
+		}
+		d.ednsBufferSize = uint16(bufferSize)
+	}
+	if err := parseIntConfig(criteria, "dnsMaxRetries", 0, &d.maxRetries); err != nil {
+		return err
+	}
+	if err := parseIntConfig(criteria, "dnsWindowSize", 1, &d.windowSize); err != nil {
+		return err
+	}
+	if err := parseIntConfig(criteria, "dnsMaxTxtFetches", 1, &d.maxTxtFetches); err != nil {
+		return err
+	}
+	if indexedTxtStr, ok := criteria["dnsIndexedTxt"]; ok && len(indexedTxtStr) > 0 {
+		indexedTxt, err := strconv.ParseBool(indexedTxtStr)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid value %s for dnsIndexedTxt", indexedTxtStr))
+		}
+		d.indexedTxt = indexedTxt
+	}
+	if timeoutStr, ok := criteria["dnsQueryTimeout"]; ok && len(timeoutStr) > 0 {
+		timeout, err := parseQueryTimeout(timeoutStr)
+		if err != nil {
+			return err
+		}
+		d.queryTimeout = timeout
+	}
+	if transport, ok := criteria["dnsTransport"]; ok && len(transport) > 0 {
+		if _, supported := dnsTransportNetworks[strings.ToLower(transport)]; !supported {
+			return errors.New(fmt.Sprintf("Unsupported DNS transport %s", transport))
+		}
+		d.transport = strings.ToLower(transport)
+	}
+	if tlsServerName, ok := criteria["dnsTlsServerName"]; ok {
+		d.tlsServerName = tlsServerName
+	}
+	if d.transport == DNS_TRANSPORT_HTTPS {
+		if err := d.setDohClient(criteria["dnsDohUrl"], criteria); err != nil {
+			return err
+		}
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] DNS tunneling over %s using %s encoding with %d data label(s) per query and window size %d. Indexed TXT fetching: %t", d.transport, d.encoding.name, d.encoding.dataLabelsPerQuery(d.dataLabels, d.baseDomain), d.windowSize, d.indexedTxt))
+	return nil
+}
+
+// Sets up the DNS-over-HTTPS endpoint and client, using the HTTP proxy settings if any are provided.
+func (d* DnsTunneling) setDohClient(dohUrl string, criteria map[string]string) error {
+	if len(dohUrl) == 0 {
+		dohUrl = fmt.Sprintf("https://%s%s", d.dnsServerAddr, DEFAULT_DOH_PATH)
+	}
+	if _, err := url.ParseRequestURI(dohUrl); err != nil {
+		return errors.New(fmt.Sprintf("Invalid DNS-over-HTTPS URL %s: %s", dohUrl, err.Error()))
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = d.getTlsConfig()
+	proxyDialer, err := configureProxy(transport, criteria)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid HTTP proxy settings: %s", err.Error()))
+	}
+	var roundTripper http.RoundTripper = transport
+	if proxyDialer != nil {
+		roundTripper = &proxyRoundTripper{next: transport, dialer: proxyDialer}
+	}
+	d.dohUrl = dohUrl
+	d.httpClient = &http.Client{
+		Transport: roundTripper,
+		Timeout: d.queryTimeout,
+	}
+	return nil
+}
+
+// Resolvers used for tunneling typically present self-signed certificates, similar to the HTTP contact.
+func (d* DnsTunneling) getTlsConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName: d.tlsServerName,
+	}
+}
+
 func (d* DnsTunneling) SetUpstreamDestAddr(upstreamDestAddr string) {
 	d.dnsServerAddr = upstreamDestAddr
 	d.setResolver()
@@ -225,31 +373,53 @@ func (d* DnsTunneling) tunnelBytes(dataType string, data []byte) (string, error)
 	return messageID, d.tunnelBytesWithSpecificID(messageID, dataType, data)
 }
 
+// Sends the data in chunks, with up to windowSize chunks in flight at once. Each chunk is acknowledged
+// separately, so only failed chunks are retried. The server marks the message as complete upon receiving
+// the final chunk, so the final chunk is only sent once all other chunks have been acknowledged.
 func (d* DnsTunneling) tunnelBytesWithSpecificID(messageID string, dataType string, data []byte) error {
 	// Chunk out data
 	dataSize := len(data)
-	numChunks := int(math.Ceil(float64(dataSize) / float64(MAX_UPLOAD_CHUNK_SIZE)))
-	start := 0
-	finalChunk := false
-	for i := 0; i < numChunks; i++ {
-		end := start + MAX_UPLOAD_CHUNK_SIZE
+	chunkSize := d.getChunkSize()
+	numChunks := int(math.Ceil(float64(dataSize) / float64(chunkSize)))
+	sendChunk := func(chunkIndex int) error {
+		start := chunkIndex * chunkSize
+		end := start + chunkSize
 		if end > dataSize {
 			end = dataSize
 		}
-		if (i == numChunks - 1) {
-			finalChunk = true
-		}
-		chunk := data[start:end]
-		qname, err := generateQname(messageID, dataType, i, numChunks, chunk)
+		qname, err := d.generateQname(messageID, dataType, chunkIndex, numChunks, data[start:end])
 		if err != nil {
 			return err
 		}
-		if err = d.sendDataChunk(qname, finalChunk); err != nil {
-			return err
+		finalChunk := chunkIndex == numChunks - 1
+		return d.withRetries(fmt.Sprintf("data chunk %d/%d of message %s", chunkIndex + 1, numChunks, messageID), func() error {
+			return d.sendDataChunk(qname, finalChunk)
+		})
+	}
+	if numChunks == 0 {
+		return nil
+	}
+	if err := runInWindow(numChunks - 1, d.windowSize, sendChunk); err != nil {
+		return err
+	}
+	return sendChunk(numChunks - 1)
+}
+
+// Calls the given query function, retrying up to maxRetries times upon failure.
+func (d *DnsTunneling) withRetries(description string, query func() error) error {
+	var err error
+	for attempt := 0; attempt <= d.maxRetries; attempt++ {
+		if err = query(); err == nil {
+			return nil
 		}
-		start += MAX_UPLOAD_CHUNK_SIZE
+		output.VerbosePrint(fmt.Sprintf("[-] Attempt %d for %s failed: %s", attempt + 1, description, err.Error()))
 	}
-	return nil
+	return errors.New(fmt.Sprintf("Giving up on %s after %d attempt(s): %s", description, d.maxRetries + 1, err.Error()))
+}
+
+// Returns the max number of data bytes that can be sent in a single query.
+func (d *DnsTunneling) getChunkSize() int {
+	return d.encoding.maxBytesPerLabel * d.encoding.dataLabelsPerQuery(d.dataLabels, d.baseDomain)
 }
 
 // If data chunk is the final chunk and server does not respond with completion, returns error.
@@ -269,75 +439,146 @@ func (d *DnsTunneling) sendDataChunk(qname string, finalChunk bool) error {
 	return nil
 }
 
+// Fetches the response via TXT queries. Fetching stops after maxTxtFetches chunks in case the server
+// never indicates that the response is complete.
 func (d *DnsTunneling) fetchResponseViaTxt(messageID, messageType string) ([]byte, error) {
-	completed := false
+	if d.indexedTxt {
+		return d.fetchIndexedResponseViaTxt(messageID, messageType)
+	}
+	return d.fetchSequentialResponseViaTxt(messageID, messageType)
+}
+
+// Fetches the response one chunk at a time. The server sends the next chunk upon each query, regardless of
+// the chunk index, so failed queries are not retried since the server may have already sent their chunk.
+func (d *DnsTunneling) fetchSequentialResponseViaTxt(messageID, messageType string) ([]byte, error) {
 	var buffer bytes.Buffer
-	for (!completed) {
-		randomData := generateRandomData(MAX_UPLOAD_CHUNK_SIZE)
-		qname, err := generateQname(messageID, messageType, 0, 1, randomData)
-		if err != nil {
-			return nil, err
+	for fetches := 0; ; fetches++ {
+		if fetches >= d.maxTxtFetches {
+			return nil, errors.New(fmt.Sprintf("Server did not finish sending message %s within %d TXT queries.", messageID, d.maxTxtFetches))
 		}
-		responses, err := d.fetchTxtRecords(qname)
+		chunk, finalChunk, err := d.fetchTxtChunk(messageID, messageType, 0)
 		if err != nil {
 			return nil, err
 		}
-		if len(responses) == 0 || len(responses[0]) == 0 {
-			return nil, errors.New("Server failed to send back any data via TXT record.")
+		buffer.WriteString(chunk)
+		if finalChunk {
+			break
 		}
+	}
+	output.VerbosePrint("Finished fetching data from server.")
+	return base64.StdEncoding.DecodeString(buffer.String())
+}
 
-		// Expecting only one txt response. Last char of response indicates whether or not there is remaining data.
-		chunkLength := len(responses[0]) - 1
-		buffer.WriteString(responses[0][:chunkLength])
-		finalChar := string(responses[0][chunkLength])
-		if finalChar == "." {
-			// Still expecting more data from server
-			continue
-		} else if finalChar == "," {
-			completed = true
-			output.VerbosePrint("Finished fetching data from server.")
-		} else {
-			return nil, errors.New(fmt.Sprintf("Server responded with invalid final TXT record character %s", finalChar))
+// Fetches the response in indexed chunks, with up to windowSize TXT queries in flight at once.
+// Chunks are reassembled by index, so they may arrive in any order, and failed queries are retried.
+func (d *DnsTunneling) fetchIndexedResponseViaTxt(messageID, messageType string) ([]byte, error) {
+	chunks := make(map[int]string)
+	finalIndex := -1
+	for batchStart := 0; finalIndex < 0; batchStart += d.windowSize {
+		if batchStart >= d.maxTxtFetches {
+			return nil, errors.New(fmt.Sprintf("Server did not finish sending message %s within %d TXT queries.", messageID, d.maxTxtFetches))
+		}
+		batchSize := d.windowSize
+		if batchStart + batchSize > d.maxTxtFetches {
+			batchSize = d.maxTxtFetches - batchStart
+		}
+		batchChunks := make([]string, batchSize)
+		batchFinal := make([]bool, batchSize)
+		batchErrs := make([]error, batchSize)
+		runInWindow(batchSize, batchSize, func(i int) error {
+			chunkIndex := batchStart + i
+			batchErrs[i] = d.withRetries(fmt.Sprintf("TXT chunk %d of message %s", chunkIndex, messageID), func() error {
+				var err error
+				batchChunks[i], batchFinal[i], err = d.fetchTxtChunk(messageID, messageType, chunkIndex)
+				return err
+			})
+			return nil
+		})
+
+		// Chunks past the final one are not needed, so their errors are ignored.
+		for i := 0; i < batchSize && finalIndex < 0; i++ {
+			if batchErrs[i] != nil {
+				return nil, batchErrs[i]
+			}
+			chunks[batchStart + i] = batchChunks[i]
+			if batchFinal[i] {
+				finalIndex = batchStart + i
+			}
 		}
 	}
+	output.VerbosePrint("Finished fetching data from server.")
+	var buffer bytes.Buffer
+	for i := 0; i <= finalIndex; i++ {
+		buffer.WriteString(chunks[i])
+	}
 	return base64.StdEncoding.DecodeString(buffer.String())
 }
 
-func generateQname(messageID string, messageType string, chunkIndex int, numChunks int, data []byte) (string, error) {
-	if len(data) > MAX_UPLOAD_CHUNK_SIZE {
+// Fetches the chunk with the given index of the server response, or the next chunk if the server
+// sends chunks sequentially. Returns the chunk data and whether or not it is the final chunk.
+func (d *DnsTunneling) fetchTxtChunk(messageID string, messageType string, chunkIndex int) (string, bool, error) {
+	randomData := generateRandomData(d.encoding.maxBytesPerLabel)
+	qname, err := d.generateQname(messageID, messageType, chunkIndex, 1, randomData)
+	if err != nil {
+		return "", false, err
+	}
+	responses, err := d.fetchTxtRecords(qname)
+	if err != nil {
+		return "", false, err
+	}
+
+	// The server may split larger responses across several TXT strings when EDNS0 is enabled.
+	// Last char of the combined response indicates whether or not there is remaining data.
+	response := strings.Join(responses, "")
+	if len(response) == 0 {
+		return "", false, errors.New("Server failed to send back any data via TXT record.")
+	}
+	chunkLength := len(response) - 1
+	finalChar := string(response[chunkLength])
+	if finalChar == "." {
+		// Still expecting more data from server
+		return response[:chunkLength], false, nil
+	} else if finalChar == "," {
+		return response[:chunkLength], true, nil
+	}
+	return "", false, errors.New(fmt.Sprintf("Server responded with invalid final TXT record character %s", finalChar))
+}
+
+// Query names take the form messageID.messageType.chunkIndex.numChunks.dataLabel1[...dataLabelN].baseDomain.
+func (d* DnsTunneling) generateQname(messageID string, messageType string, chunkIndex int, numChunks int, data []byte) (string, error) {
+	if len(data) > d.getChunkSize() {
 		return "", errors.New("Data chunk too large.")
 	}
-	dataHex := hex.EncodeToString(data)
-	return fmt.Sprintf("%s.%s.%d.%d.%s.%s.", messageID, messageType, chunkIndex, numChunks, dataHex, BASE_DOMAIN), nil
+	dataLabels := d.encoding.encodeLabels(data)
+	return fmt.Sprintf("%s.%s.%d.%d.%s.%s.", messageID, messageType, chunkIndex, numChunks, dataLabels, d.baseDomain), nil
 }
 
+// Returns the strings from all TXT records in the answer, in order.
 func (d* DnsTunneling) fetchTxtRecords(qname string) ([]string, error) {
-	msg := new(dns.Msg)
-	msg.Id = dns.Id()
-	msg.RecursionDesired = true
-	msg.Question = make([]dns.Question, 1)
-	msg.Question[0] = dns.Question{qname, dns.TypeTXT, dns.ClassINET}
-	answer, err := dns.Exchange(msg, d.dnsServerAddr)
+	answer, err := d.exchange(qname, dns.TypeTXT)
 	if err != nil {
 		return nil, err
 	}
-	if txtRecordStruct, ok := answer.Answer[0].(*dns.TXT); ok {
-		return txtRecordStruct.Txt, nil
-	} else {
+	var txtStrings []string
+	for _, record := range answer.Answer {
+		if txtRecordStruct, ok := record.(*dns.TXT); ok {
+			txtStrings = append(txtStrings, txtRecordStruct.Txt...)
+		}
+	}
+	if len(txtStrings) == 0 {
 		return nil, errors.New("Failed to retrieve TXT records.")
 	}
+	return txtStrings, nil
 }
 
 func (d* DnsTunneling) fetchARecord(qname string) (net.IP, error) {
-	msg := new(dns.Msg)
-	msg.Id = dns.Id()
-	msg.RecursionDesired = true
-	msg.Question = make([]dns.Question, 1)
-	msg.Question[0] = dns.Question{qname, dns.TypeA, dns.ClassINET}
-	answer, err := dns.Exchange(msg, d.dnsServerAddr)
+	answer, err := d.exchange(qname, dns.TypeA)
 	if err != nil {
 		return net.IPv4(0, 0, 0, 0), err
 	}
+	if len(answer.Answer) == 0 {
+		return net.IPv4(0, 0, 0, 0), errors.New("Failed to retrieve A record.")
+	}
 	if aRecordStruct, ok := answer.Answer[0].(*dns.A); ok {
 		return aRecordStruct.A, nil
 	} else {
@@ -345,6 +586,36 @@ func (d* DnsTunneling) fetchARecord(qname string) (net.IP, error) {
 	}
 }
 
+// Sends a query for the given name and record type over the configured transport. If EDNS0 is enabled
+// and the UDP response is still truncated, the query is retried over TCP.
+func (d* DnsTunneling) exchange(qname string, recordType uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.Id = dns.Id()
+	msg.RecursionDesired = true
+	msg.Question = make([]dns.Question, 1)
+	msg.Question[0] = dns.Question{qname, recordType, dns.ClassINET}
+	if d.ednsBufferSize > 0 {
+		msg.SetEdns0(d.ednsBufferSize, false)
+	}
+	if d.transport == DNS_TRANSPORT_HTTPS {
+		return exchangeHttps(d.httpClient, d.dohUrl, msg)
+	}
+	client := &dns.Client{
+		Net: dnsTransportNetworks[d.transport],
+		Timeout: d.queryTimeout,
+		UDPSize: d.ednsBufferSize,
+	}
+	if d.transport == DNS_TRANSPORT_TLS {
+		client.TLSConfig = d.getTlsConfig()
+	}
+	answer, _, err := client.Exchange(msg, d.dnsServerAddr)
+	if err == nil && answer.Truncated && d.ednsBufferSize > 0 && d.transport == DNS_TRANSPORT_UDP {
+		client.Net = dnsTransportNetworks[DNS_TRANSPORT_TCP]
+		answer, _, err = client.Exchange(msg, d.dnsServerAddr)
+	}
+	return answer, err
+}
+
 // Generate random 8-digit message ID
 func generateRandomMessageID() string {
 	rand.Seed(time.Now().UnixNano())
@@ -0,0 +1,463 @@
+package contact
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testBaseDomain       = "tunnel.example.com"
+	testMaxTxtString     = 255
+	testResponseOverhead = 300 // room for the question and answer names and record headers
+)
+
+// Minimal in-process DNS tunneling server that reassembles uploaded chunks and serves TXT downloads.
+type stubDnsServer struct {
+	t           *testing.T
+	encoding    *dnsLabelEncoding
+	mutex       sync.Mutex
+	queries     int
+	uploads     map[string]map[int][]byte
+	downloads   map[string]string
+	seenNames   map[string]bool
+	dropEvery   int  // drops the first query for every nth distinct query name, if set
+	dropAll     bool // drops every query
+	neverFinish bool // never marks TXT downloads as complete
+	indexedTxt  bool // serves TXT chunks by index, rather than the next chunk upon each query like the C2 server
+	txtOffsets  map[string]int
+	udpServer   *dns.Server
+	tcpServer   *dns.Server
+	tlsServer   *dns.Server
+	dohServer   *httptest.Server
+	addr        string
+	tlsAddr     string
+}
+
+func newStubDnsServer(t *testing.T) *stubDnsServer {
+	s := &stubDnsServer{
+		t:          t,
+		uploads:    make(map[string]map[int][]byte),
+		downloads:  make(map[string]string),
+		seenNames:  make(map[string]bool),
+		txtOffsets: make(map[string]int),
+	}
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = packetConn.LocalAddr().String()
+	s.udpServer = &dns.Server{PacketConn: packetConn, Handler: s}
+	s.tcpServer = &dns.Server{Listener: listener, Handler: s}
+	go s.udpServer.ActivateAndServe()
+	go s.tcpServer.ActivateAndServe()
+
+	// DNS-over-TLS reuses the self-signed certificate of the DNS-over-HTTPS test server.
+	s.dohServer = httptest.NewTLSServer(s)
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", s.dohServer.TLS.Clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tlsAddr = tlsListener.Addr().String()
+	s.tlsServer = &dns.Server{Listener: tlsListener, Net: "tcp-tls", Handler: s}
+	go s.tlsServer.ActivateAndServe()
+	t.Cleanup(func() {
+		s.udpServer.Shutdown()
+		s.tcpServer.Shutdown()
+		s.tlsServer.Shutdown()
+		s.dohServer.Close()
+	})
+	return s
+}
+
+func (s *stubDnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	maxSize := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		maxSize = int(opt.UDPSize())
+	}
+	if _, isUdp := w.RemoteAddr().(*net.UDPAddr); !isUdp {
+		maxSize = dns.MaxMsgSize
+	}
+	if resp := s.handle(req, maxSize); resp != nil {
+		w.WriteMsg(resp)
+	}
+}
+
+// Handles RFC 8484 DNS-over-HTTPS POST requests.
+func (s *stubDnsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != DEFAULT_DOH_PATH || r.Header.Get("Content-Type") != DNS_MESSAGE_MIME_TYPE {
+		http.Error(w, "invalid DNS-over-HTTPS request", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := new(dns.Msg)
+	if err = req.Unpack(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := s.handle(req, dns.MaxMsgSize)
+	if resp == nil {
+		http.Error(w, "dropped", http.StatusServiceUnavailable)
+		return
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", DNS_MESSAGE_MIME_TYPE)
+	w.Write(packed)
+}
+
+func (s *stubDnsServer) handle(req *dns.Msg, maxSize int) *dns.Msg {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries++
+	question := req.Question[0]
+	if s.dropAll {
+		return nil
+	}
+	if !s.seenNames[question.Name] {
+		s.seenNames[question.Name] = true
+		if s.dropEvery > 0 && len(s.seenNames)%s.dropEvery == 0 {
+			return nil
+		}
+	}
+	labels := strings.Split(strings.TrimSuffix(question.Name, "."+testBaseDomain+"."), ".")
+	messageID, messageType := labels[0], labels[1]
+	chunkIndex, _ := strconv.Atoi(labels[2])
+	numChunks, _ := strconv.Atoi(labels[3])
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Compress = true
+	switch question.Qtype {
+	case dns.TypeA:
+		data, err := s.encoding.decodeLabels(labels[4:])
+		if err != nil {
+			s.t.Errorf("failed to decode labels of %s: %s", question.Name, err.Error())
+			resp.Rcode = dns.RcodeFormatError
+			return resp
+		}
+		if s.uploads[messageID] == nil {
+			s.uploads[messageID] = make(map[int][]byte)
+		}
+		s.uploads[messageID][chunkIndex] = data
+		lastOctet := byte(2)
+		if chunkIndex == numChunks-1 {
+			lastOctet = 3
+			if len(s.uploads[messageID]) != numChunks {
+				s.t.Errorf("received final chunk of message %s before all other chunks", messageID)
+			}
+		}
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IPv4(10, 0, 0, lastOctet),
+		})
+	case dns.TypeTXT:
+		download := s.downloads[messageType+messageID]
+		chunkSize := maxSize - testResponseOverhead - maxSize/testMaxTxtString
+		start := chunkIndex * chunkSize
+		if !s.indexedTxt {
+			start = s.txtOffsets[messageType+messageID]
+			s.txtOffsets[messageType+messageID] = start + chunkSize
+		}
+		if start > len(download) {
+			start = len(download)
+		}
+		end := start + chunkSize
+		finalChar := "."
+		if end >= len(download) && !s.neverFinish {
+			end = len(download)
+			finalChar = ","
+		} else if end > len(download) {
+			end = len(download)
+		}
+		payload := download[start:end] + finalChar
+		var txtStrings []string
+		for len(payload) > testMaxTxtString {
+			txtStrings = append(txtStrings, payload[:testMaxTxtString])
+			payload = payload[testMaxTxtString:]
+		}
+		txtStrings = append(txtStrings, payload)
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: txtStrings,
+		})
+	}
+	return resp
+}
+
+func (s *stubDnsServer) setDownload(messageID, messageType string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.downloads[messageType+messageID] = base64.StdEncoding.EncodeToString(data)
+	delete(s.txtOffsets, messageType+messageID)
+}
+
+func (s *stubDnsServer) getUpload(messageID string) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var data []byte
+	for i := 0; i < len(s.uploads[messageID]); i++ {
+		data = append(data, s.uploads[messageID][i]...)
+	}
+	return data
+}
+
+func (s *stubDnsServer) getQueryCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queries
+}
+
+func newTestDnsTunneling(t *testing.T, config map[string]string) (*DnsTunneling, *stubDnsServer) {
+	d := newDnsTunneling(testBaseDomain)
+	server := newStubDnsServer(t)
+	switch config["dnsTransport"] {
+	case DNS_TRANSPORT_TLS:
+		d.SetUpstreamDestAddr(server.tlsAddr)
+	case DNS_TRANSPORT_HTTPS:
+		d.SetUpstreamDestAddr(server.dohServer.Listener.Addr().String())
+	default:
+		d.SetUpstreamDestAddr(server.addr)
+	}
+	if err := d.applyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	server.mutex.Lock()
+	server.encoding = d.encoding
+	server.indexedTxt = d.indexedTxt
+	server.mutex.Unlock()
+	return d, server
+}
+
+func generateTestData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDnsLabelEncodingsRoundTrip(t *testing.T) {
+	for name, encoding := range dnsLabelEncodings {
+		for _, size := range []int{1, 7, encoding.maxBytesPerLabel - 1, encoding.maxBytesPerLabel, 3*encoding.maxBytesPerLabel + 5} {
+			data := generateTestData(t, size)
+			data[0] = 0 // leading zero bytes must survive encodings that treat data as a number
+			labels := strings.Split(encoding.encodeLabels(data), ".")
+			for _, label := range labels {
+				if len(label) > MAX_DNS_LABEL_LENGTH {
+					t.Errorf("%s label of length %d exceeds max label length", name, len(label))
+				}
+			}
+			decoded, err := encoding.decodeLabels(labels)
+			if err != nil {
+				t.Fatalf("%s failed to decode %d bytes: %s", name, size, err.Error())
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("%s round trip of %d bytes returned different data", name, size)
+			}
+		}
+	}
+}
+
+func TestDnsQnameLength(t *testing.T) {
+	for name := range dnsLabelEncodings {
+		d, _ := newTestDnsTunneling(t, map[string]string{"dnsEncoding": name, "dnsDataLabels": "10"})
+		qname, err := d.generateQname("99999999", UPLOAD_DATA_TYPE, 9999999, 9999999, generateTestData(t, d.getChunkSize()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(strings.TrimSuffix(qname, ".")) > MAX_DNS_NAME_LENGTH {
+			t.Errorf("%s query name of length %d exceeds max name length", name, len(qname))
+		}
+		if _, err = d.generateQname("99999999", UPLOAD_DATA_TYPE, 0, 1, generateTestData(t, d.getChunkSize()+1)); err == nil {
+			t.Errorf("%s expected error for oversized data chunk", name)
+		}
+	}
+}
+
+func TestDnsInvalidConfig(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"dnsEncoding": "base64"},
+		{"dnsDataLabels": "0"},
+		{"dnsDataLabels": "many"},
+		{"dnsEdnsBufferSize": "70000"},
+		{"dnsTransport": "quic"},
+		{"dnsTransport": "https", "dnsDohUrl": "not a url"},
+		{"dnsMaxRetries": "-1"},
+		{"dnsWindowSize": "0"},
+		{"dnsMaxTxtFetches": "0"},
+		{"dnsIndexedTxt": "sometimes"},
+		{"dnsQueryTimeout": "soon"},
+		{"dnsQueryTimeout": "-5s"},
+	} {
+		d := newDnsTunneling(testBaseDomain)
+		if err := d.applyConfig(config); err == nil {
+			t.Errorf("expected error for config %v", config)
+		}
+	}
+}
+
+func uploadAndCountQueries(t *testing.T, config map[string]string, data []byte) int {
+	d, server := newTestDnsTunneling(t, config)
+	messageID, err := d.tunnelBytes(BEACON_UPLOAD_TYPE, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(server.getUpload(messageID), data) {
+		t.Fatalf("server received different data with config %v", config)
+	}
+	return server.getQueryCount()
+}
+
+func TestDnsMultiLabelUploadUsesFewerQueries(t *testing.T) {
+	data := generateTestData(t, 4096)
+	hexQueries := uploadAndCountQueries(t, map[string]string{}, data)
+	if hexQueries != 133 {
+		t.Errorf("expected 133 queries for legacy hex upload, got %d", hexQueries)
+	}
+	for _, encodingName := range []string{"hex", "base32", "base36"} {
+		queries := uploadAndCountQueries(t, map[string]string{"dnsEncoding": encodingName, "dnsDataLabels": "3"}, data)
+		if queries*2 >= hexQueries {
+			t.Errorf("expected %s with 3 labels to need less than half of %d queries, got %d", encodingName, hexQueries, queries)
+		}
+	}
+}
+
+func downloadAndCountQueries(t *testing.T, config map[string]string, data []byte) int {
+	d, server := newTestDnsTunneling(t, config)
+	server.setDownload("12345678", INSTRUCTION_DOWNLOAD_TYPE, data)
+	received, err := d.fetchResponseViaTxt("12345678", INSTRUCTION_DOWNLOAD_TYPE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("client received different data with config %v", config)
+	}
+	return server.getQueryCount()
+}
+
+func TestDnsEdnsDownloadUsesFewerQueries(t *testing.T) {
+	data := generateTestData(t, 16384)
+	legacyQueries := downloadAndCountQueries(t, map[string]string{}, data)
+	ednsQueries := downloadAndCountQueries(t, map[string]string{"dnsEdnsBufferSize": "4096"}, data)
+	if ednsQueries*4 >= legacyQueries {
+		t.Errorf("expected EDNS0 download to need less than a quarter of %d queries, got %d", legacyQueries, ednsQueries)
+	}
+}
+
+func TestDnsTransports(t *testing.T) {
+	uploadData := generateTestData(t, 1024)
+	downloadData := generateTestData(t, 4096)
+	for _, transport := range []string{DNS_TRANSPORT_UDP, DNS_TRANSPORT_TCP, DNS_TRANSPORT_TLS, DNS_TRANSPORT_HTTPS} {
+		config := map[string]string{"dnsTransport": transport, "dnsEncoding": "base32", "dnsDataLabels": "4"}
+		uploadAndCountQueries(t, config, uploadData)
+		queries := downloadAndCountQueries(t, config, downloadData)
+		if transport != DNS_TRANSPORT_UDP && queries != 1 {
+			t.Errorf("expected stream-based %s transport to fetch the response in a single query, got %d", transport, queries)
+		}
+	}
+}
+
+func TestDnsRetransmitsDroppedQueries(t *testing.T) {
+	uploadData := generateTestData(t, 2048)
+	downloadData := generateTestData(t, 4096)
+	for _, transport := range []string{DNS_TRANSPORT_UDP, DNS_TRANSPORT_HTTPS} {
+		for _, windowSize := range []string{"1", "8"} {
+			config := map[string]string{"dnsTransport": transport, "dnsWindowSize": windowSize, "dnsQueryTimeout": "100ms", "dnsIndexedTxt": "true"}
+			d, server := newTestDnsTunneling(t, config)
+			server.mutex.Lock()
+			server.dropEvery = 3
+			server.mutex.Unlock()
+			messageID, err := d.tunnelBytes(BEACON_UPLOAD_TYPE, uploadData)
+			if err != nil {
+				t.Fatalf("upload over %s with window size %s failed: %s", transport, windowSize, err.Error())
+			}
+			if !bytes.Equal(server.getUpload(messageID), uploadData) {
+				t.Errorf("server received different data over %s with window size %s", transport, windowSize)
+			}
+			server.setDownload("12345678", INSTRUCTION_DOWNLOAD_TYPE, downloadData)
+			received, err := d.fetchResponseViaTxt("12345678", INSTRUCTION_DOWNLOAD_TYPE)
+			if err != nil {
+				t.Fatalf("download over %s with window size %s failed: %s", transport, windowSize, err.Error())
+			}
+			if !bytes.Equal(received, downloadData) {
+				t.Errorf("client received different data over %s with window size %s", transport, windowSize)
+			}
+		}
+	}
+}
+
+func TestDnsGivesUpAfterMaxRetries(t *testing.T) {
+	d, server := newTestDnsTunneling(t, map[string]string{"dnsMaxRetries": "2", "dnsQueryTimeout": "50ms"})
+	server.mutex.Lock()
+	server.dropAll = true
+	server.mutex.Unlock()
+	if _, err := d.tunnelBytes(BEACON_UPLOAD_TYPE, generateTestData(t, 10)); err == nil {
+		t.Errorf("expected upload to fail when every query is dropped")
+	}
+	if queries := server.getQueryCount(); queries != 3 {
+		t.Errorf("expected 3 attempts for the dropped chunk, got %d", queries)
+	}
+}
+
+func TestDnsTxtFetchLimit(t *testing.T) {
+	for _, indexedTxt := range []string{"false", "true"} {
+		d, server := newTestDnsTunneling(t, map[string]string{"dnsMaxTxtFetches": "20", "dnsWindowSize": "3", "dnsIndexedTxt": indexedTxt})
+		server.mutex.Lock()
+		server.neverFinish = true
+		server.mutex.Unlock()
+		server.setDownload("12345678", INSTRUCTION_DOWNLOAD_TYPE, generateTestData(t, 64))
+		if _, err := d.fetchResponseViaTxt("12345678", INSTRUCTION_DOWNLOAD_TYPE); err == nil {
+			t.Errorf("expected error when server never finishes sending data with indexed TXT %s", indexedTxt)
+		}
+		if queries := server.getQueryCount(); queries != 20 {
+			t.Errorf("expected fetching to stop after 20 TXT queries with indexed TXT %s, got %d", indexedTxt, queries)
+		}
+	}
+}
+
+func TestDnsSequentialTxtFetch(t *testing.T) {
+	downloadData := generateTestData(t, 4096)
+	d, server := newTestDnsTunneling(t, map[string]string{"dnsWindowSize": "8", "dnsQueryTimeout": "50ms"})
+	server.setDownload("12345678", INSTRUCTION_DOWNLOAD_TYPE, downloadData)
+	received, err := d.fetchResponseViaTxt("12345678", INSTRUCTION_DOWNLOAD_TYPE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, downloadData) {
+		t.Errorf("client received different data from sequential TXT server")
+	}
+
+	// Failed queries are not retried, since the server may have already sent their chunk.
+	server.mutex.Lock()
+	server.dropAll = true
+	server.queries = 0
+	server.mutex.Unlock()
+	if _, err = d.fetchResponseViaTxt("12345678", INSTRUCTION_DOWNLOAD_TYPE); err == nil {
+		t.Errorf("expected fetch to fail when every query is dropped")
+	}
+	if queries := server.getQueryCount(); queries != 1 {
+		t.Errorf("expected a single attempt for the dropped TXT chunk, got %d", queries)
+	}
+}
@@ -0,0 +1,262 @@
+package contact
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	MAX_DNS_NAME_LENGTH  = 253
+	MAX_DNS_LABEL_LENGTH = 63
+
+	// Worst-case length of the messageID.messageType.chunkIndex.numChunks. prefix of a query name.
+	MAX_QNAME_HEADER_LENGTH = 8 + 1 + 2 + 1 + 7 + 1 + 7 + 1
+
+	DNS_TRANSPORT_UDP   = "udp"
+	DNS_TRANSPORT_TCP   = "tcp"
+	DNS_TRANSPORT_TLS   = "tls"
+	DNS_TRANSPORT_HTTPS = "https"
+
+	DEFAULT_DOH_PATH      = "/dns-query"
+	DNS_MESSAGE_MIME_TYPE = "application/dns-message"
+)
+
+// Encodes data chunks into DNS labels.
+type dnsLabelEncoding struct {
+	name             string
+	maxBytesPerLabel int // max number of data bytes that fit in a single label of at most 63 characters
+	encode           func(data []byte) string
+	decode           func(label string) ([]byte, error)
+}
+
+var (
+	// Lower-case base32 without padding. Resolvers may randomize the case of query names, so decoding is case-insensitive.
+	dnsBase32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	// Maps supported transports to the network names used by the miekg/dns client.
+	// DNS-over-HTTPS is handled separately by exchangeHttps.
+	dnsTransportNetworks = map[string]string{
+		DNS_TRANSPORT_UDP:   "udp",
+		DNS_TRANSPORT_TCP:   "tcp",
+		DNS_TRANSPORT_TLS:   "tcp-tls",
+		DNS_TRANSPORT_HTTPS: "",
+	}
+
+	dnsLabelEncodings = map[string]*dnsLabelEncoding{
+		"hex": {
+			name:             "hex",
+			maxBytesPerLabel: 31,
+			encode:           hex.EncodeToString,
+			decode: func(label string) ([]byte, error) {
+				return hex.DecodeString(strings.ToLower(label))
+			},
+		},
+		"base32": {
+			name:             "base32",
+			maxBytesPerLabel: 39,
+			encode: func(data []byte) string {
+				return strings.ToLower(dnsBase32Encoding.EncodeToString(data))
+			},
+			decode: func(label string) ([]byte, error) {
+				return dnsBase32Encoding.DecodeString(strings.ToUpper(label))
+			},
+		},
+		"base36": {
+			name:             "base36",
+			maxBytesPerLabel: 40,
+			encode:           encodeBase36,
+			decode:           decodeBase36,
+		},
+	}
+)
+
+// Returns the DNS label encoding with the given name.
+func getDnsLabelEncoding(encodingName string) (*dnsLabelEncoding, error) {
+	if encoding, ok := dnsLabelEncodings[strings.ToLower(encodingName)]; ok {
+		return encoding, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported DNS tunneling encoding %s", encodingName))
+}
+
+// Returns the number of characters needed for the encoded form of a full label's worth of data.
+func (e *dnsLabelEncoding) maxLabelLength() int {
+	return len(e.encode(make([]byte, e.maxBytesPerLabel)))
+}
+
+// Returns how many data labels of this encoding fit in a query name for the given base domain,
+// capped at the requested number of labels.
+func (e *dnsLabelEncoding) dataLabelsPerQuery(requestedLabels int, baseDomain string) int {
+	available := MAX_DNS_NAME_LENGTH - MAX_QNAME_HEADER_LENGTH - len(baseDomain)
+	maxLabels := available / (e.maxLabelLength() + 1)
+	if requestedLabels > maxLabels {
+		requestedLabels = maxLabels
+	}
+	if requestedLabels < 1 {
+		return 1
+	}
+	return requestedLabels
+}
+
+// Splits the data into dot-separated encoded labels, with at most maxBytesPerLabel bytes per label.
+func (e *dnsLabelEncoding) encodeLabels(data []byte) string {
+	var labels []string
+	for start := 0; start < len(data); start += e.maxBytesPerLabel {
+		end := start + e.maxBytesPerLabel
+		if end > len(data) {
+			end = len(data)
+		}
+		labels = append(labels, e.encode(data[start:end]))
+	}
+	return strings.Join(labels, ".")
+}
+
+// Decodes and concatenates the given encoded labels.
+func (e *dnsLabelEncoding) decodeLabels(labels []string) ([]byte, error) {
+	var data []byte
+	for _, label := range labels {
+		decoded, err := e.decode(label)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, decoded...)
+	}
+	return data, nil
+}
+
+// Base36 encoding with a fixed width for each input length, so that leading zero bytes are preserved
+// and the decoded length can be derived from the label length.
+func encodeBase36(data []byte) string {
+	encoded := new(big.Int).SetBytes(data).Text(36)
+	width := base36Width(len(data))
+	if len(encoded) < width {
+		encoded = strings.Repeat("0", width-len(encoded)) + encoded
+	}
+	return encoded
+}
+
+func decodeBase36(label string) ([]byte, error) {
+	numBytes := -1
+	for n := 0; base36Width(n) <= len(label); n++ {
+		if base36Width(n) == len(label) {
+			numBytes = n
+			break
+		}
+	}
+	value, ok := new(big.Int).SetString(strings.ToLower(label), 36)
+	if numBytes < 0 || !ok || value.BitLen() > numBytes*8 {
+		return nil, errors.New(fmt.Sprintf("Invalid base36 label %s", label))
+	}
+	return value.FillBytes(make([]byte, numBytes)), nil
+}
+
+// Number of base36 characters needed to represent any value of the given byte length.
+func base36Width(numBytes int) int {
+	return int(math.Ceil(float64(numBytes*8) / math.Log2(36)))
+}
+
+// Sends the DNS query to the DNS-over-HTTPS endpoint using the RFC 8484 wire format.
+func exchangeHttps(client *http.Client, dohUrl string, msg *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends a message ID of 0 to make responses cache-friendly.
+	query := msg.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, dohUrl, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", DNS_MESSAGE_MIME_TYPE)
+	req.Header.Set("Accept", DNS_MESSAGE_MIME_TYPE)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("DNS-over-HTTPS request failed with status %d", resp.StatusCode))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	if err = answer.Unpack(body); err != nil {
+		return nil, err
+	}
+	answer.Id = msg.Id
+	return answer, nil
+}
+
+// Runs the task for each index in [0, numTasks), with at most windowSize tasks running at once.
+// Stops starting new tasks after the first failure and returns the first error encountered.
+func runInWindow(numTasks int, windowSize int, task func(index int) error) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	window := make(chan struct{}, windowSize)
+	for i := 0; i < numTasks; i++ {
+		window <- struct{}{}
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed {
+			<-window
+			break
+		}
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			defer func() { <-window }()
+			if err := task(index); err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Sets the destination to the integer config value for the given key, if present. The value must be at least minVal.
+func parseIntConfig(config map[string]string, key string, minVal int, dest *int) error {
+	valStr, ok := config[key]
+	if !ok || len(valStr) == 0 {
+		return nil
+	}
+	val, err := strconv.Atoi(valStr)
+	if err != nil || val < minVal {
+		return errors.New(fmt.Sprintf("Invalid value %s for %s. Expected integer of at least %d", valStr, key, minVal))
+	}
+	*dest = val
+	return nil
+}
+
+// Parses a query timeout given either as a duration string (e.g. 500ms) or a number of seconds.
+func parseQueryTimeout(timeoutStr string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(timeoutStr); err == nil && seconds > 0 {
+		return time.Second * time.Duration(seconds), nil
+	}
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil || timeout <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid DNS query timeout %s", timeoutStr))
+	}
+	return timeout, nil
+}
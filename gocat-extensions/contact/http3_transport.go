@@ -0,0 +1,19 @@
+package contact
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP/3 runs over QUIC, so proxy settings from the base transport do not apply.
+func init() {
+	HttpTransportFactories[HTTP_TRANSPORT_H3] = func(baseTransport *http.Transport) (http.RoundTripper, error) {
+		tlsConfig := &tls.Config{}
+		if baseTransport.TLSClientConfig != nil {
+			tlsConfig = baseTransport.TLSClientConfig.Clone()
+		}
+		return &http3.Transport{TLSClientConfig: tlsConfig}, nil
+	}
+}
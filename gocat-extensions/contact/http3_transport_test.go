@@ -0,0 +1,47 @@
+package contact_test
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHttp3Transport(t *testing.T) {
+	// Borrow the self-signed certificate of a regular test server.
+	tlsServer := httptest.NewTLSServer(nil)
+	certificate := tlsServer.TLS.Certificates[0]
+	tlsServer.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{certificate}}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(r.Proto))))
+		}),
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	api := contact.CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	if valid, _ := api.C2RequirementsMet(nil, map[string]string{"httpTransport": contact.HTTP_TRANSPORT_H3}); !valid {
+		t.Fatal("HTTP contact rejected HTTP/3 transport")
+	}
+	api.SetUpstreamDestAddr(fmt.Sprintf("https://%s", conn.LocalAddr().String()))
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "HTTP/3.0" {
+		t.Errorf("expected HTTP/3.0 beacon, got %s", got)
+	}
+	if got := api.(contact.ProtocolReporter).GetActiveProtocol(); got != "HTTP/3.0" {
+		t.Errorf("expected active protocol HTTP/3.0, got %s", got)
+	}
+}
@@ -0,0 +1,120 @@
+package contact
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/dop251/goja"
+)
+
+// Evaluates PAC scripts with an embedded JavaScript interpreter. The date and time functions
+// of the PAC standard are not provided.
+type gojaPacEvaluator struct {
+	runtime         *goja.Runtime
+	findProxyForURL goja.Callable
+	mutex           sync.Mutex // runtimes are not safe for concurrent use
+}
+
+func init() {
+	NewPacEvaluator = newGojaPacEvaluator
+}
+
+func newGojaPacEvaluator(script string) (PacEvaluator, error) {
+	runtime := goja.New()
+	for name, function := range pacFunctions {
+		if err := runtime.Set(name, function); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := runtime.RunString(script); err != nil {
+		return nil, err
+	}
+	findProxyForURL, ok := goja.AssertFunction(runtime.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("PAC script does not define FindProxyForURL")
+	}
+	return &gojaPacEvaluator{runtime: runtime, findProxyForURL: findProxyForURL}, nil
+}
+
+func (g *gojaPacEvaluator) FindProxyForURL(targetUrl string, host string) (string, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	result, err := g.findProxyForURL(goja.Undefined(), g.runtime.ToValue(targetUrl), g.runtime.ToValue(host))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("PAC evaluation failed for %s: %s", targetUrl, err.Error()))
+	}
+	return result.String(), nil
+}
+
+// Predefined functions available to PAC scripts.
+var pacFunctions = map[string]interface{}{
+	"isPlainHostName": func(host string) bool {
+		return !strings.Contains(host, ".")
+	},
+	"dnsDomainIs": func(host string, domain string) bool {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+	},
+	"localHostOrDomainIs": func(host string, hostDomain string) bool {
+		host, hostDomain = strings.ToLower(host), strings.ToLower(hostDomain)
+		if strings.Contains(host, ".") {
+			return host == hostDomain
+		}
+		return strings.HasPrefix(hostDomain, host+".")
+	},
+	"isResolvable": func(host string) bool {
+		_, err := net.LookupHost(host)
+		return err == nil
+	},
+	"isInNet": func(host string, pattern string, mask string) bool {
+		ip := pacResolve(host)
+		patternIp, maskIp := net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+		if ip == nil || patternIp == nil || maskIp == nil {
+			return false
+		}
+		return ip.Mask(net.IPMask(maskIp)).Equal(patternIp.Mask(net.IPMask(maskIp)))
+	},
+	"dnsResolve": func(host string) interface{} {
+		if ip := pacResolve(host); ip != nil {
+			return ip.String()
+		}
+		return nil
+	},
+	"myIpAddress": func() string {
+		// Connecting a UDP socket sends no packets, but selects the outbound interface.
+		conn, err := net.Dial("udp", "198.51.100.1:53")
+		if err != nil {
+			return "127.0.0.1"
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	},
+	"dnsDomainLevels": func(host string) int {
+		return strings.Count(host, ".")
+	},
+	"shExpMatch": func(str string, shExp string) bool {
+		// PAC patterns match across slashes, unlike path patterns.
+		matched, err := path.Match(strings.ReplaceAll(shExp, "/", "\x00"), strings.ReplaceAll(str, "/", "\x00"))
+		return err == nil && matched
+	},
+}
+
+// Resolves the host to an IPv4 address, if possible.
+func pacResolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ip := addr.To4(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package contact_test
+
+import (
+	"testing"
+
+	"github.com/mitre/gocat/contact"
+)
+
+const testPacScript = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".corp.lab")) {
+		return "DIRECT";
+	}
+	if (isInNet(host, "10.0.0.0", "255.0.0.0")) {
+		return "PROXY internal-proxy.lab:3128";
+	}
+	if (shExpMatch(url, "https://*")) {
+		return "HTTPS secure-proxy.lab:8443; DIRECT";
+	}
+	return "PROXY proxy.lab:8080; PROXY backup-proxy.lab:8080; DIRECT";
+}
+`
+
+func TestPacEvaluator(t *testing.T) {
+	evaluator, err := contact.NewPacEvaluator(testPacScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		targetUrl string
+		host      string
+		want      string
+	}{
+		{"http://intranet:80", "intranet", "DIRECT"},
+		{"http://wiki.corp.lab:80", "wiki.corp.lab", "DIRECT"},
+		{"http://10.1.2.3:80", "10.1.2.3", "PROXY internal-proxy.lab:3128"},
+		{"https://c2.example.test:443", "c2.example.test", "HTTPS secure-proxy.lab:8443; DIRECT"},
+		{"http://c2.example.test:80", "c2.example.test", "PROXY proxy.lab:8080; PROXY backup-proxy.lab:8080; DIRECT"},
+	}
+	for _, testCase := range testCases {
+		got, err := evaluator.FindProxyForURL(testCase.targetUrl, testCase.host)
+		if err != nil {
+			t.Errorf("PAC evaluation failed for %s: %s", testCase.targetUrl, err.Error())
+		} else if got != testCase.want {
+			t.Errorf("expected %q for %s, got %q", testCase.want, testCase.targetUrl, got)
+		}
+	}
+}
+
+func TestInvalidPacScript(t *testing.T) {
+	for _, script := range []string{"function FindProxyForURL(url, host) {", "var proxy = 'DIRECT';"} {
+		if _, err := contact.NewPacEvaluator(script); err == nil {
+			t.Errorf("expected error for PAC script %q", script)
+		}
+	}
+}
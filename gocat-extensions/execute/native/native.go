@@ -15,6 +15,7 @@ import (
 
 	_ "github.com/mitre/gocat/execute/native/discovery" // necessary to initialize all submodules
 	_ "github.com/mitre/gocat/execute/native/aws" // necessary to initialize all submodules
+	_ "github.com/mitre/gocat/execute/native/socks" // necessary to initialize all submodules
 )
 
 type NativeExecutor struct {
@@ -0,0 +1,108 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mitre/gocat/execute/native/util"
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/pivot"
+)
+
+const (
+	startArgErrMsg = "Expected format: [bind address:port] [username] [password]"
+	stopArgErrMsg  = "Expected format: [bind address:port]"
+)
+
+var (
+	// Maps the bind addresses that servers were started with to their listening addresses, which pivots are
+	// registered under. Listening addresses are normalized, e.g. localhost:1080 listens on 127.0.0.1:1080.
+	bindAddresses = map[string]string{}
+	bindMutex     sync.Mutex
+)
+
+func init() {
+	util.NativeMethods["StartSocks5"] = StartSocks5Server
+	util.NativeMethods["StopSocks5"] = StopSocks5Server
+}
+
+func getPivotName(address string) string {
+	return fmt.Sprintf("socks5:%s", address)
+}
+
+// Returns the listening address of the server started with the given bind address, or the address itself if no
+// server was started with it, and stops tracking the bind address.
+func removeBindAddress(address string) string {
+	bindMutex.Lock()
+	defer bindMutex.Unlock()
+	listeningAddress, ok := bindAddresses[address]
+	if !ok {
+		listeningAddress = address
+	}
+	for bindAddress, listening := range bindAddresses {
+		if listening == listeningAddress {
+			delete(bindAddresses, bindAddress)
+		}
+	}
+	return listeningAddress
+}
+
+// Starts a SOCKS5 server on the agent that operators can route tooling through.
+// Expects args to be of the format: [bind address:port] [username] [password]
+// Credentials are optional. If provided, clients must authenticate with them.
+func StartSocks5Server(args []string) util.NativeCmdResult {
+	if len(args) != 1 && len(args) != 3 {
+		return util.GenerateErrorResultFromString(startArgErrMsg, util.INPUT_ERROR_EXIT_CODE)
+	}
+	if _, _, err := net.SplitHostPort(args[0]); err != nil {
+		return util.GenerateErrorResultFromString(fmt.Sprintf("Invalid bind address %s. %s", args[0], startArgErrMsg), util.INPUT_ERROR_EXIT_CODE)
+	}
+	var username, password string
+	if len(args) == 3 {
+		username = args[1]
+		password = args[2]
+		if len(username) == 0 {
+			return util.GenerateErrorResult(errors.New("SOCKS5 username must not be empty"), util.INPUT_ERROR_EXIT_CODE)
+		}
+	}
+	server, err := NewSocks5Server(args[0], username, password)
+	if err != nil {
+		return util.GenerateErrorResultFromString(fmt.Sprintf("Failed to start SOCKS5 server: %s", err.Error()), util.PROCESS_ERROR_EXIT_CODE)
+	}
+	pivot.RegisterPivot(getPivotName(server.GetAddress()), server)
+	if _, port, _ := net.SplitHostPort(args[0]); port != "0" {
+		bindMutex.Lock()
+		bindAddresses[args[0]] = server.GetAddress()
+		bindMutex.Unlock()
+	}
+	go server.Serve()
+	output.VerbosePrint(fmt.Sprintf("[*] Started SOCKS5 server on %s", server.GetAddress()))
+	return util.NativeCmdResult{
+		Stdout:   []byte(fmt.Sprintf("Started SOCKS5 server on %s", server.GetAddress())),
+		Stderr:   nil,
+		Err:      nil,
+		ExitCode: util.SUCCESS_EXIT_CODE,
+	}
+}
+
+// Stops the SOCKS5 server listening on the given address and closes its connections. The address can either be the
+// bind address that the server was started with, or the address that it reported listening on.
+// Expects args to be of the format: [bind address:port]
+func StopSocks5Server(args []string) util.NativeCmdResult {
+	if len(args) != 1 {
+		return util.GenerateErrorResultFromString(stopArgErrMsg, util.INPUT_ERROR_EXIT_CODE)
+	}
+	server, ok := pivot.UnregisterPivot(getPivotName(removeBindAddress(args[0])))
+	if !ok {
+		return util.GenerateErrorResultFromString(fmt.Sprintf("No SOCKS5 server running on %s", args[0]), util.PROCESS_ERROR_EXIT_CODE)
+	}
+	server.Stop()
+	return util.NativeCmdResult{
+		Stdout:   []byte(fmt.Sprintf("Stopped SOCKS5 server on %s", args[0])),
+		Stderr:   nil,
+		Err:      nil,
+		ExitCode: util.SUCCESS_EXIT_CODE,
+	}
+}
@@ -0,0 +1,329 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mitre/gocat/output"
+)
+
+// SOCKS5 protocol values (RFC 1928, RFC 1929)
+const (
+	socks5Version        = 5
+	userPassAuthVersion  = 1
+	authNone             = 0
+	authUserPass         = 2
+	authNoAcceptable     = 0xff
+	cmdConnect           = 1
+	addrTypeIPv4         = 1
+	addrTypeDomain       = 3
+	addrTypeIPv6         = 4
+	replySucceeded       = 0
+	replyGeneralFailure  = 1
+	replyHostUnreachable = 4
+	replyConnRefused     = 5
+	replyCmdUnsupported  = 7
+	replyAddrUnsupported = 8
+)
+
+var (
+	socks5HandshakeTimeout = 30 * time.Second
+	socks5DialTimeout      = 30 * time.Second
+)
+
+// SOCKS5 server that relays CONNECT requests from operator tooling into the target network.
+// Implements the pivot.Pivot interface.
+type Socks5Server struct {
+	listener          net.Listener
+	username          string // authentication is not required if empty
+	password          string
+	started           time.Time
+	activeConnections int64
+	totalConnections  int64
+	failedConnections int64
+	bytesSent         int64             // bytes relayed from clients to destinations
+	bytesReceived     int64             // bytes relayed from destinations to clients
+	conns             map[net.Conn]bool // open client and destination connections
+	stopped           bool
+	connMutex         sync.Mutex
+}
+
+// Listens on the bind address. Call Serve to start accepting connections.
+func NewSocks5Server(bindAddr string, username string, password string) (*Socks5Server, error) {
+	if len(username) > 255 || len(password) > 255 {
+		return nil, errors.New("SOCKS5 username and password must be at most 255 bytes")
+	}
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Socks5Server{
+		listener: listener,
+		username: username,
+		password: password,
+		started:  time.Now().UTC(),
+		conns:    make(map[net.Conn]bool),
+	}, nil
+}
+
+func (s *Socks5Server) GetAddress() string {
+	return s.listener.Addr().String()
+}
+
+// Must be run as go routine. Returns once the server is stopped.
+func (s *Socks5Server) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			output.VerbosePrint(fmt.Sprintf("[!] Error accepting SOCKS5 connection: %s", err.Error()))
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// Closes the listener and all relayed connections.
+func (s *Socks5Server) Stop() {
+	s.listener.Close()
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	s.stopped = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Stopped SOCKS5 server on %s", s.GetAddress()))
+}
+
+func (s *Socks5Server) GetStatus() map[string]interface{} {
+	return map[string]interface{}{
+		"type":               "socks5",
+		"address":            s.GetAddress(),
+		"authenticated":      len(s.username) > 0,
+		"started":            s.started.Format(time.RFC3339),
+		"active_connections": atomic.LoadInt64(&s.activeConnections),
+		"total_connections":  atomic.LoadInt64(&s.totalConnections),
+		"failed_connections": atomic.LoadInt64(&s.failedConnections),
+		"bytes_sent":         atomic.LoadInt64(&s.bytesSent),
+		"bytes_received":     atomic.LoadInt64(&s.bytesReceived),
+	}
+}
+
+// Tracks the connection so that it is closed when the server stops. Returns false if the server already stopped.
+func (s *Socks5Server) trackConn(conn net.Conn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Socks5Server) untrackConn(conn net.Conn) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Socks5Server) handleConnection(clientConn net.Conn) {
+	defer clientConn.Close()
+	if !s.trackConn(clientConn) {
+		return
+	}
+	defer s.untrackConn(clientConn)
+	atomic.AddInt64(&s.totalConnections, 1)
+
+	clientConn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	if err := s.authenticate(clientConn); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] SOCKS5 client %s failed authentication: %s", clientConn.RemoteAddr().String(), err.Error()))
+		atomic.AddInt64(&s.failedConnections, 1)
+		return
+	}
+	destAddr, replyCode, err := readConnectRequest(clientConn)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Invalid SOCKS5 request from %s: %s", clientConn.RemoteAddr().String(), err.Error()))
+		atomic.AddInt64(&s.failedConnections, 1)
+		writeReply(clientConn, replyCode)
+		return
+	}
+	destConn, err := net.DialTimeout("tcp", destAddr, socks5DialTimeout)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] SOCKS5 connection to %s failed: %s", destAddr, err.Error()))
+		atomic.AddInt64(&s.failedConnections, 1)
+		writeReply(clientConn, getDialErrorReply(err))
+		return
+	}
+	defer destConn.Close()
+	if !s.trackConn(destConn) {
+		return
+	}
+	defer s.untrackConn(destConn)
+	if err = writeReply(clientConn, replySucceeded); err != nil {
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+	output.VerbosePrint(fmt.Sprintf("[*] Relaying SOCKS5 connection from %s to %s", clientConn.RemoteAddr().String(), destAddr))
+
+	atomic.AddInt64(&s.activeConnections, 1)
+	defer atomic.AddInt64(&s.activeConnections, -1)
+	done := make(chan struct{})
+	go func() {
+		s.relay(destConn, clientConn, &s.bytesSent)
+		close(done)
+	}()
+	s.relay(clientConn, destConn, &s.bytesReceived)
+	<-done
+}
+
+// Copies data until either side closes, counting the bytes written.
+func (s *Socks5Server) relay(writer net.Conn, reader net.Conn, counter *int64) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			written, writeErr := writer.Write(buf[:n])
+			atomic.AddInt64(counter, int64(written))
+			if writeErr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if tcpConn, ok := writer.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	} else {
+		writer.Close()
+	}
+}
+
+// Negotiates the authentication method, requiring username/password authentication if credentials are set.
+func (s *Socks5Server) authenticate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return errors.New(fmt.Sprintf("Unsupported SOCKS version %d", header[0]))
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	method := byte(authNone)
+	if len(s.username) > 0 {
+		method = authUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, authNoAcceptable})
+		return errors.New("No acceptable authentication method offered")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == authNone {
+		return nil
+	}
+
+	// RFC 1929 username/password subnegotiation
+	version := make([]byte, 2)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+	username := make([]byte, version[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	passwordLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passwordLen); err != nil {
+		return err
+	}
+	password := make([]byte, passwordLen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	if version[0] != userPassAuthVersion || string(username) != s.username || string(password) != s.password {
+		conn.Write([]byte{userPassAuthVersion, 1})
+		return errors.New("Invalid credentials")
+	}
+	_, err := conn.Write([]byte{userPassAuthVersion, 0})
+	return err
+}
+
+// Reads a CONNECT request and returns the destination address. Returns the reply code to send if the request
+// is invalid or unsupported.
+func readConnectRequest(conn net.Conn) (string, byte, error) {
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", replyGeneralFailure, err
+	}
+	if request[0] != socks5Version {
+		return "", replyGeneralFailure, errors.New(fmt.Sprintf("Unsupported SOCKS version %d", request[0]))
+	}
+	if request[1] != cmdConnect {
+		return "", replyCmdUnsupported, errors.New(fmt.Sprintf("Unsupported SOCKS5 command %d", request[1]))
+	}
+	var host string
+	switch request[3] {
+	case addrTypeIPv4, addrTypeIPv6:
+		addrLen := net.IPv4len
+		if request[3] == addrTypeIPv6 {
+			addrLen = net.IPv6len
+		}
+		addr := make([]byte, addrLen)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", replyGeneralFailure, err
+		}
+		host = net.IP(addr).String()
+	case addrTypeDomain:
+		hostLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, hostLen); err != nil {
+			return "", replyGeneralFailure, err
+		}
+		hostBytes := make([]byte, hostLen[0])
+		if _, err := io.ReadFull(conn, hostBytes); err != nil {
+			return "", replyGeneralFailure, err
+		}
+		host = string(hostBytes)
+	default:
+		return "", replyAddrUnsupported, errors.New(fmt.Sprintf("Unsupported SOCKS5 address type %d", request[3]))
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", replyGeneralFailure, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), replySucceeded, nil
+}
+
+// Sends a reply with an unspecified bound address.
+func writeReply(conn net.Conn, replyCode byte) error {
+	_, err := conn.Write([]byte{socks5Version, replyCode, 0, addrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func getDialErrorReply(err error) byte {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) || opErr.Timeout() {
+			return replyHostUnreachable
+		}
+		return replyConnRefused
+	}
+	return replyGeneralFailure
+}
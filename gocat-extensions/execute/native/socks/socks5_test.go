@@ -0,0 +1,190 @@
+package socks_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/mitre/gocat/execute/native/socks"
+	"github.com/mitre/gocat/execute/native/testutil"
+	"github.com/mitre/gocat/execute/native/util"
+	"github.com/mitre/gocat/pivot"
+)
+
+func startServer(t *testing.T, args ...string) string {
+	result := socks.StartSocks5Server(args)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	address := strings.TrimPrefix(string(result.Stdout), "Started SOCKS5 server on ")
+	t.Cleanup(func() { socks.StopSocks5Server([]string{address}) })
+	return address
+}
+
+func getThroughProxy(address string, auth *proxy.Auth, targetUrl string) (string, error) {
+	dialer, err := proxy.SOCKS5("tcp", address, auth, proxy.Direct)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{Dial: dialer.Dial, DisableKeepAlives: true},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get(targetUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func getPivotStatus(t *testing.T, address string) map[string]interface{} {
+	for _, status := range pivot.GetPivotStatuses() {
+		if status["name"] == "socks5:"+address {
+			return status
+		}
+	}
+	t.Fatalf("no pivot status reported for %s", address)
+	return nil
+}
+
+func TestSocks5ServerWithAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal service"))
+	}))
+	defer backend.Close()
+	address := startServer(t, "127.0.0.1:0", "operator", "s3cret")
+
+	body, err := getThroughProxy(address, &proxy.Auth{User: "operator", Password: "s3cret"}, backend.URL)
+	if err != nil {
+		t.Fatalf("request through SOCKS5 server failed: %s", err.Error())
+	}
+	if body != "internal service" {
+		t.Errorf("unexpected response through SOCKS5 server: %s", body)
+	}
+	if _, err := getThroughProxy(address, &proxy.Auth{User: "operator", Password: "wrong"}, backend.URL); err == nil {
+		t.Errorf("expected request with wrong SOCKS5 credentials to fail")
+	}
+	if _, err := getThroughProxy(address, nil, backend.URL); err == nil {
+		t.Errorf("expected request without SOCKS5 credentials to fail")
+	}
+
+	status := getPivotStatus(t, address)
+	if status["type"] != "socks5" || status["authenticated"] != true {
+		t.Errorf("unexpected SOCKS5 pivot status: %v", status)
+	}
+	if status["total_connections"] != int64(3) || status["failed_connections"] != int64(2) || status["active_connections"] != int64(0) {
+		t.Errorf("unexpected SOCKS5 connection counters: %v", status)
+	}
+	if sent, received := status["bytes_sent"].(int64), status["bytes_received"].(int64); sent == 0 || received < int64(len("internal service")) {
+		t.Errorf("unexpected SOCKS5 byte counters: sent %d, received %d", sent, received)
+	}
+}
+
+func TestSocks5ServerWithoutAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	address := startServer(t, "127.0.0.1:0")
+
+	// Hostnames are resolved by the server.
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	if body, err := getThroughProxy(address, nil, "http://localhost:"+port); err != nil || body != "ok" {
+		t.Errorf("request through SOCKS5 server failed: %v %s", err, body)
+	}
+	if _, err := getThroughProxy(address, nil, "http://127.0.0.1:"+getClosedPort(t)); err == nil {
+		t.Errorf("expected request to closed port through SOCKS5 server to fail")
+	}
+	if status := getPivotStatus(t, address); status["authenticated"] != false || status["failed_connections"] != int64(1) {
+		t.Errorf("unexpected SOCKS5 pivot status: %v", status)
+	}
+}
+
+func getClosedPort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func TestStopSocks5Server(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	result := socks.StartSocks5Server([]string{"127.0.0.1:0"})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	address := strings.TrimPrefix(string(result.Stdout), "Started SOCKS5 server on ")
+
+	// Relayed connections are closed along with the server.
+	dialer, _ := proxy.SOCKS5("tcp", address, nil, proxy.Direct)
+	conn, err := dialer.Dial("tcp", backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	result = socks.StopSocks5Server([]string{address})
+	testutil.VerifyResult(t, result, "Stopped SOCKS5 server on "+address, "", "")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected relayed connection to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Errorf("expected stopped SOCKS5 server to refuse connections")
+	}
+	for _, status := range pivot.GetPivotStatuses() {
+		if status["name"] == "socks5:"+address {
+			t.Errorf("expected stopped SOCKS5 server not to be reported")
+		}
+	}
+
+	errMsg := "No SOCKS5 server running on " + address
+	testutil.VerifyResult(t, socks.StopSocks5Server([]string{address}), "", errMsg, errMsg)
+}
+
+func TestStopSocks5ServerByBindAddress(t *testing.T) {
+	bindAddress := "localhost:" + getClosedPort(t)
+	result := socks.StartSocks5Server([]string{bindAddress})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	address := strings.TrimPrefix(string(result.Stdout), "Started SOCKS5 server on ")
+	if address == bindAddress {
+		t.Fatalf("expected listening address to differ from bind address %s", bindAddress)
+	}
+
+	// The server is stopped through the bind address it was started with.
+	testutil.VerifyResult(t, socks.StopSocks5Server([]string{bindAddress}), "Stopped SOCKS5 server on "+bindAddress, "", "")
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Errorf("expected stopped SOCKS5 server to refuse connections")
+	}
+	errMsg := "No SOCKS5 server running on " + address
+	testutil.VerifyResult(t, socks.StopSocks5Server([]string{address}), "", errMsg, errMsg)
+}
+
+func TestSocks5ServerInvalidArgs(t *testing.T) {
+	startErrMsg := "Expected format: [bind address:port] [username] [password]"
+	testutil.VerifyResult(t, socks.StartSocks5Server([]string{}), "", startErrMsg, startErrMsg)
+	testutil.VerifyResult(t, socks.StartSocks5Server([]string{"127.0.0.1:0", "operator"}), "", startErrMsg, startErrMsg)
+	invalidAddrMsg := "Invalid bind address 1080. " + startErrMsg
+	testutil.VerifyResult(t, socks.StartSocks5Server([]string{"1080"}), "", invalidAddrMsg, invalidAddrMsg)
+	stopErrMsg := "Expected format: [bind address:port]"
+	testutil.VerifyResult(t, socks.StopSocks5Server([]string{}), "", stopErrMsg, stopErrMsg)
+	if _, ok := util.NativeMethods["StartSocks5"]; !ok {
+		t.Errorf("expected StartSocks5 native method to be registered")
+	}
+}
@@ -3,20 +3,28 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"math/big"
 	"net"
 	"net/http"
 	"io"
 	"sync"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mitre/gocat/output"
 	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/p2pauth"
 	"github.com/grandcat/zeroconf"
 )
 
@@ -29,6 +37,10 @@ var (
 	minReceiverPort = 50000
 	maxReceiverPort = 63000
 	maxMemory = int64(20*1024*1024)
+	httpShutdownTimeout = 5*time.Second
+	httpReceiverTls = "false" // serve HTTPS using a self-signed certificate generated at startup. Set at compile time.
+	httpReceiverCert = "" // base64-encoded PEM certificate to serve HTTPS with instead. Set at compile time.
+	httpReceiverKey = "" // base64-encoded PEM private key for httpReceiverCert. Set at compile time.
 )
 
 //HttpReceiver forwards data received from HTTP requests to the upstream server via HTTP. Implements the P2pReceiver interface.
@@ -37,62 +49,151 @@ type HttpReceiver struct {
 	agentServer *string // refers to agent's current server value
 	port int
 	bindPortStr string
+	config receiverConfig // listening and advertising settings, set remotely
 	receiverName string
 	upstreamComs *contact.Contact
-	httpServer *http.Server
+	listener net.Listener
+	httpServer *http.Server // serves the receiver endpoints on its own mux, so that the receiver can be restarted.
 	waitgroup *sync.WaitGroup
-	receiverContext context.Context
-	receiverCancelFunc context.CancelFunc
 	urlList []string // list of HTTP urls that external machines can use to reach this receiver.
 	dnsServer *zeroconf.Server
+	terminated bool
+	pawReady chan struct{} // closed once the receiver has an agent paw to advertise under.
+	done chan struct{} // closed when the receiver terminates.
+	stateMutex sync.Mutex // protects agentPaw, dnsServer, terminated, pawReady and done
+	tlsCertificate *tls.Certificate // certificate used to serve HTTPS. HTTPS is disabled if nil.
+	certFingerprint string // SHA-256 fingerprint of the certificate, advertised so that peers can pin it.
+	peerTracker // statistics for the downstream peers that sent requests to this receiver.
+}
+
+// Wraps the response writer for a client request to collect the peer statistics for the request.
+type peerResponseWriter struct {
+	http.ResponseWriter
+	paw string
+	requestType string
+	status int
+	bytesSent int
+	requestErr string
 }
 
 func init() {
 	P2pReceiverChannels[httpProxyName] = &HttpReceiver{}
 }
 
+// Sets up a new listener and server for the receiver. Can be called again after the receiver terminates to restart it.
+// If the agent was compiled with a P2P key, only authenticated peers can connect, using HTTPS. Otherwise, HTTPS is
+// served with the receiver certificate, if there is one.
 func (h *HttpReceiver) InitializeReceiver(agentServer *string, upstreamComs *contact.Contact, waitgroup *sync.WaitGroup) error {
-	err := h.initializeReceiverPort()
-	if err != nil {
-		return err
-	}
 	h.receiverName = httpProxyName
 	h.agentServer = agentServer
 	h.upstreamComs = upstreamComs // contact will keep track of upstream dest addr.
-	h.httpServer = &http.Server{
-		Addr: h.bindPortStr,
-		Handler: nil,
+	if err := h.initializeReceiverCertificate(); err != nil {
+		return err
+	}
+	listener, err := h.initializeReceiverPort()
+	if err != nil {
+		return err
 	}
 	h.urlList, err = h.getReachableUrls()
 	if err != nil {
+		listener.Close()
+		return err
+	}
+	authListener, err := p2pauth.WrapListener(listener, h.receiverName)
+	if err != nil {
+		listener.Close()
 		return err
 	}
+	if h.tlsCertificate != nil {
+		authListener = tls.NewListener(authListener, &tls.Config{Certificates: []tls.Certificate{*h.tlsCertificate}})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(beaconEndpoint, h.trackPeerRequests("beacon", h.handleBeaconEndpoint))
+	mux.HandleFunc(payloadEndpoint, h.trackPeerRequests("payload", h.handlePayloadEndpoint))
+	mux.HandleFunc(uploadEndpoint, h.trackPeerRequests("upload", h.handleUploadEndpoint))
+	h.listener = authListener
+	h.httpServer = &http.Server{
+		Addr: h.bindPortStr,
+		Handler: mux,
+	}
 	h.waitgroup = waitgroup
-	h.receiverContext, h.receiverCancelFunc = context.WithTimeout(context.Background(), 5*time.Second)
+	h.stateMutex.Lock()
+	h.terminated = false
+	h.dnsServer = nil
+	h.pawReady = make(chan struct{})
+	if len(h.agentPaw) > 0 {
+		close(h.pawReady)
+	}
+	h.done = make(chan struct{})
+	h.stateMutex.Unlock()
 	return nil
 }
 
 func (h *HttpReceiver) RunReceiver() {
 	output.VerbosePrint(fmt.Sprintf("[*] Starting HTTP proxy receiver on local port %d", h.port))
 	output.VerbosePrint(fmt.Sprintf("[*] HTTP proxy receiver is using upstream contact %s", (*h.upstreamComs).GetName()))
-	h.broadcastReceiverChannel(h.port)
-	h.startHttpProxy()
+	httpServer, listener := h.httpServer, h.listener // the receiver may be initialized again once terminated
+	h.stateMutex.Lock()
+	pawReady, done := h.pawReady, h.done
+	h.stateMutex.Unlock()
+	go h.broadcastReceiverChannel(h.port, pawReady, done)
+	startHttpProxy(httpServer, listener)
+}
+
+// Sets the bind address, port and mDNS advertising for the next time the receiver is initialized.
+func (h *HttpReceiver) SetReceiverConfig(config map[string]string) error {
+	receiverConfig, err := parseReceiverConfig(config)
+	if err != nil {
+		return err
+	}
+	h.config = receiverConfig
+	return nil
 }
 
+// Stops advertising the receiver and shuts down its server, waiting for in-flight requests up to the shutdown timeout.
 func (h *HttpReceiver) Terminate() {
-	defer func() {
-		h.waitgroup.Done()
-		h.receiverCancelFunc()
- 		h.dnsServer.Shutdown()
-	}()
-	if err := h.httpServer.Shutdown(h.receiverContext); err != nil {
+	defer h.waitgroup.Done()
+	h.stateMutex.Lock()
+	if !h.terminated {
+		close(h.done)
+	}
+	h.terminated = true
+	dnsServer := h.dnsServer
+	h.dnsServer = nil
+	h.stateMutex.Unlock()
+	if dnsServer != nil {
+		dnsServer.Shutdown()
+	}
+	shutdownContext, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := h.httpServer.Shutdown(shutdownContext); err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Error when shutting down HTTP receiver server: %s", err.Error()))
+		h.httpServer.Close()
 	}
+
+	// The listener is only closed by the server if it started serving.
+	h.listener.Close()
 }
 
-// Update paw of agent running this receiver.
+// Update paw of agent running this receiver. The receiver is advertised once it has a paw.
 func (h *HttpReceiver) UpdateAgentPaw(newPaw string) {
+	h.stateMutex.Lock()
+	defer h.stateMutex.Unlock()
 	h.agentPaw = newPaw
+	if h.pawReady == nil || len(newPaw) == 0 {
+		return
+	}
+	select {
+	case <-h.pawReady:
+	default:
+		close(h.pawReady)
+	}
+}
+
+func (h *HttpReceiver) getAgentPaw() string {
+	h.stateMutex.Lock()
+	defer h.stateMutex.Unlock()
+	return h.agentPaw
 }
 
 func (h *HttpReceiver) GetReceiverAddresses() []string {
@@ -100,11 +201,8 @@ func (h *HttpReceiver) GetReceiverAddresses() []string {
 }
 
 // Helper method for StartReceiver. Starts HTTP proxy to forward messages from peers to the C2 server.
-func (h *HttpReceiver) startHttpProxy() {
-	http.HandleFunc(beaconEndpoint, h.handleBeaconEndpoint)
-	http.HandleFunc(payloadEndpoint, h.handlePayloadEndpoint)
-	http.HandleFunc(uploadEndpoint, h.handleUploadEndpoint)
-	if err := http.ListenAndServe(h.bindPortStr, nil); err != nil {
+func startHttpProxy(httpServer *http.Server, listener net.Listener) {
+	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 		output.VerbosePrint(fmt.Sprintf("[-] HTTP proxy error: %s", err.Error()))
 	}
 }
@@ -134,8 +232,11 @@ func (h *HttpReceiver) handleBeaconEndpoint(writer http.ResponseWriter, reader *
 		return
 	}
 
+	clientPaw, _ := profile["paw"].(string)
+	setPeerRequestInfo(writer, clientPaw, "beacon")
+
 	//make sure our paw is not in the peer chain (loop scenario)
-	if isInPeerChain(profile, h.agentPaw) {
+	if isInPeerChain(profile, h.getAgentPaw()) {
 	    output.VerbosePrint(fmt.Sprintf("[!] Error: agent paw already in proxy chain, loop detected"))
 	    http.Error(writer, "peer loop detected", http.StatusInternalServerError)
 	    return
@@ -155,9 +256,17 @@ func (h *HttpReceiver) handleBeaconEndpoint(writer http.ResponseWriter, reader *
 	// Check if profile contains execution results
 	if results, ok := profile["results"]; ok {
 		output.VerbosePrint("[*] HTTP proxy: handling execution results from client.")
+		setPeerRequestInfo(writer, clientPaw, "results")
 		resultList := results.([]interface{})
 		if len(resultList) > 0 {
-			(*h.upstreamComs).SendExecutionResults(profile, resultList[0].(map[string]interface{}))
+			queued, err := forwardExecutionResults(*h.upstreamComs, profile, resultList[0].(map[string]interface{}))
+			if err != nil {
+				output.VerbosePrint(fmt.Sprintf("[!] Error forwarding execution results for client: %s", err.Error()))
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+			} else if queued {
+				// Let the client know that the results were queued rather than delivered.
+				writer.WriteHeader(http.StatusAccepted)
+			}
 		} else {
 			output.VerbosePrint("[!] Error: client sent empty result list.")
 			http.Error(writer, "Empty result list received from client", http.StatusInternalServerError)
@@ -166,8 +275,12 @@ func (h *HttpReceiver) handleBeaconEndpoint(writer http.ResponseWriter, reader *
 		output.VerbosePrint("[*] HTTP proxy: handling beacon request from client.")
 
 		// Update peer proxy chain information to indicate that the beacon is going through this agent.
-		updatePeerChain(profile, h.agentPaw, receiverAddress, h.receiverName)
+		updatePeerChain(profile, h.getAgentPaw(), receiverAddress, h.receiverName)
 		beaconResponse := (*h.upstreamComs).GetBeaconBytes(profile)
+		recordUpstreamBeacon(*h.upstreamComs, beaconResponse)
+		if beaconResponse == nil {
+			setPeerRequestError(writer, "No beacon response from upstream")
+		}
 		encodedResponse := []byte(base64.StdEncoding.EncodeToString(beaconResponse))
 		if err = sendResponseToClient(encodedResponse, nil, writer); err != nil {
 			output.VerbosePrint(fmt.Sprintf("[!] Error sending response to client: %s", err.Error()))
@@ -202,6 +315,7 @@ func (h *HttpReceiver) handlePayloadEndpoint(writer http.ResponseWriter, reader
 		return
 	}
 	clientPaw := pawHeader[0]
+	setPeerRequestInfo(writer, clientPaw, "payload")
 
 	// Build profile to send request upstream.
 	profile := make(map[string]interface{})
@@ -235,6 +349,7 @@ func (h *HttpReceiver)  handleUploadEndpoint (writer http.ResponseWriter, reader
 		return
 	}
 	clientPaw := pawHeader[0]
+	setPeerRequestInfo(writer, clientPaw, "upload")
 
 	hostHeader, ok := reader.Header["X-Host"]
 	if !ok {
@@ -259,11 +374,64 @@ func (h *HttpReceiver)  handleUploadEndpoint (writer http.ResponseWriter, reader
 	profile["host"] = clientHost
 
 	output.VerbosePrint(fmt.Sprintf("[*] Forwarding file upload request for client paw %s. File: %s. Size: %d", clientPaw, uploadName, len(data)))
-	if err = (*h.upstreamComs).UploadFileBytes(profile, uploadName, data); err != nil {
+	queued, err := forwardUploadBytes(*h.upstreamComs, profile, uploadName, data)
+	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[!] Error uploading file %s for client paw %s: %s", uploadName, clientPaw, err.Error()))
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if queued {
+		// Let the client know that the upload was queued rather than delivered.
+		writer.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Wraps the endpoint handler to record the request in the statistics for the requesting peer. Handlers can set the
+// peer paw and request type once known, otherwise the request is recorded for the remote address with the given type.
+// Requests that the handler fails with an HTTP error count as failed requests.
+func (h *HttpReceiver) trackPeerRequests(requestType string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, reader *http.Request) {
+		peerWriter := &peerResponseWriter{ResponseWriter: writer, requestType: requestType, status: http.StatusOK}
+		handler(peerWriter, reader)
+		var requestErr error
+		if len(peerWriter.requestErr) > 0 {
+			requestErr = errors.New(peerWriter.requestErr)
+		}
+		bytesReceived := 0
+		if reader.ContentLength > 0 {
+			bytesReceived = int(reader.ContentLength)
+		}
+		h.recordRequest(peerWriter.paw, reader.RemoteAddr, peerWriter.requestType, bytesReceived, peerWriter.bytesSent, requestErr)
+	}
+}
+
+// Sets the paw and request type to record the client request under.
+func setPeerRequestInfo(writer http.ResponseWriter, paw string, requestType string) {
+	if peerWriter, ok := writer.(*peerResponseWriter); ok {
+		peerWriter.paw = paw
+		peerWriter.requestType = requestType
+	}
+}
+
+// Records the client request as failed, for failures that are not reported to the client as HTTP errors.
+func setPeerRequestError(writer http.ResponseWriter, requestErr string) {
+	if peerWriter, ok := writer.(*peerResponseWriter); ok {
+		peerWriter.requestErr = requestErr
+	}
+}
+
+func (p *peerResponseWriter) WriteHeader(status int) {
+	p.status = status
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *peerResponseWriter) Write(data []byte) (int, error) {
+	if p.status >= http.StatusBadRequest && len(p.requestErr) == 0 {
+		p.requestErr = strings.TrimSpace(string(data))
+	}
+	written, err := p.ResponseWriter.Write(data)
+	p.bytesSent += written
+	return written, err
 }
 
 func getUploadNameAndData(reader *http.Request) (string, []byte, error) {
@@ -304,52 +472,85 @@ func sendResponseToClient(data []byte, headers map[string][]string, writer http.
 // Port must be set for the HTTP receiver before calling this method.
 func (h *HttpReceiver) getReachableUrls() ([]string, error) {
 	var urlList []string
-	ipAddrs, err := GetLocalIPv4Addresses()
+	ipAddrs, err := h.config.getReachableHosts()
 	if err != nil {
 		return nil, err
 	}
 	for _, addr := range ipAddrs {
-		url := "http://" + addr + ":" + strconv.Itoa(h.port)
+		url := contact.GetPinnedAddress(h.getReceiverScheme() + "://" + addr + ":" + strconv.Itoa(h.port), h.certFingerprint)
 		urlList = append(urlList, url)
 	}
 	return urlList, nil
 }
 
-// Helper method for initializing the receiver port.
-func (h *HttpReceiver) initializeReceiverPort() error {
-	// Try 5 random ports before giving up.
-	retryCount := 0
-	for (retryCount < maxPortRetries) {
-		currPort := generateRandomPort(minReceiverPort, maxReceiverPort)
-		currBindPortStr := ":" + strconv.Itoa(currPort)
-
-		// Check if port is already in use.
-		if ln, err := net.Listen("tcp", currBindPortStr); err != nil {
-			output.VerbosePrint(fmt.Sprintf("[-] Error trying to use random port %d: %s", currPort, err.Error()))
-		} else {
-			h.port = currPort
-			h.bindPortStr = currBindPortStr
-			return ln.Close()
-		}
+// Helper method for initializing the receiver port. Returns the listener bound to the port.
+func (h *HttpReceiver) initializeReceiverPort() (net.Listener, error) {
+	listener, port, err := h.config.listenTcp(minReceiverPort, maxReceiverPort, maxPortRetries)
+	if err != nil {
+		return nil, err
 	}
-	return errors.New(fmt.Sprintf("Failed to find available port %d consecutive times.", maxPortRetries))
-}
-
-// Generate random port for the receiver in the range [minPort, maxPort]
-func generateRandomPort(minPort int, maxPort int) int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(maxPort - minPort) + minPort
+	h.port = port
+	h.bindPortStr = net.JoinHostPort(h.config.bindAddress, strconv.Itoa(port))
+	return listener, nil
 }
 
-func (h *HttpReceiver) broadcastReceiverChannel(port int) {
-    for h.agentPaw == "" {time.Sleep(1)}
-    info := []string{"HTTP"}
-    server, err := zeroconf.Register(h.agentPaw, "_service._comms", "local.", port, info, nil)
+// Advertises the receiver over mDNS once the agent has a paw, unless advertising is disabled or the receiver
+// terminates first. The TXT records carry the protocol, certificate fingerprint, P2P key fingerprint and hop count,
+// and are announced again whenever the hop count changes until the receiver terminates.
+func (h *HttpReceiver) broadcastReceiverChannel(port int, pawReady <-chan struct{}, done <-chan struct{}) {
+    discoveryConfig := GetDiscoveryConfig()
+    if h.config.advertisingDisabled || !discoveryConfig.AdvertisingEnabled {
+        output.VerbosePrint("[*] mDNS advertising disabled for HTTP proxy receiver")
+        return
+    }
+    select {
+    case <-pawReady:
+    case <-done:
+        return
+    }
+    ifaces, err := discoveryConfig.GetInterfaces()
+    if err != nil {
+        output.VerbosePrint(fmt.Sprintf("[-] Unable to advertise HTTP proxy receiver: %s", err.Error()))
+        return
+    }
+    agentPaw := h.getAgentPaw()
+    hops, hopsChanged := WatchAgentHopCount()
+    info := BuildServiceText(h.receiverName, h.certFingerprint, p2pauth.KeyFingerprint(), hops)
+    server, err := zeroconf.Register(agentPaw, discoveryConfig.Service, discoveryConfig.Domain, port, info, ifaces)
     if err != nil {
         output.VerbosePrint(fmt.Sprintf("unable to start mdns server, error: %s" , err))
+        return
+    }
+    h.stateMutex.Lock()
+    if h.terminated {
+        // The receiver terminated while registering.
+        h.stateMutex.Unlock()
+        server.Shutdown()
+        return
     }
     h.dnsServer = server
-    output.VerbosePrint(fmt.Sprintf("advertising agent on mdns (_service._comms)"))
+    h.stateMutex.Unlock()
+    output.VerbosePrint(fmt.Sprintf("advertising agent on mdns (%s)", discoveryConfig.Service))
+    for {
+        select {
+        case <-hopsChanged:
+            hops, hopsChanged = WatchAgentHopCount()
+            h.updateServiceText(server, BuildServiceText(h.receiverName, h.certFingerprint, p2pauth.KeyFingerprint(), hops))
+        case <-done:
+            return
+        }
+    }
+}
+
+// Announces the updated TXT records, unless the receiver stopped advertising in the meantime.
+func (h *HttpReceiver) updateServiceText(server *zeroconf.Server, info []string) {
+    h.stateMutex.Lock()
+    defer h.stateMutex.Unlock()
+    if h.dnsServer != server {
+        return
+    }
+    server.SetText(info)
+    output.VerbosePrint(fmt.Sprintf("[*] Updated mdns advertisement: %v", info))
 }
 
 func (h *HttpReceiver) getLocalAddressForRequest(request *http.Request) (string, error) {
@@ -357,5 +558,78 @@ func (h *HttpReceiver) getLocalAddressForRequest(request *http.Request) (string,
 	if !ok {
 		return "", errors.New("Could not access local address for HTTP request")
 	}
-	return "http://" + addr.String(), nil
+	return h.getReceiverScheme() + "://" + addr.String(), nil
+}
+
+// Authenticated HTTP receivers and receivers with a certificate use HTTPS.
+func (h *HttpReceiver) getReceiverScheme() string {
+	if p2pauth.Enabled() || h.tlsCertificate != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Sets up the certificate for serving HTTPS, using the embedded certificate if provided, or generating a self-signed
+// one if HTTPS is requested. P2P authentication uses its own certificate instead.
+func (h *HttpReceiver) initializeReceiverCertificate() error {
+	h.tlsCertificate = nil
+	h.certFingerprint = ""
+	if p2pauth.Enabled() {
+		return nil
+	}
+	var certificate tls.Certificate
+	var err error
+	if len(httpReceiverCert) > 0 || len(httpReceiverKey) > 0 {
+		certificate, err = loadEmbeddedCertificate(httpReceiverCert, httpReceiverKey)
+	} else if httpReceiverTls == "true" {
+		certificate, err = generateSelfSignedCertificate()
+	} else {
+		return nil
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not set up HTTPS receiver certificate: %s", err.Error()))
+	}
+	h.tlsCertificate = &certificate
+	h.certFingerprint = contact.GetCertificateFingerprint(certificate.Certificate[0])
+	output.VerbosePrint(fmt.Sprintf("[*] HTTP proxy receiver serving HTTPS with certificate fingerprint %s", h.certFingerprint))
+	return nil
+}
+
+func loadEmbeddedCertificate(encodedCert string, encodedKey string) (tls.Certificate, error) {
+	certPem, err := base64.StdEncoding.DecodeString(encodedCert)
+	if err != nil {
+		return tls.Certificate{}, errors.New(fmt.Sprintf("malformed certificate base64: %s", err.Error()))
+	}
+	keyPem, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return tls.Certificate{}, errors.New(fmt.Sprintf("malformed private key base64: %s", err.Error()))
+	}
+	return tls.X509KeyPair(certPem, keyPem)
+}
+
+func generateSelfSignedCertificate() (tls.Certificate, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serialNumber, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{CommonName: "localhost"},
+		NotBefore: time.Now().Add(-1 * time.Hour),
+		NotAfter: time.Now().AddDate(1, 0, 0),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certBytes, err := x509.CreateCertificate(crand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{certBytes},
+		PrivateKey: privateKey,
+	}, nil
 }
\ No newline at end of file
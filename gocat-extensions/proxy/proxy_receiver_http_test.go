@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+)
+
+func initializeHttpReceiver(t *testing.T) (*HttpReceiver, error) {
+	var upstream contact.Contact = &recordingContact{uploads: make(map[string][]byte)}
+	server := "http://c2.example.test:8888"
+	var waitgroup sync.WaitGroup
+	receiver := &HttpReceiver{}
+	if err := receiver.InitializeReceiver(&server, &upstream, &waitgroup); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() {
+		waitgroup.Add(1)
+		receiver.Terminate()
+	})
+	return receiver, nil
+}
+
+// Initializes and starts the receiver. Can be called again after the receiver terminates.
+func startHttpReceiver(t *testing.T, receiver *HttpReceiver, upstream *contact.Contact, waitgroup *sync.WaitGroup) {
+	server := "http://c2.example.test:8888"
+	if err := receiver.InitializeReceiver(&server, upstream, waitgroup); err != nil {
+		t.Fatal(err)
+	}
+	receiver.UpdateAgentPaw("receiverpaw")
+	waitgroup.Add(1)
+	go receiver.RunReceiver()
+}
+
+// Sends a beacon to the receiver, retrying while the receiver is starting up.
+func sendHttpBeacon(port int, paw string) (string, error) {
+	beaconUrl := "http://127.0.0.1:" + strconv.Itoa(port) + beaconEndpoint
+	body := base64.StdEncoding.EncodeToString([]byte(`{"paw": "` + paw + `"}`))
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		var resp *http.Response
+		if resp, err = http.Post(beaconUrl, "text/plain", strings.NewReader(body)); err == nil {
+			defer resp.Body.Close()
+			respBody, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return "", err
+			}
+			decoded, err := base64.StdEncoding.DecodeString(string(respBody))
+			return string(decoded), err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return "", err
+}
+
+func setHttpReceiverTls(t *testing.T, useTls string, encodedCert string, encodedKey string) {
+	originalTls, originalCert, originalKey := httpReceiverTls, httpReceiverCert, httpReceiverKey
+	httpReceiverTls, httpReceiverCert, httpReceiverKey = useTls, encodedCert, encodedKey
+	t.Cleanup(func() { httpReceiverTls, httpReceiverCert, httpReceiverKey = originalTls, originalCert, originalKey })
+}
+
+func checkReceiverUrls(t *testing.T, receiver *HttpReceiver, prefix string, suffix string) {
+	for _, url := range receiver.GetReceiverAddresses() {
+		if !strings.HasPrefix(url, prefix) || !strings.HasSuffix(url, suffix) {
+			t.Errorf("expected receiver URL %s to start with %s and end with %q", url, prefix, suffix)
+		}
+	}
+}
+
+func TestHttpReceiverWithoutTls(t *testing.T) {
+	setHttpReceiverTls(t, "false", "", "")
+	receiver, err := initializeHttpReceiver(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.tlsCertificate != nil || len(receiver.certFingerprint) > 0 {
+		t.Errorf("expected no receiver certificate by default")
+	}
+	checkReceiverUrls(t, receiver, "http://", ":"+strconv.Itoa(receiver.port))
+}
+
+func TestHttpReceiverSelfSignedCertificate(t *testing.T) {
+	setHttpReceiverTls(t, "true", "", "")
+	receiver, err := initializeHttpReceiver(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.tlsCertificate == nil {
+		t.Fatalf("expected self-signed receiver certificate")
+	}
+	if expected := contact.GetCertificateFingerprint(receiver.tlsCertificate.Certificate[0]); receiver.certFingerprint != expected {
+		t.Errorf("expected certificate fingerprint %s, got %s", expected, receiver.certFingerprint)
+	}
+	checkReceiverUrls(t, receiver, "https://", "#sha256="+receiver.certFingerprint)
+}
+
+func TestHttpReceiverEmbeddedCertificate(t *testing.T) {
+	certificate, err := generateSelfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	setHttpReceiverTls(t, "false", base64.StdEncoding.EncodeToString(certPem), base64.StdEncoding.EncodeToString(keyPem))
+
+	receiver, err := initializeHttpReceiver(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := contact.GetCertificateFingerprint(certificate.Certificate[0]); receiver.certFingerprint != expected {
+		t.Errorf("expected embedded certificate fingerprint %s, got %s", expected, receiver.certFingerprint)
+	}
+	checkReceiverUrls(t, receiver, "https://", "#sha256="+receiver.certFingerprint)
+
+	// Malformed certificates are reported instead of falling back to plain HTTP.
+	setHttpReceiverTls(t, "false", "not base64", base64.StdEncoding.EncodeToString(keyPem))
+	if _, err = initializeHttpReceiver(t); err == nil {
+		t.Errorf("expected error for malformed embedded certificate")
+	}
+}
+
+func TestHttpReceiverRestart(t *testing.T) {
+	setHttpReceiverTls(t, "false", "", "")
+	recorder := &recordingContact{uploads: make(map[string][]byte)}
+	var upstream contact.Contact = recorder
+	var waitgroup sync.WaitGroup
+	receiver := &HttpReceiver{}
+	if err := receiver.SetReceiverConfig(map[string]string{"bindAddress": "127.0.0.1", "advertise": "false"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ {
+		startHttpReceiver(t, receiver, &upstream, &waitgroup)
+		if addresses := receiver.GetReceiverAddresses(); len(addresses) != 1 || addresses[0] != "http://127.0.0.1:"+strconv.Itoa(receiver.port) {
+			t.Errorf("expected only the bind address to be advertised, got %v", addresses)
+		}
+		if beacon, err := sendHttpBeacon(receiver.port, "clientpaw"); err != nil || beacon != `{"paw": "clientpaw"}` {
+			t.Fatalf("unexpected beacon response on run %d: %q %v", run, beacon, err)
+		}
+		port := receiver.port
+		receiver.Terminate()
+		waitgroup.Wait()
+		if _, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + beaconEndpoint); err == nil {
+			t.Errorf("expected receiver to stop listening on port %d after termination", port)
+		}
+	}
+	// Peer statistics are kept across restarts.
+	if peers := receiver.GetPeers(); len(peers) != 1 || peers[0]["paw"] != "clientpaw" || peers[0]["requests"].(map[string]int)["beacon"] != 2 {
+		t.Errorf("expected both beacons to be recorded for the client peer, got %v", peers)
+	}
+	if len(recorder.profiles) != 2 {
+		t.Errorf("expected a forwarded beacon for each run, got %d", len(recorder.profiles))
+	}
+	if hop := recorder.profiles[0]["proxy_chain"].([]interface{})[0].([]string); hop[0] != "receiverpaw" || hop[2] != httpProxyName {
+		t.Errorf("unexpected proxy chain hop: %v", hop)
+	}
+
+	// Receivers can be terminated before they start serving.
+	server := "http://c2.example.test:8888"
+	if err := receiver.InitializeReceiver(&server, &upstream, &waitgroup); err != nil {
+		t.Fatal(err)
+	}
+	waitgroup.Add(1)
+	receiver.Terminate()
+	waitgroup.Wait()
+}
+
+func TestHttpReceiverAdvertisesOncePawIsReady(t *testing.T) {
+	setHttpReceiverTls(t, "false", "", "")
+	receiver, err := initializeHttpReceiver(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.UpdateAgentPaw("")
+	select {
+	case <-receiver.pawReady:
+		t.Fatalf("expected paw-ready signal to wait for a paw")
+	default:
+	}
+
+	// Advertising stops waiting for a paw when the receiver terminates.
+	broadcastDone := make(chan struct{})
+	go func() {
+		receiver.broadcastReceiverChannel(receiver.port, receiver.pawReady, receiver.done)
+		close(broadcastDone)
+	}()
+	close(receiver.done)
+	select {
+	case <-broadcastDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected advertising to stop once the receiver terminates")
+	}
+	receiver.done = make(chan struct{})
+
+	receiver.UpdateAgentPaw("receiverpaw")
+	receiver.UpdateAgentPaw("newpaw")
+	select {
+	case <-receiver.pawReady:
+	default:
+		t.Errorf("expected paw-ready signal once the receiver has a paw")
+	}
+}
+
+func TestHttpReceiverQueuesWhileUpstreamUnreachable(t *testing.T) {
+	setHttpReceiverTls(t, "false", "", "")
+	useTestRelayQueue(t, "1048576")
+	recorder := &recordingContact{uploads: make(map[string][]byte)}
+	var upstream contact.Contact = recorder
+	var waitgroup sync.WaitGroup
+	receiver := &HttpReceiver{}
+	if err := receiver.SetReceiverConfig(map[string]string{"bindAddress": "127.0.0.1", "advertise": "false"}); err != nil {
+		t.Fatal(err)
+	}
+	startHttpReceiver(t, receiver, &upstream, &waitgroup)
+	defer func() {
+		receiver.Terminate()
+		waitgroup.Wait()
+	}()
+	if _, err := sendHttpBeacon(receiver.port, "clientpaw"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Results are acknowledged with 202 Accepted while queued.
+	SetUpstreamReachable(false)
+	results := base64.StdEncoding.EncodeToString([]byte(`{"paw": "clientpaw", "results": [{"id": "link1"}]}`))
+	resp, err := http.Post("http://127.0.0.1:"+strconv.Itoa(receiver.port)+beaconEndpoint, "text/plain", strings.NewReader(results))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || GetQueuedRequestCount() != 1 {
+		t.Fatalf("expected queued results acknowledgment, got status %d with %d queued", resp.StatusCode, GetQueuedRequestCount())
+	}
+
+	// The next relayed beacon flushes the queue.
+	if _, err := sendHttpBeacon(receiver.port, "clientpaw"); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 0; attempt < 50 && GetQueuedRequestCount() > 0; attempt++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if len(recorder.results) != 1 || recorder.results[0]["id"] != "link1" {
+		t.Errorf("expected queued results to be flushed upstream, got %v", recorder.results)
+	}
+}
+
+func TestHttpReceiverRelaysProfiledClient(t *testing.T) {
+	setHttpReceiverTls(t, "false", "", "")
+	recorder := &recordingContact{uploads: make(map[string][]byte)}
+	var upstream contact.Contact = recorder
+	var waitgroup sync.WaitGroup
+	receiver := &HttpReceiver{}
+	if err := receiver.SetReceiverConfig(map[string]string{"bindAddress": "127.0.0.1", "advertise": "false"}); err != nil {
+		t.Fatal(err)
+	}
+	startHttpReceiver(t, receiver, &upstream, &waitgroup)
+	defer func() {
+		receiver.Terminate()
+		waitgroup.Wait()
+	}()
+	if _, err := sendHttpBeacon(receiver.port, "warmuppaw"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The malleable profile only applies to the C2 server, so the client uses the default format with the receiver.
+	client := contact.CommunicationChannels["HTTP"]
+	client.(contact.PeerAuthenticator).SetUpstreamIsPeer(true)
+	defer client.(contact.PeerAuthenticator).SetUpstreamIsPeer(false)
+	client.SetUpstreamDestAddr("http://127.0.0.1:" + strconv.Itoa(receiver.port))
+	httpProfile := `{"beacon": {"uris": ["/api/status"], "client": {"location": "header", "name": "X-Session"}},
+		"download": {"uris": ["/assets"], "client": {"location": "uri"}},
+		"upload": {"uris": ["/upload"], "client": {"location": "query", "name": "d"}}}`
+	if ok, _ := client.C2RequirementsMet(nil, map[string]string{"httpProfile": httpProfile}); !ok {
+		t.Fatal("expected HTTP contact requirements to be met")
+	}
+	agentProfile := map[string]interface{}{"paw": "clientpaw", "host": "clienthost", "platform": "linux"}
+	if beacon := client.GetBeaconBytes(agentProfile); string(beacon) != `{"paw": "clientpaw"}` {
+		t.Errorf("unexpected relayed beacon response: %q", beacon)
+	}
+	if payload, payloadName := client.GetPayloadBytes(agentProfile, "tool"); string(payload) != "payload for clientpaw" || payloadName != "real-tool" {
+		t.Errorf("unexpected relayed payload %q with name %s", payload, payloadName)
+	}
+	if err := client.UploadFileBytes(agentProfile, "loot.txt", []byte("loot")); err != nil {
+		t.Fatal(err)
+	}
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if string(recorder.uploads["loot.txt"]) != "loot" {
+		t.Errorf("expected relayed upload to reach the upstream contact, got %v", recorder.uploads)
+	}
+}
@@ -26,6 +26,8 @@
  * agents, it will forward the message upstream and return the response.  Each upstream P2P message via SMB pipes
  * must contain the requesting agent's mailbox pipe path for response messages, so the P2P receiver knows where to send
  * the responses.
+ * If the agent was compiled with a P2P key, every pipe connection is authenticated and encrypted using the p2pauth
+ * package, including the connections that deliver responses to the mailbox pipes.
  */
 
 package proxy
@@ -82,6 +84,7 @@ type SmbPipeReceiver struct {
 	waitgroup            *sync.WaitGroup
 	receiverContext      context.Context
 	receiverCancelFunc   context.CancelFunc
+	peerTracker          // statistics for the downstream peers that sent requests to this receiver.
 }
 
 func init() {
@@ -122,7 +125,7 @@ func (s *SmbPipeReceiver) InitializeReceiver(agentServer *string, upstreamComs *
 func (s *SmbPipeReceiver) RunReceiver() {
 	output.VerbosePrint(fmt.Sprintf("[*] Starting SMB pipe proxy receiver on local pipe path %s", s.localMainPipePath))
 	output.VerbosePrint(fmt.Sprintf("[*] SMB pipe proxy receiver has upstream contact type %s", (*s.upstreamComs).GetName()))
-	s.startReceiverHelper()
+	s.startReceiverHelper(s.listener) // the receiver may be initialized again once terminated
 }
 
 // Update paw of agent running this receiver.
@@ -146,12 +149,15 @@ func (s *SmbPipeReceiver) GetReceiverAddresses() []string {
 	return addrList
 }
 
-// Helper method for StartReceiver.
-func (s *SmbPipeReceiver) startReceiverHelper() {
+// Helper method for StartReceiver. Returns once the listener is closed.
+func (s *SmbPipeReceiver) startReceiverHelper(listener net.Listener) {
 	// Whenever a client connects to pipe with a request, process the request using a go routine.
 	for {
-		totalData, err := fetchDataFromPipe(s.listener)
+		totalData, err := fetchDataFromPipe(listener)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			output.VerbosePrint(fmt.Sprintf("[!] Error with reading client input: %s", err.Error()))
 			continue
 		}
@@ -162,6 +168,8 @@ func (s *SmbPipeReceiver) startReceiverHelper() {
 			output.VerbosePrint("[!] Error - downstream agent sent an empty P2P message.")
 			continue
 		}
+		// Responses are sent back asynchronously, so only the requests are recorded for the peer.
+		s.recordRequest(message.SourcePaw, message.SourceAddress, getPeerRequestType(message.MessageType), len(totalData), 0, nil)
 		switch message.MessageType {
 		case GET_INSTRUCTIONS:
 			go s.forwardGetBeaconBytes(message)
@@ -191,6 +199,7 @@ func (s *SmbPipeReceiver) forwardGetBeaconBytes(message P2pMessage) {
 	updatePeerChain(clientProfile, s.agentPaw, s.externalMainPipePath, s.receiverName)
 	output.VerbosePrint(fmt.Sprintf("[*] Forwarding instructions request on behalf of paw %s", message.SourcePaw))
 	response := (*s.upstreamComs).GetBeaconBytes(clientProfile)
+	recordUpstreamBeacon(*s.upstreamComs, response)
 
 	// Connect to client mailbox to send response back to client.
 	if len(message.SourceAddress) > 0 {
@@ -268,9 +277,11 @@ func (s *SmbPipeReceiver) forwardSendExecResults(message P2pMessage) {
 	result := resultInfo.([]interface{})[0]
 	clientProfile["server"] = *s.agentServer
 
-	// Send execution results upstream. No response will be sent to client.
+	// Send or queue execution results upstream. No response will be sent to client.
 	output.VerbosePrint(fmt.Sprintf("[*] Forwarding execution results on behalf of paw %s", message.SourcePaw))
-	(*s.upstreamComs).SendExecutionResults(clientProfile, result.(map[string]interface{}))
+	if _, err := forwardExecutionResults(*s.upstreamComs, clientProfile, result.(map[string]interface{})); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error forwarding execution results for client: %s", err.Error()))
+	}
 }
 
 func (s *SmbPipeReceiver) forwardSendUploadBytes(message P2pMessage) {
@@ -283,35 +294,37 @@ func (s *SmbPipeReceiver) forwardSendUploadBytes(message P2pMessage) {
 	var requestInfo uploadRequestInfo
 	if err := json.Unmarshal(message.Payload, &requestInfo); err != nil {
 		output.VerbosePrint(fmt.Sprintf("[!] Error extracting file upload request info from p2p message: %s", err.Error()))
-		s.sendUploadResultsToClient(message.SourceAddress, "", false)
+		s.sendUploadResultsToClient(message.SourceAddress, "", false, false)
 		return
 	}
 	if len(requestInfo.UploadName) == 0 {
 		output.VerbosePrint("[!] Error - client did not send upload name in upload request.")
-		s.sendUploadResultsToClient(message.SourceAddress, "", false)
+		s.sendUploadResultsToClient(message.SourceAddress, "", false, false)
 		return
 	}
 	if requestInfo.UploadData == nil {
 		output.VerbosePrint("[!] Error. Client did not include file data for upload.")
-		s.sendUploadResultsToClient(message.SourceAddress, requestInfo.UploadName, false)
+		s.sendUploadResultsToClient(message.SourceAddress, requestInfo.UploadName, false, false)
 		return
 	}
 	requestInfo.Profile["server"] = *s.agentServer
 	output.VerbosePrint(fmt.Sprintf("[*] Forwarding upload request for file %s on behalf of paw %s", requestInfo.UploadName, message.SourcePaw))
 	successfulUpload := true
-	if err := (*s.upstreamComs).UploadFileBytes(requestInfo.Profile, requestInfo.UploadName, requestInfo.UploadData); err != nil {
+	queued, err := forwardUploadBytes(*s.upstreamComs, requestInfo.Profile, requestInfo.UploadName, requestInfo.UploadData)
+	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[!] Error uploading file bytes for client: %s", err.Error()))
 		successfulUpload = false
 	}
 
 	// Send response to client
-	s.sendUploadResultsToClient(message.SourceAddress, requestInfo.UploadName, successfulUpload)
+	s.sendUploadResultsToClient(message.SourceAddress, requestInfo.UploadName, successfulUpload, queued)
 }
 
-func (s *SmbPipeReceiver) sendUploadResultsToClient(address string, uploadName string, successful bool) {
+func (s *SmbPipeReceiver) sendUploadResultsToClient(address string, uploadName string, successful bool, queued bool) {
 	respInfo := uploadResponseInfo{
 		UploadName: uploadName,
 		Result:     successful,
+		Queued:     queued,
 	}
 	respData, err := json.Marshal(respInfo)
 	if err != nil {
@@ -455,6 +468,14 @@ func (s *SmbPipeAPI) SetUpstreamDestAddr(upstreamDestAddr string) {
 }
 
 func (s *SmbPipeAPI) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+	if err := s.DeliverExecutionResults(profile, result); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error sending execution results upstream: %s", err.Error()))
+	}
+}
+
+// Returns an error if the execution results could not be sent to the upstream pipe. Receivers do not acknowledge
+// execution results, so results lost after reaching the pipe are not detected.
+func (s *SmbPipeAPI) DeliverExecutionResults(profile map[string]interface{}, result map[string]interface{}) error {
 	requestingPaw := getPawFromProfile(profile)
 
 	// Set up mailbox pipe and listener if needed.
@@ -474,15 +495,13 @@ func (s *SmbPipeAPI) SendExecutionResults(profile map[string]interface{}, result
 	profileCopy["results"] = results
 	msgPayload, err := json.Marshal(profileCopy)
 	if err != nil {
-		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. Error with profile marshal: %s", err.Error()))
+		return errors.New(fmt.Sprintf("Cannot send results. Error with profile marshal: %s", err.Error()))
 	}
 	output.VerbosePrint(fmt.Sprintf("[*] P2p Client: sending execution results to %s", s.upstreamDestAddr))
 	upstreamPipeLock.Lock()
 	err = sendRequestToUpstreamPipe(s.upstreamDestAddr, requestingPaw, SEND_EXECUTION_RESULTS, msgPayload, mailBoxPipePath)
 	upstreamPipeLock.Unlock()
-	if err != nil {
-		output.VerbosePrint(fmt.Sprintf("[!] Error sending execution results upstream: %s", err.Error()))
-	}
+	return err
 }
 
 func (s *SmbPipeAPI) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
@@ -532,6 +551,9 @@ func (s *SmbPipeAPI) UploadFileBytes(profile map[string]interface{}, uploadName
 	if !responseInfo.Result {
 		return errors.New(fmt.Sprintf("Failed upload for file %s", responseInfo.UploadName))
 	}
+	if responseInfo.Queued {
+		output.VerbosePrint(fmt.Sprintf("[*] Upstream receiver queued upload of file %s until its upstream is reachable", uploadName))
+	}
 	return nil
 }
 
@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+)
+
+func TestSmbPipeReceiverStopsOnTerminate(t *testing.T) {
+	var upstream contact.Contact = &recordingContact{uploads: make(map[string][]byte)}
+	server := "http://c2.example.test:8888"
+	receiver := &SmbPipeReceiver{}
+
+	// The receiver is restarted once, and each run should stop accepting on its own listener when terminated.
+	for run := 0; run < 2; run++ {
+		var waitgroup sync.WaitGroup
+		if err := receiver.InitializeReceiver(&server, &upstream, &waitgroup); err != nil {
+			t.Fatal(err)
+		}
+		waitgroup.Add(1)
+		receiverDone := make(chan struct{})
+		go func() {
+			receiver.RunReceiver()
+			close(receiverDone)
+		}()
+		receiver.Terminate()
+		waitgroup.Wait()
+		select {
+		case <-receiverDone:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected receiver to stop on run %d once terminated", run)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/p2pauth"
 
 	"gopkg.in/natefinch/npipe.v2"
 )
@@ -27,31 +28,6 @@ const (
 	pipeDialTimeoutSec = 10 // number of seconds to wait before timing out of pipe dial attempt.
 )
 
-// Auxiliary struct that defines P2P message payload structure for an ability payload request
-type payloadRequestInfo struct {
-	PayloadName string
-	Profile map[string]interface{}
-}
-
-// Auxiliary struct that defines P2P message payload structure for an ability payload response
-type payloadResponseInfo struct {
-	PayloadName string
-	PayloadData []byte
-}
-
-// Auxiliary struct that defines P2P message payload structure for an ability upload request
-type uploadRequestInfo struct {
-	UploadName string
-	UploadData []byte
-	Profile map[string]interface{}
-}
-
-// Auxiliary struct that defines P2P message payload structure for an ability upload response
-type uploadResponseInfo struct {
-	UploadName string
-	Result bool
-}
-
 /*
  * SMB Read/Write helper functions
  */
@@ -79,7 +55,11 @@ func getResponseMessage(listener net.Listener) (P2pMessage, error) {
 func sendDataToPipe(pipePath string, data []byte) (int, error) {
 	// Connect to pipe.
 	timeout := pipeDialTimeoutSec * time.Second
-	conn, err := npipe.DialTimeout(pipePath, timeout)
+	pipeConn, err := npipe.DialTimeout(pipePath, timeout)
+    if err != nil {
+        return 0, err
+    }
+    conn, err := p2pauth.ClientConn(pipeConn)
     if err != nil {
         return 0, err
     }
@@ -241,9 +221,33 @@ func createNewReturnMailBox() (string, net.Listener, error) {
     return mailBoxPipePath, mailBoxListener, nil
 }
 
-// Helper function that listens on pipe and returns listener and any error.
+// Helper function that listens on pipe and returns listener and any error. If the agent was compiled with a P2P key,
+// the listener only returns connections that completed the P2P handshake.
 func listenPipeFullAccess(pipePath string) (net.Listener, error) {
-    return npipe.Listen(pipePath)
+    listener, err := npipe.Listen(pipePath)
+    if err != nil {
+        return nil, err
+    }
+    authListener, err := p2pauth.WrapListener(&pipeListener{listener}, protocolName)
+    if err != nil {
+        listener.Close()
+        return nil, err
+    }
+    return authListener, nil
+}
+
+// Pipe listener that reports closed pipes as net.ErrClosed, so that authenticating listeners stop accepting
+// connections once the pipe is closed.
+type pipeListener struct {
+    net.Listener
+}
+
+func (p *pipeListener) Accept() (net.Conn, error) {
+    conn, err := p.Listener.Accept()
+    if err == npipe.ErrClosed {
+        return nil, net.ErrClosed
+    }
+    return conn, err
 }
 
 // Helper function that creates random pipename of random length, using specified seed.
@@ -265,12 +269,4 @@ func getMainPipeName(seedStr string) string {
 		seedNum += i*int(rune)
 	}
 	return getRandPipeName(int64(seedNum))
-}
-
-// Return the paw from the profile.
-func getPawFromProfile(profile map[string]interface{}) string {
-	if profile["paw"] != nil {
-		return profile["paw"].(string)
-	}
-	return ""
 }
\ No newline at end of file
@@ -0,0 +1,307 @@
+/*
+ * This file contains implementations for a P2P client (TcpAPI) and P2P receiver (TcpReceiver) that exchange
+ * P2pMessage frames over raw TCP connections, using the stream framing helpers in the core proxy package.
+ *
+ * The TCP client keeps a single persistent connection to its upstream TCP receiver and sends one request at a
+ * time, waiting for the matching response frame before sending the next request. Requests forwarded on behalf of
+ * downstream agents share the same connection. Every request gets a response, including execution results,
+ * which are acknowledged with an ACK_EXECUTION_RESULTS message, so that the client can detect dead connections.
+ * If a request fails over an existing connection before the upstream receiver could have processed it, the client
+ * reconnects and retries the request once. Requests are not retried once a response started to arrive or timed out,
+ * so that execution results and uploads are not sent upstream twice.
+ * If the agent was compiled with a P2P key, connections are authenticated and encrypted using the p2pauth package.
+ *
+ * The TCP receiver accepts any number of persistent client connections and handles the requests of each
+ * connection in order, forwarding them upstream using the agent's current contact.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/p2pauth"
+)
+
+var (
+	tcpProxyName       = "TCP"
+	tcpMaxPortRetries  = 5
+	tcpMinReceiverPort = 50000
+	tcpMaxReceiverPort = 63000
+	tcpDialTimeout     = 10 * time.Second
+	tcpResponseTimeout = 5 * time.Minute // upstream requests such as payload downloads may take a while
+)
+
+// TcpAPI communicates with an upstream TcpReceiver over a persistent TCP connection. Implements the Contact interface.
+type TcpAPI struct {
+	name             string
+	upstreamDestAddr string
+	conn             net.Conn // persistent connection to the upstream receiver
+	connMutex        sync.Mutex
+}
+
+// TcpReceiver forwards P2P messages received over TCP to the upstream destination. Implements the P2pReceiver interface.
+type TcpReceiver struct {
+	streamForwarder
+	port      int
+	config    receiverConfig // listening settings, set remotely
+	listener  net.Listener
+	addresses []string // addresses that external machines can use to reach this receiver
+	waitgroup *sync.WaitGroup
+	conns     map[net.Conn]bool
+	connMutex sync.Mutex
+	handlers  sync.WaitGroup // connection handlers, waited for on termination
+	closed    bool           // whether the receiver terminated. Protected by connMutex
+}
+
+func init() {
+	tcpClient := &TcpAPI{name: tcpProxyName}
+	contact.CommunicationChannels[tcpProxyName] = tcpClient
+	P2pClientChannels[tcpProxyName] = tcpClient
+	P2pReceiverChannels[tcpProxyName] = &TcpReceiver{}
+}
+
+/*
+ * TcpReceiver Implementation (implements P2pReceiver interface).
+ */
+
+func (t *TcpReceiver) InitializeReceiver(agentServer *string, upstreamComs *contact.Contact, waitgroup *sync.WaitGroup) error {
+	listener, port, err := t.config.listenTcp(tcpMinReceiverPort, tcpMaxReceiverPort, tcpMaxPortRetries)
+	if err != nil {
+		return err
+	}
+	ipAddrs, err := t.config.getReachableHosts()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	authListener, err := p2pauth.WrapListener(listener, tcpProxyName)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	t.addresses = make([]string, 0, len(ipAddrs))
+	for _, addr := range ipAddrs {
+		t.addresses = append(t.addresses, net.JoinHostPort(addr, strconv.Itoa(port)))
+	}
+	t.listener = authListener
+	t.port = port
+	t.receiverName = tcpProxyName
+	t.agentServer = agentServer
+	t.upstreamComs = upstreamComs
+	t.waitgroup = waitgroup
+	t.connMutex.Lock()
+	t.conns = make(map[net.Conn]bool)
+	t.closed = false
+	t.connMutex.Unlock()
+	return nil
+}
+
+// Accepts client connections. This method must be run as a go routine.
+func (t *TcpReceiver) RunReceiver() {
+	output.VerbosePrint(fmt.Sprintf("[*] Starting TCP proxy receiver on local port %d", t.port))
+	output.VerbosePrint(fmt.Sprintf("[*] TCP proxy receiver is using upstream contact %s", (*t.upstreamComs).GetName()))
+	listener := t.listener // the receiver may be initialized again once terminated
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			output.VerbosePrint(fmt.Sprintf("[!] Error accepting TCP proxy connection: %s", err.Error()))
+			continue
+		}
+		t.connMutex.Lock()
+		if t.closed {
+			t.connMutex.Unlock()
+			conn.Close()
+			continue
+		}
+		t.conns[conn] = true
+		t.handlers.Add(1)
+		t.connMutex.Unlock()
+		go t.handleConnection(conn)
+	}
+}
+
+// Sets the bind address and port for the next time the receiver is initialized.
+func (t *TcpReceiver) SetReceiverConfig(config map[string]string) error {
+	receiverConfig, err := parseReceiverConfig(config)
+	if err != nil {
+		return err
+	}
+	t.config = receiverConfig
+	return nil
+}
+
+// Update paw of agent running this receiver.
+func (t *TcpReceiver) UpdateAgentPaw(newPaw string) {
+	t.agentPaw = newPaw
+}
+
+func (t *TcpReceiver) Terminate() {
+	defer t.waitgroup.Done()
+	if err := t.listener.Close(); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error when closing TCP receiver listener: %s", err.Error()))
+	}
+	t.connMutex.Lock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.connMutex.Unlock()
+
+	// Requests that are being forwarded are finished before the receiver can be initialized again.
+	t.handlers.Wait()
+}
+
+func (t *TcpReceiver) GetReceiverAddresses() []string {
+	return t.addresses
+}
+
+// Handles the requests sent over a client connection, in order, until the connection closes.
+func (t *TcpReceiver) handleConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		t.connMutex.Lock()
+		delete(t.conns, conn)
+		t.connMutex.Unlock()
+		t.handlers.Done()
+	}()
+	t.serveConnection(conn, conn.LocalAddr().String())
+}
+
+/*
+ * TcpAPI implementation (implements contact.Contact interface)
+ */
+
+func (t *TcpAPI) GetBeaconBytes(profile map[string]interface{}) []byte {
+	return getStreamBeaconBytes(t, profile)
+}
+
+// Will obtain the payload bytes in memory to be written to disk later by caller.
+func (t *TcpAPI) GetPayloadBytes(profile map[string]interface{}, payload string) ([]byte, string) {
+	return getStreamPayloadBytes(t, profile, payload)
+}
+
+// Requires the upstream destination to be a TCP receiver address of the form host:port.
+func (t *TcpAPI) C2RequirementsMet(profile map[string]interface{}, criteria map[string]string) (bool, map[string]string) {
+	t.connMutex.Lock()
+	upstreamDestAddr := t.upstreamDestAddr
+	t.connMutex.Unlock()
+	if len(upstreamDestAddr) == 0 {
+		output.VerbosePrint("[!] Upstream destination address not yet set for TCP contact.")
+		return false, nil
+	}
+	if _, _, err := net.SplitHostPort(upstreamDestAddr); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Invalid TCP receiver address %s: %s", upstreamDestAddr, err.Error()))
+		return false, nil
+	}
+	return true, nil
+}
+
+// Sets the upstream TCP receiver address. The tcp:// prefix is optional. Closes the persistent connection
+// if the address changes.
+func (t *TcpAPI) SetUpstreamDestAddr(upstreamDestAddr string) {
+	upstreamDestAddr = strings.TrimPrefix(upstreamDestAddr, "tcp://")
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	if upstreamDestAddr != t.upstreamDestAddr && t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	t.upstreamDestAddr = upstreamDestAddr
+}
+
+func (t *TcpAPI) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+	sendStreamExecutionResults(t, profile, result)
+}
+
+// Returns an error if the upstream receiver did not acknowledge the execution results.
+func (t *TcpAPI) DeliverExecutionResults(profile map[string]interface{}, result map[string]interface{}) error {
+	return deliverStreamExecutionResults(t, profile, result)
+}
+
+func (t *TcpAPI) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
+	return uploadStreamFileBytes(t, profile, uploadName, data)
+}
+
+func (t *TcpAPI) GetName() string {
+	return t.name
+}
+
+func (t *TcpAPI) SupportsContinuous() bool {
+	return false
+}
+
+// Sends the request over the persistent connection and returns the payload of the response, which must be of
+// the expected type. If the request fails over an existing connection and can safely be sent again, the connection
+// is replaced and the request is retried once.
+func (t *TcpAPI) sendRequest(paw string, messageType int, payload []byte, expectedType int) ([]byte, error) {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		reused := t.conn != nil
+		if !reused {
+			conn, err := net.DialTimeout("tcp", t.upstreamDestAddr, tcpDialTimeout)
+			if err != nil {
+				return nil, err
+			}
+			if conn, err = p2pauth.ClientConn(conn); err != nil {
+				return nil, err
+			}
+			t.conn = conn
+		}
+		respMessage, retryable, err := t.exchange(paw, messageType, payload)
+		if err == nil {
+			return getStreamResponsePayload(respMessage, messageType, expectedType)
+		}
+		t.conn.Close()
+		t.conn = nil
+		if !reused || !retryable {
+			return nil, err
+		}
+		output.VerbosePrint(fmt.Sprintf("[-] Error sending request over existing TCP connection, reconnecting: %s", err.Error()))
+	}
+	return nil, errors.New("Could not send request to upstream TCP receiver")
+}
+
+// Writes the request frame and reads the response frame. Must be called with the connection lock held. Returns
+// whether the request can safely be sent again, which is the case if the request frame could not be written, or if
+// the connection was closed before any response bytes arrived.
+func (t *TcpAPI) exchange(paw string, messageType int, payload []byte) (P2pMessage, bool, error) {
+	t.conn.SetDeadline(time.Now().Add(tcpResponseTimeout))
+	defer t.conn.SetDeadline(time.Time{})
+	if err := writeStreamFrame(t.conn, paw, messageType, payload, t.conn.LocalAddr().String()); err != nil {
+		return P2pMessage{}, true, err
+	}
+	reader := &countingReader{reader: t.conn}
+	respMessage, err := readStreamFrame(reader)
+	if err != nil {
+		connClosed := errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+		return P2pMessage{}, connClosed && reader.count == 0, err
+	}
+	return respMessage, false, nil
+}
+
+// Reader that counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += n
+	return n, err
+}
@@ -0,0 +1,401 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/p2pauth"
+)
+
+// Upstream contact stand-in that records the requests forwarded by the receiver.
+type recordingContact struct {
+	mutex    sync.Mutex
+	profiles []map[string]interface{}
+	results  []map[string]interface{}
+	uploads  map[string][]byte
+}
+
+func (r *recordingContact) GetBeaconBytes(profile map[string]interface{}) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.profiles = append(r.profiles, profile)
+	return []byte(`{"paw": "` + profile["paw"].(string) + `"}`)
+}
+
+func (r *recordingContact) GetPayloadBytes(profile map[string]interface{}, payload string) ([]byte, string) {
+	return []byte("payload for " + profile["paw"].(string)), "real-" + payload
+}
+
+func (r *recordingContact) C2RequirementsMet(profile map[string]interface{}, criteria map[string]string) (bool, map[string]string) {
+	return true, nil
+}
+
+func (r *recordingContact) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.results = append(r.results, result)
+}
+
+func (r *recordingContact) GetName() string {
+	return "recording"
+}
+
+func (r *recordingContact) SetUpstreamDestAddr(upstreamDestAddr string) {}
+
+func (r *recordingContact) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
+	if uploadName == "denied.txt" {
+		return errors.New("upload denied")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.uploads[uploadName] = data
+	return nil
+}
+
+func (r *recordingContact) SupportsContinuous() bool {
+	return false
+}
+
+func startTcpReceiver(t *testing.T) (*TcpReceiver, *recordingContact) {
+	var upstream contact.Contact = &recordingContact{uploads: make(map[string][]byte)}
+	server := "http://c2.example.test:8888"
+	var waitgroup sync.WaitGroup
+	receiver := &TcpReceiver{}
+	if err := receiver.InitializeReceiver(&server, &upstream, &waitgroup); err != nil {
+		t.Fatal(err)
+	}
+	receiver.UpdateAgentPaw("receiverpaw")
+	waitgroup.Add(1)
+	go receiver.RunReceiver()
+	t.Cleanup(func() {
+		receiver.Terminate()
+		waitgroup.Wait()
+	})
+	return receiver, upstream.(*recordingContact)
+}
+
+func newTcpClient(receiver *TcpReceiver) *TcpAPI {
+	client := &TcpAPI{name: tcpProxyName}
+	client.SetUpstreamDestAddr("tcp://127.0.0.1:" + strconv.Itoa(receiver.port))
+	return client
+}
+
+func getOpenConnCount(receiver *TcpReceiver) int {
+	receiver.connMutex.Lock()
+	defer receiver.connMutex.Unlock()
+	return len(receiver.conns)
+}
+
+func TestTcpP2pMessageTypes(t *testing.T) {
+	useTestRelayQueue(t, "1048576")
+	receiver, upstream := startTcpReceiver(t)
+	client := newTcpClient(receiver)
+	defer client.SetUpstreamDestAddr("")
+	if valid, _ := client.C2RequirementsMet(nil, nil); !valid {
+		t.Fatalf("expected TCP contact requirements to be met")
+	}
+	profile := map[string]interface{}{"paw": "clientpaw", "server": "http://peer:8888"}
+
+	if beacon := client.GetBeaconBytes(profile); string(beacon) != `{"paw": "clientpaw"}` {
+		t.Errorf("unexpected beacon response: %s", beacon)
+	}
+	forwarded := upstream.profiles[0]
+	if forwarded["server"] != "http://c2.example.test:8888" {
+		t.Errorf("expected server to be replaced with the receiver agent's server, got %v", forwarded["server"])
+	}
+	proxyChain, ok := forwarded["proxy_chain"].([]interface{})
+	if !ok || len(proxyChain) != 1 {
+		t.Fatalf("expected one hop in proxy chain, got %v", forwarded["proxy_chain"])
+	}
+	if hop := proxyChain[0].([]string); hop[0] != "receiverpaw" || hop[1] != "127.0.0.1:"+strconv.Itoa(receiver.port) || hop[2] != "TCP" {
+		t.Errorf("unexpected proxy chain hop: %v", hop)
+	}
+
+	payloadData, payloadName := client.GetPayloadBytes(profile, "tool.exe")
+	if string(payloadData) != "payload for clientpaw" || payloadName != "real-tool.exe" {
+		t.Errorf("unexpected payload response: %s %s", payloadData, payloadName)
+	}
+
+	client.SendExecutionResults(profile, map[string]interface{}{"id": "link1", "output": "b2s="})
+	if len(upstream.results) != 1 || upstream.results[0]["id"] != "link1" {
+		t.Errorf("expected execution results to be forwarded, got %v", upstream.results)
+	}
+
+	if err := client.UploadFileBytes(profile, "loot.txt", []byte("secret")); err != nil {
+		t.Errorf("upload through TCP receiver failed: %s", err.Error())
+	}
+	if string(upstream.uploads["loot.txt"]) != "secret" {
+		t.Errorf("expected upload to be forwarded, got %v", upstream.uploads)
+	}
+	// Uploads that fail upstream are queued for later delivery.
+	if err := client.UploadFileBytes(profile, "denied.txt", []byte("secret")); err != nil || GetQueuedRequestCount() != 1 {
+		t.Errorf("expected failed upstream upload to be queued, got %v with %d queued", err, GetQueuedRequestCount())
+	}
+
+	// All requests share one persistent connection.
+	if conns := getOpenConnCount(receiver); conns != 1 {
+		t.Errorf("expected 1 persistent connection, got %d", conns)
+	}
+}
+
+func TestTcpP2pClientReconnects(t *testing.T) {
+	receiver, _ := startTcpReceiver(t)
+	client := newTcpClient(receiver)
+	defer client.SetUpstreamDestAddr("")
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	if beacon := client.GetBeaconBytes(profile); beacon == nil {
+		t.Fatalf("expected beacon response")
+	}
+	receiver.connMutex.Lock()
+	for conn := range receiver.conns {
+		conn.Close()
+	}
+	receiver.connMutex.Unlock()
+	if beacon := client.GetBeaconBytes(profile); beacon == nil {
+		t.Errorf("expected beacon response after reconnecting")
+	}
+}
+
+// Upstream TCP receiver stand-in that counts the request frames it reads, and handles each request with the given
+// function. The connection is closed if the function returns false.
+func startScriptedTcpReceiver(t *testing.T, handle func(conn net.Conn, request int) bool) (*TcpAPI, func() int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var mutex sync.Mutex
+	requests := 0
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					if _, err := readStreamFrame(conn); err != nil {
+						return
+					}
+					mutex.Lock()
+					requests++
+					request := requests
+					mutex.Unlock()
+					if !handle(conn, request) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	client := &TcpAPI{name: tcpProxyName}
+	client.SetUpstreamDestAddr(listener.Addr().String())
+	t.Cleanup(func() { client.SetUpstreamDestAddr("") })
+	return client, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests
+	}
+}
+
+func TestTcpP2pClientRetries(t *testing.T) {
+	originalTimeout := tcpResponseTimeout
+	tcpResponseTimeout = 200 * time.Millisecond
+	defer func() { tcpResponseTimeout = originalTimeout }()
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	result := map[string]interface{}{"id": "link1"}
+	acknowledge := func(conn net.Conn) bool {
+		return writeStreamFrame(conn, "", ACK_EXECUTION_RESULTS, nil, "") == nil
+	}
+
+	// Requests are retried if the existing connection was closed before any response bytes arrived.
+	client, getRequestCount := startScriptedTcpReceiver(t, func(conn net.Conn, request int) bool {
+		return request != 2 && acknowledge(conn)
+	})
+	for i := 0; i < 2; i++ {
+		if err := client.DeliverExecutionResults(profile, result); err != nil {
+			t.Fatalf("expected results to be delivered, got %s", err.Error())
+		}
+	}
+	if requests := getRequestCount(); requests != 3 {
+		t.Errorf("expected results to be sent again over a new connection, got %d requests", requests)
+	}
+
+	// Requests are not retried once a partial response arrived, or if the response timed out.
+	partialResponse := func(conn net.Conn, request int) bool {
+		if request == 1 {
+			return acknowledge(conn)
+		}
+		conn.Write([]byte{0, 0})
+		return false
+	}
+	noResponse := func(conn net.Conn, request int) bool {
+		if request == 1 {
+			return acknowledge(conn)
+		}
+		time.Sleep(2 * tcpResponseTimeout)
+		return false
+	}
+	for _, handle := range []func(net.Conn, int) bool{partialResponse, noResponse} {
+		client, getRequestCount = startScriptedTcpReceiver(t, handle)
+		client.DeliverExecutionResults(profile, result)
+		if err := client.DeliverExecutionResults(profile, result); err == nil {
+			t.Errorf("expected error for request without a complete response")
+		}
+		if requests := getRequestCount(); requests != 2 {
+			t.Errorf("expected results not to be sent again, got %d requests", requests)
+		}
+	}
+}
+
+func TestTcpP2pLoopDetection(t *testing.T) {
+	receiver, upstream := startTcpReceiver(t)
+	client := newTcpClient(receiver)
+	defer client.SetUpstreamDestAddr("")
+	profile := map[string]interface{}{
+		"paw":         "clientpaw",
+		"proxy_chain": []interface{}{[]interface{}{"receiverpaw", "10.0.0.1:50000", "TCP"}},
+	}
+	if beacon := client.GetBeaconBytes(profile); beacon != nil {
+		t.Errorf("expected no beacon response for looping peer chain, got %s", beacon)
+	}
+	if len(upstream.profiles) != 0 {
+		t.Errorf("expected looping beacon not to be forwarded upstream")
+	}
+}
+
+func TestTcpPeerStatistics(t *testing.T) {
+	receiver, _ := startTcpReceiver(t)
+	client := newTcpClient(receiver)
+	defer client.SetUpstreamDestAddr("")
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	client.GetBeaconBytes(profile)
+	client.GetBeaconBytes(profile)
+	client.UploadFileBytes(profile, "loot.txt", []byte("secret"))
+	client.GetBeaconBytes(map[string]interface{}{
+		"paw":         "clientpaw",
+		"proxy_chain": []interface{}{[]interface{}{"receiverpaw", "10.0.0.1:50000", "TCP"}},
+	})
+
+	peers := receiver.GetPeers()
+	if len(peers) != 1 {
+		t.Fatalf("expected one tracked peer, got %v", peers)
+	}
+	peer := peers[0]
+	if requests := peer["requests"].(map[string]int); peer["paw"] != "clientpaw" || requests["beacon"] != 3 || requests["upload"] != 1 {
+		t.Errorf("unexpected peer request counts: %v", peer)
+	}
+	if peer["errors"] != 1 || peer["last_error"] != "No beacon response from upstream" {
+		t.Errorf("expected looping beacon to be recorded as an error, got %v", peer)
+	}
+	if peer["bytes_received"].(int) == 0 || peer["bytes_sent"].(int) == 0 {
+		t.Errorf("expected relayed bytes to be recorded, got %v", peer)
+	}
+}
+
+func TestTcpP2pAuthentication(t *testing.T) {
+	p2pauth.SetKey("shared-secret")
+	defer p2pauth.SetKey("")
+	receiver, upstream := startTcpReceiver(t)
+	client := newTcpClient(receiver)
+	defer client.SetUpstreamDestAddr("")
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	if beacon := client.GetBeaconBytes(profile); string(beacon) != `{"paw": "clientpaw"}` {
+		t.Fatalf("expected beacon response from authenticated client, got %s", beacon)
+	}
+
+	// Clients with a different key are rejected before any request is forwarded.
+	p2pauth.SetKey("other-secret")
+	otherClient := newTcpClient(receiver)
+	defer otherClient.SetUpstreamDestAddr("")
+	if beacon := otherClient.GetBeaconBytes(profile); beacon != nil {
+		t.Errorf("expected client with different key to be rejected, got %s", beacon)
+	}
+	if len(upstream.profiles) != 1 {
+		t.Errorf("expected only the authenticated beacon to be forwarded, got %d", len(upstream.profiles))
+	}
+	rejected := false
+	for attempt := 0; attempt < 100 && !rejected; attempt++ {
+		for _, rejection := range p2pauth.GetRejections() {
+			rejected = rejected || rejection["receiver"] == tcpProxyName
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !rejected {
+		t.Errorf("expected rejected client to be recorded, got %v", p2pauth.GetRejections())
+	}
+}
+
+func TestTcpReceiverConfig(t *testing.T) {
+	receiver := &TcpReceiver{}
+	if err := receiver.SetReceiverConfig(map[string]string{"bindAddress": "127.0.0.1", "port": "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.SetReceiverConfig(map[string]string{"port": "tcp"}); err == nil {
+		t.Errorf("expected error for invalid port")
+	}
+	var upstream contact.Contact = &recordingContact{uploads: make(map[string][]byte)}
+	server := "http://c2.example.test:8888"
+	var waitgroup sync.WaitGroup
+	profile := map[string]interface{}{"paw": "clientpaw"}
+
+	// The receiver only advertises its bind address, and can be restarted on the same port.
+	for run := 0; run < 2; run++ {
+		if err := receiver.InitializeReceiver(&server, &upstream, &waitgroup); err != nil {
+			t.Fatal(err)
+		}
+		address := "127.0.0.1:" + strconv.Itoa(receiver.port)
+		if addresses := receiver.GetReceiverAddresses(); len(addresses) != 1 || addresses[0] != address {
+			t.Errorf("expected only bind address %s to be advertised, got %v", address, addresses)
+		}
+		receiver.UpdateAgentPaw("receiverpaw")
+		waitgroup.Add(1)
+		go receiver.RunReceiver()
+		client := newTcpClient(receiver)
+		if beacon := client.GetBeaconBytes(profile); beacon == nil {
+			t.Errorf("expected beacon response on run %d", run)
+		}
+		client.SetUpstreamDestAddr("")
+		receiver.Terminate()
+		waitgroup.Wait()
+		if err := receiver.SetReceiverConfig(map[string]string{"bindAddress": "127.0.0.1", "port": strconv.Itoa(receiver.port)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTcpP2pQueuesWhileUpstreamUnreachable(t *testing.T) {
+	useTestRelayQueue(t, "1048576")
+	receiver, upstream := startTcpReceiver(t)
+	client := newTcpClient(receiver)
+	defer client.SetUpstreamDestAddr("")
+	profile := map[string]interface{}{"paw": "clientpaw", "host": "clienthost"}
+
+	SetUpstreamReachable(false)
+	client.SendExecutionResults(profile, map[string]interface{}{"id": "link1", "output": "b2s="})
+	if err := client.UploadFileBytes(profile, "loot.txt", []byte("secret")); err != nil {
+		t.Errorf("expected queued upload to be acknowledged: %s", err.Error())
+	}
+	if len(upstream.results) != 0 || len(upstream.uploads) != 0 || GetQueuedRequestCount() != 2 {
+		t.Fatalf("expected requests to be queued, got %d queued", GetQueuedRequestCount())
+	}
+
+	// The next relayed beacon flushes the queue.
+	if beacon := client.GetBeaconBytes(profile); beacon == nil {
+		t.Fatalf("expected beacon response")
+	}
+	for attempt := 0; attempt < 50 && GetQueuedRequestCount() > 0; attempt++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+	if len(upstream.results) != 1 || upstream.results[0]["id"] != "link1" || string(upstream.uploads["loot.txt"]) != "secret" {
+		t.Errorf("expected queued requests to be flushed upstream, got %v and %v", upstream.results, upstream.uploads)
+	}
+}
@@ -0,0 +1,386 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * This file contains implementations for a P2P client (UnixSocketAPI) and P2P receiver (UnixSocketReceiver) that
+ * exchange P2pMessage frames over Unix domain sockets, using the stream framing helpers in the core proxy package.
+ * This allows agents on the same host (e.g. in different containers or user contexts that share a volume) to relay
+ * through each other without opening network ports.
+ *
+ * Each agent listening for Unix socket P2P messages will activate a Unix socket receiver that listens on a main
+ * socket path. The socket name is generated from the hostname and a random identifier of the agent, so that several
+ * agents on the same host do not share a socket, while a client agent that only knows the hostname of its upstream
+ * agent can still find the socket. The identifier is random because the paw is not known yet when the receiver
+ * starts, and may change. The socket is created in unixSocketDir (the system temp directory by default), and its
+ * permissions are set to unixSocketMode so that only the intended users or groups can connect. Both values can be
+ * set at compile time. Clients look for the upstream socket in the directory given by the unixSocketDir contact
+ * setting, if any, and use the most recently created socket for the hostname if several agents on it listen. The
+ * socket of the client agent's own receiver is skipped, so that an agent never relays through itself.
+ *
+ * Unlike SMB pipe clients, Unix socket clients do not need mailbox sockets: each request is sent over a new
+ * connection to the receiver, and the response is returned over the same connection. If the agent was compiled with
+ * a P2P key, connections are authenticated and encrypted using the p2pauth package.
+ */
+
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/p2pauth"
+)
+
+var (
+	unixSocketProxyName       = "UnixSocket"
+	unixSocketDir             = ""     // directory for receiver sockets. Defaults to the system temp directory.
+	unixSocketMode            = "0660" // octal permissions for receiver sockets
+	unixSocketDialTimeout     = 10 * time.Second
+	unixSocketResponseTimeout = 5 * time.Minute // upstream requests such as payload downloads may take a while
+	unixSocketAgentId         = newUnixSocketAgentId()
+)
+
+// UnixSocketAPI communicates with an upstream UnixSocketReceiver over Unix domain sockets. Implements the Contact interface.
+type UnixSocketAPI struct {
+	name             string
+	upstreamDestAddr string // socket path of upstream receiver
+	destMutex        sync.Mutex
+}
+
+// UnixSocketReceiver forwards P2P messages received over a Unix domain socket to the upstream destination.
+// Implements the P2pReceiver interface.
+type UnixSocketReceiver struct {
+	streamForwarder
+	socketPath string
+	listener   net.Listener
+	waitgroup  *sync.WaitGroup
+	conns      map[net.Conn]bool
+	connMutex  sync.Mutex
+	handlers   sync.WaitGroup // connection handlers, waited for on termination
+	closed     bool           // whether the receiver terminated. Protected by connMutex
+}
+
+func init() {
+	unixSocketClient := &UnixSocketAPI{name: unixSocketProxyName}
+	contact.CommunicationChannels[unixSocketProxyName] = unixSocketClient
+	P2pClientChannels[unixSocketProxyName] = unixSocketClient
+	P2pReceiverChannels[unixSocketProxyName] = &UnixSocketReceiver{}
+}
+
+/*
+ * UnixSocketReceiver Implementation (implements P2pReceiver interface).
+ */
+
+func (u *UnixSocketReceiver) InitializeReceiver(agentServer *string, upstreamComs *contact.Contact, waitgroup *sync.WaitGroup) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid Unix socket mode %s: %s", unixSocketMode, err.Error()))
+	}
+	socketPath := getMainSocketPath("", hostname, unixSocketAgentId)
+	removeStaleHostSockets(filepath.Dir(socketPath), hostname, socketPath)
+	if err = removeStaleSocket(socketPath); err != nil {
+		return err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(socketPath, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return err
+	}
+	authListener, err := p2pauth.WrapListener(listener, unixSocketProxyName)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	u.socketPath = socketPath
+	u.listener = authListener
+	u.receiverName = unixSocketProxyName
+	u.agentServer = agentServer
+	u.upstreamComs = upstreamComs
+	u.waitgroup = waitgroup
+	u.connMutex.Lock()
+	u.conns = make(map[net.Conn]bool)
+	u.closed = false
+	u.connMutex.Unlock()
+	return nil
+}
+
+// Accepts client connections. This method must be run as a go routine.
+func (u *UnixSocketReceiver) RunReceiver() {
+	output.VerbosePrint(fmt.Sprintf("[*] Starting Unix socket proxy receiver on socket path %s", u.socketPath))
+	output.VerbosePrint(fmt.Sprintf("[*] Unix socket proxy receiver is using upstream contact %s", (*u.upstreamComs).GetName()))
+	listener := u.listener // the receiver may be initialized again once terminated
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			output.VerbosePrint(fmt.Sprintf("[!] Error accepting Unix socket proxy connection: %s", err.Error()))
+			continue
+		}
+		u.connMutex.Lock()
+		if u.closed {
+			u.connMutex.Unlock()
+			conn.Close()
+			continue
+		}
+		u.conns[conn] = true
+		u.handlers.Add(1)
+		u.connMutex.Unlock()
+		go u.handleConnection(conn)
+	}
+}
+
+// Update paw of agent running this receiver.
+func (u *UnixSocketReceiver) UpdateAgentPaw(newPaw string) {
+	u.agentPaw = newPaw
+}
+
+// Closes the listener, which also removes the socket file, and any open client connections.
+func (u *UnixSocketReceiver) Terminate() {
+	defer u.waitgroup.Done()
+	if err := u.listener.Close(); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error when closing Unix socket receiver listener: %s", err.Error()))
+	}
+	u.connMutex.Lock()
+	u.closed = true
+	for conn := range u.conns {
+		conn.Close()
+	}
+	u.connMutex.Unlock()
+
+	// Requests that are being forwarded are finished before the receiver can be initialized again.
+	u.handlers.Wait()
+}
+
+func (u *UnixSocketReceiver) GetReceiverAddresses() []string {
+	return []string{u.socketPath}
+}
+
+// Handles the requests sent over a client connection until the connection closes.
+func (u *UnixSocketReceiver) handleConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		u.connMutex.Lock()
+		delete(u.conns, conn)
+		u.connMutex.Unlock()
+		u.handlers.Done()
+	}()
+	u.serveConnection(conn, u.socketPath)
+}
+
+/*
+ * UnixSocketAPI implementation (implements contact.Contact interface)
+ */
+
+func (u *UnixSocketAPI) GetBeaconBytes(profile map[string]interface{}) []byte {
+	return getStreamBeaconBytes(u, profile)
+}
+
+// Will obtain the payload bytes in memory to be written to disk later by caller.
+func (u *UnixSocketAPI) GetPayloadBytes(profile map[string]interface{}, payload string) ([]byte, string) {
+	return getStreamPayloadBytes(u, profile, payload)
+}
+
+// Check if current upstream destination is a full socket path. If not, treat it as the hostname of the upstream
+// agent and return config with the main socket path of a receiver for that hostname, in the unixSocketDir setting
+// directory if provided.
+func (u *UnixSocketAPI) C2RequirementsMet(profile map[string]interface{}, criteria map[string]string) (bool, map[string]string) {
+	upstreamDestAddr := u.getUpstreamDestAddr()
+	if len(upstreamDestAddr) == 0 {
+		output.VerbosePrint("[!] Upstream destination address not yet set for Unix socket contact.")
+		return false, nil
+	}
+	if !filepath.IsAbs(upstreamDestAddr) {
+		socketPath, err := findMainSocketPath(criteria["unixSocketDir"], upstreamDestAddr)
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] %s", err.Error()))
+			return false, nil
+		}
+		config := make(map[string]string)
+		config["upstreamDest"] = socketPath
+		return true, config
+	}
+	return true, nil
+}
+
+// Sets the upstream socket path or hostname. The unix:// prefix is optional.
+func (u *UnixSocketAPI) SetUpstreamDestAddr(upstreamDestAddr string) {
+	u.destMutex.Lock()
+	defer u.destMutex.Unlock()
+	u.upstreamDestAddr = strings.TrimPrefix(upstreamDestAddr, "unix://")
+}
+
+func (u *UnixSocketAPI) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+	sendStreamExecutionResults(u, profile, result)
+}
+
+// Returns an error if the upstream receiver did not acknowledge the execution results.
+func (u *UnixSocketAPI) DeliverExecutionResults(profile map[string]interface{}, result map[string]interface{}) error {
+	return deliverStreamExecutionResults(u, profile, result)
+}
+
+func (u *UnixSocketAPI) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
+	return uploadStreamFileBytes(u, profile, uploadName, data)
+}
+
+func (u *UnixSocketAPI) GetName() string {
+	return u.name
+}
+
+func (u *UnixSocketAPI) SupportsContinuous() bool {
+	return false
+}
+
+func (u *UnixSocketAPI) getUpstreamDestAddr() string {
+	u.destMutex.Lock()
+	defer u.destMutex.Unlock()
+	return u.upstreamDestAddr
+}
+
+// Sends the request over a new connection to the upstream socket and returns the payload of the response, which
+// must be of the expected type.
+func (u *UnixSocketAPI) sendRequest(paw string, messageType int, payload []byte, expectedType int) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", u.getUpstreamDestAddr(), unixSocketDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = p2pauth.ClientConn(conn); err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(unixSocketResponseTimeout))
+	if err = writeStreamFrame(conn, paw, messageType, payload, ""); err != nil {
+		return nil, err
+	}
+	respMessage, err := readStreamFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	return getStreamResponsePayload(respMessage, messageType, expectedType)
+}
+
+/*
+ * Unix socket helper functions
+ */
+
+// Returns a random identifier that distinguishes the sockets of agents on the same host.
+func newUnixSocketAgentId() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Returns the socket directory, using unixSocketDir if no directory is given.
+func getSocketDir(socketDir string) string {
+	if len(socketDir) == 0 {
+		socketDir = unixSocketDir
+	}
+	if len(socketDir) == 0 {
+		socketDir = os.TempDir()
+	}
+	return socketDir
+}
+
+// Returns the main receiver socket path for the given hostname and agent. Uses unixSocketDir if no directory is given.
+func getMainSocketPath(socketDir string, hostname string, agentId string) string {
+	return filepath.Join(getSocketDir(socketDir), getMainSocketName(hostname, agentId))
+}
+
+// Returns the socket name calculated from the given hostname and agent identifier.
+func getMainSocketName(hostname string, agentId string) string {
+	return fmt.Sprintf("%s%s.sock", getMainSocketPrefix(hostname), agentId)
+}
+
+// Returns the prefix shared by the socket names of all agents on the given hostname.
+func getMainSocketPrefix(hostname string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.ToLower(hostname)))
+	return fmt.Sprintf(".s%08x-", hash.Sum32())
+}
+
+// Returns the paths of the receiver sockets for the given hostname in the socket directory.
+func getHostSocketPaths(socketDir string, hostname string) []string {
+	entries, err := os.ReadDir(socketDir)
+	if err != nil {
+		return nil
+	}
+	prefix := getMainSocketPrefix(hostname)
+	var socketPaths []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) && strings.HasSuffix(entry.Name(), ".sock") && entry.Type()&os.ModeSocket != 0 {
+			socketPaths = append(socketPaths, filepath.Join(socketDir, entry.Name()))
+		}
+	}
+	return socketPaths
+}
+
+// Returns the main socket path of the most recently started receiver for the given hostname, other than the receiver
+// of this agent, which cannot be its own upstream. Uses unixSocketDir if no directory is given.
+func findMainSocketPath(socketDir string, hostname string) (string, error) {
+	socketDir = getSocketDir(socketDir)
+	ownSocketPath := getMainSocketPath(socketDir, hostname, unixSocketAgentId)
+	var socketPath string
+	var newest time.Time
+	for _, path := range getHostSocketPaths(socketDir, hostname) {
+		if path == ownSocketPath {
+			continue
+		}
+		if fileInfo, err := os.Lstat(path); err == nil && (len(socketPath) == 0 || fileInfo.ModTime().After(newest)) {
+			socketPath, newest = path, fileInfo.ModTime()
+		}
+	}
+	if len(socketPath) == 0 {
+		return "", errors.New(fmt.Sprintf("No Unix socket receiver found for hostname %s in %s", hostname, socketDir))
+	}
+	return socketPath, nil
+}
+
+// Removes the sockets left behind for the given hostname by receivers that did not shut down cleanly, except for
+// the given socket path. Sockets of receivers that are still listening are kept.
+func removeStaleHostSockets(socketDir string, hostname string, socketPath string) {
+	for _, path := range getHostSocketPaths(socketDir, hostname) {
+		if path != socketPath {
+			removeStaleSocket(path)
+		}
+	}
+}
+
+// Removes a socket file left behind by a receiver that did not shut down cleanly. Returns an error if the path is
+// not a socket or if another receiver is still listening on it.
+func removeStaleSocket(socketPath string) error {
+	fileInfo, err := os.Lstat(socketPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fileInfo.Mode()&os.ModeSocket == 0 {
+		return errors.New(fmt.Sprintf("%s already exists and is not a socket", socketPath))
+	}
+	if conn, err := net.DialTimeout("unix", socketPath, unixSocketDialTimeout); err == nil {
+		conn.Close()
+		return errors.New(fmt.Sprintf("Another receiver is already listening on %s", socketPath))
+	}
+	output.VerbosePrint(fmt.Sprintf("[-] Removing stale Unix socket %s", socketPath))
+	return os.Remove(socketPath)
+}
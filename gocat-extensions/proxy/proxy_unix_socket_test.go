@@ -0,0 +1,263 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+)
+
+func useTempSocketDir(t *testing.T) string {
+	originalDir := unixSocketDir
+	unixSocketDir = t.TempDir()
+	t.Cleanup(func() { unixSocketDir = originalDir })
+	return unixSocketDir
+}
+
+func startUnixSocketReceiver(t *testing.T) (*UnixSocketReceiver, *recordingContact) {
+	var upstream contact.Contact = &recordingContact{uploads: make(map[string][]byte)}
+	server := "http://c2.example.test:8888"
+	var waitgroup sync.WaitGroup
+	receiver := &UnixSocketReceiver{}
+	if err := receiver.InitializeReceiver(&server, &upstream, &waitgroup); err != nil {
+		t.Fatal(err)
+	}
+	receiver.UpdateAgentPaw("receiverpaw")
+	waitgroup.Add(1)
+	go receiver.RunReceiver()
+	t.Cleanup(func() {
+		receiver.Terminate()
+		waitgroup.Wait()
+	})
+	return receiver, upstream.(*recordingContact)
+}
+
+// Returns a client using the upstream receiver's hostname, as an operator would provide it. The client runs as
+// another agent on the host, since agents skip their own receiver socket.
+func newUnixSocketClient(t *testing.T) *UnixSocketAPI {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalAgentId := unixSocketAgentId
+	unixSocketAgentId = "clientagent"
+	defer func() { unixSocketAgentId = originalAgentId }()
+	client := &UnixSocketAPI{name: unixSocketProxyName}
+	client.SetUpstreamDestAddr(hostname)
+	valid, config := client.C2RequirementsMet(nil, nil)
+	if !valid || config == nil {
+		t.Fatalf("expected Unix socket contact to calculate the upstream socket path")
+	}
+	client.SetUpstreamDestAddr(config["upstreamDest"])
+	return client
+}
+
+func TestUnixSocketP2pMessageTypes(t *testing.T) {
+	useTestRelayQueue(t, "1048576")
+	useTempSocketDir(t)
+	receiver, upstream := startUnixSocketReceiver(t)
+	client := newUnixSocketClient(t)
+	if client.upstreamDestAddr != receiver.socketPath {
+		t.Fatalf("expected client to use receiver socket %s, got %s", receiver.socketPath, client.upstreamDestAddr)
+	}
+	if valid, config := client.C2RequirementsMet(nil, nil); !valid || config != nil {
+		t.Errorf("expected full socket path to be accepted as is")
+	}
+	profile := map[string]interface{}{"paw": "clientpaw", "server": "http://peer:8888"}
+
+	if beacon := client.GetBeaconBytes(profile); string(beacon) != `{"paw": "clientpaw"}` {
+		t.Errorf("unexpected beacon response: %s", beacon)
+	}
+	forwarded := upstream.profiles[0]
+	if forwarded["server"] != "http://c2.example.test:8888" {
+		t.Errorf("expected server to be replaced with the receiver agent's server, got %v", forwarded["server"])
+	}
+	proxyChain, ok := forwarded["proxy_chain"].([]interface{})
+	if !ok || len(proxyChain) != 1 {
+		t.Fatalf("expected one hop in proxy chain, got %v", forwarded["proxy_chain"])
+	}
+	if hop := proxyChain[0].([]string); hop[0] != "receiverpaw" || hop[1] != receiver.socketPath || hop[2] != "UnixSocket" {
+		t.Errorf("unexpected proxy chain hop: %v", hop)
+	}
+
+	payloadData, payloadName := client.GetPayloadBytes(profile, "tool")
+	if string(payloadData) != "payload for clientpaw" || payloadName != "real-tool" {
+		t.Errorf("unexpected payload response: %s %s", payloadData, payloadName)
+	}
+
+	client.SendExecutionResults(profile, map[string]interface{}{"id": "link1", "output": "b2s="})
+	if len(upstream.results) != 1 || upstream.results[0]["id"] != "link1" {
+		t.Errorf("expected execution results to be forwarded, got %v", upstream.results)
+	}
+
+	if err := client.UploadFileBytes(profile, "loot.txt", []byte("secret")); err != nil {
+		t.Errorf("upload through Unix socket receiver failed: %s", err.Error())
+	}
+	if string(upstream.uploads["loot.txt"]) != "secret" {
+		t.Errorf("expected upload to be forwarded, got %v", upstream.uploads)
+	}
+	// Uploads that fail upstream are queued for later delivery.
+	if err := client.UploadFileBytes(profile, "denied.txt", []byte("secret")); err != nil || GetQueuedRequestCount() != 1 {
+		t.Errorf("expected failed upstream upload to be queued, got %v with %d queued", err, GetQueuedRequestCount())
+	}
+}
+
+func TestUnixSocketP2pLoopDetection(t *testing.T) {
+	useTempSocketDir(t)
+	_, upstream := startUnixSocketReceiver(t)
+	client := newUnixSocketClient(t)
+	profile := map[string]interface{}{
+		"paw":         "clientpaw",
+		"proxy_chain": []interface{}{[]interface{}{"receiverpaw", "/tmp/peer.sock", "UnixSocket"}},
+	}
+	if beacon := client.GetBeaconBytes(profile); beacon != nil {
+		t.Errorf("expected no beacon response for looping peer chain, got %s", beacon)
+	}
+	if len(upstream.profiles) != 0 {
+		t.Errorf("expected looping beacon not to be forwarded upstream")
+	}
+}
+
+// Listens on the main socket of another agent on the given hostname.
+func listenAsAgent(t *testing.T, socketDir string, hostname string, agentId string) string {
+	socketPath := getMainSocketPath(socketDir, hostname, agentId)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return socketPath
+}
+
+func TestUnixSocketPathFromConfig(t *testing.T) {
+	socketDir := t.TempDir()
+	client := &UnixSocketAPI{name: unixSocketProxyName}
+	client.SetUpstreamDestAddr("unix://peerhost")
+	if valid, _ := client.C2RequirementsMet(nil, map[string]string{"unixSocketDir": socketDir}); valid {
+		t.Errorf("expected error without a receiver socket for the hostname")
+	}
+
+	// The most recently started receiver for the hostname is used.
+	listenAsAgent(t, socketDir, "otherhost", "agent1")
+	olderPath := listenAsAgent(t, socketDir, "peerhost", "agent1")
+	os.Chtimes(olderPath, time.Now().Add(-time.Minute), time.Now().Add(-time.Minute))
+	newerPath := listenAsAgent(t, socketDir, "PeerHost", "agent2")
+	_, config := client.C2RequirementsMet(nil, map[string]string{"unixSocketDir": socketDir})
+	if config["upstreamDest"] != newerPath {
+		t.Errorf("expected upstream socket path %s, got %s", newerPath, config["upstreamDest"])
+	}
+
+	// The agent's own receiver socket is skipped, even if it is the most recent one.
+	listenAsAgent(t, socketDir, "peerhost", unixSocketAgentId)
+	_, config = client.C2RequirementsMet(nil, map[string]string{"unixSocketDir": socketDir})
+	if config["upstreamDest"] != newerPath {
+		t.Errorf("expected the agent's own socket to be skipped, got %s", config["upstreamDest"])
+	}
+}
+
+func TestUnixSocketAgentsOnSameHost(t *testing.T) {
+	socketDir := useTempSocketDir(t)
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPath := listenAsAgent(t, socketDir, hostname, "otheragent")
+	receiver, _ := startUnixSocketReceiver(t)
+	if receiver.socketPath == otherPath || filepath.Dir(receiver.socketPath) != socketDir {
+		t.Errorf("expected receiver to listen on its own socket in %s, got %s", socketDir, receiver.socketPath)
+	}
+	if addresses := receiver.GetReceiverAddresses(); len(addresses) != 1 || addresses[0] != receiver.socketPath {
+		t.Errorf("expected receiver to advertise its full socket path, got %v", addresses)
+	}
+	if _, err := os.Lstat(otherPath); err != nil {
+		t.Errorf("expected socket of the other agent to be kept: %s", err.Error())
+	}
+}
+
+func TestUnixSocketPermissions(t *testing.T) {
+	useTempSocketDir(t)
+	originalMode := unixSocketMode
+	unixSocketMode = "0600"
+	defer func() { unixSocketMode = originalMode }()
+	receiver, _ := startUnixSocketReceiver(t)
+	fileInfo, err := os.Stat(receiver.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Mode()&os.ModeSocket == 0 || fileInfo.Mode().Perm() != 0600 {
+		t.Errorf("expected socket with 0600 permissions, got %s", fileInfo.Mode())
+	}
+}
+
+func TestUnixSocketStaleSocketHandling(t *testing.T) {
+	socketDir := useTempSocketDir(t)
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketPath := getMainSocketPath(socketDir, hostname, unixSocketAgentId)
+
+	// Live sockets are left alone.
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = removeStaleSocket(socketPath); err == nil {
+		t.Errorf("expected error for socket with an active listener")
+	}
+
+	// Sockets without a listener are replaced, and those of other agents on the host are removed.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	otherPath := getMainSocketPath(socketDir, hostname, "otheragent")
+	otherListener, err := net.Listen("unix", otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherListener.(*net.UnixListener).SetUnlinkOnClose(false)
+	otherListener.Close()
+	receiver, _ := startUnixSocketReceiver(t)
+	if receiver.socketPath != socketPath {
+		t.Errorf("expected receiver to listen on %s, got %s", socketPath, receiver.socketPath)
+	}
+	if _, err = os.Lstat(otherPath); !os.IsNotExist(err) {
+		t.Errorf("expected stale socket of another agent to be removed")
+	}
+
+	// Regular files are never removed.
+	filePath := filepath.Join(socketDir, "regular")
+	if err = os.WriteFile(filePath, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = removeStaleSocket(filePath); err == nil {
+		t.Errorf("expected error for path that is not a socket")
+	}
+	if _, err = os.Stat(filePath); err != nil {
+		t.Errorf("expected regular file to be kept: %s", err.Error())
+	}
+}
+
+func TestUnixSocketReceiverRemovesSocket(t *testing.T) {
+	useTempSocketDir(t)
+	var upstream contact.Contact = &recordingContact{uploads: make(map[string][]byte)}
+	server := "http://c2.example.test:8888"
+	var waitgroup sync.WaitGroup
+	receiver := &UnixSocketReceiver{}
+	if err := receiver.InitializeReceiver(&server, &upstream, &waitgroup); err != nil {
+		t.Fatal(err)
+	}
+	waitgroup.Add(1)
+	go receiver.RunReceiver()
+	receiver.Terminate()
+	waitgroup.Wait()
+	if _, err := os.Lstat(receiver.socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected socket file to be removed on termination")
+	}
+}
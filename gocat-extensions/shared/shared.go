@@ -11,6 +11,7 @@ import (
 
     "github.com/mitre/gocat/contact"
     "github.com/mitre/gocat/core"
+    "github.com/mitre/gocat/proxy"
 )
 
 var (
@@ -23,6 +24,9 @@ var (
     listenP2P  = "false" // need to set as string to allow ldflags -X build-time variable change on server-side.
     runOnInit  = "false" // need to set as string to allow ldflags -X build-time variable change on server-side.
     httpProxyGateway = ""
+    c2Config   = "" // additional contact config entries of the form key1=value1;key2=value2
+    httpProfile = "" // malleable HTTP profile as a base64-encoded JSON/YAML blob
+    mdnsConfig  = "" // mDNS peer discovery and advertising settings of the form key1=value1;key2=value2
 )
 
 var running atomic.Bool // false
@@ -56,7 +60,24 @@ func VoidFunc() {
         "c2Name": c2Protocol,
         "c2Key": c2Key,
         "httpProxyGateway": httpProxyGateway,
+        "httpProfile": httpProfile,
     }
+    additionalConfig, err := contact.ParseContactConfig(c2Config)
+    if err != nil {
+        return
+    }
+    for configKey, configVal := range additionalConfig {
+        contactConfig[configKey] = configVal
+    }
+    discoverySettings, err := contact.ParseContactConfig(mdnsConfig)
+    if err != nil {
+        return
+    }
+    discoveryConfig, err := proxy.ParseDiscoveryConfig(discoverySettings)
+    if err != nil {
+        return
+    }
+    proxy.SetDiscoveryConfig(discoveryConfig)
     tunnelConfig, err := contact.BuildTunnelConfig("", "", trimmedServer, "", "")
     if err != nil {
         return
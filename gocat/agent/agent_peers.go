@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/proxy"
+)
+
+/*
+ * Selection of the peer receiver to relay through. Candidate peers are probed for reachability and latency, and ranked
+ * by their latest probe, their beacon history, their hop count to the C2 server, and their latency, in that order.
+ * Remaining ties are broken by protocol and address, so that the agent falls back through the peers in a
+ * deterministic order.
+ */
+
+var peerProbeTimeout = 2 * time.Second
+
+// Reachability and beacon history of a peer receiver.
+type peerHealth struct {
+	hops                int           // number of peers between the agent and the C2 server when relaying through this receiver, or -1 if unknown.
+	successes           int           // successful beacons through the peer.
+	failures            int           // failed beacons through the peer.
+	consecutiveFailures int           // failed beacons through the peer since the last successful one.
+	probeFailed         bool          // whether the latest probe failed. Peers that cannot be probed count as reachable.
+	latency             time.Duration // connect time of the latest successful probe, or 0 if unknown.
+}
+
+// Peer receiver that the agent can relay through.
+type peerCandidate struct {
+	protocol string
+	address  string
+	health   peerHealth
+}
+
+// Returns the health of the peer receiver address, creating it if needed.
+func (a *Agent) getPeerHealth(address string) *peerHealth {
+	if a.peerHealth == nil {
+		a.peerHealth = make(map[string]*peerHealth)
+	}
+	health, ok := a.peerHealth[address]
+	if !ok {
+		health = &peerHealth{hops: -1}
+		a.peerHealth[address] = health
+	}
+	return health
+}
+
+// Returns the known peer receivers, ranked from best to worst.
+func (a *Agent) getRankedPeerCandidates() []peerCandidate {
+	var candidates []peerCandidate
+	for protocol, addresses := range a.availablePeerReceivers {
+		for _, address := range addresses {
+			candidates = append(candidates, peerCandidate{protocol, address, *a.getPeerHealth(address)})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return comparePeerCandidates(candidates[i], candidates[j]) < 0 })
+	return candidates
+}
+
+// Returns a negative number if the first peer should be preferred over the second one, and a positive number otherwise.
+func comparePeerCandidates(first peerCandidate, second peerCandidate) int {
+	if order := comparePeerReliability(first.health, second.health); order != 0 {
+		return order
+	}
+	if first.health.successes != second.health.successes {
+		return second.health.successes - first.health.successes
+	}
+	if order := compareUnknownLast(int64(first.health.latency), int64(second.health.latency), 0); order != 0 {
+		return order
+	}
+	if first.protocol != second.protocol {
+		return compareStrings(first.protocol, second.protocol)
+	}
+	return compareStrings(first.address, second.address)
+}
+
+// Compares the latest probe, recent beacon failures and hop count of the peers. Only differences in these are worth
+// switching peers for.
+func comparePeerReliability(first peerHealth, second peerHealth) int {
+	if first.probeFailed != second.probeFailed {
+		if first.probeFailed {
+			return 1
+		}
+		return -1
+	}
+	if first.consecutiveFailures != second.consecutiveFailures {
+		return first.consecutiveFailures - second.consecutiveFailures
+	}
+	return compareUnknownLast(int64(first.hops), int64(second.hops), -1)
+}
+
+// Compares values where lower is better, except for the unknown value, which is worse than any known value.
+func compareUnknownLast(first int64, second int64, unknown int64) int {
+	switch {
+	case first == second:
+		return 0
+	case first == unknown:
+		return 1
+	case second == unknown:
+		return -1
+	case first < second:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func compareStrings(first string, second string) int {
+	if first < second {
+		return -1
+	}
+	if first > second {
+		return 1
+	}
+	return 0
+}
+
+// Probes the known peer receivers concurrently and records the results. The C2 server is only probed for a connection,
+// since it does not take part in the P2P handshake.
+func (a *Agent) probePeerReceivers() {
+	type probeResult struct {
+		address string
+		latency time.Duration
+		err     error
+	}
+	var results []probeResult
+	var resultMutex sync.Mutex
+	var waitgroup sync.WaitGroup
+	for protocol, addresses := range a.availablePeerReceivers {
+		for _, address := range addresses {
+			waitgroup.Add(1)
+			go func(protocol string, address string) {
+				defer waitgroup.Done()
+				probeFunc := proxy.ProbePeerReceiver
+				if address == a.server {
+					probeFunc = proxy.ProbeServer
+				}
+				latency, err := probeFunc(protocol, address, peerProbeTimeout)
+				resultMutex.Lock()
+				results = append(results, probeResult{address, latency, err})
+				resultMutex.Unlock()
+			}(protocol, address)
+		}
+	}
+	waitgroup.Wait()
+	for _, result := range results {
+		health := a.getPeerHealth(result.address)
+		switch {
+		case result.err == proxy.ErrProbeUnsupported:
+			health.probeFailed = false
+		case result.err != nil:
+			output.VerbosePrint(fmt.Sprintf("[-] Peer receiver %s is unreachable: %s", result.address, result.err.Error()))
+			health.probeFailed = true
+		default:
+			health.probeFailed = false
+			health.latency = result.latency
+		}
+	}
+}
+
+// Attempts to look for any compatible peer-to-peer proxy clients for available proxy receivers.
+// Probes the peer receivers and uses the best ranked one that the agent has a client for.
+// Returns an error if no valid proxy clients are found.
+func (a *Agent) findAvailablePeerProxyClient() error {
+	if len(a.availablePeerReceivers) == 0 {
+		return errors.New("No peer proxy receivers available to connect to.")
+	}
+	a.probePeerReceivers()
+	for _, candidate := range a.getRankedPeerCandidates() {
+		if _, ok := a.availablePeerReceivers[candidate.protocol]; !ok {
+			// Proxy channel was removed from the pool while going through the candidates.
+			continue
+		}
+		if err := a.selectPeerReceiver(candidate); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error attempting to use proxy channel %s: %s", candidate.protocol, err.Error()))
+			if _, ok := contact.CommunicationChannels[candidate.protocol]; !ok {
+				// Remove the unsupported proxy channel from the pool.
+				delete(a.availablePeerReceivers, candidate.protocol)
+			}
+			continue
+		}
+		a.peerProxyReceiverDisplay()
+		return nil
+	}
+	return errors.New("No available compatible peer-to-peer proxy clients found.")
+}
+
+// Switches the agent to relay through the given peer receiver.
+func (a *Agent) selectPeerReceiver(candidate peerCandidate) error {
+	output.VerbosePrint(fmt.Sprintf("[-] Verifying proxy channel %s", candidate.protocol))
+
+	// The channel requirements are checked against the peer address.
+	previousDestAddr := a.upstreamDestAddr
+	a.upstreamDestAddr = candidate.address
+	if err := a.AttemptSelectComChannel(nil, candidate.protocol); err != nil {
+		a.upstreamDestAddr = previousDestAddr
+		return err
+	}
+	a.usingPeerReceivers = true
+	a.updateUpstreamDestAddr(candidate.address)
+	output.VerbosePrint(fmt.Sprintf("[*] Updated agent's destination address to proxy peer address: %s", candidate.address))
+	return nil
+}
+
+// EvaluatePeers probes the known peer receivers and switches to the best ranked one if the agent is relaying through
+// a peer that is unreachable, has recently failed, or is more hops away from the C2 server.
+func (a *Agent) EvaluatePeers() {
+	if !a.usingPeerReceivers || len(a.availablePeerReceivers) == 0 {
+		return
+	}
+	a.probePeerReceivers()
+	current := *a.getPeerHealth(a.upstreamDestAddr)
+	for _, candidate := range a.getRankedPeerCandidates() {
+		if candidate.address == a.upstreamDestAddr || comparePeerReliability(candidate.health, current) >= 0 {
+			return
+		}
+		if _, ok := contact.CommunicationChannels[candidate.protocol]; !ok {
+			continue
+		}
+		output.VerbosePrint(fmt.Sprintf("[*] Switching from peer %s to better ranked peer %s", a.upstreamDestAddr, candidate.address))
+		if err := a.selectPeerReceiver(candidate); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error attempting to use proxy channel %s: %s", candidate.protocol, err.Error()))
+			continue
+		}
+		return
+	}
+}
+
+// Records the beacon result for the server or peer the agent is beaconing to, and updates the hop count the agent
+// advertises to its own peers and whether its receivers can relay requests upstream.
+func (a *Agent) recordPeerBeacon(successful bool) {
+	proxy.SetUpstreamReachable(successful)
+	health := a.getPeerHealth(a.upstreamDestAddr)
+	if successful {
+		health.successes++
+		health.consecutiveFailures = 0
+		proxy.SetAgentHopCount(a.getHopCount())
+	} else {
+		health.failures++
+		health.consecutiveFailures++
+	}
+}
+
+// Returns the number of peers between the agent and the C2 server, or -1 if unknown.
+func (a *Agent) getHopCount() int {
+	if !a.usingPeerReceivers {
+		if _, ok := proxy.P2pClientChannels[a.GetCurrentContactName()]; !ok {
+			// Beaconing to the C2 server directly or through a tunnel.
+			return 0
+		}
+	}
+	return a.getPeerHealth(a.upstreamDestAddr).hops
+}
+
+// Display some output about the ranked peer proxy receivers.
+func (a *Agent) peerProxyReceiverDisplay() {
+	output.VerbosePrint("[*] Peer proxy receivers, from best to worst: ")
+	for _, candidate := range a.getRankedPeerCandidates() {
+		output.VerbosePrint(fmt.Sprintf("\t%s : %s (failures: %d, hops: %d)", candidate.protocol, candidate.address,
+			candidate.health.consecutiveFailures, candidate.health.hops))
+	}
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/p2pauth"
+	"github.com/mitre/gocat/proxy"
+)
+
+// Peer client stand-in that accepts any upstream address.
+type fakePeerContact struct {
+	upstreamDestAddr string
+}
+
+func (f *fakePeerContact) GetBeaconBytes(profile map[string]interface{}) []byte { return nil }
+
+func (f *fakePeerContact) GetPayloadBytes(profile map[string]interface{}, payload string) ([]byte, string) {
+	return nil, ""
+}
+
+func (f *fakePeerContact) C2RequirementsMet(profile map[string]interface{}, criteria map[string]string) (bool, map[string]string) {
+	return true, nil
+}
+
+func (f *fakePeerContact) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+}
+
+func (f *fakePeerContact) GetName() string { return "FAKEPEER" }
+
+func (f *fakePeerContact) SetUpstreamDestAddr(upstreamDestAddr string) {
+	f.upstreamDestAddr = upstreamDestAddr
+}
+
+func (f *fakePeerContact) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
+	return nil
+}
+
+func (f *fakePeerContact) SupportsContinuous() bool { return false }
+
+func newPeerAgent(t *testing.T, hops map[string]int) *Agent {
+	contact.CommunicationChannels["FAKEPEER"] = &fakePeerContact{}
+	t.Cleanup(func() { delete(contact.CommunicationChannels, "FAKEPEER") })
+	a := &Agent{availablePeerReceivers: map[string][]string{"FAKEPEER": nil}}
+	for address, peerHops := range hops {
+		a.availablePeerReceivers["FAKEPEER"] = append(a.availablePeerReceivers["FAKEPEER"], address)
+		a.getPeerHealth(address).hops = peerHops
+	}
+	return a
+}
+
+func getRankedAddresses(a *Agent) []string {
+	var addresses []string
+	for _, candidate := range a.getRankedPeerCandidates() {
+		addresses = append(addresses, candidate.address)
+	}
+	return addresses
+}
+
+func TestPeerRanking(t *testing.T) {
+	a := newPeerAgent(t, map[string]int{"peer-a": 2, "peer-b": 2, "peer-c": 1, "peer-d": -1, "peer-e": 1})
+	a.getPeerHealth("peer-b").latency = 5 * time.Millisecond
+	a.getPeerHealth("peer-a").latency = 20 * time.Millisecond
+	a.getPeerHealth("peer-e").probeFailed = true
+	expected := []string{"peer-c", "peer-b", "peer-a", "peer-d", "peer-e"}
+	if ranked := getRankedAddresses(a); !reflect.DeepEqual(ranked, expected) {
+		t.Errorf("expected ranking %v, got %v", expected, ranked)
+	}
+
+	// Recent failures outweigh hop count, and successes break ties between otherwise equal peers.
+	a.getPeerHealth("peer-c").consecutiveFailures = 1
+	a.getPeerHealth("peer-a").successes = 3
+	expected = []string{"peer-a", "peer-b", "peer-d", "peer-c", "peer-e"}
+	if ranked := getRankedAddresses(a); !reflect.DeepEqual(ranked, expected) {
+		t.Errorf("expected ranking %v, got %v", expected, ranked)
+	}
+}
+
+func TestPeerFallback(t *testing.T) {
+	a := newPeerAgent(t, map[string]int{"peer-a": 2, "peer-b": 1, "peer-c": -1})
+	for _, expected := range []string{"peer-b", "peer-a", "peer-c", "peer-b"} {
+		if err := a.findAvailablePeerProxyClient(); err != nil {
+			t.Fatal(err)
+		}
+		if a.upstreamDestAddr != expected || a.beaconContact.(*fakePeerContact).upstreamDestAddr != expected {
+			t.Fatalf("expected agent to fall back to %s, got %s", expected, a.upstreamDestAddr)
+		}
+		for i := 0; i < beaconFailureThreshold; i++ {
+			a.recordPeerBeacon(false)
+		}
+	}
+	a.recordPeerBeacon(true)
+	if hops := proxy.GetAgentHopCount(); hops != 1 {
+		t.Errorf("expected agent to advertise 1 hop through peer-b, got %d", hops)
+	}
+	proxy.SetAgentHopCount(-1)
+}
+
+func TestEvaluatePeers(t *testing.T) {
+	a := newPeerAgent(t, map[string]int{"peer-a": 2, "peer-b": 3})
+	a.EvaluatePeers()
+	if a.upstreamDestAddr != "" {
+		t.Errorf("expected no peer to be selected when not relaying through a peer")
+	}
+	if err := a.selectPeerReceiver(peerCandidate{"FAKEPEER", "peer-b", *a.getPeerHealth("peer-b")}); err != nil {
+		t.Fatal(err)
+	}
+	a.getPeerHealth("peer-a").successes = 10
+	a.getPeerHealth("peer-b").hops = 2
+	a.EvaluatePeers()
+	if a.upstreamDestAddr != "peer-b" {
+		t.Errorf("expected agent to keep equally reliable peer, got %s", a.upstreamDestAddr)
+	}
+	a.getPeerHealth("peer-b").hops = 3
+	a.EvaluatePeers()
+	if a.upstreamDestAddr != "peer-a" {
+		t.Errorf("expected agent to switch to peer with fewer hops, got %s", a.upstreamDestAddr)
+	}
+}
+
+func TestProbeServerWithP2pKey(t *testing.T) {
+	p2pauth.SetKey("shared-secret")
+	defer p2pauth.SetKey("")
+	serverListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverListener.Close()
+	peerListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerListener, err = p2pauth.WrapListener(peerListener, "TCP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerListener.Close()
+
+	// The C2 server does not complete the P2P handshake, but is still reachable.
+	server := "http://" + serverListener.Addr().String()
+	peer := peerListener.Addr().String()
+	a := &Agent{server: server, availablePeerReceivers: map[string][]string{"HTTP": {server}, "TCP": {peer}}}
+	a.getPeerHealth(server).hops = 0
+	a.getPeerHealth(peer).hops = 1
+	a.probePeerReceivers()
+	if a.getPeerHealth(server).probeFailed || a.getPeerHealth(peer).probeFailed {
+		t.Errorf("expected server and authenticated peer to be reachable")
+	}
+	if ranked := getRankedAddresses(a); !reflect.DeepEqual(ranked, []string{server, peer}) {
+		t.Errorf("expected server to rank first, got %v", ranked)
+	}
+
+	// Peers are still probed with the P2P handshake.
+	a.availablePeerReceivers["TCP"] = append(a.availablePeerReceivers["TCP"], serverListener.Addr().String())
+	originalTimeout := peerProbeTimeout
+	peerProbeTimeout = 200 * time.Millisecond
+	defer func() { peerProbeTimeout = originalTimeout }()
+	a.probePeerReceivers()
+	if !a.getPeerHealth(serverListener.Addr().String()).probeFailed {
+		t.Errorf("expected peer without the P2P handshake to be unreachable")
+	}
+}
@@ -3,6 +3,7 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/mitre/gocat/output"
 	"github.com/mitre/gocat/proxy"
@@ -10,14 +11,8 @@ import (
 
 func (a *Agent) ActivateLocalP2pReceivers() {
 	for receiverName, p2pReceiver := range proxy.P2pReceiverChannels {
-		if err := p2pReceiver.InitializeReceiver(&a.server, &a.beaconContact, a.p2pReceiverWaitGroup); err != nil {
+		if err := a.startLocalP2pReceiver(receiverName, p2pReceiver); err != nil {
 			output.VerbosePrint(fmt.Sprintf("[-] Error when initializing p2p receiver %s: %s", receiverName, err.Error()))
-		} else {
-			output.VerbosePrint(fmt.Sprintf("[*] Initialized p2p receiver %s", receiverName))
-			a.localP2pReceivers[receiverName] = p2pReceiver
-			a.p2pReceiverWaitGroup.Add(1)
-			a.storeLocalP2pReceiverAddresses(receiverName, p2pReceiver)
-			go p2pReceiver.RunReceiver()
 		}
 	}
 }
@@ -30,109 +25,143 @@ func (a *Agent) TerminateLocalP2pReceivers() {
 	a.p2pReceiverWaitGroup.Wait()
 }
 
-func (a *Agent) storeLocalP2pReceiverAddresses(receiverName string, p2pReceiver proxy.P2pReceiver) {
-	for _, address := range p2pReceiver.GetReceiverAddresses() {
-		if _, ok := a.localP2pReceiverAddresses[receiverName]; !ok {
-			a.localP2pReceiverAddresses[receiverName] = make([]string, 0)
+// Starts, stops or restarts local P2P receivers as requested in a beacon response. Accepts a single change or a list
+// of changes, each with the receiver protocol, the action, and optional settings for receivers that support them.
+// The updated receiver addresses are reported in the next profile.
+func (a *Agent) ProcessReceiverChange(receiverChanges interface{}) error {
+	changeList, ok := receiverChanges.([]interface{})
+	if !ok {
+		changeList = []interface{}{receiverChanges}
+	}
+	var failures []string
+	for _, receiverChange := range changeList {
+		if err := a.processSingleReceiverChange(receiverChange); err != nil {
+			failures = append(failures, err.Error())
 		}
-		a.localP2pReceiverAddresses[receiverName] = append(a.localP2pReceiverAddresses[receiverName], address)
 	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
 }
 
-// Attempts to look for any compatible peer-to-peer proxy clients for available proxy receivers.
-// Sets the first valid one it can find. Returns an error if no valid proxy clients are found.
-func (a *Agent) findAvailablePeerProxyClient() error {
-	if len(a.availablePeerReceivers) == 0 {
-		// Either we used all available peers, or we simply never had any to start with. Refresh
-		// the used peers if possible.
-		if len(a.exhaustedPeerReceivers) == 0 {
-			return errors.New("No peer proxy receivers available to connect to.")
+func (a *Agent) processSingleReceiverChange(receiverChangeMap interface{}) error {
+	receiverChange, ok := receiverChangeMap.(map[string]interface{})
+	if !ok {
+		return errors.New("Malformed receiver change mapping.")
+	}
+	receiverName, _ := receiverChange["receiver"].(string)
+	action, _ := receiverChange["action"].(string)
+	if len(receiverName) == 0 || len(action) == 0 {
+		return errors.New("Missing receiver name or action for receiver change.")
+	}
+	p2pReceiver, ok := proxy.P2pReceiverChannels[receiverName]
+	if !ok {
+		return errors.New(fmt.Sprintf("P2P receiver %s not available", receiverName))
+	}
+	_, running := a.localP2pReceivers[receiverName]
+	switch action {
+	case "start":
+		if running {
+			return errors.New(fmt.Sprintf("P2P receiver %s is already running", receiverName))
+		}
+	case "stop":
+		if !running {
+			return errors.New(fmt.Sprintf("P2P receiver %s is not running", receiverName))
 		}
-		output.VerbosePrint("[*] All available peer proxy receivers have been tried. Retrying them.")
-		a.refreshAvailablePeerReceivers()
+	case "restart":
+	default:
+		return errors.New(fmt.Sprintf("P2P receiver change action %s not supported", action))
 	}
-	for proxyChannel, receiverAddresses := range a.availablePeerReceivers {
-		if len(receiverAddresses) > 0 {
-			output.VerbosePrint(fmt.Sprintf("[-] Verifying proxy channel %s", proxyChannel))
-
-			// Attempt to set the new coms channel.
-			if err := a.AttemptSelectComChannel(nil, proxyChannel); err != nil {
-				output.VerbosePrint(fmt.Sprintf("[!] Error attempting to use proxy channel %s: %s", proxyChannel, err.Error()))
-
-				// Remove the invalid proxy channel from the pool. Safe to remove during iteration.
-				delete(a.availablePeerReceivers, proxyChannel)
-				continue
-			}
-			// Successfully set the channel. Update dest address.
-			a.usingPeerReceivers = true
-			addressToUse := receiverAddresses[0]
-			a.updateUpstreamDestAddr(addressToUse)
-			output.VerbosePrint(fmt.Sprintf("[*] Updated agent's destination address to proxy peer address: %s", addressToUse))
 
-			// Mark proxy channel and peer receiver address as used.
-			a.markPeerReceiverAsUsed(proxyChannel, addressToUse)
-			a.peerProxyReceiverDisplay()
-			return nil
+	// Settings are only applied once the action is known to be valid.
+	previousConfig := a.localP2pReceiverConfigs[receiverName]
+	config, configChanged := receiverChange["config"]
+	if configChanged {
+		if err := a.setLocalP2pReceiverConfig(receiverName, p2pReceiver, config); err != nil {
+			return err
 		}
 	}
-	return errors.New("No available compatible peer-to-peer proxy clients found.")
-}
-
-// Mark the peer proxy channel and receiver address as exhausted, so the agent doesn't try using it again
-// before trying the remaining ones.
-func (a *Agent) markPeerReceiverAsUsed(proxyChannel string, usedAddress string) {
-	if _, ok := a.exhaustedPeerReceivers[proxyChannel]; !ok {
-		a.exhaustedPeerReceivers[proxyChannel] = make([]string, 0)
-	}
-	a.exhaustedPeerReceivers[proxyChannel] = append(a.exhaustedPeerReceivers[proxyChannel], usedAddress)
-	if receiverAddresses, ok := a.availablePeerReceivers[proxyChannel]; ok {
-		a.availablePeerReceivers[proxyChannel] = deleteStringFromSlice(receiverAddresses, usedAddress)
-		// Clear map key if this was the last remaining address for the proxy channel.
-		if len(a.availablePeerReceivers[proxyChannel]) == 0 {
-			delete(a.availablePeerReceivers, proxyChannel)
+	switch action {
+	case "start":
+		return a.startLocalP2pReceiver(receiverName, p2pReceiver)
+	case "stop":
+		a.stopLocalP2pReceiver(receiverName, p2pReceiver)
+		return nil
+	default:
+		if running {
+			a.stopLocalP2pReceiver(receiverName, p2pReceiver)
 		}
+		err := a.startLocalP2pReceiver(receiverName, p2pReceiver)
+		if err != nil && running && configChanged {
+			return a.restoreLocalP2pReceiver(receiverName, p2pReceiver, previousConfig, err)
+		}
+		return err
 	}
 }
 
-// Should only be called once the agent's availablePeerReceivers map is empty.
-// Will repopulate availablePeerReceivers with the exhausted peer receivers so that the agent
-// can try them again.
-func (a *Agent) refreshAvailablePeerReceivers() {
-	a.availablePeerReceivers = a.exhaustedPeerReceivers
-	a.exhaustedPeerReceivers = make(map[string][]string)
+// Restores the previous settings of a receiver that failed to restart with new settings, and starts it again with
+// them. Returns an error describing the failed restart either way.
+func (a *Agent) restoreLocalP2pReceiver(receiverName string, p2pReceiver proxy.P2pReceiver, previousConfig map[string]string, restartErr error) error {
+	output.VerbosePrint(fmt.Sprintf("[-] Failed to restart p2p receiver %s with new settings: %s", receiverName, restartErr.Error()))
+	if err := p2pReceiver.(proxy.ConfigurableP2pReceiver).SetReceiverConfig(previousConfig); err != nil {
+		return errors.New(fmt.Sprintf("Failed to restart P2P receiver %s: %s. Previous settings could not be restored: %s", receiverName, restartErr.Error(), err.Error()))
+	}
+	a.localP2pReceiverConfigs[receiverName] = previousConfig
+	if err := a.startLocalP2pReceiver(receiverName, p2pReceiver); err != nil {
+		return errors.New(fmt.Sprintf("Failed to restart P2P receiver %s: %s. Restarting it with its previous settings failed as well: %s", receiverName, restartErr.Error(), err.Error()))
+	}
+	return errors.New(fmt.Sprintf("Failed to restart P2P receiver %s with the new settings, restarted it with its previous settings: %s", receiverName, restartErr.Error()))
 }
 
-// Utility function to remove a given string from a string slice.
-// Returns the new slice (not necessarily in the same order).
-// If the element to delete does not exist in the slice, the original slice will be returned.
-func deleteStringFromSlice(deleteFrom []string, toDelete string) []string {
-	indexToDelete := -1
-	maxIndex := len(deleteFrom) - 1
-	for i, element := range deleteFrom {
-		if element == toDelete {
-			indexToDelete = i
-			break
-		}
+func (a *Agent) setLocalP2pReceiverConfig(receiverName string, p2pReceiver proxy.P2pReceiver, configMap interface{}) error {
+	config, ok := configMap.(map[string]interface{})
+	if !ok {
+		return errors.New(fmt.Sprintf("Malformed settings for P2P receiver %s", receiverName))
+	}
+	configurableReceiver, ok := p2pReceiver.(proxy.ConfigurableP2pReceiver)
+	if !ok {
+		return errors.New(fmt.Sprintf("P2P receiver %s does not support settings", receiverName))
+	}
+	receiverConfig := make(map[string]string)
+	for setting, value := range config {
+		receiverConfig[setting] = fmt.Sprintf("%v", value)
 	}
-	if indexToDelete >= 0 {
-		deleteFrom[indexToDelete] = deleteFrom[maxIndex]
-		return deleteFrom[:maxIndex]
+	if err := configurableReceiver.SetReceiverConfig(receiverConfig); err != nil {
+		return errors.New(fmt.Sprintf("Invalid settings for P2P receiver %s: %s", receiverName, err.Error()))
 	}
-	return deleteFrom
+	a.localP2pReceiverConfigs[receiverName] = receiverConfig
+	return nil
 }
 
-// Display some output about the available/used peer proxy receivers.
-func (a* Agent) peerProxyReceiverDisplay() {
-	output.VerbosePrint("[*] Valid peer proxy receivers used so far: ")
-	for channel, addrs := range a.exhaustedPeerReceivers {
-		for _, addr := range addrs {
-			output.VerbosePrint(fmt.Sprintf("\t%s : %s", channel, addr))
-		}
+func (a *Agent) startLocalP2pReceiver(receiverName string, p2pReceiver proxy.P2pReceiver) error {
+	if err := p2pReceiver.InitializeReceiver(&a.server, &a.beaconContact, a.p2pReceiverWaitGroup); err != nil {
+		return err
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Initialized p2p receiver %s", receiverName))
+	a.localP2pReceivers[receiverName] = p2pReceiver
+	a.p2pReceiverWaitGroup.Add(1)
+	a.storeLocalP2pReceiverAddresses(receiverName, p2pReceiver)
+	if len(a.paw) > 0 {
+		p2pReceiver.UpdateAgentPaw(a.paw)
 	}
-	output.VerbosePrint("[*] Valid peer proxy receivers left to try out: ")
-	for channel, addrs := range a.availablePeerReceivers {
-		for _, addr := range addrs {
-			output.VerbosePrint(fmt.Sprintf("\t%s : %s", channel, addr))
+	go p2pReceiver.RunReceiver()
+	return nil
+}
+
+func (a *Agent) stopLocalP2pReceiver(receiverName string, p2pReceiver proxy.P2pReceiver) {
+	output.VerbosePrint(fmt.Sprintf("[*] Terminating p2p receiver %s", receiverName))
+	p2pReceiver.Terminate()
+	delete(a.localP2pReceivers, receiverName)
+	delete(a.localP2pReceiverAddresses, receiverName)
+}
+
+func (a *Agent) storeLocalP2pReceiverAddresses(receiverName string, p2pReceiver proxy.P2pReceiver) {
+	for _, address := range p2pReceiver.GetReceiverAddresses() {
+		if _, ok := a.localP2pReceiverAddresses[receiverName]; !ok {
+			a.localP2pReceiverAddresses[receiverName] = make([]string, 0)
 		}
+		a.localP2pReceiverAddresses[receiverName] = append(a.localP2pReceiverAddresses[receiverName], address)
 	}
 }
+
@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/proxy"
+)
+
+// Receiver stand-in that records its lifecycle and settings.
+type fakeReceiver struct {
+	paw         string
+	port        string
+	initialized int
+	terminated  int
+	waitgroup   *sync.WaitGroup
+}
+
+func (f *fakeReceiver) InitializeReceiver(agentServer *string, upstreamComs *contact.Contact, waitgroup *sync.WaitGroup) error {
+	if f.port == "0" {
+		return errors.New("no port available")
+	}
+	f.initialized++
+	f.waitgroup = waitgroup
+	return nil
+}
+
+func (f *fakeReceiver) RunReceiver() {}
+
+func (f *fakeReceiver) UpdateAgentPaw(newPaw string) {
+	f.paw = newPaw
+}
+
+func (f *fakeReceiver) Terminate() {
+	f.terminated++
+	f.waitgroup.Done()
+}
+
+func (f *fakeReceiver) GetReceiverAddresses() []string {
+	return []string{"10.0.0.5:" + f.port}
+}
+
+func (f *fakeReceiver) SetReceiverConfig(config map[string]string) error {
+	if port, ok := config["port"]; ok {
+		f.port = port
+	}
+	return nil
+}
+
+func registerFakeReceiver(t *testing.T, receiverName string, receiver proxy.P2pReceiver) {
+	proxy.P2pReceiverChannels[receiverName] = receiver
+	t.Cleanup(func() { delete(proxy.P2pReceiverChannels, receiverName) })
+}
+
+func newReceiverAgent() *Agent {
+	return &Agent{
+		paw:                       "agentpaw",
+		localP2pReceivers:         make(map[string]proxy.P2pReceiver),
+		localP2pReceiverAddresses: make(map[string][]string),
+		localP2pReceiverConfigs:   make(map[string]map[string]string),
+		p2pReceiverWaitGroup:      &sync.WaitGroup{},
+	}
+}
+
+func TestReceiverChangeLifecycle(t *testing.T) {
+	receiver := &fakeReceiver{port: "51000"}
+	registerFakeReceiver(t, "FAKE", receiver)
+	a := newReceiverAgent()
+
+	if err := a.ProcessReceiverChange(map[string]interface{}{"receiver": "FAKE", "action": "start"}); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.initialized != 1 || receiver.paw != "agentpaw" {
+		t.Errorf("expected receiver to be started with the agent paw, got %+v", receiver)
+	}
+	if addresses := a.GetFullProfile()["proxy_receivers"].(map[string][]string)["FAKE"]; len(addresses) != 1 || addresses[0] != "10.0.0.5:51000" {
+		t.Errorf("unexpected receiver addresses in profile: %v", addresses)
+	}
+	if err := a.ProcessReceiverChange(map[string]interface{}{"receiver": "FAKE", "action": "start"}); err == nil {
+		t.Errorf("expected error when starting a running receiver")
+	}
+
+	// Settings from the beacon apply on restart, and JSON numbers are accepted.
+	restart := []interface{}{map[string]interface{}{"receiver": "FAKE", "action": "restart", "config": map[string]interface{}{"port": float64(52000)}}}
+	if err := a.ProcessReceiverChange(restart); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.terminated != 1 || receiver.initialized != 2 {
+		t.Errorf("expected receiver to be terminated and started again, got %+v", receiver)
+	}
+	if addresses := a.localP2pReceiverAddresses["FAKE"]; len(addresses) != 1 || addresses[0] != "10.0.0.5:52000" {
+		t.Errorf("expected only the restarted receiver address, got %v", addresses)
+	}
+
+	if err := a.ProcessReceiverChange(map[string]interface{}{"receiver": "FAKE", "action": "stop"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.localP2pReceivers["FAKE"]; ok || len(a.localP2pReceiverAddresses["FAKE"]) > 0 {
+		t.Errorf("expected stopped receiver to be removed from the profile")
+	}
+	if err := a.ProcessReceiverChange(map[string]interface{}{"receiver": "FAKE", "action": "stop"}); err == nil {
+		t.Errorf("expected error when stopping a receiver that is not running")
+	}
+	a.p2pReceiverWaitGroup.Wait()
+}
+
+func TestReceiverChangeSettings(t *testing.T) {
+	receiver := &fakeReceiver{}
+	registerFakeReceiver(t, "FAKE", receiver)
+	a := newReceiverAgent()
+	withPort := func(action string, port string) map[string]interface{} {
+		return map[string]interface{}{"receiver": "FAKE", "action": action, "config": map[string]interface{}{"port": port}}
+	}
+	if err := a.ProcessReceiverChange(withPort("start", "51000")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings of rejected changes are not applied.
+	if err := a.ProcessReceiverChange(withPort("start", "52000")); err == nil || receiver.port != "51000" {
+		t.Errorf("expected rejected start to keep the receiver settings, got port %s", receiver.port)
+	}
+
+	// A receiver that fails to restart with new settings is restarted with its previous settings.
+	if err := a.ProcessReceiverChange(withPort("restart", "0")); err == nil {
+		t.Errorf("expected error when the receiver fails to restart with new settings")
+	}
+	if _, running := a.localP2pReceivers["FAKE"]; !running || receiver.port != "51000" || receiver.initialized != 2 {
+		t.Errorf("expected receiver to run again with its previous settings, got %+v", receiver)
+	}
+	if addresses := a.localP2pReceiverAddresses["FAKE"]; len(addresses) != 1 || addresses[0] != "10.0.0.5:51000" {
+		t.Errorf("expected the previous receiver address, got %v", addresses)
+	}
+
+	if err := a.ProcessReceiverChange(map[string]interface{}{"receiver": "FAKE", "action": "stop"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ProcessReceiverChange(withPort("stop", "53000")); err == nil || receiver.port != "51000" {
+		t.Errorf("expected rejected stop to keep the receiver settings, got port %s", receiver.port)
+	}
+	a.p2pReceiverWaitGroup.Wait()
+}
+
+func TestReceiverChangeErrors(t *testing.T) {
+	registerFakeReceiver(t, "FAKE", &fakeReceiver{port: "0"})
+	a := newReceiverAgent()
+	invalidChanges := []interface{}{
+		"start",
+		map[string]interface{}{"receiver": "FAKE"},
+		map[string]interface{}{"receiver": "MISSING", "action": "start"},
+		map[string]interface{}{"receiver": "FAKE", "action": "pause"},
+		map[string]interface{}{"receiver": "FAKE", "action": "start"},
+		map[string]interface{}{"receiver": "FAKE", "action": "start", "config": "port=51000"},
+	}
+	for _, invalidChange := range invalidChanges {
+		if err := a.ProcessReceiverChange(invalidChange); err == nil {
+			t.Errorf("expected error for receiver change %v", invalidChange)
+		}
+	}
+	if len(a.localP2pReceivers) > 0 {
+		t.Errorf("expected no receivers to be running, got %v", a.localP2pReceivers)
+	}
+}
+
+// Receiver stand-in that reports a downstream peer.
+type peerReportingReceiver struct {
+	fakeReceiver
+}
+
+func (p *peerReportingReceiver) GetPeers() []map[string]interface{} {
+	return []map[string]interface{}{{"paw": "clientpaw", "errors": 0}}
+}
+
+func TestP2pPeersInProfile(t *testing.T) {
+	a := newReceiverAgent()
+	if _, ok := a.GetFullProfile()["p2p_peers"]; ok {
+		t.Errorf("expected no peer table without receivers")
+	}
+	a.localP2pReceivers["FAKE"] = &fakeReceiver{port: "51000"}
+	a.localP2pReceivers["PEERS"] = &peerReportingReceiver{fakeReceiver{port: "51001"}}
+	peers, ok := a.GetFullProfile()["p2p_peers"].([]map[string]interface{})
+	if !ok || len(peers) != 1 || peers[0]["paw"] != "clientpaw" || peers[0]["receiver"] != "PEERS" {
+		t.Errorf("expected peer table with the receiver name, got %v", peers)
+	}
+}
+
+func TestEvaluateNewPeers(t *testing.T) {
+	a := &Agent{
+		availablePeerReceivers: make(map[string][]string),
+	}
+	entries := make(chan *zeroconf.ServiceEntry, 4)
+	newEntry := func(instance string, port int, text []string) *zeroconf.ServiceEntry {
+		entry := zeroconf.NewServiceEntry(instance, "_service._comms", "local.")
+		entry.AddrIPv4 = []net.IP{net.ParseIP("10.0.0.5")}
+		entry.Port = port
+		entry.Text = text
+		return entry
+	}
+	entries <- newEntry("legacy", 51000, []string{"HTTP"})
+	entries <- newEntry("pinned", 51001, proxy.BuildServiceText("HTTP", "abcd", "", 1))
+	entries <- newEntry("keyed", 51002, proxy.BuildServiceText("HTTP", "", "other-key", -1))
+	entries <- newEntry("empty", 51003, nil)
+	close(entries)
+	a.evaluateNewPeers(entries)
+
+	expected := []string{"http://10.0.0.5:51000", "https://10.0.0.5:51001#sha256=abcd"}
+	if peers := a.availablePeerReceivers["HTTP"]; !reflect.DeepEqual(peers, expected) {
+		t.Errorf("expected peers %v, got %v", expected, peers)
+	}
+	if legacyHops, pinnedHops := a.getPeerHealth(expected[0]).hops, a.getPeerHealth(expected[1]).hops; legacyHops != -1 || pinnedHops != 2 {
+		t.Errorf("expected unknown hops for legacy peer and 2 hops through pinned peer, got %d and %d", legacyHops, pinnedHops)
+	}
+}
@@ -3,6 +3,7 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/mitre/gocat/contact"
 	"github.com/mitre/gocat/output"
@@ -29,7 +30,53 @@ func (a *Agent) StartTunnel(tunnelConfig *contact.TunnelConfig) error {
 		output.VerbosePrint(fmt.Sprintf("[*] %s tunnel ready and listening on %s.", a.tunnel.GetName(), a.tunnel.GetLocalEndpoint()))
 		a.updateUpstreamDestAddr(a.tunnel.GetLocalEndpoint())
 		a.usingTunnel = true
+		a.lastTunnelCheck = time.Now()
 		return nil
 	}
 	return errors.New(fmt.Sprintf("Failed to start communication tunnel %s", a.tunnel.GetName()))
-}
\ No newline at end of file
+}
+
+// Checks the health of the tunnel and restarts it if needed. If the tunnel remains unhealthy for too many
+// consecutive checks, the tunnel is stopped and the agent falls back to contacting the C2 server directly.
+// Since the health check is a network round trip, a healthy tunnel is only checked again once
+// tunnelCheckInterval has passed or a beacon has failed. A restarted tunnel is checked before the next beacon.
+func (a *Agent) CheckTunnel() {
+	if a.tunnel == nil || !a.usingTunnel {
+		return
+	}
+	if a.failedTunnelChecks == 0 && time.Since(a.lastTunnelCheck) < tunnelCheckInterval {
+		return
+	}
+	a.lastTunnelCheck = time.Now()
+	if a.tunnel.Healthy() {
+		a.failedTunnelChecks = 0
+		return
+	}
+	a.failedTunnelChecks += 1
+	if a.failedTunnelChecks >= tunnelFailureThreshold {
+		output.VerbosePrint(fmt.Sprintf("[!] Reached tunnel failure threshold. Falling back to direct contact with %s", a.server))
+		a.StopTunnel()
+		a.updateUpstreamDestAddr(a.server)
+		return
+	}
+	output.VerbosePrint(fmt.Sprintf("[-] %s tunnel is unhealthy. Restarting tunnel.", a.tunnel.GetName()))
+	a.tunnel.Stop()
+	if err := a.StartTunnel(a.tunnelConfig); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Failed to restart tunnel: %s", err.Error()))
+
+		// Keep monitoring the tunnel so that the restart is retried on the next check.
+		a.usingTunnel = true
+	}
+}
+
+// Stops the tunnel, if any. The agent will no longer use it to contact C2.
+func (a *Agent) StopTunnel() {
+	if a.tunnel == nil {
+		return
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Stopping %s tunnel", a.tunnel.GetName()))
+	a.tunnel.Stop()
+	a.tunnel = nil
+	a.usingTunnel = false
+	a.failedTunnelChecks = 0
+}
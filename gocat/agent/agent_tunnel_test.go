@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+)
+
+// Tunnel stand-in whose health is controlled by the test.
+type fakeTunnel struct {
+	id      int
+	healthy bool
+	started bool
+	stopped bool
+}
+
+func (f *fakeTunnel) GetName() string {
+	return "FAKE"
+}
+
+func (f *fakeTunnel) Start(tunnelReady chan bool) {
+	f.started = true
+	tunnelReady <- true
+}
+
+func (f *fakeTunnel) GetLocalEndpoint() string {
+	return fmt.Sprintf("http://localhost:%d", 50000+f.id)
+}
+
+func (f *fakeTunnel) GetRemoteEndpoint() string {
+	return "http://c2.example.test:8888"
+}
+
+func (f *fakeTunnel) Stop() {
+	f.stopped = true
+}
+
+func (f *fakeTunnel) Healthy() bool {
+	return f.healthy && !f.stopped
+}
+
+// Registers a fake tunnel factory that creates healthy tunnels as long as restartsHealthy is set.
+func registerFakeTunnels(restartsHealthy *bool) *[]*fakeTunnel {
+	var tunnels []*fakeTunnel
+	contact.CommunicationTunnelFactories["FAKE"] = func(tunnelConfig *contact.TunnelConfig) (contact.Tunnel, error) {
+		tunnel := &fakeTunnel{id: len(tunnels), healthy: *restartsHealthy}
+		tunnels = append(tunnels, tunnel)
+		return tunnel, nil
+	}
+	return &tunnels
+}
+
+// Checks the tunnel before every beacon for the duration of the test.
+func checkTunnelEveryBeacon(t *testing.T) {
+	interval := tunnelCheckInterval
+	tunnelCheckInterval = 0
+	t.Cleanup(func() { tunnelCheckInterval = interval })
+}
+
+func newTunnelAgent(t *testing.T) *Agent {
+	a := &Agent{server: "http://c2.example.test:8888", tunnelConfig: &contact.TunnelConfig{Protocol: "FAKE"}}
+	if err := a.StartTunnel(a.tunnelConfig); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestCheckTunnelRestartsUnhealthyTunnel(t *testing.T) {
+	checkTunnelEveryBeacon(t)
+	restartsHealthy := true
+	tunnels := registerFakeTunnels(&restartsHealthy)
+	defer delete(contact.CommunicationTunnelFactories, "FAKE")
+	a := newTunnelAgent(t)
+
+	a.CheckTunnel()
+	if len(*tunnels) != 1 || a.upstreamDestAddr != "http://localhost:50000" {
+		t.Fatalf("expected healthy tunnel to be kept, got %d tunnels and upstream %s", len(*tunnels), a.upstreamDestAddr)
+	}
+	(*tunnels)[0].healthy = false
+	a.CheckTunnel()
+	if len(*tunnels) != 2 || !(*tunnels)[0].stopped || !(*tunnels)[1].started {
+		t.Fatalf("expected unhealthy tunnel to be stopped and replaced")
+	}
+	if !a.usingTunnel || a.upstreamDestAddr != "http://localhost:50001" {
+		t.Errorf("expected agent to use restarted tunnel, got upstream %s", a.upstreamDestAddr)
+	}
+	a.CheckTunnel()
+	if a.failedTunnelChecks != 0 {
+		t.Errorf("expected failed tunnel checks to be reset after healthy check, got %d", a.failedTunnelChecks)
+	}
+}
+
+func TestCheckTunnelFallsBackToDirectContact(t *testing.T) {
+	checkTunnelEveryBeacon(t)
+	restartsHealthy := false
+	tunnels := registerFakeTunnels(&restartsHealthy)
+	defer delete(contact.CommunicationTunnelFactories, "FAKE")
+	a := newTunnelAgent(t)
+
+	for i := 0; i < tunnelFailureThreshold; i++ {
+		a.CheckTunnel()
+	}
+	if len(*tunnels) != tunnelFailureThreshold {
+		t.Errorf("expected %d tunnel starts before falling back, got %d", tunnelFailureThreshold, len(*tunnels))
+	}
+	for _, tunnel := range *tunnels {
+		if !tunnel.stopped {
+			t.Errorf("expected tunnel %d to be stopped", tunnel.id)
+		}
+	}
+	if a.usingTunnel || a.tunnel != nil || a.upstreamDestAddr != a.server {
+		t.Errorf("expected agent to fall back to direct contact, got upstream %s", a.upstreamDestAddr)
+	}
+
+	// Once fallen back, the tunnel is no longer checked.
+	a.CheckTunnel()
+	if len(*tunnels) != tunnelFailureThreshold {
+		t.Errorf("expected no tunnel restarts after falling back to direct contact")
+	}
+}
+
+func TestCheckTunnelRateLimited(t *testing.T) {
+	restartsHealthy := true
+	tunnels := registerFakeTunnels(&restartsHealthy)
+	defer delete(contact.CommunicationTunnelFactories, "FAKE")
+	a := newTunnelAgent(t)
+	a.beaconContact = &fakePeerContact{}
+
+	// A freshly started tunnel is not checked again until the check interval has passed.
+	(*tunnels)[0].healthy = false
+	a.CheckTunnel()
+	if len(*tunnels) != 1 || (*tunnels)[0].stopped {
+		t.Fatalf("expected tunnel not to be checked within the check interval")
+	}
+	a.lastTunnelCheck = time.Now().Add(-tunnelCheckInterval)
+	a.CheckTunnel()
+	if len(*tunnels) != 2 || !(*tunnels)[0].stopped {
+		t.Fatalf("expected unhealthy tunnel to be replaced once the check interval has passed")
+	}
+
+	// A restarted tunnel is checked again before the next beacon to confirm it is healthy.
+	a.CheckTunnel()
+	if a.failedTunnelChecks != 0 {
+		t.Fatalf("expected restarted tunnel to be checked before the next beacon")
+	}
+
+	// A failed beacon triggers a check before the next beacon.
+	(*tunnels)[1].healthy = false
+	a.CheckTunnel()
+	if len(*tunnels) != 2 {
+		t.Fatalf("expected restarted tunnel not to be checked within the check interval")
+	}
+	a.Beacon()
+	a.CheckTunnel()
+	if len(*tunnels) != 3 || !(*tunnels)[1].stopped {
+		t.Errorf("expected unhealthy tunnel to be replaced after a failed beacon")
+	}
+}
+
+func TestStopTunnelOnTerminate(t *testing.T) {
+	restartsHealthy := true
+	tunnels := registerFakeTunnels(&restartsHealthy)
+	defer delete(contact.CommunicationTunnelFactories, "FAKE")
+	a := newTunnelAgent(t)
+
+	a.Terminate()
+	if !(*tunnels)[0].stopped || a.tunnel != nil || a.usingTunnel {
+		t.Errorf("expected tunnel to be stopped on termination")
+	}
+}
+
+func TestStopTunnelOnPeerSwitch(t *testing.T) {
+	restartsHealthy := true
+	tunnels := registerFakeTunnels(&restartsHealthy)
+	defer delete(contact.CommunicationTunnelFactories, "FAKE")
+	a := newTunnelAgent(t)
+	failBeacons := func() error {
+		var err error
+		for i := 0; i < beaconFailureThreshold; i++ {
+			err = a.HandleBeaconFailure()
+		}
+		return err
+	}
+
+	// The tunnel is kept while there is no peer to switch to.
+	if err := failBeacons(); err == nil {
+		t.Fatalf("expected error without peers to switch to")
+	}
+	if (*tunnels)[0].stopped || !a.usingTunnel || a.upstreamDestAddr != "http://localhost:50000" {
+		t.Fatalf("expected agent to keep using the tunnel, got upstream %s", a.upstreamDestAddr)
+	}
+
+	contact.CommunicationChannels["FAKEPEER"] = &fakePeerContact{}
+	defer delete(contact.CommunicationChannels, "FAKEPEER")
+	a.availablePeerReceivers = map[string][]string{"FAKEPEER": {"peer-a"}}
+	if err := failBeacons(); err != nil {
+		t.Fatal(err)
+	}
+	if !(*tunnels)[0].stopped || a.tunnel != nil || a.usingTunnel || a.upstreamDestAddr != "peer-a" {
+		t.Errorf("expected tunnel to be stopped once the agent switched to a peer, got upstream %s", a.upstreamDestAddr)
+	}
+}
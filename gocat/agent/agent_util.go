@@ -7,6 +7,7 @@ import (
 	"os/user"
 	"time"
 
+	"github.com/mitre/gocat/encoders"
 	"github.com/mitre/gocat/output"
 )
 
@@ -36,3 +37,32 @@ func getExecutablePath() string {
 	}
 	return path
 }
+
+// Returns the data encoder name listed under the given instruction key, along with the instruction's
+// encoder config. Returns an empty name if the instruction does not request a data encoder.
+func getInstructionEncoder(instruction map[string]interface{}, encoderKey string) (string, map[string]interface{}) {
+	encoderName, ok := instruction[encoderKey].(string)
+	if !ok {
+		return "", nil
+	}
+	encoderConfig, _ := instruction["encoder_config"].(map[string]interface{})
+	return encoderName, encoderConfig
+}
+
+// Encodes the data using the requested data encoder.
+func encodeData(encoderName string, data []byte, config map[string]interface{}) ([]byte, error) {
+	encoder, err := encoders.GetDataEncoder(encoderName)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.EncodeData(data, config)
+}
+
+// Decodes the data using the requested data encoder.
+func decodeData(encoderName string, data []byte, config map[string]interface{}) ([]byte, error) {
+	encoder, err := encoders.GetDataEncoder(encoderName)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.DecodeData(data, config)
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitre/gocat/encoders"
+	"github.com/mitre/gocat/execute"
+)
+
+const testEncoderKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" // base64 of a 32-byte key
+
+// Contact stand-in that serves a fixed payload and records uploads.
+type payloadContact struct {
+	payload []byte
+	uploads map[string][]byte
+}
+
+func (p *payloadContact) GetBeaconBytes(profile map[string]interface{}) []byte { return nil }
+
+func (p *payloadContact) GetPayloadBytes(profile map[string]interface{}, payload string) ([]byte, string) {
+	return p.payload, payload
+}
+
+func (p *payloadContact) C2RequirementsMet(profile map[string]interface{}, criteria map[string]string) (bool, map[string]string) {
+	return true, nil
+}
+
+func (p *payloadContact) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+}
+
+func (p *payloadContact) GetName() string { return "PAYLOAD" }
+
+func (p *payloadContact) SetUpstreamDestAddr(upstreamDestAddr string) {}
+
+func (p *payloadContact) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
+	p.uploads[uploadName] = data
+	return nil
+}
+
+func (p *payloadContact) SupportsContinuous() bool { return false }
+
+// Executor stand-in that keeps payloads in memory.
+type memoryExecutor struct{}
+
+func (m *memoryExecutor) Run(command string, timeout int, info execute.InstructionInfo) execute.CommandResults {
+	return execute.CommandResults{}
+}
+func (m *memoryExecutor) String() string                                  { return "memexec" }
+func (m *memoryExecutor) CheckIfAvailable() bool                          { return true }
+func (m *memoryExecutor) UpdateBinary(newBinary string)                   {}
+func (m *memoryExecutor) DownloadPayloadToMemory(payloadName string) bool { return true }
+
+func newEncoderAgent(t *testing.T, payload []byte) (*Agent, *payloadContact) {
+	execute.Executors["memexec"] = &memoryExecutor{}
+	t.Cleanup(func() { delete(execute.Executors, "memexec") })
+	coms := &payloadContact{payload: payload, uploads: make(map[string][]byte)}
+	return &Agent{paw: "agentpaw", beaconContact: coms}, coms
+}
+
+// Parses the instruction as the agent receives it from the C2 server.
+func parseInstruction(t *testing.T, instructionJson string) map[string]interface{} {
+	var instruction map[string]interface{}
+	if err := json.Unmarshal([]byte(instructionJson), &instruction); err != nil {
+		t.Fatal(err)
+	}
+	return instruction
+}
+
+func encodeTestData(t *testing.T, encoderName string, data []byte, config map[string]interface{}) []byte {
+	encoder, err := encoders.GetDataEncoder(encoderName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encoder.EncodeData(data, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestUploadEncodedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loot.txt")
+	if err := os.WriteFile(path, []byte("secret data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, coms := newEncoderAgent(t, nil)
+	uploadsJson, _ := json.Marshal([]string{path})
+	a.UploadFiles(parseInstruction(t, `{"uploads": `+string(uploadsJson)+`, "upload_encoder": "aes-gcm", "encoder_config": {"key": "`+testEncoderKey+`"}}`))
+
+	encoded, ok := coms.uploads["loot.txt"]
+	if !ok || string(encoded) == "secret data" {
+		t.Fatalf("expected encoded upload, got %q", encoded)
+	}
+	decoded, err := decodeData("aes-gcm", encoded, map[string]interface{}{"key": testEncoderKey})
+	if err != nil || string(decoded) != "secret data" {
+		t.Errorf("expected upload to decode to the file contents, got %q, %v", decoded, err)
+	}
+}
+
+func TestDownloadDecodedPayload(t *testing.T) {
+	config := map[string]interface{}{"key": testEncoderKey}
+	a, _ := newEncoderAgent(t, encodeTestData(t, "aes-gcm", []byte("payload bytes"), config))
+	instruction := parseInstruction(t, `{"payloads": ["tool"], "executor": "memexec", "payload_encoder": "aes-gcm", "encoder_config": {"key": "`+testEncoderKey+`"}}`)
+	_, inMemoryPayloads := a.DownloadPayloadsForInstruction(instruction)
+	if string(inMemoryPayloads["tool"]) != "payload bytes" {
+		t.Errorf("expected decoded payload, got %q", inMemoryPayloads["tool"])
+	}
+
+	// Payloads are passed on as-is without a payload encoder.
+	delete(instruction, "payload_encoder")
+	if _, inMemoryPayloads = a.DownloadPayloadsForInstruction(instruction); string(inMemoryPayloads["tool"]) == "payload bytes" {
+		t.Errorf("expected payload not to be decoded without a payload encoder")
+	}
+}
+
+func TestUnknownInstructionEncoder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loot.txt")
+	if err := os.WriteFile(path, []byte("secret data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, coms := newEncoderAgent(t, []byte("payload bytes"))
+	if err := a.uploadSingleFile(path, "rot13", nil); err == nil {
+		t.Errorf("expected error for upload with unknown encoder")
+	}
+	if len(coms.uploads) != 0 {
+		t.Errorf("expected upload with unknown encoder not to be sent, got %v", coms.uploads)
+	}
+	instruction := parseInstruction(t, `{"payloads": ["tool"], "executor": "memexec", "payload_encoder": "rot13"}`)
+	if _, inMemoryPayloads := a.DownloadPayloadsForInstruction(instruction); len(inMemoryPayloads) != 0 {
+		t.Errorf("expected payload with unknown encoder to be skipped, got %v", inMemoryPayloads)
+	}
+}
+
+func TestInvalidInstructionEncoderConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loot.txt")
+	if err := os.WriteFile(path, []byte("secret data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	payload := encodeTestData(t, "aes-gcm", []byte("payload bytes"), map[string]interface{}{"key": testEncoderKey})
+	a, coms := newEncoderAgent(t, payload)
+	for _, encoderConfig := range []string{
+		``,
+		`, "encoder_config": "` + testEncoderKey + `"`,
+		`, "encoder_config": {"key": "not base64!"}`,
+		`, "encoder_config": {"key": 42}`,
+		`, "encoder_config": {"key": "` + base64.StdEncoding.EncodeToString([]byte("short key")) + `"}`,
+	} {
+		uploadInstruction := parseInstruction(t, `{"upload_encoder": "aes-gcm"`+encoderConfig+`}`)
+		encoderName, config := getInstructionEncoder(uploadInstruction, "upload_encoder")
+		if err := a.uploadSingleFile(path, encoderName, config); err == nil {
+			t.Errorf("expected upload error for encoder config %q", encoderConfig)
+		}
+		payloadInstruction := parseInstruction(t, `{"payloads": ["tool"], "executor": "memexec", "payload_encoder": "aes-gcm"`+encoderConfig+`}`)
+		if _, inMemoryPayloads := a.DownloadPayloadsForInstruction(payloadInstruction); len(inMemoryPayloads) != 0 {
+			t.Errorf("expected payload to be skipped for encoder config %q", encoderConfig)
+		}
+	}
+	if len(coms.uploads) != 0 {
+		t.Errorf("expected uploads with invalid encoder config not to be sent, got %v", coms.uploads)
+	}
+}
+
+func TestGetInstructionEncoder(t *testing.T) {
+	instruction := parseInstruction(t, `{"upload_encoder": "base64", "payload_encoder": 5, "encoder_config": {"key": "abc"}}`)
+	if encoderName, config := getInstructionEncoder(instruction, "upload_encoder"); encoderName != "base64" || config["key"] != "abc" {
+		t.Errorf("unexpected upload encoder %s with config %v", encoderName, config)
+	}
+	if encoderName, _ := getInstructionEncoder(instruction, "payload_encoder"); encoderName != "" {
+		t.Errorf("expected malformed encoder name to be ignored, got %s", encoderName)
+	}
+}
@@ -10,10 +10,12 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
-	"net/url"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/p2pauth"
 )
 
 var (
@@ -26,6 +28,12 @@ type API struct {
 	client *http.Client
 	upstreamDestAddr string
 	userAgent string
+	httpProfile *HttpProfile // malleable request profile. Uses the default request format if nil.
+	transportMode string
+	protocolRecorder *protocolRecorder
+	pinnedFingerprint string // SHA-256 fingerprint of the upstream certificate, if pinned by the upstream address.
+	upstreamIsPeer bool // whether the upstream destination is a peer receiver rather than the C2 server.
+	pinMutex sync.Mutex // protects pinnedFingerprint and upstreamIsPeer
 }
 
 func init() {
@@ -38,6 +46,8 @@ func (a *API) GetBeaconBytes(profile map[string]interface{}) []byte {
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Cannot request beacon. Error with profile marshal: %s", err.Error()))
 		return nil
+	} else if httpProfile := a.getHttpProfile(); httpProfile != nil && httpProfile.Beacon != nil {
+		return a.profileRequest(httpProfile.Beacon, data)
 	} else {
 		address := fmt.Sprintf("%s%s", a.upstreamDestAddr, API_BEACON)
 		return a.request(address, data)
@@ -49,7 +59,9 @@ func (a *API) GetPayloadBytes(profile map[string]interface{}, payload string) ([
     var payloadBytes []byte
     var filename string
     platform := profile["platform"]
-    if platform != nil {
+    if httpProfile := a.getHttpProfile(); platform != nil && httpProfile != nil && httpProfile.Download != nil {
+		return a.profileDownload(httpProfile.Download, profile, payload)
+    } else if platform != nil {
 		address := fmt.Sprintf("%s/file/download", a.upstreamDestAddr)
 		req, err := http.NewRequest("POST", address, nil)
 		if err != nil {
@@ -86,7 +98,14 @@ func (a *API) GetPayloadBytes(profile map[string]interface{}, payload string) ([
 //C2RequirementsMet determines if sandcat can use the selected comm channel
 func (a *API) C2RequirementsMet(profile map[string]interface{}, c2Config map[string]string) (bool, map[string]string) {
 	output.VerbosePrint(fmt.Sprintf("Beacon API=%s", API_BEACON))
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if err := p2pauth.ConfigureHttpClient(tlsConfig); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not set up P2P authentication: %s", err.Error()))
+		return false, nil
+	}
+	// Only a copy of the default transport is configured, so that other users of the default transport are not affected.
+	baseTransport := http.DefaultTransport.(*http.Transport).Clone()
+	baseTransport.TLSClientConfig = tlsConfig
 
 	// Set user agent string if provided
 	if providedUserAgent, ok := c2Config["httpUserAgent"]; ok && len(providedUserAgent) > 0 {
@@ -94,25 +113,87 @@ func (a *API) C2RequirementsMet(profile map[string]interface{}, c2Config map[str
 	}
 
 	// Handle proxy gateway configuration.
-	if proxyUrlStr, ok := c2Config["httpProxyGateway"]; ok && len(proxyUrlStr) > 0 {
-		proxyUrl, err := url.Parse(proxyUrlStr)
+	proxyDialer, err := configureProxy(baseTransport, c2Config)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not establish HTTP proxy requirements: %s", err.Error()))
+		return false, nil
+	}
+	// Set up the requested HTTP transport mode.
+	a.transportMode = c2Config["httpTransport"]
+	if len(a.transportMode) == 0 {
+		a.transportMode = HTTP_TRANSPORT_DEFAULT
+	}
+	if a.isUpstreamPeer() && p2pauth.Enabled() && !strings.HasPrefix(a.upstreamDestAddr, "https://") {
+		output.VerbosePrint("[!] Error - peer receivers must be reached over HTTPS when authenticating peers")
+		return false, nil
+	}
+	// Certificates pinned by the upstream address only apply to this contact's connections.
+	a.configurePinning(baseTransport.TLSClientConfig)
+	a.configurePeerAuthentication(baseTransport.TLSClientConfig)
+	if tlsServerName, ok := c2Config["httpTlsServerName"]; ok && len(tlsServerName) > 0 {
+		baseTransport.TLSClientConfig.ServerName = tlsServerName
+	}
+	transport, err := GetHttpTransport(a.transportMode, baseTransport)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not set up HTTP transport: %s", err.Error()))
+		return false, nil
+	}
+	if proxyDialer != nil {
+		transport = &proxyRoundTripper{next: transport, dialer: proxyDialer}
+	}
+
+	// Handle domain fronting configuration.
+	frontEndpoints, err := parseFrontEndpoints(c2Config["httpFrontEndpoints"])
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not establish HTTP front endpoints: %s", err.Error()))
+		return false, nil
+	}
+	if hostHeader := c2Config["httpHostHeader"]; len(frontEndpoints) > 0 || len(hostHeader) > 0 {
+		transport = newFrontingRoundTripper(transport, frontEndpoints, hostHeader)
+		output.VerbosePrint(fmt.Sprintf("[*] Using %d front endpoint(s) with Host header %s", len(frontEndpoints), hostHeader))
+	}
+	// Idle connections of the previous client may have been dialed with previous proxy settings.
+	if a.client != nil {
+		a.client.CloseIdleConnections()
+	}
+	a.protocolRecorder = &protocolRecorder{next: transport}
+	a.client = &http.Client{Transport: a.protocolRecorder}
+	output.VerbosePrint(fmt.Sprintf("[*] Using HTTP transport %s", a.transportMode))
+
+	// Load malleable HTTP profile if provided.
+	a.httpProfile = nil
+	if profileStr, ok := c2Config["httpProfile"]; ok && len(profileStr) > 0 {
+		httpProfile, err := LoadHttpProfile(profileStr)
 		if err != nil {
-			output.VerbosePrint(fmt.Sprintf("[!] Error - could not establish HTTP proxy requirements: %s", err.Error()))
+			output.VerbosePrint(fmt.Sprintf("[!] Error - could not load HTTP profile: %s", err.Error()))
 			return false, nil
 		}
-		http.DefaultTransport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+		a.httpProfile = httpProfile
+		output.VerbosePrint("[*] Using malleable HTTP profile")
 	}
-	a.client = &http.Client{Transport: http.DefaultTransport}
 
 	return true, nil
 }
 
+// Sets the upstream address. A certificate fingerprint appended to the address is pinned for HTTPS connections.
 func (a *API) SetUpstreamDestAddr(upstreamDestAddr string) {
+	upstreamDestAddr, fingerprint := splitPinnedFingerprint(upstreamDestAddr)
 	a.upstreamDestAddr = upstreamDestAddr
+	a.pinMutex.Lock()
+	a.pinnedFingerprint = fingerprint
+	a.pinMutex.Unlock()
 }
 
 // SendExecutionResults will send the execution results to the upstream destination.
 func (a *API) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+	if err := a.DeliverExecutionResults(profile, result); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. %s", err.Error()))
+	}
+}
+
+// DeliverExecutionResults sends the execution results to the upstream destination, and returns an error if the
+// request fails or the upstream destination does not accept the results.
+func (a *API) DeliverExecutionResults(profile map[string]interface{}, result map[string]interface{}) error {
 	address := fmt.Sprintf("%s%s", a.upstreamDestAddr, API_BEACON)
 	profileCopy := make(map[string]interface{})
 	for k,v := range profile {
@@ -123,10 +204,74 @@ func (a *API) SendExecutionResults(profile map[string]interface{}, result map[st
 	profileCopy["results"] = results
 	data, err := json.Marshal(profileCopy)
 	if err != nil {
-		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. Error with profile marshal: %s", err.Error()))
+		return errors.New(fmt.Sprintf("Error with profile marshal: %s", err.Error()))
+	}
+	var resp *http.Response
+	if httpProfile := a.getHttpProfile(); httpProfile != nil && httpProfile.Results != nil {
+		resp, err = a.doProfileRequest(httpProfile.Results, data)
 	} else {
-		a.request(address, data)
+		resp, err = a.postEncoded(address, data)
 	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	logQueuedResponse(resp)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return errors.New(fmt.Sprintf("Non-successful HTTP response status code: %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// SetUpstreamIsPeer sets whether the upstream destination is a peer receiver. If the agent was compiled with a P2P key,
+// peer receivers must present the P2P certificate.
+func (a *API) SetUpstreamIsPeer(isPeer bool) {
+	a.pinMutex.Lock()
+	defer a.pinMutex.Unlock()
+	a.upstreamIsPeer = isPeer
+}
+
+// Returns the malleable HTTP profile for the current upstream destination. Peer receivers only understand the default
+// request format, so the profile only applies to the C2 server and the local tunnel endpoint.
+func (a *API) getHttpProfile() *HttpProfile {
+	if a.isUpstreamPeer() {
+		return nil
+	}
+	return a.httpProfile
+}
+
+func (a *API) isUpstreamPeer() bool {
+	a.pinMutex.Lock()
+	defer a.pinMutex.Unlock()
+	return a.upstreamIsPeer
+}
+
+// Wraps the connection verification of the TLS config to require the P2P certificate while the upstream destination
+// is a peer receiver.
+func (a *API) configurePeerAuthentication(config *tls.Config) {
+	verifyConnection := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verifyConnection != nil {
+			if err := verifyConnection(state); err != nil {
+				return err
+			}
+		}
+		if !a.isUpstreamPeer() {
+			return nil
+		}
+		return p2pauth.VerifyReceiverCertificate(state)
+	}
+}
+
+// Returns the protocol of the most recent HTTP response, or the configured transport mode if no response has been received yet.
+func (a *API) GetActiveProtocol() string {
+	if a.protocolRecorder != nil {
+		if protocol := a.protocolRecorder.getProtocol(); len(protocol) > 0 {
+			return protocol
+		}
+	}
+	return a.transportMode
 }
 
 func (a *API) GetName() string {
@@ -134,6 +279,9 @@ func (a *API) GetName() string {
 }
 
 func (a *API) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
+	if httpProfile := a.getHttpProfile(); httpProfile != nil && httpProfile.Upload != nil {
+		return a.profileUpload(httpProfile.Upload, profile, uploadName, data)
+	}
 	uploadUrl := a.upstreamDestAddr + "/file/upload"
 
 	// Set up the form
@@ -162,7 +310,8 @@ func (a *API) UploadFileBytes(profile map[string]interface{}, uploadName string,
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
+	logQueuedResponse(resp)
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
 		return nil
 	} else {
 		return errors.New(fmt.Sprintf("Non-successful HTTP response status code: %d", resp.StatusCode))
@@ -200,28 +349,129 @@ func createUploadRequest(uploadUrl string, requestBody *bytes.Buffer, headers ma
 }
 
 func (a *API) request(address string, data []byte) []byte {
+	resp, err := a.postEncoded(address, data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] %s", err.Error()))
+		return nil
+	}
+	defer resp.Body.Close()
+	logQueuedResponse(resp)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to read HTTP response: %s", err.Error()))
+		return nil
+	}
+	decodedBody, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to decode HTTP response: %s", err.Error()))
+		return nil
+	}
+	return decodedBody
+}
+
+// Posts the base64-encoded data to the address.
+func (a *API) postEncoded(address string, data []byte) (*http.Response, error) {
 	encodedData := []byte(base64.StdEncoding.EncodeToString(data))
 	req, err := http.NewRequest("POST", address, bytes.NewBuffer(encodedData))
 	if err != nil {
-		output.VerbosePrint(fmt.Sprintf("[-] Failed to create HTTP request: %s", err.Error()))
-		return nil
+		return nil, errors.New(fmt.Sprintf("Failed to create HTTP request: %s", err.Error()))
 	}
 	req.Header.Set("User-Agent", a.userAgent)
 	resp, err := a.client.Do(req)
 	if err != nil {
-		output.VerbosePrint(fmt.Sprintf("[-] Failed to perform HTTP request: %s", err.Error()))
-		return nil
+		return nil, errors.New(fmt.Sprintf("Failed to perform HTTP request: %s", err.Error()))
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	return resp, nil
+}
+
+// Sends the data using the given HTTP profile transaction and returns the server's data from the response.
+func (a *API) profileRequest(transaction *HttpTransaction, data []byte) []byte {
+	resp, err := a.doProfileRequest(transaction, data)
 	if err != nil {
-		output.VerbosePrint(fmt.Sprintf("[-] Failed to read HTTP response: %s", err.Error()))
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to perform HTTP request: %s", err.Error()))
 		return nil
 	}
-	decodedBody, err := base64.StdEncoding.DecodeString(string(body))
+	defer resp.Body.Close()
+	logQueuedResponse(resp)
+	decodedBody, err := transaction.extractResponse(resp)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Failed to decode HTTP response: %s", err.Error()))
 		return nil
 	}
 	return decodedBody
 }
+
+func (a *API) doProfileRequest(transaction *HttpTransaction, data []byte) (*http.Response, error) {
+	req, err := transaction.buildRequest(a.upstreamDestAddr, a.userAgent, data)
+	if err != nil {
+		return nil, err
+	}
+	return a.client.Do(req)
+}
+
+// Requests a payload using the HTTP profile. The payload metadata is sent as JSON in place of the
+// individual file, platform, and paw headers.
+func (a *API) profileDownload(transaction *HttpTransaction, profile map[string]interface{}, payload string) ([]byte, string) {
+	metadata, err := json.Marshal(map[string]string{
+		"file": payload,
+		"platform": profile["platform"].(string),
+		"paw": profile["paw"].(string),
+	})
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot request payload. Error with metadata marshal: %s", err.Error()))
+		return nil, ""
+	}
+	resp, err := a.doProfileRequest(transaction, metadata)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error sending payload request: %s", err.Error()))
+		return nil, ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != ok {
+		output.VerbosePrint(fmt.Sprintf("[-] Payload request failed with HTTP status code %d", resp.StatusCode))
+		return nil, ""
+	}
+	payloadBytes, err := transaction.extractResponse(resp)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error reading HTTP response: %s", err.Error()))
+		return nil, ""
+	}
+	var filename string
+	if name_header, ok := resp.Header["Filename"]; ok {
+		filename = filepath.Join(name_header[0])
+	} else {
+		output.VerbosePrint("[-] HTTP response missing Filename header.")
+	}
+	return payloadBytes, filename
+}
+
+// Uploads a file using the HTTP profile. The file contents and upload metadata are sent together as JSON
+// in place of the multipart form.
+func (a *API) profileUpload(transaction *HttpTransaction, profile map[string]interface{}, uploadName string, data []byte) error {
+	uploadData, err := json.Marshal(map[string]interface{}{
+		"file": uploadName,
+		"paw": profile["paw"].(string),
+		"host": profile["host"].(string),
+		"data": data,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := a.doProfileRequest(transaction, uploadData)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	logQueuedResponse(resp)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return errors.New(fmt.Sprintf("Non-successful HTTP response status code: %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// Peer receivers respond with 202 Accepted to requests that they queued until their upstream destination is reachable.
+func logQueuedResponse(resp *http.Response) {
+	if resp.StatusCode == http.StatusAccepted {
+		output.VerbosePrint("[*] Peer receiver queued the request until its upstream is reachable")
+	}
+}
@@ -1,5 +1,11 @@
 package contact
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 const (
 	ok = 200
 	created = 201
@@ -17,6 +23,21 @@ type Contact interface {
 	SupportsContinuous() bool
 }
 
+//ProtocolReporter is implemented by contacts that can report the protocol currently in use
+type ProtocolReporter interface {
+	GetActiveProtocol() string
+}
+
+//ResultsDeliverer is implemented by contacts that can report whether execution results reached the upstream destination
+type ResultsDeliverer interface {
+	DeliverExecutionResults(profile map[string]interface{}, result map[string]interface{}) error
+}
+
+//PeerAuthenticator is implemented by contacts that authenticate the upstream destination when it is a peer receiver
+type PeerAuthenticator interface {
+	SetUpstreamIsPeer(isPeer bool)
+}
+
 //CommunicationChannels contains the contact implementations
 var CommunicationChannels = map[string]Contact{}
 
@@ -26,4 +47,21 @@ func GetAvailableCommChannels() []string {
 		channels = append(channels, k)
 	}
 	return channels
-}
\ No newline at end of file
+}
+
+// Parses a semicolon-separated list of key=value pairs (e.g. "dnsEncoding=base32;dnsDataLabels=3")
+// into contact config entries. Values may contain commas, but not semicolons.
+func ParseContactConfig(configStr string) (map[string]string, error) {
+	config := make(map[string]string)
+	for _, entry := range strings.Split(configStr, ";") {
+		if len(strings.TrimSpace(entry)) == 0 {
+			continue
+		}
+		keyVal := strings.SplitN(entry, "=", 2)
+		if len(keyVal) != 2 || len(strings.TrimSpace(keyVal[0])) == 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid contact config entry %s. Expected key=value", entry))
+		}
+		config[strings.TrimSpace(keyVal[0])] = strings.TrimSpace(keyVal[1])
+	}
+	return config, nil
+}
@@ -26,6 +26,28 @@ func TestSupportsContinuous(t *testing.T) {
 
 }
 
+func TestParseContactConfig(t *testing.T) {
+	config, err := contact.ParseContactConfig(" dnsEncoding=base32; dnsDataLabels = 3;;httpProfile=a=b ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"dnsEncoding": "base32", "dnsDataLabels": "3", "httpProfile": "a=b"}
+	if len(config) != len(want) {
+		t.Errorf("expected %d config entries, got %d", len(want), len(config))
+	}
+	for key, val := range want {
+		if config[key] != val {
+			t.Errorf("expected %s for config key %s, got %s", val, key, config[key])
+		}
+	}
+	if _, err = contact.ParseContactConfig("dnsEncoding"); err == nil {
+		t.Errorf("expected error for config entry without value")
+	}
+	if config, _ = contact.ParseContactConfig(""); len(config) != 0 {
+		t.Errorf("expected empty config for empty string")
+	}
+}
+
 func contains(s []string, str string) bool {
 	for _, v := range s {
 		if v == str {
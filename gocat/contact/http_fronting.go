@@ -0,0 +1,114 @@
+package contact
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mitre/gocat/output"
+)
+
+// Sends requests to one of several front endpoints while presenting a different Host header.
+// Rotates to the next front endpoint when a request fails.
+type frontingRoundTripper struct {
+	next       http.RoundTripper
+	endpoints  []string // host[:port] addresses to connect to. If empty, the request URL host is used.
+	hostHeader string   // Host header to send. If empty, the original request host is used.
+	mutex      sync.Mutex
+	current    int
+}
+
+// Parses a comma-separated list of front endpoints, given as host[:port] or as URLs.
+func parseFrontEndpoints(endpointsStr string) ([]string, error) {
+	var endpoints []string
+	for _, endpoint := range strings.Split(endpointsStr, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if len(endpoint) == 0 {
+			continue
+		}
+		if strings.Contains(endpoint, "://") {
+			endpointUrl, err := url.Parse(endpoint)
+			if err != nil {
+				return nil, err
+			}
+			endpoint = endpointUrl.Host
+		}
+		if len(endpoint) == 0 || strings.ContainsAny(endpoint, "/?#") {
+			return nil, errors.New(fmt.Sprintf("Invalid front endpoint %s", endpoint))
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+func newFrontingRoundTripper(next http.RoundTripper, endpoints []string, hostHeader string) *frontingRoundTripper {
+	return &frontingRoundTripper{
+		next:       next,
+		endpoints:  endpoints,
+		hostHeader: hostHeader,
+	}
+}
+
+func (f *frontingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	hostHeader := f.hostHeader
+	if len(hostHeader) == 0 {
+		hostHeader = req.URL.Host
+	}
+	if len(f.endpoints) == 0 {
+		return f.next.RoundTrip(f.redirect(req, req.URL.Host, hostHeader))
+	}
+	start := f.getCurrent()
+	var lastErr error
+	for attempt := 0; attempt < len(f.endpoints); attempt++ {
+		index := (start + attempt) % len(f.endpoints)
+		if attempt > 0 {
+			// Request bodies can only be read once, so they must be recreated for each retry.
+			if req.Body != nil && req.Body != http.NoBody {
+				if req.GetBody == nil {
+					return nil, lastErr
+				}
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req = req.Clone(req.Context())
+				req.Body = body
+			}
+		}
+		resp, err := f.next.RoundTrip(f.redirect(req, f.endpoints[index], hostHeader))
+		if err == nil {
+			f.setCurrent(index)
+			return resp, nil
+		}
+		output.VerbosePrint(fmt.Sprintf("[-] Request via front endpoint %s failed: %s", f.endpoints[index], err.Error()))
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Returns a copy of the request that connects to the given endpoint and presents the given Host header.
+func (f *frontingRoundTripper) redirect(req *http.Request, endpoint string, hostHeader string) *http.Request {
+	redirected := req.Clone(req.Context())
+	redirected.Body = req.Body
+	redirected.URL.Host = endpoint
+	redirected.Host = hostHeader
+	return redirected
+}
+
+func (f *frontingRoundTripper) getCurrent() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.current
+}
+
+func (f *frontingRoundTripper) setCurrent(index int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.current != index {
+		output.VerbosePrint(fmt.Sprintf("[*] Rotated to front endpoint %s", f.endpoints[index]))
+	}
+	f.current = index
+}
@@ -0,0 +1,168 @@
+package contact_test
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mitre/gocat/contact"
+)
+
+// Records the Host header and TLS server name of each request and echoes the Host header back.
+type frontRecorder struct {
+	mutex       sync.Mutex
+	hosts       []string
+	serverNames []string
+}
+
+func (f *frontRecorder) newServer(useTls bool) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mutex.Lock()
+		f.hosts = append(f.hosts, r.Host)
+		f.mutex.Unlock()
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(r.Host))))
+	}))
+	if useTls {
+		server.TLS = &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				f.mutex.Lock()
+				f.serverNames = append(f.serverNames, hello.ServerName)
+				f.mutex.Unlock()
+				return nil, nil
+			},
+		}
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	return server
+}
+
+func getHost(serverUrl string) string {
+	return serverUrl[strings.Index(serverUrl, "://")+3:]
+}
+
+func TestHttpFrontingRotation(t *testing.T) {
+	recorder := &frontRecorder{}
+	deadFront := recorder.newServer(false)
+	deadFront.Close()
+	liveFront := recorder.newServer(false)
+	defer liveFront.Close()
+
+	api := contact.CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	config := map[string]string{
+		"httpFrontEndpoints": deadFront.URL + ", " + getHost(liveFront.URL),
+		"httpHostHeader":     "c2.example.com",
+	}
+	if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+		t.Fatal("HTTP contact rejected fronting config")
+	}
+	api.SetUpstreamDestAddr("http://unused.invalid")
+	for i := 0; i < 2; i++ {
+		if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "c2.example.com" {
+			t.Errorf("expected Host header c2.example.com, got %s", got)
+		}
+	}
+
+	// After rotating, requests should keep using the live front endpoint.
+	if len(recorder.hosts) != 2 {
+		t.Errorf("expected 2 requests to reach the live front endpoint, got %d", len(recorder.hosts))
+	}
+}
+
+func TestHttpFrontingTlsServerName(t *testing.T) {
+	recorder := &frontRecorder{}
+	front := recorder.newServer(true)
+	defer front.Close()
+
+	api := contact.CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	config := map[string]string{
+		"httpFrontEndpoints": getHost(front.URL),
+		"httpHostHeader":     "c2.example.com",
+		"httpTlsServerName":  "cdn.example.net",
+		"httpTransport":      contact.HTTP_TRANSPORT_HTTP1,
+	}
+	if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+		t.Fatal("HTTP contact rejected fronting config")
+	}
+	api.SetUpstreamDestAddr("https://unused.invalid")
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "c2.example.com" {
+		t.Errorf("expected Host header c2.example.com, got %s", got)
+	}
+	if len(recorder.serverNames) != 1 || recorder.serverNames[0] != "cdn.example.net" {
+		t.Errorf("expected TLS server name cdn.example.net, got %v", recorder.serverNames)
+	}
+}
+
+func TestHttpFrontingWithProxyGateway(t *testing.T) {
+	recorder := &frontRecorder{}
+	front := recorder.newServer(true)
+	defer front.Close()
+
+	// HTTPS requests through the proxy gateway should tunnel to the front endpoint.
+	var connectTargets []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		recorder.mutex.Lock()
+		connectTargets = append(connectTargets, r.Host)
+		recorder.mutex.Unlock()
+		upstream, err := net.Dial("tcp", getHost(front.URL))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	defer proxy.Close()
+
+	api := contact.CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	config := map[string]string{
+		"httpFrontEndpoints": "front.example.net:443",
+		"httpHostHeader":     "c2.example.com",
+		"httpProxyGateway":   proxy.URL,
+	}
+	if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+		t.Fatal("HTTP contact rejected fronting config")
+	}
+	api.SetUpstreamDestAddr("https://unused.invalid")
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "c2.example.com" {
+		t.Errorf("expected Host header c2.example.com, got %s", got)
+	}
+	if len(connectTargets) != 1 || connectTargets[0] != "front.example.net:443" {
+		t.Errorf("expected proxy tunnel to front endpoint, got %v", connectTargets)
+	}
+	if len(recorder.serverNames) != 1 || recorder.serverNames[0] != "front.example.net" {
+		t.Errorf("expected TLS server name of front endpoint, got %v", recorder.serverNames)
+	}
+}
+
+func TestHttpFrontingInvalidEndpoint(t *testing.T) {
+	api := contact.CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	if valid, _ := api.C2RequirementsMet(nil, map[string]string{"httpFrontEndpoints": "front.example.net/path"}); valid {
+		t.Errorf("HTTP contact accepted invalid front endpoint")
+	}
+}
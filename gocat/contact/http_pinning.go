@@ -0,0 +1,68 @@
+package contact
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Upstream addresses may pin the server certificate by appending its SHA-256 fingerprint as a URL fragment,
+// e.g. https://10.0.0.5:51234#sha256=<hex fingerprint>. HTTPS peer receivers advertise their addresses this way.
+var pinnedFingerprintPrefix = "#sha256="
+
+// Splits the pinned certificate fingerprint, if any, from the upstream address.
+func splitPinnedFingerprint(address string) (string, string) {
+	index := strings.Index(address, pinnedFingerprintPrefix)
+	if index < 0 {
+		return address, ""
+	}
+	fingerprint := strings.ToLower(strings.ReplaceAll(address[index+len(pinnedFingerprintPrefix):], ":", ""))
+	return address[:index], fingerprint
+}
+
+// Returns the address with the certificate fingerprint appended to it, or the address as is if there is no fingerprint.
+func GetPinnedAddress(address string, fingerprint string) string {
+	if len(fingerprint) == 0 {
+		return address
+	}
+	return address + pinnedFingerprintPrefix + fingerprint
+}
+
+// Returns the hex-encoded SHA-256 fingerprint of the DER-encoded certificate.
+func GetCertificateFingerprint(certificate []byte) string {
+	fingerprint := sha256.Sum256(certificate)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// Wraps the connection verification of the TLS config to also check the certificate pinned by the current
+// upstream address.
+func (a *API) configurePinning(config *tls.Config) {
+	verifyConnection := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verifyConnection != nil {
+			if err := verifyConnection(state); err != nil {
+				return err
+			}
+		}
+		return a.verifyPinnedCertificate(state)
+	}
+}
+
+func (a *API) verifyPinnedCertificate(state tls.ConnectionState) error {
+	a.pinMutex.Lock()
+	fingerprint := a.pinnedFingerprint
+	a.pinMutex.Unlock()
+	if len(fingerprint) == 0 {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("Server did not present a certificate to verify against the pinned fingerprint")
+	}
+	if serverFingerprint := GetCertificateFingerprint(state.PeerCertificates[0].Raw); serverFingerprint != fingerprint {
+		return errors.New(fmt.Sprintf("Server certificate fingerprint %s does not match pinned fingerprint %s", serverFingerprint, fingerprint))
+	}
+	return nil
+}
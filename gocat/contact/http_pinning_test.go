@@ -0,0 +1,109 @@
+package contact_test
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/p2pauth"
+)
+
+func newBeaconServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("pinned"))))
+	}))
+}
+
+func TestPinnedCertificate(t *testing.T) {
+	api := contact.CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	defer api.SetUpstreamDestAddr("")
+	if valid, _ := api.C2RequirementsMet(nil, map[string]string{}); !valid {
+		t.Fatalf("HTTP contact rejected default config")
+	}
+
+	server := newBeaconServer()
+	defer server.Close()
+	fingerprint := contact.GetCertificateFingerprint(server.Certificate().Raw)
+	api.SetUpstreamDestAddr(contact.GetPinnedAddress(server.URL, strings.ToUpper(fingerprint)))
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "pinned" {
+		t.Errorf("expected beacon to succeed with matching pinned certificate, got %q", got)
+	}
+
+	mismatchServer := newBeaconServer()
+	defer mismatchServer.Close()
+	api.SetUpstreamDestAddr(contact.GetPinnedAddress(mismatchServer.URL, strings.Repeat("00", 32)))
+	if got := api.GetBeaconBytes(map[string]interface{}{}); got != nil {
+		t.Errorf("expected beacon to fail with mismatched pinned certificate, got %q", got)
+	}
+}
+
+func TestPinnedAddress(t *testing.T) {
+	if got := contact.GetPinnedAddress("https://10.0.0.5:51234", ""); got != "https://10.0.0.5:51234" {
+		t.Errorf("expected address without fingerprint to be unchanged, got %s", got)
+	}
+	if got := contact.GetPinnedAddress("https://10.0.0.5:51234", "abcd"); got != "https://10.0.0.5:51234#sha256=abcd" {
+		t.Errorf("unexpected pinned address %s", got)
+	}
+}
+
+func TestPeerReceiverRequiresP2pCertificate(t *testing.T) {
+	p2pauth.SetKey("shared-secret")
+	api := contact.CommunicationChannels["HTTP"]
+	authenticator := api.(contact.PeerAuthenticator)
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	defer p2pauth.SetKey("")
+	defer api.SetUpstreamDestAddr("")
+	defer authenticator.SetUpstreamIsPeer(false)
+
+	// Receivers with an unrelated certificate are refused, even though the certificate is not verified otherwise.
+	rogueServer := newBeaconServer()
+	defer rogueServer.Close()
+	authenticator.SetUpstreamIsPeer(true)
+	api.SetUpstreamDestAddr(rogueServer.URL)
+	if valid, _ := api.C2RequirementsMet(nil, map[string]string{}); !valid {
+		t.Fatalf("HTTP contact rejected default config")
+	}
+	if got := api.GetBeaconBytes(map[string]interface{}{}); got != nil {
+		t.Errorf("expected beacon to a receiver without the P2P certificate to fail, got %q", got)
+	}
+
+	// Receivers with the P2P certificate are accepted.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err = p2pauth.WrapListener(listener, "AUTH_HTTP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("peer"))))
+	})}
+	go receiver.Serve(listener)
+	defer receiver.Close()
+	api.SetUpstreamDestAddr("https://" + listener.Addr().String())
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "peer" {
+		t.Errorf("expected beacon to an authenticated receiver to succeed, got %q", got)
+	}
+
+	// Peer receivers cannot be reached over plain HTTP.
+	api.SetUpstreamDestAddr("http://" + listener.Addr().String())
+	if valid, _ := api.C2RequirementsMet(nil, map[string]string{}); valid {
+		t.Errorf("expected plain HTTP peer receiver to be refused")
+	}
+
+	// The C2 server does not need the P2P certificate.
+	authenticator.SetUpstreamIsPeer(false)
+	api.SetUpstreamDestAddr(rogueServer.URL)
+	if valid, _ := api.C2RequirementsMet(nil, map[string]string{}); !valid {
+		t.Fatalf("HTTP contact rejected default config")
+	}
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "pinned" {
+		t.Errorf("expected beacon to the C2 server to succeed, got %q", got)
+	}
+}
@@ -0,0 +1,277 @@
+package contact
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PAYLOAD_LOCATION_BODY   = "body"
+	PAYLOAD_LOCATION_HEADER = "header"
+	PAYLOAD_LOCATION_COOKIE = "cookie"
+	PAYLOAD_LOCATION_URI    = "uri"
+	PAYLOAD_LOCATION_QUERY  = "query"
+
+	PAYLOAD_ENCODING_BASE64    = "base64"
+	PAYLOAD_ENCODING_BASE64URL = "base64url" // URL-safe base64 without padding
+	PAYLOAD_ENCODING_NONE      = "none"
+)
+
+// Malleable HTTP profile that controls how the HTTP contact shapes its requests. Each transaction
+// that is omitted from the profile uses the default request format. Execution results use the
+// beacon transaction if no results transaction is provided.
+type HttpProfile struct {
+	Beacon   *HttpTransaction `json:"beacon"`
+	Results  *HttpTransaction `json:"results"`
+	Download *HttpTransaction `json:"download"`
+	Upload   *HttpTransaction `json:"upload"`
+}
+
+// Describes a single type of request and where to find the server's data in the response.
+type HttpTransaction struct {
+	Uris        []string          `json:"uris"` // a URI is picked at random for each request
+	Verb        string            `json:"verb"`
+	Headers     map[string]string `json:"headers"`
+	Cookies     map[string]string `json:"cookies"`
+	QueryParams map[string]string `json:"query_params"`
+	Client      HttpPayloadSpec   `json:"client"` // placement of the agent's data in the request
+	Server      HttpPayloadSpec   `json:"server"` // placement of the server's data in the response
+}
+
+// Describes where a payload is placed and how it is encoded and padded.
+type HttpPayloadSpec struct {
+	Location string `json:"location"` // body, header, cookie, uri, or query. Responses only support body, header, and cookie.
+	Name     string `json:"name"`     // header, cookie, or query parameter name
+	Encoding string `json:"encoding"` // base64, base64url, or none
+	Prepend  string `json:"prepend"`
+	Append   string `json:"append"`
+}
+
+// Loads an HTTP profile from a file path, a base64-encoded blob, or a raw JSON/YAML blob.
+func LoadHttpProfile(profileStr string) (*HttpProfile, error) {
+	profileStr = strings.TrimSpace(profileStr)
+	if len(profileStr) == 0 {
+		return nil, errors.New("Empty HTTP profile")
+	}
+	profileData := []byte(profileStr)
+	if _, err := os.Stat(profileStr); err == nil {
+		if profileData, err = os.ReadFile(profileStr); err != nil {
+			return nil, err
+		}
+	} else if decoded, err := base64.StdEncoding.DecodeString(profileStr); err == nil {
+		profileData = decoded
+	}
+	return ParseHttpProfile(profileData)
+}
+
+// Parses an HTTP profile from JSON or YAML, filling in defaults and validating each transaction.
+func ParseHttpProfile(profileData []byte) (*HttpProfile, error) {
+	if !json.Valid(profileData) {
+		// Convert YAML to JSON so that the same field names apply to both formats.
+		var yamlProfile interface{}
+		if err := yaml.Unmarshal(profileData, &yamlProfile); err != nil {
+			return nil, errors.New(fmt.Sprintf("HTTP profile is neither valid JSON nor YAML: %s", err.Error()))
+		}
+		converted, err := json.Marshal(yamlProfile)
+		if err != nil {
+			return nil, err
+		}
+		profileData = converted
+	}
+	profile := &HttpProfile{}
+	if err := json.Unmarshal(profileData, profile); err != nil {
+		return nil, err
+	}
+	transactions := map[string]*HttpTransaction{
+		"beacon":   profile.Beacon,
+		"results":  profile.Results,
+		"download": profile.Download,
+		"upload":   profile.Upload,
+	}
+	for transactionName, transaction := range transactions {
+		if transaction == nil {
+			continue
+		}
+		defaultResponseEncoding := PAYLOAD_ENCODING_BASE64
+		if transactionName == "download" {
+			defaultResponseEncoding = PAYLOAD_ENCODING_NONE
+		}
+		if err := transaction.validate(defaultResponseEncoding); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid %s transaction in HTTP profile: %s", transactionName, err.Error()))
+		}
+	}
+	if profile.Results == nil {
+		profile.Results = profile.Beacon
+	}
+	return profile, nil
+}
+
+func (t *HttpTransaction) validate(defaultResponseEncoding string) error {
+	if len(t.Uris) == 0 {
+		return errors.New("At least one URI is required")
+	}
+	for _, uri := range t.Uris {
+		if !strings.HasPrefix(uri, "/") {
+			return errors.New(fmt.Sprintf("URI %s must start with /", uri))
+		}
+	}
+	if len(t.Verb) == 0 {
+		t.Verb = http.MethodPost
+	}
+	t.Verb = strings.ToUpper(t.Verb)
+	if len(t.Client.Location) == 0 {
+		t.Client.Location = PAYLOAD_LOCATION_BODY
+	}
+	if t.Client.Location == PAYLOAD_LOCATION_BODY && (t.Verb == http.MethodGet || t.Verb == http.MethodHead) {
+		return errors.New(fmt.Sprintf("%s requests cannot carry the payload in the body", t.Verb))
+	}
+	if err := t.Client.validate(PAYLOAD_ENCODING_BASE64, true); err != nil {
+		return err
+	}
+	if len(t.Server.Location) == 0 {
+		t.Server.Location = PAYLOAD_LOCATION_BODY
+	}
+	return t.Server.validate(defaultResponseEncoding, false)
+}
+
+func (s *HttpPayloadSpec) validate(defaultBodyEncoding string, isRequest bool) error {
+	s.Location = strings.ToLower(s.Location)
+	switch s.Location {
+	case PAYLOAD_LOCATION_BODY:
+	case PAYLOAD_LOCATION_HEADER, PAYLOAD_LOCATION_COOKIE:
+		if len(s.Name) == 0 {
+			return errors.New(fmt.Sprintf("Payload location %s requires a name", s.Location))
+		}
+	case PAYLOAD_LOCATION_URI, PAYLOAD_LOCATION_QUERY:
+		if !isRequest {
+			return errors.New(fmt.Sprintf("Payload location %s is only supported for requests", s.Location))
+		}
+		if s.Location == PAYLOAD_LOCATION_QUERY && len(s.Name) == 0 {
+			return errors.New(fmt.Sprintf("Payload location %s requires a name", s.Location))
+		}
+	default:
+		return errors.New(fmt.Sprintf("Unsupported payload location %s", s.Location))
+	}
+
+	// Payloads outside of the body must be safe to use in URIs, headers, and cookies.
+	if len(s.Encoding) == 0 {
+		if s.Location == PAYLOAD_LOCATION_BODY {
+			s.Encoding = defaultBodyEncoding
+		} else {
+			s.Encoding = PAYLOAD_ENCODING_BASE64URL
+		}
+	}
+	s.Encoding = strings.ToLower(s.Encoding)
+	switch s.Encoding {
+	case PAYLOAD_ENCODING_BASE64, PAYLOAD_ENCODING_BASE64URL:
+		return nil
+	case PAYLOAD_ENCODING_NONE:
+		// Headers and cookies are not escaped, and cookie values lose quotes, semicolons and backslashes.
+		if s.Location == PAYLOAD_LOCATION_HEADER || s.Location == PAYLOAD_LOCATION_COOKIE {
+			return errors.New(fmt.Sprintf("Payload location %s requires an encoding", s.Location))
+		}
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("Unsupported payload encoding %s", s.Encoding))
+	}
+}
+
+func (s *HttpPayloadSpec) encode(data []byte) string {
+	var encoded string
+	switch s.Encoding {
+	case PAYLOAD_ENCODING_BASE64:
+		encoded = base64.StdEncoding.EncodeToString(data)
+	case PAYLOAD_ENCODING_BASE64URL:
+		encoded = base64.RawURLEncoding.EncodeToString(data)
+	default:
+		encoded = string(data)
+	}
+	return s.Prepend + encoded + s.Append
+}
+
+func (s *HttpPayloadSpec) decode(payload string) ([]byte, error) {
+	payload = strings.TrimSuffix(strings.TrimPrefix(payload, s.Prepend), s.Append)
+	switch s.Encoding {
+	case PAYLOAD_ENCODING_BASE64:
+		return base64.StdEncoding.DecodeString(payload)
+	case PAYLOAD_ENCODING_BASE64URL:
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(payload, "="))
+	default:
+		return []byte(payload), nil
+	}
+}
+
+// Builds the request for this transaction against the given server address, placing the data as specified by the profile.
+func (t *HttpTransaction) buildRequest(serverAddr string, userAgent string, data []byte) (*http.Request, error) {
+	requestUrl, err := url.Parse(serverAddr + t.Uris[rand.Intn(len(t.Uris))])
+	if err != nil {
+		return nil, err
+	}
+	query := requestUrl.Query()
+	for param, val := range t.QueryParams {
+		query.Set(param, val)
+	}
+	payload := t.Client.encode(data)
+	var body io.Reader
+	switch t.Client.Location {
+	case PAYLOAD_LOCATION_BODY:
+		body = bytes.NewBufferString(payload)
+	case PAYLOAD_LOCATION_URI:
+		requestUrl = requestUrl.JoinPath(payload)
+	case PAYLOAD_LOCATION_QUERY:
+		query.Set(t.Client.Name, payload)
+	}
+	requestUrl.RawQuery = query.Encode()
+	req, err := http.NewRequest(t.Verb, requestUrl.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for header, val := range t.Headers {
+		req.Header.Set(header, val)
+	}
+	for cookie, val := range t.Cookies {
+		req.AddCookie(&http.Cookie{Name: cookie, Value: val})
+	}
+	switch t.Client.Location {
+	case PAYLOAD_LOCATION_HEADER:
+		req.Header.Set(t.Client.Name, payload)
+	case PAYLOAD_LOCATION_COOKIE:
+		req.AddCookie(&http.Cookie{Name: t.Client.Name, Value: payload})
+	}
+	return req, nil
+}
+
+// Extracts the server's data from the response as specified by the profile.
+func (t *HttpTransaction) extractResponse(resp *http.Response) ([]byte, error) {
+	var payload string
+	switch t.Server.Location {
+	case PAYLOAD_LOCATION_BODY:
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		payload = string(body)
+	case PAYLOAD_LOCATION_HEADER:
+		payload = resp.Header.Get(t.Server.Name)
+	case PAYLOAD_LOCATION_COOKIE:
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == t.Server.Name {
+				payload = cookie.Value
+				break
+			}
+		}
+	}
+	return t.Server.decode(payload)
+}
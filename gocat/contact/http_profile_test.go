@@ -0,0 +1,225 @@
+package contact_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitre/gocat/contact"
+)
+
+const testYamlProfile = `
+beacon:
+  uris: [/api/v2/status, /api/v2/health]
+  verb: GET
+  headers:
+    Accept: application/json
+  cookies:
+    theme: dark
+  query_params:
+    v: "2"
+  client:
+    location: header
+    name: X-Session
+    prepend: "sess="
+  server:
+    location: body
+    prepend: "<html><!--"
+    append: "--></html>"
+results:
+  uris: [/api/v2/metrics]
+  client:
+    location: cookie
+    name: metrics
+download:
+  uris: [/assets]
+  verb: PUT
+  client:
+    location: uri
+upload:
+  uris: [/upload]
+  client:
+    location: query
+    name: d
+`
+
+func TestParseHttpProfile(t *testing.T) {
+	httpProfile, err := contact.ParseHttpProfile([]byte(testYamlProfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpProfile.Beacon.Verb != http.MethodGet || httpProfile.Results.Verb != http.MethodPost {
+		t.Errorf("unexpected verbs %s and %s", httpProfile.Beacon.Verb, httpProfile.Results.Verb)
+	}
+	if httpProfile.Beacon.Client.Encoding != contact.PAYLOAD_ENCODING_BASE64URL {
+		t.Errorf("expected URL-safe encoding for header payload, got %s", httpProfile.Beacon.Client.Encoding)
+	}
+	if httpProfile.Download.Server.Encoding != contact.PAYLOAD_ENCODING_NONE {
+		t.Errorf("expected raw payload downloads, got %s", httpProfile.Download.Server.Encoding)
+	}
+
+	// Equivalent JSON profile should parse the same way.
+	jsonProfile, err := json.Marshal(httpProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reparsed, err := contact.ParseHttpProfile(jsonProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reparsed.Beacon.Client.Name != "X-Session" || len(reparsed.Beacon.Uris) != 2 {
+		t.Errorf("JSON profile did not match YAML profile")
+	}
+
+	// Results should default to the beacon transaction.
+	beaconOnly, err := contact.ParseHttpProfile([]byte(`{"beacon": {"uris": ["/b"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beaconOnly.Results != beaconOnly.Beacon || beaconOnly.Download != nil || beaconOnly.Upload != nil {
+		t.Errorf("unexpected defaults for transactions missing from profile")
+	}
+}
+
+func TestParseInvalidHttpProfile(t *testing.T) {
+	invalidProfiles := []string{
+		`{"beacon": {"uris": []}}`,
+		`{"beacon": {"uris": ["beacon"]}}`,
+		`{"beacon": {"uris": ["/b"], "verb": "GET"}}`,
+		`{"beacon": {"uris": ["/b"], "client": {"location": "header"}}}`,
+		`{"beacon": {"uris": ["/b"], "client": {"location": "fragment"}}}`,
+		`{"beacon": {"uris": ["/b"], "client": {"encoding": "rot13"}}}`,
+		`{"beacon": {"uris": ["/b"], "server": {"location": "uri"}}}`,
+		`{"beacon": {"uris": ["/b"], "client": {"location": "header", "name": "X-Data", "encoding": "none"}}}`,
+		`{"beacon": {"uris": ["/b"], "client": {"location": "cookie", "name": "data", "encoding": "none"}}}`,
+		`{"download": {"uris": ["/d"], "server": {"location": "header", "name": "X-Data", "encoding": "none"}}}`,
+		"beacon: [",
+	}
+	for _, invalidProfile := range invalidProfiles {
+		if _, err := contact.ParseHttpProfile([]byte(invalidProfile)); err == nil {
+			t.Errorf("expected error for profile %s", invalidProfile)
+		}
+	}
+}
+
+func TestLoadHttpProfile(t *testing.T) {
+	profilePath := filepath.Join(t.TempDir(), "profile.yml")
+	if err := os.WriteFile(profilePath, []byte(testYamlProfile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, profileStr := range []string{profilePath, base64.StdEncoding.EncodeToString([]byte(testYamlProfile)), testYamlProfile} {
+		httpProfile, err := contact.LoadHttpProfile(profileStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if httpProfile.Beacon.Client.Name != "X-Session" {
+			t.Errorf("unexpected beacon client name %s", httpProfile.Beacon.Client.Name)
+		}
+	}
+}
+
+// Server that only understands the test profile.
+func newTestProfileServer(t *testing.T, received map[string][]byte) *httptest.Server {
+	decode := func(payload string) []byte {
+		decoded, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil {
+			t.Errorf("failed to decode payload %s: %s", payload, err.Error())
+		}
+		return decoded
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && (r.URL.Path == "/api/v2/status" || r.URL.Path == "/api/v2/health"):
+			if r.URL.Query().Get("v") != "2" || r.Header.Get("Accept") != "application/json" || r.Header.Get("User-Agent") != "test-agent" {
+				t.Errorf("beacon missing profile query params or headers")
+			}
+			if cookie, err := r.Cookie("theme"); err != nil || cookie.Value != "dark" {
+				t.Errorf("beacon missing profile cookie")
+			}
+			received["beacon"] = decode(strings.TrimPrefix(r.Header.Get("X-Session"), "sess="))
+			w.Write([]byte("<html><!--" + base64.StdEncoding.EncodeToString([]byte(`{"paw": "abc"}`)) + "--></html>"))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v2/metrics":
+			cookie, err := r.Cookie("metrics")
+			if err != nil {
+				t.Errorf("results missing metrics cookie")
+				return
+			}
+			received["results"] = decode(cookie.Value)
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/assets/"):
+			received["download"] = decode(strings.TrimPrefix(r.URL.Path, "/assets/"))
+			w.Header().Set("Filename", "payload.bin")
+			w.Write([]byte("payload contents"))
+		case r.Method == http.MethodPost && r.URL.Path == "/upload":
+			body, _ := io.ReadAll(r.Body)
+			if len(body) > 0 {
+				t.Errorf("upload should not have a body")
+			}
+			received["upload"] = decode(r.URL.Query().Get("d"))
+		default:
+			t.Errorf("unexpected %s request to %s", r.Method, r.URL.String())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestHttpContactWithProfile(t *testing.T) {
+	received := make(map[string][]byte)
+	server := newTestProfileServer(t, received)
+	defer server.Close()
+	api := contact.CommunicationChannels["HTTP"]
+	config := map[string]string{
+		"httpUserAgent": "test-agent",
+		"httpProfile":   base64.StdEncoding.EncodeToString([]byte(testYamlProfile)),
+	}
+	if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+		t.Fatal("HTTP contact rejected valid profile")
+	}
+	api.SetUpstreamDestAddr(server.URL)
+	defer api.C2RequirementsMet(nil, map[string]string{})
+
+	profile := map[string]interface{}{"paw": "abc", "host": "testhost", "platform": "linux"}
+	if response := api.GetBeaconBytes(profile); string(response) != `{"paw": "abc"}` {
+		t.Errorf("unexpected beacon response %s", string(response))
+	}
+	var beacon map[string]interface{}
+	if err := json.Unmarshal(received["beacon"], &beacon); err != nil || beacon["paw"] != "abc" {
+		t.Errorf("server received unexpected beacon %s", string(received["beacon"]))
+	}
+
+	api.SendExecutionResults(profile, map[string]interface{}{"id": "link1"})
+	if !strings.Contains(string(received["results"]), `"link1"`) {
+		t.Errorf("server received unexpected results %s", string(received["results"]))
+	}
+
+	payload, filename := api.GetPayloadBytes(profile, "payload.bin")
+	if string(payload) != "payload contents" || filename != "payload.bin" {
+		t.Errorf("unexpected payload %s with name %s", string(payload), filename)
+	}
+	if !strings.Contains(string(received["download"]), `"file":"payload.bin"`) {
+		t.Errorf("server received unexpected payload request %s", string(received["download"]))
+	}
+
+	if err := api.UploadFileBytes(profile, "loot.txt", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	var upload map[string]interface{}
+	if err := json.Unmarshal(received["upload"], &upload); err != nil {
+		t.Fatal(err)
+	}
+	if upload["file"] != "loot.txt" || upload["data"] != base64.StdEncoding.EncodeToString([]byte("secret")) {
+		t.Errorf("server received unexpected upload %v", upload)
+	}
+}
+
+func TestHttpContactRejectsInvalidProfile(t *testing.T) {
+	api := contact.CommunicationChannels["HTTP"]
+	if valid, _ := api.C2RequirementsMet(nil, map[string]string{"httpProfile": `{"beacon": {"uris": []}}`}); valid {
+		t.Errorf("HTTP contact accepted invalid profile")
+	}
+}
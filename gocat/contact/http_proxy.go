@@ -0,0 +1,475 @@
+package contact
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitre/gocat/output"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	PROXY_GATEWAY_ENV  = "env" // discover the proxy from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	PROXY_AUTH_AUTO    = "auto"
+	PROXY_AUTH_BASIC   = "basic"
+	PROXY_AUTH_DIGEST  = "digest"
+	PROXY_AUTH_NTLM    = "ntlm"
+	maxProxyAuthRounds = 4
+)
+
+// Evaluates a proxy auto-config (PAC) script.
+type PacEvaluator interface {
+	// Returns the result of the FindProxyForURL function of the script, e.g. "PROXY proxy:8080; DIRECT".
+	FindProxyForURL(targetUrl string, host string) (string, error)
+}
+
+// Creates a PacEvaluator from the given script. PAC scripts are JavaScript, so evaluation is provided by an
+// extension that registers this function. Nil if no such extension is compiled in.
+var NewPacEvaluator func(script string) (PacEvaluator, error)
+
+// Selects the proxies to try, in order, to reach the given target. A nil entry means a direct connection.
+type proxySelector func(target *url.URL) ([]*url.URL, error)
+
+// Credentials for authenticating to proxies.
+type proxyCredentials struct {
+	username string
+	password string
+	domain   string // NTLM domain. Also taken from usernames of the form DOMAIN\user.
+}
+
+// Dials connections through proxies, tunneling each connection with CONNECT so that any
+// authentication handshake happens on the connection being tunneled.
+type proxyDialer struct {
+	selector    proxySelector
+	authScheme  string
+	credentials proxyCredentials
+	dialer      *net.Dialer
+}
+
+// Forwards plain HTTP requests through the selected proxies, so that proxies which only allow CONNECT to
+// SSL ports can still be used, and authenticates the requests to the proxy. Other requests are passed on,
+// and their connections tunneled by the proxy dialer of the transport.
+type proxyRoundTripper struct {
+	next   http.RoundTripper
+	dialer *proxyDialer
+}
+
+// Context key for the proxy that the transport forwards a plain HTTP request through. A nil proxy URL
+// means a direct connection.
+type forwardProxyKey struct{}
+
+// Context key for the scheme of the request that the proxy dialer tunnels a connection for, so that proxies are
+// selected for the scheme of the request rather than the port.
+type tunnelSchemeKey struct{}
+
+// Sets up the proxy settings of the transport from the contact configuration. Without any proxy
+// settings, the transport falls back to Go's defaults. Otherwise, returns the proxy dialer, whose
+// proxyRoundTripper must wrap the transport for plain HTTP requests to be forwarded rather than tunneled.
+func configureProxy(transport *http.Transport, c2Config map[string]string) (*proxyDialer, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	proxyDialer, err := newProxyDialer(c2Config, dialer)
+	if err != nil {
+		return nil, err
+	}
+	if proxyDialer == nil {
+		transport.Proxy = http.ProxyFromEnvironment
+		transport.DialContext = dialer.DialContext
+		return nil, nil
+	}
+	transport.Proxy = getForwardProxy
+	transport.DialContext = proxyDialer.DialContext
+	return proxyDialer, nil
+}
+
+// Returns the proxy that the transport forwards the request through, as selected by the proxyRoundTripper.
+func getForwardProxy(req *http.Request) (*url.URL, error) {
+	proxyUrl, _ := req.Context().Value(forwardProxyKey{}).(*url.URL)
+	return proxyUrl, nil
+}
+
+// Returns a proxyDialer for the given contact configuration, or nil if no proxy settings are provided.
+func newProxyDialer(c2Config map[string]string, dialer *net.Dialer) (*proxyDialer, error) {
+	gateway := strings.TrimSpace(c2Config["httpProxyGateway"])
+	pacLocation := strings.TrimSpace(c2Config["httpProxyPac"])
+	if len(gateway) == 0 && len(pacLocation) == 0 {
+		return nil, nil
+	}
+	authScheme := strings.ToLower(c2Config["httpProxyAuth"])
+	switch authScheme {
+	case "":
+		authScheme = PROXY_AUTH_AUTO
+	case PROXY_AUTH_AUTO, PROXY_AUTH_BASIC, PROXY_AUTH_DIGEST, PROXY_AUTH_NTLM:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported proxy authentication scheme %s", authScheme))
+	}
+	proxyDialer := &proxyDialer{
+		authScheme: authScheme,
+		credentials: proxyCredentials{
+			username: c2Config["httpProxyUser"],
+			password: c2Config["httpProxyPassword"],
+			domain:   c2Config["httpProxyDomain"],
+		},
+		dialer: dialer,
+	}
+	var err error
+	switch {
+	case len(pacLocation) > 0:
+		proxyDialer.selector, err = newPacSelector(pacLocation, dialer)
+		output.VerbosePrint(fmt.Sprintf("[*] Selecting HTTP proxies using PAC file %s", pacLocation))
+	case strings.ToLower(gateway) == PROXY_GATEWAY_ENV:
+		proxyDialer.selector = newEnvironmentSelector()
+		output.VerbosePrint("[*] Selecting HTTP proxies using environment variables")
+	default:
+		proxyDialer.selector, err = newStaticSelector(gateway)
+		output.VerbosePrint(fmt.Sprintf("[*] Using HTTP proxy gateway %s", gateway))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return proxyDialer, nil
+}
+
+// Always selects the given proxy URL.
+func newStaticSelector(gateway string) (proxySelector, error) {
+	proxyUrl, err := parseProxyUrl(gateway)
+	if err != nil {
+		return nil, err
+	}
+	return func(target *url.URL) ([]*url.URL, error) {
+		return []*url.URL{proxyUrl}, nil
+	}, nil
+}
+
+// Selects proxies from the environment variables at the time of each connection.
+func newEnvironmentSelector() proxySelector {
+	return func(target *url.URL) ([]*url.URL, error) {
+		proxyUrl, err := httpproxy.FromEnvironment().ProxyFunc()(target)
+		if err != nil {
+			return nil, err
+		}
+		return []*url.URL{proxyUrl}, nil
+	}
+}
+
+// Selects proxies by evaluating the PAC file at the given URL or file path.
+func newPacSelector(pacLocation string, dialer *net.Dialer) (proxySelector, error) {
+	if NewPacEvaluator == nil {
+		return nil, errors.New("PAC files are not supported without the pac extension")
+	}
+	script, err := loadPacScript(pacLocation, dialer)
+	if err != nil {
+		return nil, err
+	}
+	evaluator, err := NewPacEvaluator(script)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not load PAC file %s: %s", pacLocation, err.Error()))
+	}
+	return func(target *url.URL) ([]*url.URL, error) {
+		result, err := evaluator.FindProxyForURL(target.String(), target.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		return parsePacResult(result)
+	}, nil
+}
+
+// Fetches the PAC script directly, since the proxy to use is not known yet.
+func loadPacScript(pacLocation string, dialer *net.Dialer) (string, error) {
+	if !strings.HasPrefix(pacLocation, "http://") && !strings.HasPrefix(pacLocation, "https://") {
+		script, err := os.ReadFile(strings.TrimPrefix(pacLocation, "file://"))
+		return string(script), err
+	}
+	transport := &http.Transport{
+		DialContext:     dialer.DialContext,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client := &http.Client{Transport: transport, Timeout: 30 * time.Second}
+	resp, err := client.Get(pacLocation)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Could not fetch PAC file %s: %s", pacLocation, resp.Status))
+	}
+	script, err := io.ReadAll(resp.Body)
+	return string(script), err
+}
+
+// Parses PAC results such as "PROXY proxy:8080; HTTPS proxy:8443; DIRECT". SOCKS entries are skipped.
+func parsePacResult(result string) ([]*url.URL, error) {
+	var proxyUrls []*url.URL
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			proxyUrls = append(proxyUrls, nil)
+		case "PROXY", "HTTP", "HTTPS":
+			if len(fields) != 2 {
+				return nil, errors.New(fmt.Sprintf("Invalid PAC result entry %s", entry))
+			}
+			scheme := "http"
+			if strings.ToUpper(fields[0]) == "HTTPS" {
+				scheme = "https"
+			}
+			proxyUrl, err := parseProxyUrl(fmt.Sprintf("%s://%s", scheme, fields[1]))
+			if err != nil {
+				return nil, err
+			}
+			proxyUrls = append(proxyUrls, proxyUrl)
+		default:
+			output.VerbosePrint(fmt.Sprintf("[-] Skipping unsupported PAC result entry %s", entry))
+		}
+	}
+	if len(proxyUrls) == 0 {
+		return nil, errors.New(fmt.Sprintf("No supported entries in PAC result %s", result))
+	}
+	return proxyUrls, nil
+}
+
+func parseProxyUrl(proxyUrlStr string) (*url.URL, error) {
+	if !strings.Contains(proxyUrlStr, "://") {
+		proxyUrlStr = "http://" + proxyUrlStr
+	}
+	proxyUrl, err := url.Parse(proxyUrlStr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyUrl.Scheme != "http" && proxyUrl.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("Unsupported proxy scheme %s", proxyUrl.Scheme))
+	}
+	if len(proxyUrl.Hostname()) == 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid proxy URL %s", proxyUrlStr))
+	}
+	return proxyUrl, nil
+}
+
+// Connects to the given address through the first selected proxy that accepts the connection. Connections
+// for forwarded requests go directly to the address, which is either the selected proxy or the target.
+func (p *proxyDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if _, ok := ctx.Value(forwardProxyKey{}).(*url.URL); ok {
+		return p.dialer.DialContext(ctx, network, addr)
+	}
+	target := &url.URL{Scheme: "http", Host: addr}
+	if scheme, ok := ctx.Value(tunnelSchemeKey{}).(string); ok {
+		target.Scheme = scheme
+	} else if _, port, err := net.SplitHostPort(addr); err == nil && port == "443" {
+		target.Scheme = "https"
+	}
+	proxyUrls, err := p.selector(target)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, proxyUrl := range proxyUrls {
+		var conn net.Conn
+		if proxyUrl == nil {
+			conn, err = p.dialer.DialContext(ctx, network, addr)
+		} else {
+			conn, err = p.connect(ctx, proxyUrl, addr)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		output.VerbosePrint(fmt.Sprintf("[-] Could not connect to %s via proxy %v: %s", addr, proxyUrl, err.Error()))
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Opens a tunnel to the address through the proxy, authenticating as required. The connection
+// to the proxy is reopened if the proxy closes it after an authentication challenge.
+func (p *proxyDialer) connect(ctx context.Context, proxyUrl *url.URL, addr string) (net.Conn, error) {
+	auth := newProxyAuthenticator(p.authScheme, p.getCredentials(proxyUrl))
+	var conn net.Conn
+	var reader *bufio.Reader
+	for round := 0; round < maxProxyAuthRounds; round++ {
+		if conn == nil {
+			var err error
+			if conn, err = p.dialProxy(ctx, proxyUrl); err != nil {
+				return nil, err
+			}
+			reader = bufio.NewReader(conn)
+		}
+		authorization, err := auth.authorization(http.MethodConnect, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if len(authorization) > 0 {
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+		if err = req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			if reader.Buffered() > 0 {
+				return &bufferedConn{Conn: conn, reader: reader}, nil
+			}
+			return conn, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			conn.Close()
+			return nil, errors.New(fmt.Sprintf("Proxy %s refused CONNECT to %s: %s", proxyUrl.Host, addr, resp.Status))
+		}
+		if err = auth.challenge(resp.Header.Values("Proxy-Authenticate")); err != nil {
+			conn.Close()
+			return nil, errors.New(fmt.Sprintf("Could not authenticate to proxy %s: %s", proxyUrl.Host, err.Error()))
+		}
+		if resp.Close {
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	return nil, errors.New(fmt.Sprintf("Could not authenticate to proxy %s: too many challenges", proxyUrl.Host))
+}
+
+// Returns the configured credentials, or the credentials in the proxy URL if none are configured.
+func (p *proxyDialer) getCredentials(proxyUrl *url.URL) proxyCredentials {
+	credentials := p.credentials
+	if proxyUrl.User != nil && len(credentials.username) == 0 {
+		credentials.username = proxyUrl.User.Username()
+		credentials.password, _ = proxyUrl.User.Password()
+	}
+	return credentials
+}
+
+func (p *proxyDialer) dialProxy(ctx context.Context, proxyUrl *url.URL) (net.Conn, error) {
+	proxyAddr := proxyUrl.Host
+	if len(proxyUrl.Port()) == 0 {
+		if proxyUrl.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "80")
+		}
+	}
+	conn, err := p.dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil || proxyUrl.Scheme != "https" {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: proxyUrl.Hostname()})
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Connection whose first bytes were already read into a buffer while reading the proxy response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// Sends plain HTTP requests through the first selected proxy that the transport can connect to. Connections for other
+// requests are tunneled by the proxy dialer, which is told the scheme of the request.
+func (p *proxyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return p.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), tunnelSchemeKey{}, req.URL.Scheme)))
+	}
+	proxyUrls, err := p.dialer.selector(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for i, proxyUrl := range proxyUrls {
+		resp, err := p.forward(req, proxyUrl, i > 0)
+		if err == nil {
+			return resp, nil
+		}
+		// Only fall back to the next proxy if the request was not sent.
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) || (opErr.Op != "dial" && opErr.Op != "proxyconnect") {
+			return nil, err
+		}
+		output.VerbosePrint(fmt.Sprintf("[-] Could not connect to %s via proxy %v: %s", req.URL.Host, proxyUrl, err.Error()))
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Sends the request through the proxy, authenticating as required.
+func (p *proxyRoundTripper) forward(req *http.Request, proxyUrl *url.URL, resend bool) (*http.Response, error) {
+	var auth *proxyAuthenticator
+	if proxyUrl != nil {
+		auth = newProxyAuthenticator(p.dialer.authScheme, p.dialer.getCredentials(proxyUrl))
+		// Credentials are sent by the authenticator rather than by the transport.
+		proxyUrl = &url.URL{Scheme: proxyUrl.Scheme, Host: proxyUrl.Host}
+	}
+	ctx := context.WithValue(req.Context(), forwardProxyKey{}, proxyUrl)
+	for round := 0; round < maxProxyAuthRounds; round++ {
+		attempt, err := cloneRequest(req, ctx, resend || round > 0)
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			authorization, err := auth.authorization(req.Method, req.URL.String())
+			if err != nil {
+				return nil, err
+			}
+			if len(authorization) > 0 {
+				attempt.Header.Set("Proxy-Authorization", authorization)
+			}
+		}
+		resp, err := p.next.RoundTrip(attempt)
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || auth == nil {
+			return resp, err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err = auth.challenge(resp.Header.Values("Proxy-Authenticate")); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not authenticate to proxy %s: %s", proxyUrl.Host, err.Error()))
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Could not authenticate to proxy %s: too many challenges", proxyUrl.Host))
+}
+
+// Returns a copy of the request with the given context. Requests that were already sent need a new body.
+func cloneRequest(req *http.Request, ctx context.Context, resend bool) (*http.Request, error) {
+	clone := req.Clone(ctx)
+	if resend && req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.New("Cannot resend request body")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
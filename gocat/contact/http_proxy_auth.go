@@ -0,0 +1,334 @@
+package contact
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	ntlmNegotiateUnicode         = 0x00000001
+	ntlmNegotiateOem             = 0x00000002
+	ntlmRequestTarget            = 0x00000004
+	ntlmNegotiateNtlm            = 0x00000200
+	ntlmNegotiateAlwaysSign      = 0x00008000
+	ntlmNegotiateExtendedSession = 0x00080000
+	ntlmNegotiateTargetInfo      = 0x00800000
+	ntlmNegotiate128             = 0x20000000
+	ntlmNegotiate56              = 0x80000000
+	ntlmNegotiateFlags           = ntlmNegotiateUnicode | ntlmNegotiateOem | ntlmRequestTarget | ntlmNegotiateNtlm |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSession | ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+	ntlmAvEol       = 0x0000
+	ntlmAvTimestamp = 0x0007
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// Tracks the authentication handshake with a proxy for a single CONNECT tunnel or forwarded request.
+type proxyAuthenticator struct {
+	scheme        string // configured scheme, or PROXY_AUTH_AUTO to follow the challenges of the proxy
+	credentials   proxyCredentials
+	selected      string            // scheme currently in use
+	digestParams  map[string]string // parameters of the latest digest challenge
+	digestCount   int
+	ntlmChallenge []byte // latest NTLM challenge message, consumed by the next authorization
+	sent          bool   // whether credentials were sent for the selected scheme
+}
+
+func newProxyAuthenticator(scheme string, credentials proxyCredentials) *proxyAuthenticator {
+	if index := strings.Index(credentials.username, "\\"); index >= 0 && len(credentials.domain) == 0 {
+		credentials.domain = credentials.username[:index]
+		credentials.username = credentials.username[index+1:]
+	}
+	auth := &proxyAuthenticator{scheme: scheme, credentials: credentials}
+	// Basic and NTLM handshakes can start without waiting for a challenge.
+	if len(credentials.username) > 0 && (scheme == PROXY_AUTH_BASIC || scheme == PROXY_AUTH_NTLM) {
+		auth.selected = scheme
+	}
+	return auth
+}
+
+// Returns the Proxy-Authorization header value for the next request with the given method and request
+// target, i.e. the address for CONNECT requests and the URL for forwarded requests, if any.
+func (p *proxyAuthenticator) authorization(method string, uri string) (string, error) {
+	switch p.selected {
+	case PROXY_AUTH_BASIC:
+		p.sent = true
+		credentials := fmt.Sprintf("%s:%s", p.credentials.username, p.credentials.password)
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)), nil
+	case PROXY_AUTH_DIGEST:
+		p.sent = true
+		return p.digestAuthorization(method, uri)
+	case PROXY_AUTH_NTLM:
+		if p.ntlmChallenge == nil {
+			return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()), nil
+		}
+		p.sent = true
+		message, err := ntlmAuthenticateMessage(p.ntlmChallenge, p.credentials)
+		p.ntlmChallenge = nil
+		if err != nil {
+			return "", err
+		}
+		return "NTLM " + base64.StdEncoding.EncodeToString(message), nil
+	}
+	return "", nil
+}
+
+// Processes the Proxy-Authenticate headers of a 407 response.
+func (p *proxyAuthenticator) challenge(headers []string) error {
+	if len(p.credentials.username) == 0 {
+		return errors.New("proxy requires authentication, but no credentials were provided")
+	}
+	offered := make(map[string]string)
+	for _, header := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+		offered[strings.ToLower(scheme)] = strings.TrimSpace(params)
+	}
+	scheme := p.scheme
+	if scheme == PROXY_AUTH_AUTO {
+		scheme = p.selected
+		if len(scheme) == 0 {
+			for _, candidate := range []string{PROXY_AUTH_NTLM, PROXY_AUTH_DIGEST, PROXY_AUTH_BASIC} {
+				if _, ok := offered[candidate]; ok {
+					scheme = candidate
+					break
+				}
+			}
+		}
+	}
+	params, ok := offered[scheme]
+	if !ok {
+		return errors.New(fmt.Sprintf("proxy does not offer a supported authentication scheme: %s", strings.Join(headers, ", ")))
+	}
+	if scheme != p.selected {
+		p.selected = scheme
+		p.sent = false
+	}
+	switch scheme {
+	case PROXY_AUTH_DIGEST:
+		digestParams := parseAuthParams(params)
+		if p.sent && !strings.EqualFold(digestParams["stale"], "true") {
+			return errors.New("proxy rejected digest credentials")
+		}
+		p.digestParams = digestParams
+		p.digestCount = 0
+	case PROXY_AUTH_NTLM:
+		if len(params) == 0 {
+			if p.sent {
+				return errors.New("proxy rejected NTLM credentials")
+			}
+			return nil
+		}
+		challenge, err := base64.StdEncoding.DecodeString(params)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid NTLM challenge: %s", err.Error()))
+		}
+		p.ntlmChallenge = challenge
+	default:
+		if p.sent {
+			return errors.New("proxy rejected basic credentials")
+		}
+	}
+	return nil
+}
+
+// Computes an RFC 7616 digest response for a request with the given method and request target.
+func (p *proxyAuthenticator) digestAuthorization(method string, uri string) (string, error) {
+	algorithm := p.digestParams["algorithm"]
+	if len(algorithm) == 0 {
+		algorithm = "MD5"
+	}
+	var newHash func() hash.Hash
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS")) {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", errors.New(fmt.Sprintf("unsupported digest algorithm %s", algorithm))
+	}
+	digest := func(data string) string {
+		h := newHash()
+		h.Write([]byte(data))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	realm, nonce := p.digestParams["realm"], p.digestParams["nonce"]
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+	p.digestCount++
+	nc := fmt.Sprintf("%08x", p.digestCount)
+
+	ha1 := digest(fmt.Sprintf("%s:%s:%s", p.credentials.username, realm, p.credentials.password))
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = digest(fmt.Sprintf("%s:%s:%s", ha1, nonce, cnonce))
+	}
+	ha2 := digest(fmt.Sprintf("%s:%s", method, uri))
+	qop := ""
+	for _, option := range strings.Split(p.digestParams["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			qop = "auth"
+		}
+	}
+	var response string
+	if len(qop) > 0 {
+		response = digest(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, nonce, nc, cnonce, qop, ha2))
+	} else {
+		response = digest(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
+	}
+	authorization := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, response="%s"`,
+		p.credentials.username, realm, nonce, uri, algorithm, response)
+	if len(qop) > 0 {
+		authorization += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	if opaque, ok := p.digestParams["opaque"]; ok {
+		authorization += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return authorization, nil
+}
+
+// Parses comma-separated key=value authentication parameters, where values may be quoted.
+func parseAuthParams(params string) map[string]string {
+	parsed := make(map[string]string)
+	for len(params) > 0 {
+		params = strings.TrimLeft(params, " ,")
+		key, rest, found := strings.Cut(params, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			value = strings.ReplaceAll(rest[1:min(end, len(rest))], `\`, "")
+			params = rest[min(end+1, len(rest)):]
+		} else {
+			value, params, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		parsed[key] = value
+	}
+	return parsed
+}
+
+func ntlmNegotiateMessage() []byte {
+	message := make([]byte, 32)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 1)
+	binary.LittleEndian.PutUint32(message[12:], ntlmNegotiateFlags)
+	return message
+}
+
+// Builds an NTLMv2 authenticate message in response to the challenge message.
+func ntlmAuthenticateMessage(challenge []byte, credentials proxyCredentials) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("invalid NTLM challenge message")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:])
+	serverChallenge := challenge[24:32]
+	targetInfoLen := int(binary.LittleEndian.Uint16(challenge[40:]))
+	targetInfoOffset := int(binary.LittleEndian.Uint32(challenge[44:]))
+	if targetInfoOffset+targetInfoLen > len(challenge) {
+		return nil, errors.New("invalid NTLM target info")
+	}
+	targetInfo := challenge[targetInfoOffset : targetInfoOffset+targetInfoLen]
+
+	timestamp := ntlmTimestamp(targetInfo)
+	if timestamp == nil {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+	ntResponse, lmResponse := ntlmV2Responses(credentials, serverChallenge, clientChallenge, timestamp, targetInfo)
+
+	domain := ntlmEncodeString(credentials.domain)
+	user := ntlmEncodeString(credentials.username)
+	workstation := ntlmEncodeString("")
+	payloads := [][]byte{lmResponse, ntResponse, domain, user, workstation, {}}
+	message := make([]byte, 64)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 3)
+	offset := len(message)
+	for i, payload := range payloads {
+		binary.LittleEndian.PutUint16(message[12+i*8:], uint16(len(payload)))
+		binary.LittleEndian.PutUint16(message[14+i*8:], uint16(len(payload)))
+		binary.LittleEndian.PutUint32(message[16+i*8:], uint32(offset))
+		offset += len(payload)
+	}
+	binary.LittleEndian.PutUint32(message[60:], flags&ntlmNegotiateFlags)
+	for _, payload := range payloads {
+		message = append(message, payload...)
+	}
+	return message, nil
+}
+
+// Computes the NTLMv2 and LMv2 responses as described in MS-NLMP 3.3.2.
+func ntlmV2Responses(credentials proxyCredentials, serverChallenge []byte, clientChallenge []byte, timestamp []byte, targetInfo []byte) ([]byte, []byte) {
+	responseKey := ntowfV2(credentials)
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+	ntProof := hmacMd5(responseKey, append(append([]byte{}, serverChallenge...), temp...))
+	lmProof := hmacMd5(responseKey, append(append([]byte{}, serverChallenge...), clientChallenge...))
+	return append(ntProof, temp...), append(lmProof, clientChallenge...)
+}
+
+func ntowfV2(credentials proxyCredentials) []byte {
+	passwordHash := md4.New()
+	passwordHash.Write(ntlmEncodeString(credentials.password))
+	return hmacMd5(passwordHash.Sum(nil), ntlmEncodeString(strings.ToUpper(credentials.username)+credentials.domain))
+}
+
+// Returns the MsvAvTimestamp value of the target info, if present.
+func ntlmTimestamp(targetInfo []byte) []byte {
+	for len(targetInfo) >= 4 {
+		avId := binary.LittleEndian.Uint16(targetInfo)
+		avLen := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if avId == ntlmAvEol || 4+avLen > len(targetInfo) {
+			break
+		}
+		if avId == ntlmAvTimestamp && avLen == 8 {
+			return targetInfo[4:12]
+		}
+		targetInfo = targetInfo[4+avLen:]
+	}
+	return nil
+}
+
+func ntlmEncodeString(str string) []byte {
+	encoded := utf16.Encode([]rune(str))
+	buf := make([]byte, 2*len(encoded))
+	for i, unit := range encoded {
+		binary.LittleEndian.PutUint16(buf[2*i:], unit)
+	}
+	return buf
+}
+
+func hmacMd5(key []byte, data []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,520 @@
+package contact
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	proxyTestUser     = "agent"
+	proxyTestPassword = "s3cret"
+	proxyTestDomain   = "LAB"
+	proxyTestRealm    = "lab-proxy"
+	proxyTestNonce    = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+)
+
+// Stand-in for an authenticating forward proxy. Accepts requests that authenticate with the required
+// scheme, and sends them to the backend regardless of the requested target. Like common proxy setups,
+// only allows CONNECT to port 443, tunneling it to the TLS backend.
+type authProxy struct {
+	scheme           string
+	closeOnChallenge bool
+	backendAddr      string
+	tlsBackendAddr   string
+	listener         net.Listener
+	mutex            sync.Mutex
+	targets          []string
+	challenges       int
+}
+
+func newAuthProxy(t *testing.T, scheme string, backendAddr string) *authProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &authProxy{scheme: scheme, backendAddr: backendAddr, tlsBackendAddr: backendAddr, listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.handle(conn)
+		}
+	}()
+	return proxy
+}
+
+func (a *authProxy) url() string {
+	return "http://" + a.listener.Addr().String()
+}
+
+func (a *authProxy) close() {
+	a.listener.Close()
+}
+
+func (a *authProxy) getTargets() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]string{}, a.targets...)
+}
+
+func (a *authProxy) getChallenges() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.challenges
+}
+
+func (a *authProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	var ntlmChallenge []byte // NTLM state is tied to the connection
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if _, port, _ := net.SplitHostPort(req.Host); req.Method == http.MethodConnect && port != "443" {
+			conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+			continue
+		}
+		authorized, challenge := a.verify(req, &ntlmChallenge)
+		if !authorized {
+			io.Copy(io.Discard, req.Body)
+			a.mutex.Lock()
+			a.challenges++
+			a.mutex.Unlock()
+			resp := fmt.Sprintf("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: %s\r\nContent-Length: 0\r\n", challenge)
+			if a.closeOnChallenge {
+				conn.Write([]byte(resp + "Connection: close\r\n\r\n"))
+				return
+			}
+			conn.Write([]byte(resp + "\r\n"))
+			continue
+		}
+		a.mutex.Lock()
+		a.targets = append(a.targets, req.Method+" "+req.RequestURI)
+		a.mutex.Unlock()
+		if req.Method != http.MethodConnect {
+			if !a.forward(conn, req) {
+				return
+			}
+			continue
+		}
+		backend, err := net.Dial("tcp", a.tlsBackendAddr)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(backend, reader)
+			backend.Close()
+		}()
+		io.Copy(conn, backend)
+		return
+	}
+}
+
+// Sends the forwarded request to the backend and relays the response. Returns whether the connection
+// to the proxy can be reused.
+func (a *authProxy) forward(conn net.Conn, req *http.Request) bool {
+	req.RequestURI = ""
+	req.Header.Del("Proxy-Authorization")
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return net.Dial("tcp", a.backendAddr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.Write(conn) == nil
+}
+
+// Checks the Proxy-Authorization header of the request, returning the next challenge if it is not accepted.
+func (a *authProxy) verify(req *http.Request, ntlmChallenge *[]byte) (bool, string) {
+	authorization := req.Header.Get("Proxy-Authorization")
+	switch a.scheme {
+	case PROXY_AUTH_BASIC:
+		expected := base64.StdEncoding.EncodeToString([]byte(proxyTestUser + ":" + proxyTestPassword))
+		return authorization == "Basic "+expected, fmt.Sprintf(`Basic realm="%s"`, proxyTestRealm)
+	case PROXY_AUTH_DIGEST:
+		challenge := fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`, proxyTestRealm, proxyTestNonce)
+		if !strings.HasPrefix(authorization, "Digest ") {
+			return false, challenge
+		}
+		params := parseAuthParams(strings.TrimPrefix(authorization, "Digest "))
+		ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", proxyTestUser, proxyTestRealm, proxyTestPassword))
+		ha2 := md5Hex(fmt.Sprintf("%s:%s", req.Method, params["uri"]))
+		expected := md5Hex(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, proxyTestNonce, params["nc"], params["cnonce"], ha2))
+		return params["uri"] == req.RequestURI && params["response"] == expected, challenge
+	case PROXY_AUTH_NTLM:
+		token, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "NTLM "))
+		if !strings.HasPrefix(authorization, "NTLM ") || err != nil || len(token) < 12 {
+			return false, "NTLM"
+		}
+		switch binary.LittleEndian.Uint32(token[8:]) {
+		case 1:
+			*ntlmChallenge = ntlmTestChallenge()
+			return false, "NTLM " + base64.StdEncoding.EncodeToString(*ntlmChallenge)
+		case 3:
+			return *ntlmChallenge != nil && verifyNtlmAuthenticate(token, *ntlmChallenge), "NTLM"
+		}
+		return false, "NTLM"
+	}
+	return true, ""
+}
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func ntlmTestChallenge() []byte {
+	targetInfo := []byte{2, 0, 6, 0}
+	targetInfo = append(targetInfo, ntlmEncodeString(proxyTestDomain)...)
+	targetInfo = append(targetInfo, 0, 0, 0, 0)
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	binary.LittleEndian.PutUint32(challenge[20:], ntlmNegotiateFlags)
+	copy(challenge[24:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	binary.LittleEndian.PutUint16(challenge[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(challenge[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	return append(challenge, targetInfo...)
+}
+
+func verifyNtlmAuthenticate(message []byte, challenge []byte) bool {
+	field := func(index int) []byte {
+		length := int(binary.LittleEndian.Uint16(message[12+index*8:]))
+		offset := int(binary.LittleEndian.Uint32(message[16+index*8:]))
+		if offset+length > len(message) {
+			return nil
+		}
+		return message[offset : offset+length]
+	}
+	if len(message) < 64 {
+		return false
+	}
+	ntResponse, domain, user := field(1), field(2), field(3)
+	if len(ntResponse) < 16 || !bytes.Equal(domain, ntlmEncodeString(proxyTestDomain)) || !bytes.Equal(user, ntlmEncodeString(proxyTestUser)) {
+		return false
+	}
+	responseKey := ntowfV2(proxyCredentials{username: proxyTestUser, password: proxyTestPassword, domain: proxyTestDomain})
+	expected := hmacMd5(responseKey, append(append([]byte{}, challenge[24:32]...), ntResponse[16:]...))
+	return bytes.Equal(ntResponse[:16], expected)
+}
+
+// Test vectors from MS-NLMP 4.2.4.
+func TestNtlmV2Responses(t *testing.T) {
+	credentials := proxyCredentials{username: "User", password: "Password", domain: "Domain"}
+	if got := hex.EncodeToString(ntowfV2(credentials)); got != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("unexpected NTOWFv2 %s", got)
+	}
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge := bytes.Repeat([]byte{0xaa}, 8)
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	ntResponse, lmResponse := ntlmV2Responses(credentials, serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+	if got := hex.EncodeToString(ntResponse[:16]); got != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("unexpected NTProofStr %s", got)
+	}
+	if got := hex.EncodeToString(lmResponse); got != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Errorf("unexpected LMv2 response %s", got)
+	}
+}
+
+func newProxyBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(handleProxyBackend))
+}
+
+func newTlsProxyBackend() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(handleProxyBackend))
+}
+
+func handleProxyBackend(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("beacon via " + r.Host))))
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	backend := newProxyBackend()
+	defer backend.Close()
+	tlsBackend := newTlsProxyBackend()
+	defer tlsBackend.Close()
+	testCases := []struct {
+		proxyScheme      string
+		authScheme       string
+		closeOnChallenge bool
+		wantChallenges   int
+	}{
+		{PROXY_AUTH_BASIC, "", false, 1},
+		{PROXY_AUTH_BASIC, PROXY_AUTH_BASIC, false, 0},
+		{PROXY_AUTH_DIGEST, "", false, 1},
+		{PROXY_AUTH_DIGEST, PROXY_AUTH_DIGEST, true, 1},
+		{PROXY_AUTH_NTLM, "", false, 2},
+		{PROXY_AUTH_NTLM, PROXY_AUTH_NTLM, false, 1},
+	}
+	api := CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	// Plain HTTP requests are forwarded by the proxy, and HTTPS connections are tunneled with CONNECT.
+	upstreams := map[string]string{
+		"http://c2.example.test":  "POST http://c2.example.test/beacon",
+		"https://c2.example.test": "CONNECT c2.example.test:443",
+	}
+	for _, testCase := range testCases {
+		for upstream, wantTarget := range upstreams {
+			proxy := newAuthProxy(t, testCase.proxyScheme, getAddr(backend.URL))
+			proxy.tlsBackendAddr = getAddr(tlsBackend.URL)
+			proxy.closeOnChallenge = testCase.closeOnChallenge
+			config := map[string]string{
+				"httpProxyGateway":  proxy.url(),
+				"httpProxyAuth":     testCase.authScheme,
+				"httpProxyUser":     proxyTestDomain + "\\" + proxyTestUser,
+				"httpProxyPassword": proxyTestPassword,
+			}
+			if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+				t.Fatalf("HTTP contact rejected proxy config %v", config)
+			}
+			api.SetUpstreamDestAddr(upstream)
+			if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "beacon via c2.example.test" {
+				t.Errorf("expected beacon to %s through %s proxy with auth %s, got %s", upstream, testCase.proxyScheme, testCase.authScheme, got)
+			}
+			if targets := proxy.getTargets(); len(targets) != 1 || targets[0] != wantTarget {
+				t.Errorf("expected %s through %s proxy, got %v", wantTarget, testCase.proxyScheme, targets)
+			}
+			if challenges := proxy.getChallenges(); challenges != testCase.wantChallenges {
+				t.Errorf("expected %d challenge(s) from %s proxy with auth %s for %s, got %d", testCase.wantChallenges, testCase.proxyScheme, testCase.authScheme, upstream, challenges)
+			}
+			proxy.close()
+		}
+	}
+}
+
+func TestProxyRejectedCredentials(t *testing.T) {
+	backend := newProxyBackend()
+	defer backend.Close()
+	api := CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	for _, scheme := range []string{PROXY_AUTH_BASIC, PROXY_AUTH_DIGEST, PROXY_AUTH_NTLM} {
+		proxy := newAuthProxy(t, scheme, getAddr(backend.URL))
+		config := map[string]string{
+			"httpProxyGateway": strings.Replace(proxy.url(), "://", "://"+proxyTestUser+":wrong@", 1),
+		}
+		if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+			t.Fatalf("HTTP contact rejected proxy config %v", config)
+		}
+		api.SetUpstreamDestAddr("http://c2.example.test")
+		if got := api.GetBeaconBytes(map[string]interface{}{}); got != nil {
+			t.Errorf("expected beacon through %s proxy to fail with wrong credentials, got %s", scheme, got)
+		}
+		if len(proxy.getTargets()) != 0 {
+			t.Errorf("expected %s proxy to refuse request with wrong credentials", scheme)
+		}
+		proxy.close()
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	backend := newProxyBackend()
+	defer backend.Close()
+	proxy := newAuthProxy(t, PROXY_AUTH_BASIC, getAddr(backend.URL))
+	defer proxy.close()
+	t.Setenv("HTTP_PROXY", proxy.url())
+	t.Setenv("NO_PROXY", "direct.example.test")
+
+	api := CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	config := map[string]string{
+		"httpProxyGateway":  PROXY_GATEWAY_ENV,
+		"httpProxyUser":     proxyTestUser,
+		"httpProxyPassword": proxyTestPassword,
+	}
+	if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+		t.Fatal("HTTP contact rejected environment proxy config")
+	}
+	api.SetUpstreamDestAddr("http://c2.example.test")
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "beacon via c2.example.test" {
+		t.Errorf("expected beacon through environment proxy, got %s", got)
+	}
+	if targets := proxy.getTargets(); len(targets) != 1 {
+		t.Errorf("expected 1 request through environment proxy, got %v", targets)
+	}
+}
+
+// Returns canned PAC results instead of evaluating a script.
+type stubPacEvaluator struct {
+	script string
+}
+
+func (s *stubPacEvaluator) FindProxyForURL(targetUrl string, host string) (string, error) {
+	return s.script, nil
+}
+
+func TestProxyFromPacFile(t *testing.T) {
+	backend := newProxyBackend()
+	defer backend.Close()
+	proxy := newAuthProxy(t, "", getAddr(backend.URL))
+	defer proxy.close()
+	deadProxy := newAuthProxy(t, "", getAddr(backend.URL))
+	deadProxy.close()
+
+	// The PAC file is fetched directly, so it is served by the backend.
+	pacScript := fmt.Sprintf("SOCKS %s; PROXY %s; PROXY %s; DIRECT", getAddr(proxy.url()), getAddr(deadProxy.url()), getAddr(proxy.url()))
+	pacServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(pacScript))
+	}))
+	defer pacServer.Close()
+	defer func(pacEvaluatorFactory func(string) (PacEvaluator, error)) {
+		NewPacEvaluator = pacEvaluatorFactory
+	}(NewPacEvaluator)
+	NewPacEvaluator = nil
+
+	api := CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	config := map[string]string{"httpProxyPac": pacServer.URL + "/proxy.pac"}
+	if valid, _ := api.C2RequirementsMet(nil, config); valid {
+		t.Errorf("HTTP contact accepted PAC file without a PAC evaluator")
+	}
+	NewPacEvaluator = func(script string) (PacEvaluator, error) {
+		return &stubPacEvaluator{script: script}, nil
+	}
+	if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+		t.Fatal("HTTP contact rejected PAC config")
+	}
+	api.SetUpstreamDestAddr("http://c2.example.test")
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "beacon via c2.example.test" {
+		t.Errorf("expected beacon through PAC proxy, got %s", got)
+	}
+	if targets := proxy.getTargets(); len(targets) != 1 {
+		t.Errorf("expected 1 request through PAC proxy after skipping unavailable proxy, got %v", targets)
+	}
+}
+
+func TestProxyFallbackForPlainHttp(t *testing.T) {
+	backend := newProxyBackend()
+	defer backend.Close()
+	proxy := newAuthProxy(t, PROXY_AUTH_DIGEST, getAddr(backend.URL))
+	defer proxy.close()
+	deadProxy := newAuthProxy(t, "", getAddr(backend.URL))
+	deadProxy.close()
+	defer func(pacEvaluatorFactory func(string) (PacEvaluator, error)) {
+		NewPacEvaluator = pacEvaluatorFactory
+	}(NewPacEvaluator)
+	NewPacEvaluator = func(script string) (PacEvaluator, error) {
+		return &stubPacEvaluator{script: script}, nil
+	}
+	pacFile := filepath.Join(t.TempDir(), "proxy.pac")
+	os.WriteFile(pacFile, []byte(fmt.Sprintf("PROXY %s; PROXY %s", getAddr(deadProxy.url()), getAddr(proxy.url()))), 0600)
+
+	api := CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	config := map[string]string{
+		"httpProxyPac":      pacFile,
+		"httpProxyUser":     proxyTestUser,
+		"httpProxyPassword": proxyTestPassword,
+	}
+	if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+		t.Fatal("HTTP contact rejected PAC config")
+	}
+	api.SetUpstreamDestAddr("http://c2.example.test")
+	if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != "beacon via c2.example.test" {
+		t.Errorf("expected beacon through the next PAC proxy, got %s", got)
+	}
+	if targets := proxy.getTargets(); len(targets) != 1 || targets[0] != "POST http://c2.example.test/beacon" {
+		t.Errorf("expected request to be forwarded through the next PAC proxy, got %v", targets)
+	}
+}
+
+func TestProxySelectionScheme(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	var targets []string
+	dialer := &proxyDialer{
+		selector: func(target *url.URL) ([]*url.URL, error) {
+			targets = append(targets, target.String())
+			return []*url.URL{nil}, nil
+		},
+		dialer: &net.Dialer{},
+	}
+	transport := &http.Transport{DialContext: dialer.DialContext, TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := &http.Client{Transport: &proxyRoundTripper{next: transport, dialer: dialer}}
+
+	// Proxies for HTTPS servers on ports other than 443 are selected for the https scheme.
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if expected := "https://" + getAddr(backend.URL); len(targets) != 1 || targets[0] != expected {
+		t.Errorf("expected proxy selection for %s, got %v", expected, targets)
+	}
+}
+
+func TestParsePacResult(t *testing.T) {
+	proxyUrls, err := parsePacResult("PROXY proxy.lab:8080; HTTPS secure.lab:8443;SOCKS5 socks.lab:1080; DIRECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, proxyUrl := range proxyUrls {
+		got = append(got, fmt.Sprintf("%v", proxyUrl))
+	}
+	if strings.Join(got, " ") != "http://proxy.lab:8080 https://secure.lab:8443 <nil>" {
+		t.Errorf("unexpected PAC proxies %v", got)
+	}
+	for _, result := range []string{"", "SOCKS socks.lab:1080", "PROXY"} {
+		if _, err := parsePacResult(result); err == nil {
+			t.Errorf("expected error for PAC result %q", result)
+		}
+	}
+}
+
+func TestProxyLeavesDefaultTransport(t *testing.T) {
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	tlsConfig, proxyFunc, dialFunc := defaultTransport.TLSClientConfig, reflect.ValueOf(defaultTransport.Proxy).Pointer(), reflect.ValueOf(defaultTransport.DialContext).Pointer()
+	api := CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	config := map[string]string{"httpProxyGateway": "http://127.0.0.1:3128"}
+	if valid, _ := api.C2RequirementsMet(nil, config); !valid {
+		t.Fatalf("HTTP contact rejected proxy config %v", config)
+	}
+	if defaultTransport.TLSClientConfig != tlsConfig || reflect.ValueOf(defaultTransport.Proxy).Pointer() != proxyFunc || reflect.ValueOf(defaultTransport.DialContext).Pointer() != dialFunc {
+		t.Errorf("expected the HTTP contact not to configure the default transport")
+	}
+}
+
+func TestUnsupportedProxyAuth(t *testing.T) {
+	api := CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	config := map[string]string{"httpProxyGateway": "http://proxy.lab:8080", "httpProxyAuth": "kerberos"}
+	if valid, _ := api.C2RequirementsMet(nil, config); valid {
+		t.Errorf("HTTP contact accepted unsupported proxy authentication scheme")
+	}
+}
+
+func getAddr(serverUrl string) string {
+	return serverUrl[strings.Index(serverUrl, "://")+3:]
+}
@@ -0,0 +1,82 @@
+package contact
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	HTTP_TRANSPORT_DEFAULT = "default" // whatever Go negotiates by default
+	HTTP_TRANSPORT_HTTP1   = "http1"   // HTTP/1.1 only
+	HTTP_TRANSPORT_H2C     = "h2c"     // HTTP/2 only, with prior knowledge for cleartext connections
+	HTTP_TRANSPORT_H3      = "h3"      // HTTP/3 over QUIC. Requires the http3 extension.
+)
+
+// Builds the round tripper for an HTTP transport mode. The base transport already has the TLS and proxy settings applied.
+type HttpTransportFactory func(baseTransport *http.Transport) (http.RoundTripper, error)
+
+// Maps HTTP transport mode to its factory.
+var HttpTransportFactories = map[string]HttpTransportFactory{}
+
+func init() {
+	HttpTransportFactories[HTTP_TRANSPORT_DEFAULT] = func(baseTransport *http.Transport) (http.RoundTripper, error) {
+		return baseTransport, nil
+	}
+	HttpTransportFactories[HTTP_TRANSPORT_HTTP1] = func(baseTransport *http.Transport) (http.RoundTripper, error) {
+		transport := baseTransport.Clone()
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+		if transport.TLSClientConfig != nil {
+			// Cloning may carry over the HTTP/2 protocol that the base transport offers during the TLS handshake.
+			transport.TLSClientConfig.NextProtos = nil
+		}
+		return transport, nil
+	}
+	HttpTransportFactories[HTTP_TRANSPORT_H2C] = func(baseTransport *http.Transport) (http.RoundTripper, error) {
+		transport := baseTransport.Clone()
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		return transport, nil
+	}
+}
+
+// Returns the round tripper for the requested HTTP transport mode.
+func GetHttpTransport(transportMode string, baseTransport *http.Transport) (http.RoundTripper, error) {
+	if len(transportMode) == 0 {
+		transportMode = HTTP_TRANSPORT_DEFAULT
+	}
+	factory, ok := HttpTransportFactories[strings.ToLower(transportMode)]
+	if !ok {
+		if strings.ToLower(transportMode) == HTTP_TRANSPORT_H3 {
+			return nil, errors.New("HTTP/3 transport requires the agent to be compiled with the http3 extension")
+		}
+		return nil, errors.New(fmt.Sprintf("Unsupported HTTP transport %s", transportMode))
+	}
+	return factory(baseTransport)
+}
+
+// Records the protocol version of each response, such as HTTP/1.1, HTTP/2.0, or HTTP/3.0.
+type protocolRecorder struct {
+	next     http.RoundTripper
+	protocol atomic.Value
+}
+
+func (p *protocolRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := p.next.RoundTrip(req)
+	if err == nil && len(resp.Proto) > 0 {
+		p.protocol.Store(resp.Proto)
+	}
+	return resp, err
+}
+
+// Returns the protocol of the most recent response, or an empty string if no response has been received.
+func (p *protocolRecorder) getProtocol() string {
+	if protocol, ok := p.protocol.Load().(string); ok {
+		return protocol
+	}
+	return ""
+}
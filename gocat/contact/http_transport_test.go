@@ -0,0 +1,68 @@
+package contact_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mitre/gocat/contact"
+)
+
+// Responds to beacons with the protocol of the request.
+func newProtocolEchoServer(useTls bool) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(r.Proto))))
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetHTTP2(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	if useTls {
+		server.EnableHTTP2 = true
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	return server
+}
+
+func TestHttpTransportModes(t *testing.T) {
+	cleartextServer := newProtocolEchoServer(false)
+	defer cleartextServer.Close()
+	tlsServer := newProtocolEchoServer(true)
+	defer tlsServer.Close()
+	testCases := []struct {
+		transportMode string
+		server        *httptest.Server
+		want          string
+	}{
+		{"", cleartextServer, "HTTP/1.1"},
+		{contact.HTTP_TRANSPORT_HTTP1, cleartextServer, "HTTP/1.1"},
+		{contact.HTTP_TRANSPORT_H2C, cleartextServer, "HTTP/2.0"},
+		{contact.HTTP_TRANSPORT_HTTP1, tlsServer, "HTTP/1.1"},
+		{contact.HTTP_TRANSPORT_H2C, tlsServer, "HTTP/2.0"},
+	}
+	api := contact.CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	for _, testCase := range testCases {
+		if valid, _ := api.C2RequirementsMet(nil, map[string]string{"httpTransport": testCase.transportMode}); !valid {
+			t.Fatalf("HTTP contact rejected transport mode %s", testCase.transportMode)
+		}
+		api.SetUpstreamDestAddr(testCase.server.URL)
+		if got := string(api.GetBeaconBytes(map[string]interface{}{})); got != testCase.want {
+			t.Errorf("expected %s with transport mode %s against %s, got %s", testCase.want, testCase.transportMode, testCase.server.URL, got)
+		}
+		if got := api.(contact.ProtocolReporter).GetActiveProtocol(); got != testCase.want {
+			t.Errorf("expected active protocol %s with transport mode %s, got %s", testCase.want, testCase.transportMode, got)
+		}
+	}
+}
+
+func TestUnsupportedHttpTransport(t *testing.T) {
+	api := contact.CommunicationChannels["HTTP"]
+	defer api.C2RequirementsMet(nil, map[string]string{})
+	if valid, _ := api.C2RequirementsMet(nil, map[string]string{"httpTransport": "spdy"}); valid {
+		t.Errorf("HTTP contact accepted unsupported transport mode")
+	}
+}
@@ -0,0 +1,159 @@
+package contact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/mitre/gocat/output"
+)
+
+const defaultSocks5Port = 1080
+
+// Will implement the Tunnel interface. Connections to the local endpoint are relayed to the remote
+// endpoint through a SOCKS5 proxy. Hostnames are resolved by the proxy.
+type Socks5Tunnel struct {
+	name                string
+	tunneledProtocol    string
+	localTunnelEndpoint string // localhost and random local port
+	proxyEndpoint       string // SOCKS5 proxy IP/hostname and port
+	remoteEndpoint      string // true dest IP/hostname and port for underlying contact
+	dialer              proxy.Dialer
+	tunnelListener
+}
+
+func init() {
+	CommunicationTunnelFactories["SOCKS5"] = Socks5TunnelFactory
+}
+
+func Socks5TunnelFactory(tunnelConfig *TunnelConfig) (Tunnel, error) {
+	proxyEndpoint, err := getSocks5ProxyEndpoint(tunnelConfig)
+	if err != nil {
+		return nil, err
+	}
+	var auth *proxy.Auth
+	if len(tunnelConfig.Username) > 0 {
+		// RFC 1929 limits usernames and passwords to 255 bytes.
+		if len(tunnelConfig.Username) > 255 || len(tunnelConfig.Password) > 255 {
+			return nil, errors.New("SOCKS5 username and password must be at most 255 bytes")
+		}
+		auth = &proxy.Auth{User: tunnelConfig.Username, Password: tunnelConfig.Password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", proxyEndpoint, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	tunnel := &Socks5Tunnel{
+		name:                tunnelConfig.Protocol,
+		tunneledProtocol:    tunnelConfig.TunneledProtocol,
+		localTunnelEndpoint: fmt.Sprintf("localhost:%d", getRandomListeningPort()),
+		proxyEndpoint:       proxyEndpoint,
+		remoteEndpoint:      net.JoinHostPort(tunnelConfig.RemoteAddr, strconv.Itoa(tunnelConfig.RemotePort)),
+		dialer:              dialer,
+	}
+	return tunnel, nil
+}
+
+// Returns the SOCKS5 proxy endpoint. If only a port is provided, the proxy is assumed to run on the
+// remote destination host. If no port is provided, the default SOCKS port is used.
+func getSocks5ProxyEndpoint(tunnelConfig *TunnelConfig) (string, error) {
+	proxyEndpoint := tunnelConfig.TunnelEndpoint
+	if len(proxyEndpoint) == 0 {
+		return "", errors.New("No SOCKS5 proxy endpoint provided.")
+	}
+	if portNum, err := strconv.Atoi(proxyEndpoint); err == nil {
+		return net.JoinHostPort(tunnelConfig.RemoteAddr, strconv.Itoa(portNum)), nil
+	}
+	if !strings.Contains(proxyEndpoint, ":") {
+		return net.JoinHostPort(proxyEndpoint, strconv.Itoa(defaultSocks5Port)), nil
+	}
+	proxyAddr, proxyPort, err := splitAddrAndPort(proxyEndpoint, "")
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(proxyAddr, strconv.Itoa(proxyPort)), nil
+}
+
+func (s *Socks5Tunnel) GetName() string {
+	return s.name
+}
+
+func (s *Socks5Tunnel) GetLocalEndpoint() string {
+	return fmt.Sprintf("%s://%s", s.tunneledProtocol, s.localTunnelEndpoint)
+}
+
+func (s *Socks5Tunnel) GetRemoteEndpoint() string {
+	return fmt.Sprintf("%s://%s", s.tunneledProtocol, s.remoteEndpoint)
+}
+
+// Must be run as go routine.
+func (s *Socks5Tunnel) Start(tunnelReady chan bool) {
+	output.VerbosePrint(fmt.Sprintf("Starting local tunnel endpoint at %s", s.localTunnelEndpoint))
+	output.VerbosePrint(fmt.Sprintf("Setting SOCKS5 proxy endpoint at %s", s.proxyEndpoint))
+	output.VerbosePrint(fmt.Sprintf("Setting remote endpoint at %s", s.remoteEndpoint))
+	listener, err := s.listen(s.localTunnelEndpoint)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error setting SOCKS5 tunnel listener: %s", err.Error()))
+		tunnelReady <- false
+		return
+	}
+	defer listener.Close()
+	// Tell caller we're ready for connections
+	tunnelReady <- true
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			if s.acceptFailed(err) {
+				output.VerbosePrint("[-] Local SOCKS5 tunnel endpoint closed")
+				return
+			}
+			output.VerbosePrint(fmt.Sprintf("[!] Error accepting local SOCKS5 tunnel connection: %s", err.Error()))
+			continue
+		}
+		output.VerbosePrint("[*] Accepted connection on local SOCKS5 tunnel endpoint")
+		go s.forwardConnection(localConn)
+	}
+}
+
+func (s *Socks5Tunnel) Stop() {
+	s.stop()
+	output.VerbosePrint(fmt.Sprintf("[*] Stopped SOCKS5 tunnel at %s", s.localTunnelEndpoint))
+}
+
+// The tunnel is healthy if the local endpoint is listening and the SOCKS5 proxy accepts connections.
+func (s *Socks5Tunnel) Healthy() bool {
+	if !s.isListening() {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", s.proxyEndpoint, tunnelHealthCheckTimeout)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] SOCKS5 tunnel health check could not reach proxy: %s", err.Error()))
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (s *Socks5Tunnel) forwardConnection(localConn net.Conn) {
+	remoteConn, err := s.dialer.Dial("tcp", s.remoteEndpoint)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error connecting to remote endpoint through SOCKS5 proxy: %s", err.Error()))
+		localConn.Close()
+		return
+	}
+	output.VerbosePrint("[*] Opened remote connection through SOCKS5 tunnel")
+	forwarderFunc := func(writer, reader net.Conn) {
+		defer writer.Close()
+		defer reader.Close()
+		if _, err := io.Copy(writer, reader); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] I/O copy error when forwarding through tunnel: %s", err.Error()))
+		}
+	}
+	go forwarderFunc(localConn, remoteConn)
+	go forwarderFunc(remoteConn, localConn)
+}
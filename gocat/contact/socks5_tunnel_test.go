@@ -0,0 +1,236 @@
+package contact_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mitre/gocat/contact"
+)
+
+// Minimal SOCKS5 server that requires username/password authentication and relays
+// CONNECT requests to the backend, recording the requested destinations.
+type socks5Server struct {
+	listener     net.Listener
+	backendAddr  string
+	username     string
+	password     string
+	mutex        sync.Mutex
+	destinations []string
+}
+
+func newSocks5Server(t *testing.T, backendAddr string, username string, password string) *socks5Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &socks5Server{listener: listener, backendAddr: backendAddr, username: username, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handle(conn)
+		}
+	}()
+	return server
+}
+
+func (s *socks5Server) getDestinations() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.destinations...)
+}
+
+func (s *socks5Server) handle(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil || !bytes.Contains(methods, []byte{2}) {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	// RFC 1929 username/password subnegotiation
+	version := make([]byte, 2)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return
+	}
+	username := make([]byte, version[1])
+	io.ReadFull(conn, username)
+	passwordLen := make([]byte, 1)
+	io.ReadFull(conn, passwordLen)
+	password := make([]byte, passwordLen[0])
+	io.ReadFull(conn, password)
+	if string(username) != s.username || string(password) != s.password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		addr := make([]byte, 4)
+		io.ReadFull(conn, addr)
+		host = net.IP(addr).String()
+	case 3:
+		hostLen := make([]byte, 1)
+		io.ReadFull(conn, hostLen)
+		hostBytes := make([]byte, hostLen[0])
+		io.ReadFull(conn, hostBytes)
+		host = string(hostBytes)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	s.mutex.Lock()
+	s.destinations = append(s.destinations, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	s.mutex.Unlock()
+
+	backend, err := net.Dial("tcp", s.backendAddr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer backend.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(backend, conn)
+	io.Copy(conn, backend)
+}
+
+func startTunnel(t *testing.T, tunnelConfig *contact.TunnelConfig) contact.Tunnel {
+	tunnel, err := contact.CommunicationTunnelFactories["SOCKS5"](tunnelConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnelReady := make(chan bool)
+	go tunnel.Start(tunnelReady)
+	if !<-tunnelReady {
+		t.Fatal("SOCKS5 tunnel failed to start")
+	}
+	t.Cleanup(tunnel.Stop)
+	return tunnel
+}
+
+func TestSocks5Tunnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from " + r.Host))
+	}))
+	defer backend.Close()
+	server := newSocks5Server(t, backend.Listener.Addr().String(), "agent", "s3cret")
+	defer server.listener.Close()
+
+	tunnelConfig, err := contact.BuildTunnelConfig("SOCKS5", server.listener.Addr().String(), "http://c2.example.test:8888", "agent", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := startTunnel(t, tunnelConfig)
+	if got := tunnel.GetRemoteEndpoint(); got != "http://c2.example.test:8888" {
+		t.Errorf("expected remote endpoint http://c2.example.test:8888, got %s", got)
+	}
+	resp, err := http.Get(tunnel.GetLocalEndpoint() + "/beacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.HasPrefix(body, []byte("hello from localhost:")) {
+		t.Errorf("unexpected response through SOCKS5 tunnel: %s", body)
+	}
+
+	// The hostname must be resolved by the proxy rather than locally.
+	if destinations := server.getDestinations(); len(destinations) != 1 || destinations[0] != "c2.example.test:8888" {
+		t.Errorf("expected SOCKS5 CONNECT to c2.example.test:8888, got %v", destinations)
+	}
+}
+
+func TestSocks5TunnelRejectedCredentials(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	server := newSocks5Server(t, backend.Listener.Addr().String(), "agent", "s3cret")
+	defer server.listener.Close()
+
+	tunnelConfig, err := contact.BuildTunnelConfig("SOCKS5", server.listener.Addr().String(), "http://c2.example.test:8888", "agent", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := startTunnel(t, tunnelConfig)
+	if resp, err := http.Get(tunnel.GetLocalEndpoint()); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected request through SOCKS5 tunnel to fail with wrong credentials")
+	}
+	if destinations := server.getDestinations(); len(destinations) != 0 {
+		t.Errorf("expected no SOCKS5 CONNECT with wrong credentials, got %v", destinations)
+	}
+}
+
+func TestSocks5TunnelPortOnlyEndpoint(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	server := newSocks5Server(t, backend.Listener.Addr().String(), "agent", "s3cret")
+	defer server.listener.Close()
+
+	// With only a port, the proxy is expected on the remote destination host.
+	_, proxyPort, _ := net.SplitHostPort(server.listener.Addr().String())
+	tunnelConfig, err := contact.BuildTunnelConfig("SOCKS5", proxyPort, "127.0.0.1:8888", "agent", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := startTunnel(t, tunnelConfig)
+	resp, err := http.Get(tunnel.GetLocalEndpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if destinations := server.getDestinations(); len(destinations) != 1 || destinations[0] != "127.0.0.1:8888" {
+		t.Errorf("expected SOCKS5 CONNECT to 127.0.0.1:8888, got %v", destinations)
+	}
+	if _, err := contact.CommunicationTunnelFactories["SOCKS5"](&contact.TunnelConfig{Protocol: "SOCKS5"}); err == nil {
+		t.Errorf("expected error for missing SOCKS5 proxy endpoint")
+	}
+}
+
+func TestSocks5TunnelStopAndHealth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	server := newSocks5Server(t, backend.Listener.Addr().String(), "agent", "s3cret")
+
+	tunnelConfig, err := contact.BuildTunnelConfig("SOCKS5", server.listener.Addr().String(), "http://c2.example.test:8888", "agent", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := startTunnel(t, tunnelConfig)
+	if !tunnel.Healthy() {
+		t.Fatalf("expected SOCKS5 tunnel to be healthy")
+	}
+	server.listener.Close()
+	if tunnel.Healthy() {
+		t.Errorf("expected SOCKS5 tunnel to be unhealthy once the proxy is unreachable")
+	}
+
+	tunnel.Stop()
+	if tunnel.Healthy() {
+		t.Errorf("expected stopped SOCKS5 tunnel to be unhealthy")
+	}
+	if !waitForClosed(strings.TrimPrefix(tunnel.GetLocalEndpoint(), "http://")) {
+		t.Errorf("expected local endpoint of stopped SOCKS5 tunnel to be closed")
+	}
+}
@@ -0,0 +1,144 @@
+package contact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mitre/gocat/output"
+)
+
+var reverseForwardRetryDelay = 5 * time.Second
+
+// Port on the SSH server that is forwarded to a service reachable from the agent.
+type sshReverseForward struct {
+	bindAddr   string // address the SSH server listens on
+	targetAddr string // agent-side address that connections are forwarded to
+}
+
+// Parses comma-separated reverse forwards in the [bindAddr:]bindPort:targetHost:targetPort format of ssh -R.
+// The SSH server binds to localhost if no bind address is provided.
+func parseSshReverseForwards(forwardsStr string) ([]sshReverseForward, error) {
+	var forwards []sshReverseForward
+	for _, forwardStr := range strings.Split(forwardsStr, ",") {
+		forwardStr = strings.TrimSpace(forwardStr)
+		if len(forwardStr) == 0 {
+			continue
+		}
+		parts := strings.Split(forwardStr, ":")
+		if len(parts) == 3 {
+			parts = append([]string{"localhost"}, parts...)
+		}
+		if len(parts) != 4 || len(parts[2]) == 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid SSH reverse forward %s", forwardStr))
+		}
+		bindAddr := net.JoinHostPort(parts[0], parts[1])
+		targetAddr := net.JoinHostPort(parts[2], parts[3])
+		for _, addr := range []string{bindAddr, targetAddr} {
+			if _, _, err := splitAddrAndPort(addr, ""); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid SSH reverse forward %s: %s", forwardStr, err.Error()))
+			}
+		}
+		forwards = append(forwards, sshReverseForward{bindAddr: bindAddr, targetAddr: targetAddr})
+	}
+	return forwards, nil
+}
+
+// Must be run as go routine. Keeps the reverse forwards registered on the SSH server, registering
+// them again whenever the SSH connection is re-established.
+func (s *SshTunnel) maintainReverseForwards() {
+	for !s.isStopped() {
+		client, _, err := s.getServerConn()
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error connecting to server SSH endpoint for reverse forwards: %s", err.Error()))
+			time.Sleep(reverseForwardRetryDelay)
+			continue
+		}
+		failed := s.registerReverseForwards(client, s.reverseForwards)
+		if len(failed) == len(s.reverseForwards) {
+			time.Sleep(reverseForwardRetryDelay)
+			continue
+		}
+		// Forwards are cancelled by the server when the connection closes.
+		s.retryReverseForwards(client, failed)
+		s.dropServerConn(client)
+		if s.isStopped() {
+			break
+		}
+		output.VerbosePrint("[-] SSH connection for reverse forwards closed, re-registering")
+	}
+}
+
+// Requests the given reverse forwards over the SSH connection and returns the ones that could not be registered.
+func (s *SshTunnel) registerReverseForwards(client *ssh.Client, forwards []sshReverseForward) []sshReverseForward {
+	var failed []sshReverseForward
+	for _, forward := range forwards {
+		listener, err := client.Listen("tcp", forward.bindAddr)
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error requesting SSH reverse forward from %s: %s", forward.bindAddr, err.Error()))
+			failed = append(failed, forward)
+			continue
+		}
+		output.VerbosePrint(fmt.Sprintf("[*] Forwarding %s on SSH server to %s", listener.Addr().String(), forward.targetAddr))
+		go s.acceptReverseConnections(listener, forward)
+	}
+	return failed
+}
+
+// Blocks until the SSH connection closes. Forwards that failed to register are requested again on the
+// keepalive timer in the meantime.
+func (s *SshTunnel) retryReverseForwards(client *ssh.Client, failed []sshReverseForward) {
+	connClosed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(connClosed)
+	}()
+	retryInterval := s.keepAlive
+	if retryInterval == 0 {
+		retryInterval = reverseForwardRetryDelay
+	}
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for len(failed) > 0 {
+		select {
+		case <-connClosed:
+			return
+		case <-ticker.C:
+			failed = s.registerReverseForwards(client, failed)
+		}
+	}
+	<-connClosed
+}
+
+func (s *SshTunnel) acceptReverseConnections(listener net.Listener, forward sshReverseForward) {
+	defer listener.Close()
+	for {
+		remoteConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.forwardReverseConnection(remoteConn, forward)
+	}
+}
+
+func (s *SshTunnel) forwardReverseConnection(remoteConn net.Conn, forward sshReverseForward) {
+	localConn, err := net.Dial("tcp", forward.targetAddr)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error connecting to reverse forward target %s: %s", forward.targetAddr, err.Error()))
+		remoteConn.Close()
+		return
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Forwarding connection from SSH server to %s", forward.targetAddr))
+	forwarderFunc := func(writer, reader net.Conn) {
+		defer writer.Close()
+		defer reader.Close()
+		io.Copy(writer, reader)
+	}
+	go forwarderFunc(localConn, remoteConn)
+	go forwarderFunc(remoteConn, localConn)
+}
@@ -3,14 +3,20 @@
 package contact
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/mitre/gocat/output"
 )
@@ -18,6 +24,7 @@ import (
 var (
 	minLocalPort = 50000
 	maxLocalPort = 65000
+	defaultSshKeepAlive = 30 * time.Second
 )
 
 // Will implement the Tunnel interface.
@@ -30,6 +37,12 @@ type SshTunnel struct {
 	serverTunnelEndpoint string // server IP/hostname and SSH port
 	remoteEndpoint string // localhost (from server's perspective) and true dest port for underlying contact
 	config *ssh.ClientConfig
+	keepAlive time.Duration // interval between keepalive requests. Disabled if 0.
+	agentSocket string // SSH agent socket to authenticate with, if any
+	reverseForwards []sshReverseForward // ports to forward from the SSH server to agent-side services
+	client *ssh.Client // SSH connection shared by all forwarded connections
+	clientMutex sync.Mutex
+	tunnelListener
 }
 
 func init() {
@@ -38,12 +51,26 @@ func init() {
 }
 
 func SshTunnelFactory(tunnelConfig *TunnelConfig) (Tunnel, error) {
+	authMethods, agentSocket, err := getSshAuthMethods(tunnelConfig)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := getSshHostKeyCallback(tunnelConfig.Options["sshHostKey"])
+	if err != nil {
+		return nil, err
+	}
+	keepAlive, err := getSshKeepAlive(tunnelConfig.Options["sshKeepAlive"])
+	if err != nil {
+		return nil, err
+	}
+	reverseForwards, err := parseSshReverseForwards(tunnelConfig.Options["sshReverseForwards"])
+	if err != nil {
+		return nil, err
+	}
 	clientConfig := &ssh.ClientConfig{
 		User: tunnelConfig.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(tunnelConfig.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth: authMethods,
+		HostKeyCallback: hostKeyCallback,
 	}
 
 	sshServerAddr, sshPort, err := getSSHServerAddrAndPort(tunnelConfig)
@@ -61,10 +88,93 @@ func SshTunnelFactory(tunnelConfig *TunnelConfig) (Tunnel, error) {
 		remoteEndpoint: fmt.Sprintf("%s:%d", relativeRemoteAddr, tunnelConfig.RemotePort),
 		config: clientConfig,
 		tunneledProtocol: tunnelConfig.TunneledProtocol,
+		keepAlive: keepAlive,
+		agentSocket: agentSocket,
+		reverseForwards: reverseForwards,
 	}
 	return tunnel, nil
 }
 
+// Returns the SSH auth methods to try, in order: private key, then password. Also returns the
+// SSH agent socket if agent auth was requested.
+func getSshAuthMethods(tunnelConfig *TunnelConfig) ([]ssh.AuthMethod, string, error) {
+	var authMethods []ssh.AuthMethod
+	var agentSocket string
+	if useAgent, _ := strconv.ParseBool(tunnelConfig.Options["sshAgent"]); useAgent {
+		if agentSocket = os.Getenv("SSH_AUTH_SOCK"); len(agentSocket) == 0 {
+			return nil, "", errors.New("SSH agent requested, but SSH_AUTH_SOCK is not set")
+		}
+	}
+	if privateKey, ok := tunnelConfig.Options["sshPrivateKey"]; ok && len(privateKey) > 0 {
+		signer, err := loadSshPrivateKey(privateKey, tunnelConfig.Options["sshPrivateKeyPassphrase"])
+		if err != nil {
+			return nil, "", err
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+	if len(tunnelConfig.Password) > 0 || (len(authMethods) == 0 && len(agentSocket) == 0) {
+		authMethods = append(authMethods, ssh.Password(tunnelConfig.Password))
+	}
+	return authMethods, agentSocket, nil
+}
+
+// Loads a private key given as a file path, or as a raw or base64-encoded PEM block.
+func loadSshPrivateKey(privateKey string, passphrase string) (ssh.Signer, error) {
+	keyBytes := []byte(privateKey)
+	if !strings.Contains(privateKey, "-----BEGIN") {
+		if decoded, err := base64.StdEncoding.DecodeString(privateKey); err == nil && strings.Contains(string(decoded), "-----BEGIN") {
+			keyBytes = decoded
+		} else if keyBytes, err = os.ReadFile(privateKey); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read SSH private key: %s", err.Error()))
+		}
+	}
+	if len(passphrase) > 0 {
+		return ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
+	}
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+// Returns a callback that only accepts host keys matching one of the comma-separated fingerprints, given in
+// the SHA256:... or legacy MD5 aa:bb:... formats of ssh-keygen. Any host key is accepted if none are given.
+func getSshHostKeyCallback(fingerprints string) (ssh.HostKeyCallback, error) {
+	if len(fingerprints) == 0 {
+		output.VerbosePrint("[-] No SSH host key fingerprint provided. The SSH server identity will not be verified.")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	pinned := make(map[string]bool)
+	for _, fingerprint := range strings.Split(fingerprints, ",") {
+		fingerprint = strings.TrimSpace(fingerprint)
+		if strings.HasPrefix(fingerprint, "SHA256:") {
+			pinned[strings.TrimRight(fingerprint, "=")] = true
+		} else if len(fingerprint) == 47 && strings.Count(fingerprint, ":") == 15 {
+			pinned[strings.ToLower(fingerprint)] = true
+		} else {
+			return nil, errors.New(fmt.Sprintf("Invalid SSH host key fingerprint %s", fingerprint))
+		}
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if pinned[ssh.FingerprintSHA256(key)] || pinned[ssh.FingerprintLegacyMD5(key)] {
+			return nil
+		}
+		return errors.New(fmt.Sprintf("SSH host key %s for %s does not match the pinned fingerprint", ssh.FingerprintSHA256(key), hostname))
+	}, nil
+}
+
+// Parses the keepalive interval, given as a duration or a number of seconds.
+func getSshKeepAlive(keepAliveStr string) (time.Duration, error) {
+	if len(keepAliveStr) == 0 {
+		return defaultSshKeepAlive, nil
+	}
+	if seconds, err := strconv.Atoi(keepAliveStr); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	keepAlive, err := time.ParseDuration(keepAliveStr)
+	if err != nil || keepAlive < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid SSH keepalive interval %s", keepAliveStr))
+	}
+	return keepAlive, nil
+}
+
 // Returns the remote addr with respect to the the SSH server. For instance, if both
 // the sshServerAddr and remoteAddr are the same, the relative remote addr for the SSH tunnel
 // would be localhost.
@@ -102,42 +212,76 @@ func (s *SshTunnel) Start(tunnelReady chan bool) {
 	output.VerbosePrint(fmt.Sprintf("Starting local tunnel endpoint at %s", s.localTunnelEndpoint))
 	output.VerbosePrint(fmt.Sprintf("Setting server tunnel endpoint at %s", s.serverTunnelEndpoint))
 	output.VerbosePrint(fmt.Sprintf("Setting remote endpoint at %s", s.remoteEndpoint))
-	listener, err := net.Listen("tcp", s.localTunnelEndpoint)
+	listener, err := s.listen(s.localTunnelEndpoint)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[!] Error setting SSH tunnel listener: %s", err.Error()))
 		tunnelReady <- false
 		return
 	}
 	defer listener.Close()
+	if len(s.reverseForwards) > 0 {
+		go s.maintainReverseForwards()
+	}
 	// Tell caller we're ready for connections
 	tunnelReady <- true
 	for {
 		output.VerbosePrint("[*] Listening on local SSH tunnel endpoint")
 		localConn, err := listener.Accept()
-		output.VerbosePrint("[*] Accepted connection on local SSH tunnel endpoint")
 		if err != nil {
+			if s.acceptFailed(err) {
+				output.VerbosePrint("[-] Local SSH tunnel endpoint closed")
+				return
+			}
 			output.VerbosePrint(fmt.Sprintf("[!] Error accepting local SSH tunnel connection: %s", err.Error()))
 			continue
 		}
+		output.VerbosePrint("[*] Accepted connection on local SSH tunnel endpoint")
 		go s.forwardConnection(localConn)
 	}
 }
 
-func (s *SshTunnel) forwardConnection(localConn net.Conn) {
-	output.VerbosePrint("[*] Forwarding connection to server")
-	serverConn, err := s.connectToServerSsh()
-	if err != nil {
-		output.VerbosePrint(fmt.Sprintf("[!] Error connecting to server SSH endpoint: %s", err.Error()))
-		localConn.Close()
-		return
+// Closes the local endpoint and the SSH connection. Reverse forwards are cancelled along with the connection.
+func (s *SshTunnel) Stop() {
+	s.stop()
+	s.clientMutex.Lock()
+	client := s.client
+	s.clientMutex.Unlock()
+	if client != nil {
+		s.dropServerConn(client)
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Stopped SSH tunnel at %s", s.localTunnelEndpoint))
+}
+
+// The tunnel is healthy if the local endpoint is listening and the SSH server answers a keepalive request,
+// reconnecting once if the existing connection is dead.
+func (s *SshTunnel) Healthy() bool {
+	if !s.isListening() {
+		return false
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		serverConn, reused, err := s.getServerConn()
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[-] SSH tunnel health check could not connect to server: %s", err.Error()))
+			return false
+		}
+		if _, _, err = serverConn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return true
+		}
+		output.VerbosePrint(fmt.Sprintf("[-] SSH tunnel health check failed: %s", err.Error()))
+		s.dropServerConn(serverConn)
+		if !reused {
+			return false
+		}
 	}
+	return false
+}
 
-	// Get remote connection through tunnel
-	remoteConn, err := serverConn.Dial("tcp", s.remoteEndpoint)
+func (s *SshTunnel) forwardConnection(localConn net.Conn) {
+	output.VerbosePrint("[*] Forwarding connection to server")
+	remoteConn, err := s.dialRemote()
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[!] Error connecting to remote endpoint: %s", err.Error()))
 		localConn.Close()
-		serverConn.Close()
 		return
 	}
 	output.VerbosePrint("[*] Opened remote connection through tunnel")
@@ -150,15 +294,96 @@ func (s *SshTunnel) forwardConnection(localConn net.Conn) {
 			output.VerbosePrint(fmt.Sprintf("[!] I/O copy error when forwarding through tunnel: %s", err.Error()))
 			localConn.Close()
 			remoteConn.Close()
-			serverConn.Close()
 		}
 	}
 	go forwarderFunc(localConn, remoteConn)
 	go forwarderFunc(remoteConn, localConn)
 }
 
+// Opens a channel to the remote endpoint over the shared SSH connection. If the channel cannot be
+// opened over an existing connection, the connection is replaced and the channel is retried once.
+func (s *SshTunnel) dialRemote() (net.Conn, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		serverConn, reused, err := s.getServerConn()
+		if err != nil {
+			return nil, err
+		}
+		remoteConn, err := serverConn.Dial("tcp", s.remoteEndpoint)
+		if err == nil || !reused {
+			return remoteConn, err
+		}
+		output.VerbosePrint(fmt.Sprintf("[-] Error opening channel over existing SSH connection, reconnecting: %s", err.Error()))
+		s.dropServerConn(serverConn)
+	}
+	return nil, errors.New("Could not open channel over SSH connection")
+}
+
+// Returns the shared SSH connection, connecting to the server if needed. Also returns whether the
+// connection was already established.
+func (s *SshTunnel) getServerConn() (*ssh.Client, bool, error) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	if s.isStopped() {
+		return nil, false, errors.New("SSH tunnel was stopped")
+	}
+	if s.client != nil {
+		return s.client, true, nil
+	}
+	client, err := s.connectToServerSsh()
+	if err != nil {
+		return nil, false, err
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Established SSH connection to %s", s.serverTunnelEndpoint))
+	s.client = client
+	go func() {
+		client.Wait()
+		output.VerbosePrint("[-] SSH connection closed")
+		s.dropServerConn(client)
+	}()
+	if s.keepAlive > 0 {
+		go s.sendKeepAlives(client)
+	}
+	return client, false, nil
+}
+
+// Closes the SSH connection and stops sharing it, unless it was already replaced.
+func (s *SshTunnel) dropServerConn(client *ssh.Client) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	if s.client == client {
+		s.client = nil
+	}
+	client.Close()
+}
+
+// Sends keepalive requests until the connection fails, so that dead connections are detected
+// before a beacon needs them and idle connections are not dropped by middleboxes.
+func (s *SshTunnel) sendKeepAlives(client *ssh.Client) {
+	ticker := time.NewTicker(s.keepAlive)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[-] SSH keepalive failed: %s", err.Error()))
+			s.dropServerConn(client)
+			return
+		}
+	}
+}
+
 func (s *SshTunnel) connectToServerSsh() (*ssh.Client, error) {
-	return ssh.Dial("tcp", s.serverTunnelEndpoint, s.config)
+	config := s.config
+	if len(s.agentSocket) > 0 {
+		// Keys held by the agent are tried first. The agent connection must stay open until authentication completes.
+		agentConn, err := net.Dial("unix", s.agentSocket)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not connect to SSH agent: %s", err.Error()))
+		}
+		defer agentConn.Close()
+		agentConfig := *s.config
+		agentConfig.Auth = append([]ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)}, s.config.Auth...)
+		config = &agentConfig
+	}
+	return ssh.Dial("tcp", s.serverTunnelEndpoint, config)
 }
 
 func getRandomListeningPort() int {
@@ -0,0 +1,536 @@
+package contact_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/mitre/gocat/contact"
+)
+
+// Minimal SSH server that accepts the authorized key, relays direct-tcpip channels to the backend,
+// and counts connections, channels and keepalive requests.
+type sshServer struct {
+	listener    net.Listener
+	backendAddr string
+	hostSigner  ssh.Signer
+	mutex       sync.Mutex
+	conns       []*ssh.ServerConn
+	channels    int
+	keepAlives  int
+	forwards    map[net.Listener]string // addresses of active remote port forwards
+}
+
+func newSshKey(t *testing.T) (ssh.Signer, ed25519.PrivateKey) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, privateKey
+}
+
+func newSshServer(t *testing.T, backendAddr string, authorizedKey ssh.PublicKey) *sshServer {
+	hostSigner, _ := newSshKey(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &sshServer{listener: listener, backendAddr: backendAddr, hostSigner: hostSigner, forwards: make(map[net.Listener]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handle(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *sshServer) handle(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mutex.Lock()
+	s.conns = append(s.conns, serverConn)
+	s.mutex.Unlock()
+	go func() {
+		for request := range requests {
+			if request.Type == "keepalive@openssh.com" {
+				s.mutex.Lock()
+				s.keepAlives++
+				s.mutex.Unlock()
+			}
+			if request.Type == "tcpip-forward" {
+				request.Reply(s.startForward(serverConn, request.Payload), nil)
+				continue
+			}
+			if request.WantReply {
+				request.Reply(false, nil)
+			}
+		}
+	}()
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+		s.mutex.Lock()
+		s.channels++
+		s.mutex.Unlock()
+		go func() {
+			defer channel.Close()
+			backend, err := net.Dial("tcp", s.backendAddr)
+			if err != nil {
+				return
+			}
+			defer backend.Close()
+			go io.Copy(backend, channel)
+			io.Copy(channel, backend)
+		}()
+	}
+}
+
+// Listens on the requested address and forwards accepted connections to the client.
+func (s *sshServer) startForward(serverConn *ssh.ServerConn, payload []byte) bool {
+	var forward struct {
+		Addr string
+		Port uint32
+	}
+	if err := ssh.Unmarshal(payload, &forward); err != nil {
+		return false
+	}
+	bindAddr := net.JoinHostPort(forward.Addr, strconv.Itoa(int(forward.Port)))
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return false
+	}
+	s.mutex.Lock()
+	s.forwards[listener] = bindAddr
+	s.mutex.Unlock()
+	go func() {
+		serverConn.Wait()
+		listener.Close()
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.forwards, listener)
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			originAddr, originPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			port, _ := strconv.Atoi(originPort)
+			channel, requests, err := serverConn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+				Addr       string
+				Port       uint32
+				OriginAddr string
+				OriginPort uint32
+			}{forward.Addr, forward.Port, originAddr, uint32(port)}))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				defer channel.Close()
+				defer conn.Close()
+				go io.Copy(channel, conn)
+				io.Copy(conn, channel)
+			}()
+		}
+	}()
+	return true
+}
+
+func (s *sshServer) getForwards() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var forwards []string
+	for _, bindAddr := range s.forwards {
+		forwards = append(forwards, bindAddr)
+	}
+	return forwards
+}
+
+func (s *sshServer) getCounts() (int, int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conns), s.channels, s.keepAlives
+}
+
+func (s *sshServer) closeConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	for listener := range s.forwards {
+		listener.Close()
+		delete(s.forwards, listener)
+	}
+}
+
+func encodePrivateKey(t *testing.T, privateKey ed25519.PrivateKey) string {
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(block))
+}
+
+func startSshTunnel(t *testing.T, server *sshServer, options map[string]string) contact.Tunnel {
+	tunnelConfig, err := contact.BuildTunnelConfig("SSH", server.listener.Addr().String(), "http://127.0.0.1:8888", "agent", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnelConfig.Options = options
+	tunnel, err := contact.CommunicationTunnelFactories["SSH"](tunnelConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnelReady := make(chan bool)
+	go tunnel.Start(tunnelReady)
+	if !<-tunnelReady {
+		t.Fatal("SSH tunnel failed to start")
+	}
+	t.Cleanup(tunnel.Stop)
+	return tunnel
+}
+
+// Sends a request through the tunnel over a new local connection.
+func getThroughTunnel(tunnel contact.Tunnel) error {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	resp, err := client.Get(tunnel.GetLocalEndpoint())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	return err
+}
+
+func newSshBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+}
+
+func TestSshTunnelKeyAuthReusesConnection(t *testing.T) {
+	backend := newSshBackend()
+	defer backend.Close()
+	clientSigner, privateKey := newSshKey(t)
+	server := newSshServer(t, backend.Listener.Addr().String(), clientSigner.PublicKey())
+	defer server.listener.Close()
+
+	tunnel := startSshTunnel(t, server, map[string]string{
+		"sshPrivateKey": encodePrivateKey(t, privateKey),
+		"sshHostKey":    ssh.FingerprintSHA256(server.hostSigner.PublicKey()),
+	})
+	for i := 0; i < 3; i++ {
+		if err := getThroughTunnel(tunnel); err != nil {
+			t.Fatalf("request %d through SSH tunnel failed: %s", i, err.Error())
+		}
+	}
+	if conns, channels, _ := server.getCounts(); conns != 1 || channels != 3 {
+		t.Errorf("expected 3 channels over 1 SSH connection, got %d channels over %d connections", channels, conns)
+	}
+}
+
+func TestSshTunnelHostKeyMismatch(t *testing.T) {
+	backend := newSshBackend()
+	defer backend.Close()
+	clientSigner, privateKey := newSshKey(t)
+	otherSigner, _ := newSshKey(t)
+	server := newSshServer(t, backend.Listener.Addr().String(), clientSigner.PublicKey())
+	defer server.listener.Close()
+
+	tunnel := startSshTunnel(t, server, map[string]string{
+		"sshPrivateKey": encodePrivateKey(t, privateKey),
+		"sshHostKey":    ssh.FingerprintLegacyMD5(otherSigner.PublicKey()),
+	})
+	if err := getThroughTunnel(tunnel); err == nil {
+		t.Errorf("expected request through SSH tunnel to fail with mismatched host key")
+	}
+	if conns, _, _ := server.getCounts(); conns != 0 {
+		t.Errorf("expected no SSH connections with mismatched host key, got %d", conns)
+	}
+}
+
+func TestSshTunnelAgentAuth(t *testing.T) {
+	backend := newSshBackend()
+	defer backend.Close()
+	clientSigner, privateKey := newSshKey(t)
+	server := newSshServer(t, backend.Listener.Addr().String(), clientSigner.PublicKey())
+	defer server.listener.Close()
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: privateKey}); err != nil {
+		t.Fatal(err)
+	}
+	agentSocket := filepath.Join(t.TempDir(), "agent.sock")
+	agentListener, err := net.Listen("unix", agentSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agentListener.Close()
+	go func() {
+		for {
+			conn, err := agentListener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", agentSocket)
+
+	tunnel := startSshTunnel(t, server, map[string]string{"sshAgent": "true"})
+	if err := getThroughTunnel(tunnel); err != nil {
+		t.Errorf("request through SSH tunnel with agent auth failed: %s", err.Error())
+	}
+}
+
+func TestSshTunnelReconnectAndKeepAlive(t *testing.T) {
+	backend := newSshBackend()
+	defer backend.Close()
+	clientSigner, privateKey := newSshKey(t)
+	server := newSshServer(t, backend.Listener.Addr().String(), clientSigner.PublicKey())
+	defer server.listener.Close()
+
+	tunnel := startSshTunnel(t, server, map[string]string{
+		"sshPrivateKey": encodePrivateKey(t, privateKey),
+		"sshKeepAlive":  "20ms",
+	})
+	if err := getThroughTunnel(tunnel); err != nil {
+		t.Fatalf("request through SSH tunnel failed: %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, _, keepAlives := server.getCounts(); keepAlives == 0 {
+		t.Errorf("expected keepalive requests over idle SSH connection")
+	}
+
+	// The tunnel should transparently reconnect after losing the SSH connection.
+	server.closeConnections()
+	time.Sleep(50 * time.Millisecond)
+	if err := getThroughTunnel(tunnel); err != nil {
+		t.Fatalf("request through SSH tunnel after reconnect failed: %s", err.Error())
+	}
+	if conns, channels, _ := server.getCounts(); conns != 2 || channels != 2 {
+		t.Errorf("expected 2 channels over 2 SSH connections, got %d channels over %d connections", channels, conns)
+	}
+}
+
+// Returns an unused local port.
+func getFreePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// Waits until the SSH server has the expected number of active remote port forwards.
+func waitForForwards(server *sshServer, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if forwards := server.getForwards(); len(forwards) == count {
+			return forwards
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server.getForwards()
+}
+
+func TestSshTunnelReverseForwards(t *testing.T) {
+	clientSigner, privateKey := newSshKey(t)
+	server := newSshServer(t, "", clientSigner.PublicKey())
+	defer server.listener.Close()
+
+	// Service on the agent's network that operators want to reach from the C2 host.
+	agentService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("agent-side service"))
+	}))
+	defer agentService.Close()
+
+	bindPort := getFreePort(t)
+	startSshTunnel(t, server, map[string]string{
+		"sshPrivateKey":      encodePrivateKey(t, privateKey),
+		"sshReverseForwards": "127.0.0.1:" + bindPort + ":" + agentService.Listener.Addr().String(),
+	})
+	for attempt := 0; attempt < 2; attempt++ {
+		forwards := waitForForwards(server, 1)
+		if len(forwards) != 1 || forwards[0] != "127.0.0.1:"+bindPort {
+			t.Fatalf("expected reverse forward on 127.0.0.1:%s, got %v", bindPort, forwards)
+		}
+		resp, err := http.Get("http://127.0.0.1:" + bindPort)
+		if err != nil {
+			t.Fatalf("request through reverse forward failed: %s", err.Error())
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "agent-side service" {
+			t.Errorf("unexpected response through reverse forward: %s", body)
+		}
+
+		// The forward should be registered again after the SSH connection drops.
+		if attempt == 0 {
+			http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+			server.closeConnections()
+		}
+	}
+	if conns, _, _ := server.getCounts(); conns != 2 {
+		t.Errorf("expected reverse forwards to reconnect once, got %d SSH connections", conns)
+	}
+}
+
+func TestSshTunnelRetriesFailedReverseForwards(t *testing.T) {
+	clientSigner, privateKey := newSshKey(t)
+	server := newSshServer(t, "", clientSigner.PublicKey())
+	defer server.listener.Close()
+
+	// The second bind port is taken on the SSH server, so only the first forward registers at first.
+	freePort := getFreePort(t)
+	takenListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, takenPort, _ := net.SplitHostPort(takenListener.Addr().String())
+	startSshTunnel(t, server, map[string]string{
+		"sshPrivateKey":      encodePrivateKey(t, privateKey),
+		"sshKeepAlive":       "20ms",
+		"sshReverseForwards": "127.0.0.1:" + freePort + ":127.0.0.1:80,127.0.0.1:" + takenPort + ":127.0.0.1:80",
+	})
+	if forwards := waitForForwards(server, 1); len(forwards) != 1 || forwards[0] != "127.0.0.1:"+freePort {
+		t.Fatalf("expected reverse forward on 127.0.0.1:%s, got %v", freePort, forwards)
+	}
+
+	// The failed forward should be registered on the keepalive timer over the same SSH connection.
+	takenListener.Close()
+	if forwards := waitForForwards(server, 2); len(forwards) != 2 {
+		t.Fatalf("expected failed reverse forward to be registered again, got %v", forwards)
+	}
+	if conns, _, _ := server.getCounts(); conns != 1 {
+		t.Errorf("expected reverse forwards to share one SSH connection, got %d SSH connections", conns)
+	}
+}
+
+func TestInvalidSshReverseForwards(t *testing.T) {
+	for _, forwards := range []string{"8080", "8080:localhost", "a:b:c:d:e", "8080::80", "x:localhost:80"} {
+		tunnelConfig, err := contact.BuildTunnelConfig("SSH", "127.0.0.1:22", "http://127.0.0.1:8888", "agent", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnelConfig.Options["sshReverseForwards"] = forwards
+		if _, err := contact.CommunicationTunnelFactories["SSH"](tunnelConfig); err == nil {
+			t.Errorf("expected error for SSH reverse forwards %s", forwards)
+		}
+	}
+}
+
+// Waits until connections to the address are refused.
+func waitForClosed(addr string) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSshTunnelStopAndHealth(t *testing.T) {
+	backend := newSshBackend()
+	defer backend.Close()
+	clientSigner, privateKey := newSshKey(t)
+	server := newSshServer(t, backend.Listener.Addr().String(), clientSigner.PublicKey())
+	defer server.listener.Close()
+
+	tunnel := startSshTunnel(t, server, map[string]string{"sshPrivateKey": encodePrivateKey(t, privateKey)})
+	if !tunnel.Healthy() {
+		t.Fatalf("expected SSH tunnel to be healthy")
+	}
+
+	// A dropped SSH connection is replaced by the health check.
+	server.closeConnections()
+	time.Sleep(50 * time.Millisecond)
+	if !tunnel.Healthy() {
+		t.Errorf("expected SSH tunnel to be healthy after reconnecting")
+	}
+	if conns, _, _ := server.getCounts(); conns != 2 {
+		t.Errorf("expected health check to reconnect once, got %d SSH connections", conns)
+	}
+
+	tunnel.Stop()
+	if tunnel.Healthy() {
+		t.Errorf("expected stopped SSH tunnel to be unhealthy")
+	}
+	if !waitForClosed(strings.TrimPrefix(tunnel.GetLocalEndpoint(), "http://")) {
+		t.Errorf("expected local endpoint of stopped SSH tunnel to be closed")
+	}
+	if err := getThroughTunnel(tunnel); err == nil {
+		t.Errorf("expected request through stopped SSH tunnel to fail")
+	}
+	if conns, _, _ := server.getCounts(); conns != 2 {
+		t.Errorf("expected stopped SSH tunnel not to reconnect, got %d SSH connections", conns)
+	}
+}
+
+func TestSshTunnelUnhealthyWithoutServer(t *testing.T) {
+	clientSigner, privateKey := newSshKey(t)
+	server := newSshServer(t, "", clientSigner.PublicKey())
+	tunnel := startSshTunnel(t, server, map[string]string{"sshPrivateKey": encodePrivateKey(t, privateKey)})
+	if !tunnel.Healthy() {
+		t.Fatalf("expected SSH tunnel to be healthy")
+	}
+	server.listener.Close()
+	server.closeConnections()
+	time.Sleep(50 * time.Millisecond)
+	if tunnel.Healthy() {
+		t.Errorf("expected SSH tunnel to be unhealthy once the server is unreachable")
+	}
+}
@@ -3,16 +3,23 @@ package contact
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+var tunnelHealthCheckTimeout = 10 * time.Second
+
 // Tunnel defines required functions for providing a comms tunnel between agent and C2.
 type Tunnel interface {
 	GetName() string
 	Start(tunnelReady chan bool) // must be run as a go routine
 	GetLocalEndpoint() string // agent-side endpoint for tunnel
 	GetRemoteEndpoint() string // tunnel destination endpoint
+	Stop() // stops accepting connections and closes the connection to the tunnel server, causing Start to return
+	Healthy() bool // whether the tunnel is running and can reach the tunnel server
 }
 
 type TunnelConfig struct {
@@ -23,6 +30,64 @@ type TunnelConfig struct {
 	RemoteAddr string // IP address or hostname that tunnel will ultimately connect to
 	RemotePort int // Port that tunnel will ultimately connect to
 	TunneledProtocol string // protocol that the tunnel will carry
+	Options map[string]string // additional tunnel-specific settings
+}
+
+// Tracks the local listener of a tunnel so that it can be stopped and its health checked.
+type tunnelListener struct {
+	listener net.Listener
+	stopped bool
+	listenerMutex sync.Mutex
+}
+
+// Listens on the local tunnel endpoint, unless the tunnel was already stopped.
+func (t *tunnelListener) listen(endpoint string) (net.Listener, error) {
+	t.listenerMutex.Lock()
+	defer t.listenerMutex.Unlock()
+	if t.stopped {
+		return nil, errors.New("Tunnel was stopped.")
+	}
+	listener, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	t.listener = listener
+	return listener, nil
+}
+
+// Called when accepting a connection fails. Returns true if the listener is closed, either because the
+// tunnel was stopped or because the listener died, in which case the accept loop should return.
+func (t *tunnelListener) acceptFailed(err error) bool {
+	t.listenerMutex.Lock()
+	defer t.listenerMutex.Unlock()
+	if t.stopped || errors.Is(err, net.ErrClosed) {
+		t.listener = nil
+		return true
+	}
+	return false
+}
+
+// Closes the listener and prevents the tunnel from listening again.
+func (t *tunnelListener) stop() {
+	t.listenerMutex.Lock()
+	defer t.listenerMutex.Unlock()
+	t.stopped = true
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+}
+
+func (t *tunnelListener) isStopped() bool {
+	t.listenerMutex.Lock()
+	defer t.listenerMutex.Unlock()
+	return t.stopped
+}
+
+func (t *tunnelListener) isListening() bool {
+	t.listenerMutex.Lock()
+	defer t.listenerMutex.Unlock()
+	return t.listener != nil
 }
 
 // CommunicationTunnels contains maps available Tunnel names to their respective factory methods.
@@ -54,6 +119,7 @@ func BuildTunnelConfig(protocol, tunnelEndpoint, destEndpoint, user, password st
 		RemoteAddr: remoteAddr,
 		RemotePort: remotePort,
 		TunneledProtocol: tunneledProtocol,
+		Options: make(map[string]string),
 	}, nil
 }
 
@@ -46,6 +46,9 @@ func runAgent(sandcatAgent *agent.Agent, c2Config map[string]string) {
 	var sleepDuration float64
 
 	for evaluateWatchdog(checkin, watchdog) {
+		// Make sure the tunnel, if any, is still usable before contacting C2 through it.
+		sandcatAgent.CheckTunnel()
+
 		// Send beacon and get response.
 		beacon := sandcatAgent.Beacon()
 
@@ -81,6 +84,13 @@ func runAgent(sandcatAgent *agent.Agent, c2Config map[string]string) {
 			}
 		}
 
+		// Check if we need to start, stop or restart P2P receivers
+		if beacon["receiver_change"] != nil {
+			if err := sandcatAgent.ProcessReceiverChange(beacon["receiver_change"]); err != nil {
+				output.VerbosePrint(fmt.Sprintf("[!] Error updating P2P receivers: %s", err.Error()))
+			}
+		}
+
 		// Handle instructions
 		if beacon["instructions"] != nil && len(beacon["instructions"].([]interface{})) > 0 {
 			// Run commands and send results.
@@ -123,6 +133,7 @@ func findPeers(last time.Time, sandcatAgent *agent.Agent) bool {
 	diff := float64(time.Now().Sub(last).Seconds())
 	if diff >= float64(rand.Intn(120)+minDiscoveryInterval) {
 		sandcatAgent.DiscoverPeers()
+		sandcatAgent.EvaluatePeers()
 		return true
 	} else {
 		return false
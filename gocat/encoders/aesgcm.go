@@ -0,0 +1,51 @@
+package encoders
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+const aes256KeySize = 32
+
+//AesGcmEncoder encrypts and decrypts data using AES-256-GCM
+type AesGcmEncoder struct {
+	name string
+}
+
+func init() {
+	DataEncoders["aes-gcm"] = &AesGcmEncoder{ name: "aes-gcm" }
+}
+
+func (a *AesGcmEncoder) GetName() string {
+	return a.name
+}
+
+// Encrypts the data using the 32-byte key in the config. Prepends the random part of the nonce to the
+// ciphertext, which follows the nonce prefix from the config if provided.
+func (a *AesGcmEncoder) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	aead, err := a.getAead(config)
+	if err != nil {
+		return nil, err
+	}
+	return sealWithAead(aead, data, config)
+}
+
+func (a *AesGcmEncoder) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	aead, err := a.getAead(config)
+	if err != nil {
+		return nil, err
+	}
+	return openWithAead(aead, data, config)
+}
+
+func (a *AesGcmEncoder) getAead(config map[string]interface{}) (cipher.AEAD, error) {
+	key, err := getConfigKey(config, aes256KeySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
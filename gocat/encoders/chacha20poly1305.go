@@ -0,0 +1,46 @@
+package encoders
+
+import (
+	"crypto/cipher"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+//ChaCha20Poly1305Encoder encrypts and decrypts data using ChaCha20-Poly1305
+type ChaCha20Poly1305Encoder struct {
+	name string
+}
+
+func init() {
+	DataEncoders["chacha20-poly1305"] = &ChaCha20Poly1305Encoder{ name: "chacha20-poly1305" }
+}
+
+func (c *ChaCha20Poly1305Encoder) GetName() string {
+	return c.name
+}
+
+// Encrypts the data using the 32-byte key in the config. Prepends the random part of the nonce to the
+// ciphertext, which follows the nonce prefix from the config if provided.
+func (c *ChaCha20Poly1305Encoder) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	aead, err := c.getAead(config)
+	if err != nil {
+		return nil, err
+	}
+	return sealWithAead(aead, data, config)
+}
+
+func (c *ChaCha20Poly1305Encoder) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	aead, err := c.getAead(config)
+	if err != nil {
+		return nil, err
+	}
+	return openWithAead(aead, data, config)
+}
+
+func (c *ChaCha20Poly1305Encoder) getAead(config map[string]interface{}) (cipher.AEAD, error) {
+	key, err := getConfigKey(config, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
@@ -1,5 +1,11 @@
 package encoders
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 // DataEncoder defines required functions for encoding/decoding data/files.
 type DataEncoder interface {
 	GetName() string
@@ -18,3 +24,15 @@ func GetAvailableDataEncoders() []string {
 	}
 	return encoderNames
 }
+
+// Returns the data encoder registered under the given name, or an error if no such encoder is available.
+// Names containing PIPELINE_SEPARATOR are treated as pipeline specs, e.g. "gzip|aes-gcm|base64".
+func GetDataEncoder(encoderName string) (DataEncoder, error) {
+	if strings.Contains(encoderName, PIPELINE_SEPARATOR) {
+		return NewPipelineEncoder(encoderName)
+	}
+	if encoder, ok := DataEncoders[encoderName]; ok {
+		return encoder, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Data encoder %s not available", encoderName))
+}
@@ -0,0 +1,189 @@
+package encoders_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/mitre/gocat/encoders"
+)
+
+var (
+	sampleData = []byte("sample exfil data that should survive a round trip")
+	sampleKey  = []byte("0123456789abcdef0123456789abcdef")
+)
+
+func TestKeyedEncodersRoundTrip(t *testing.T) {
+	configs := map[string]map[string]interface{}{
+		"raw key":    {"key": sampleKey},
+		"base64 key": {"key": base64.StdEncoding.EncodeToString(sampleKey)},
+	}
+	for _, encoderName := range []string{"aes-gcm", "chacha20-poly1305", "xor"} {
+		for configName, config := range configs {
+			verifyRoundTrip(t, encoderName+"/"+configName, encoderName, config)
+		}
+	}
+}
+
+func TestAeadEncodersWithNoncePrefix(t *testing.T) {
+	noncePrefix := []byte("0123")
+	config := map[string]interface{}{"key": sampleKey, "nonce": noncePrefix}
+	for _, encoderName := range []string{"aes-gcm", "chacha20-poly1305"} {
+		encoder := getEncoder(t, encoderName)
+		encoded := verifyRoundTrip(t, encoderName, encoderName, config)
+		if bytes.HasPrefix(encoded, noncePrefix) {
+			t.Errorf("%s: nonce prefix from config should not be prepended to the output", encoderName)
+		}
+		again, err := encoder.EncodeData(sampleData, config)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", encoderName, err.Error())
+		}
+		if bytes.Equal(encoded, again) {
+			t.Errorf("%s: expected a different nonce for each message", encoderName)
+		}
+		if _, err = encoder.DecodeData(encoded, map[string]interface{}{"key": sampleKey, "nonce": []byte("3210")}); err == nil {
+			t.Errorf("%s: expected error when decrypting with the wrong nonce prefix", encoderName)
+		}
+	}
+}
+
+func TestAeadEncodersWithStaticNonce(t *testing.T) {
+	nonce := []byte("0123456789ab")
+	config := map[string]interface{}{"key": sampleKey, "nonce": nonce}
+	for _, encoderName := range []string{"aes-gcm", "chacha20-poly1305"} {
+		encoder := getEncoder(t, encoderName)
+		if _, err := encoder.EncodeData(sampleData, config); err == nil {
+			t.Errorf("%s: expected error when encrypting with a static nonce", encoderName)
+		}
+		if _, err := encoder.EncodeData(sampleData, map[string]interface{}{"key": sampleKey, "nonce": []byte("01234")}); err == nil {
+			t.Errorf("%s: expected error for a nonce prefix without enough random bytes", encoderName)
+		}
+
+		// Ciphertext-only data encrypted elsewhere with a static nonce can still be decrypted.
+		encoded, err := encoder.EncodeData(sampleData, map[string]interface{}{"key": sampleKey})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", encoderName, err.Error())
+		}
+		ciphertext := encoded[len(nonce):]
+		decoded, err := encoder.DecodeData(ciphertext, map[string]interface{}{"key": sampleKey, "nonce": encoded[:len(nonce)]})
+		if err != nil || !bytes.Equal(decoded, sampleData) {
+			t.Errorf("%s: expected ciphertext to decrypt with a static nonce, got %q, %v", encoderName, decoded, err)
+		}
+	}
+}
+
+func TestAeadEncodersRejectBadInput(t *testing.T) {
+	for _, encoderName := range []string{"aes-gcm", "chacha20-poly1305"} {
+		encoder := getEncoder(t, encoderName)
+		if _, err := encoder.EncodeData(sampleData, map[string]interface{}{"key": []byte("short")}); err == nil {
+			t.Errorf("%s: expected error for short key", encoderName)
+		}
+		if _, err := encoder.EncodeData(sampleData, nil); err == nil {
+			t.Errorf("%s: expected error for missing key", encoderName)
+		}
+		encoded, err := encoder.EncodeData(sampleData, map[string]interface{}{"key": sampleKey})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", encoderName, err.Error())
+		}
+		wrongKey := bytes.Repeat([]byte("k"), len(sampleKey))
+		if _, err = encoder.DecodeData(encoded, map[string]interface{}{"key": wrongKey}); err == nil {
+			t.Errorf("%s: expected error when decrypting with the wrong key", encoderName)
+		}
+		encoded[len(encoded)-1] ^= 0xff
+		if _, err = encoder.DecodeData(encoded, map[string]interface{}{"key": sampleKey}); err == nil {
+			t.Errorf("%s: expected error for tampered ciphertext", encoderName)
+		}
+	}
+}
+
+func TestXorEncoderRollsKey(t *testing.T) {
+	encoder := getEncoder(t, "xor")
+	encoded, err := encoder.EncodeData([]byte{0x00, 0x00, 0x00, 0xff}, map[string]interface{}{"key": []byte{0x01, 0x02}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	want := []byte{0x01, 0x02, 0x01, 0xfd}
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("Expected %v, got %v", want, encoded)
+	}
+}
+
+func getEncoder(t *testing.T, encoderName string) encoders.DataEncoder {
+	encoder, err := encoders.GetDataEncoder(encoderName)
+	if err != nil {
+		t.Fatalf("Data encoder %s not registered: %s", encoderName, err.Error())
+	}
+	return encoder
+}
+
+func verifyRoundTrip(t *testing.T, testName string, encoderName string, config map[string]interface{}) []byte {
+	encoder := getEncoder(t, encoderName)
+	encoded, err := encoder.EncodeData(sampleData, config)
+	if err != nil {
+		t.Fatalf("%s: failed to encode: %s", testName, err.Error())
+	}
+	if bytes.Contains(encoded, sampleData) {
+		t.Errorf("%s: encoded output contains the plaintext", testName)
+	}
+	decoded, err := encoder.DecodeData(encoded, config)
+	if err != nil {
+		t.Fatalf("%s: failed to decode: %s", testName, err.Error())
+	}
+	if !bytes.Equal(decoded, sampleData) {
+		t.Errorf("%s: got %q after round trip, expected %q", testName, decoded, sampleData)
+	}
+	return encoded
+}
+
+func TestCompressionEncodersRoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte("compressible beacon data "), 200)
+	for _, encoderName := range []string{"gzip", "zlib", "zstd"} {
+		encoder := getEncoder(t, encoderName)
+		encoded, err := encoder.EncodeData(compressible, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to encode: %s", encoderName, err.Error())
+		}
+		if len(encoded) >= len(compressible) {
+			t.Errorf("%s: expected compressed output smaller than %d bytes, got %d", encoderName, len(compressible), len(encoded))
+		}
+		decoded, err := encoder.DecodeData(encoded, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %s", encoderName, err.Error())
+		}
+		if !bytes.Equal(decoded, compressible) {
+			t.Errorf("%s: round trip did not return the original data", encoderName)
+		}
+	}
+}
+
+func TestPipelineEncoder(t *testing.T) {
+	config := map[string]interface{}{"key": sampleKey}
+	encoder := getEncoder(t, "gzip | aes-gcm | base64")
+	if encoder.GetName() != "gzip|aes-gcm|base64" {
+		t.Errorf("Expected normalized pipeline name, got %s", encoder.GetName())
+	}
+	encoded := verifyRoundTrip(t, "pipeline", "gzip|aes-gcm|base64", config)
+
+	// Undo each stage by hand, in reverse order.
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		t.Fatalf("Final pipeline stage did not produce base64: %s", err.Error())
+	}
+	if decoded, err = getEncoder(t, "aes-gcm").DecodeData(decoded, config); err != nil {
+		t.Fatalf("Failed to decrypt pipeline output: %s", err.Error())
+	}
+	if decoded, err = getEncoder(t, "gzip").DecodeData(decoded, config); err != nil {
+		t.Fatalf("Failed to decompress pipeline output: %s", err.Error())
+	}
+	if !bytes.Equal(decoded, sampleData) {
+		t.Errorf("Got %q after manually decoding pipeline output, expected %q", decoded, sampleData)
+	}
+}
+
+func TestPipelineEncoderInvalidSpec(t *testing.T) {
+	for _, spec := range []string{"gzip|not-an-encoder", "gzip||base64"} {
+		if _, err := encoders.GetDataEncoder(spec); err == nil {
+			t.Errorf("Expected error for pipeline spec %q", spec)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package encoders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+//GzipEncoder compresses and decompresses data using gzip
+type GzipEncoder struct {
+	name string
+}
+
+func init() {
+	DataEncoders["gzip"] = &GzipEncoder{ name: "gzip" }
+}
+
+func (g *GzipEncoder) GetName() string {
+	return g.name
+}
+
+func (g *GzipEncoder) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (g *GzipEncoder) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
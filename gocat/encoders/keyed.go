@@ -0,0 +1,103 @@
+package encoders
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+const (
+	CONFIG_KEY   = "key"
+	CONFIG_NONCE = "nonce"
+
+	MIN_RANDOM_NONCE_SIZE = 8 // number of random bytes in each AEAD nonce when the config provides a nonce prefix
+)
+
+// Fetches the byte value for the given config entry. Byte slices are returned as-is, and strings are treated
+// as standard base64, which matches how byte slices are represented in JSON-marshalled instructions.
+// Returns nil and no error if the entry is not present.
+func getConfigBytes(config map[string]interface{}, entryName string) ([]byte, error) {
+	if config == nil {
+		return nil, nil
+	}
+	switch val := config[entryName].(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return val, nil
+	case string:
+		decoded, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid base64 value for encoder config entry %s: %s", entryName, err.Error()))
+		}
+		return decoded, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported type %T for encoder config entry %s", val, entryName))
+	}
+}
+
+// Fetches the key from the config and verifies that it has the required length.
+func getConfigKey(config map[string]interface{}, keySize int) ([]byte, error) {
+	key, err := getConfigBytes(config, CONFIG_KEY)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, errors.New("No key provided in encoder config.")
+	}
+	if keySize > 0 && len(key) != keySize {
+		return nil, errors.New(fmt.Sprintf("Encoder key must be %d bytes, got %d", keySize, len(key)))
+	}
+	return key, nil
+}
+
+// Encrypts the data using the given AEAD cipher. The nonce starts with the nonce prefix from the config, if any,
+// followed by random bytes, which are prepended to the output. A full-length nonce from the config is rejected,
+// since reusing it for every message under the same key breaks the cipher.
+func sealWithAead(aead cipher.AEAD, data []byte, config map[string]interface{}) ([]byte, error) {
+	noncePrefix, err := getConfigBytes(config, CONFIG_NONCE)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkNoncePrefix(aead, noncePrefix); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, noncePrefix)
+	nonceSuffix := nonce[len(noncePrefix):]
+	if _, err = rand.Read(nonceSuffix); err != nil {
+		return nil, err
+	}
+	return aead.Seal(append([]byte{}, nonceSuffix...), nonce, data, nil), nil
+}
+
+// Decrypts data produced by sealWithAead using the same config. A full-length nonce from the config is accepted for
+// data that only contains the ciphertext, such as payloads encrypted by the C2 server.
+func openWithAead(aead cipher.AEAD, data []byte, config map[string]interface{}) ([]byte, error) {
+	noncePrefix, err := getConfigBytes(config, CONFIG_NONCE)
+	if err != nil {
+		return nil, err
+	}
+	if len(noncePrefix) == aead.NonceSize() {
+		return aead.Open(nil, noncePrefix, data, nil)
+	}
+	if err = checkNoncePrefix(aead, noncePrefix); err != nil {
+		return nil, err
+	}
+	suffixSize := aead.NonceSize() - len(noncePrefix)
+	if len(data) < suffixSize {
+		return nil, errors.New("Encrypted data is shorter than the nonce.")
+	}
+	nonce := append(append([]byte{}, noncePrefix...), data[:suffixSize]...)
+	return aead.Open(nil, nonce, data[suffixSize:], nil)
+}
+
+// Verifies that the nonce prefix leaves enough random nonce bytes for each message.
+func checkNoncePrefix(aead cipher.AEAD, noncePrefix []byte) error {
+	if maxPrefixSize := aead.NonceSize() - MIN_RANDOM_NONCE_SIZE; len(noncePrefix) > maxPrefixSize {
+		return errors.New(fmt.Sprintf("Encoder nonce prefix must be at most %d bytes, got %d", maxPrefixSize, len(noncePrefix)))
+	}
+	return nil
+}
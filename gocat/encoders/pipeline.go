@@ -0,0 +1,64 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Separates encoder names in a pipeline spec, e.g. "gzip|aes-gcm|base64"
+const PIPELINE_SEPARATOR = "|"
+
+//PipelineEncoder chains several data encoders together. Encoding runs the stages in order,
+//and decoding runs them in reverse order. Every stage receives the same config.
+type PipelineEncoder struct {
+	name string
+	stages []DataEncoder
+}
+
+// Builds a pipeline encoder from a spec string of encoder names joined by PIPELINE_SEPARATOR.
+// Returns an error if the spec is empty or names an unavailable encoder.
+func NewPipelineEncoder(spec string) (*PipelineEncoder, error) {
+	var stages []DataEncoder
+	var stageNames []string
+	for _, stageName := range strings.Split(spec, PIPELINE_SEPARATOR) {
+		stageName = strings.TrimSpace(stageName)
+		if len(stageName) == 0 {
+			return nil, errors.New(fmt.Sprintf("Empty encoder name in pipeline spec %s", spec))
+		}
+		stage, ok := DataEncoders[stageName]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Data encoder %s in pipeline spec %s not available", stageName, spec))
+		}
+		stages = append(stages, stage)
+		stageNames = append(stageNames, stageName)
+	}
+	return &PipelineEncoder{
+		name: strings.Join(stageNames, PIPELINE_SEPARATOR),
+		stages: stages,
+	}, nil
+}
+
+func (p *PipelineEncoder) GetName() string {
+	return p.name
+}
+
+func (p *PipelineEncoder) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	var err error
+	for _, stage := range p.stages {
+		if data, err = stage.EncodeData(data, config); err != nil {
+			return nil, errors.New(fmt.Sprintf("Pipeline stage %s failed to encode data: %s", stage.GetName(), err.Error()))
+		}
+	}
+	return data, nil
+}
+
+func (p *PipelineEncoder) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	var err error
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		if data, err = p.stages[i].DecodeData(data, config); err != nil {
+			return nil, errors.New(fmt.Sprintf("Pipeline stage %s failed to decode data: %s", p.stages[i].GetName(), err.Error()))
+		}
+	}
+	return data, nil
+}
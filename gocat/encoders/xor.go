@@ -0,0 +1,35 @@
+package encoders
+
+//XorEncoder encodes and decodes data using a rolling XOR with the key from the config
+type XorEncoder struct {
+	name string
+}
+
+func init() {
+	DataEncoders["xor"] = &XorEncoder{ name: "xor" }
+}
+
+func (x *XorEncoder) GetName() string {
+	return x.name
+}
+
+func (x *XorEncoder) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	key, err := getConfigKey(config, 0)
+	if err != nil {
+		return nil, err
+	}
+	return xorWithKey(data, key), nil
+}
+
+func (x *XorEncoder) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	return x.EncodeData(data, config)
+}
+
+// XORs each data byte with the key byte at the same position, rolling over to the start of the key as needed.
+func xorWithKey(data []byte, key []byte) []byte {
+	output := make([]byte, len(data))
+	for i := range data {
+		output[i] = data[i] ^ key[i % len(key)]
+	}
+	return output
+}
@@ -0,0 +1,41 @@
+package encoders
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+//ZlibEncoder compresses and decompresses data using zlib
+type ZlibEncoder struct {
+	name string
+}
+
+func init() {
+	DataEncoders["zlib"] = &ZlibEncoder{ name: "zlib" }
+}
+
+func (z *ZlibEncoder) GetName() string {
+	return z.name
+}
+
+func (z *ZlibEncoder) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (z *ZlibEncoder) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,36 @@
+package encoders
+
+import (
+	"github.com/klauspost/compress/zstd"
+)
+
+//ZstdEncoder compresses and decompresses data using zstd
+type ZstdEncoder struct {
+	name string
+}
+
+func init() {
+	DataEncoders["zstd"] = &ZstdEncoder{ name: "zstd" }
+}
+
+func (z *ZstdEncoder) GetName() string {
+	return z.name
+}
+
+func (z *ZstdEncoder) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil), nil
+}
+
+func (z *ZstdEncoder) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(data, nil)
+}
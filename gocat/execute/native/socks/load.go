@@ -0,0 +1 @@
+package socks
\ No newline at end of file
@@ -0,0 +1,330 @@
+/*
+ * Mutual authentication and encryption between P2P peers. When a shared P2P key is compiled into the agent, P2P
+ * receivers only hand out client connections that complete a TLS 1.3 handshake with a certificate derived from the
+ * key, and P2P clients only accept receivers that present the same certificate. Agents built with different keys,
+ * or without a key, cannot relay through each other. Rejected client connections are kept for the agent profile.
+ */
+
+package p2pauth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/output"
+)
+
+var (
+	sharedKey        = "" // shared P2P key, set at compile time. Authentication is disabled if empty.
+	handshakeTimeout = 10 * time.Second
+	maxRejections    = 20
+
+	identity      *p2pIdentity
+	identityMutex sync.Mutex
+
+	rejections     []map[string]interface{}
+	rejectionMutex sync.Mutex
+)
+
+// Certificate and public key derived from the shared P2P key.
+type p2pIdentity struct {
+	key         string
+	certificate tls.Certificate
+	publicKey   ed25519.PublicKey
+	commonName  string
+}
+
+// Listener that only returns client connections that completed the P2P handshake.
+type authListener struct {
+	net.Listener
+	receiverName string
+	config       *tls.Config
+	conns        chan net.Conn
+	done         chan struct{}
+	acceptErr    error
+}
+
+// Enabled returns true if a shared P2P key was provided.
+func Enabled() bool {
+	identityMutex.Lock()
+	defer identityMutex.Unlock()
+	return len(sharedKey) > 0
+}
+
+// KeyFingerprint returns a short fingerprint derived from the shared P2P key, which peers can compare without
+// revealing the key. Returns an empty string if authentication is disabled.
+func KeyFingerprint() string {
+	if !Enabled() {
+		return ""
+	}
+	p2pId, err := getIdentity()
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to derive P2P identity: %s", err.Error()))
+		return ""
+	}
+	return p2pId.commonName
+}
+
+// SetKey sets the shared P2P key. An empty key disables authentication.
+func SetKey(key string) {
+	identityMutex.Lock()
+	defer identityMutex.Unlock()
+	sharedKey = key
+}
+
+// WrapListener returns a listener that performs the P2P handshake on accepted connections and only returns the
+// authenticated ones, recording the rejected connections for the given receiver. Returns the original listener if
+// authentication is disabled.
+func WrapListener(listener net.Listener, receiverName string) (net.Listener, error) {
+	if !Enabled() {
+		return listener, nil
+	}
+	config, err := serverConfig()
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &authListener{
+		Listener:     listener,
+		receiverName: receiverName,
+		config:       config,
+		conns:        make(chan net.Conn),
+		done:         make(chan struct{}),
+	}
+	go wrapped.acceptConnections()
+	return wrapped, nil
+}
+
+// ClientConn performs the client side of the P2P handshake over the given connection to a receiver. Returns the
+// original connection if authentication is disabled. The connection is closed if the handshake fails.
+func ClientConn(conn net.Conn) (net.Conn, error) {
+	if !Enabled() {
+		return conn, nil
+	}
+	config, err := clientConfig()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = handshake(tlsConn); err != nil {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("P2P handshake with receiver failed: %s", err.Error()))
+	}
+	return tlsConn, nil
+}
+
+// ConfigureHttpClient sets up the TLS client configuration of an HTTP contact to authenticate to HTTP P2P receivers,
+// which are recognized by their P2P certificate. Other servers are not affected, so contacts that connect to a peer
+// receiver must also check the receiver with VerifyReceiverCertificate. Does nothing if authentication is disabled.
+func ConfigureHttpClient(config *tls.Config) error {
+	if !Enabled() {
+		return nil
+	}
+	p2pId, err := getIdentity()
+	if err != nil {
+		return err
+	}
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &p2pId.certificate, nil
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) > 0 && state.PeerCertificates[0].Subject.CommonName == p2pId.commonName {
+			return p2pId.verifyCertificate(state.PeerCertificates[0])
+		}
+		return nil
+	}
+	return nil
+}
+
+// VerifyReceiverCertificate checks that the receiver presented the P2P certificate on the TLS connection. Always
+// succeeds if authentication is disabled.
+func VerifyReceiverCertificate(state tls.ConnectionState) error {
+	if !Enabled() {
+		return nil
+	}
+	p2pId, err := getIdentity()
+	if err != nil {
+		return err
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("peer did not present a P2P certificate")
+	}
+	return p2pId.verifyCertificate(state.PeerCertificates[0])
+}
+
+// GetRejections returns the most recent rejected P2P client connections.
+func GetRejections() []map[string]interface{} {
+	rejectionMutex.Lock()
+	defer rejectionMutex.Unlock()
+	rejectionsCopy := make([]map[string]interface{}, len(rejections))
+	copy(rejectionsCopy, rejections)
+	return rejectionsCopy
+}
+
+func recordRejection(receiverName string, address string, reason string) {
+	output.VerbosePrint(fmt.Sprintf("[!] %s receiver rejected unauthenticated P2P client %s: %s", receiverName, address, reason))
+	rejectionMutex.Lock()
+	defer rejectionMutex.Unlock()
+	rejections = append(rejections, map[string]interface{}{
+		"receiver": receiverName,
+		"address":  address,
+		"reason":   reason,
+		"time":     time.Now().UTC().Format(time.RFC3339),
+	})
+	if len(rejections) > maxRejections {
+		rejections = rejections[len(rejections)-maxRejections:]
+	}
+}
+
+func (l *authListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.acceptErr
+	}
+}
+
+// Accepts connections from the wrapped listener and authenticates them until the listener is closed.
+func (l *authListener) acceptConnections() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.acceptErr = err
+				close(l.done)
+				return
+			}
+			output.VerbosePrint(fmt.Sprintf("[!] Error accepting %s P2P connection: %s", l.receiverName, err.Error()))
+			continue
+		}
+		go l.authenticate(conn)
+	}
+}
+
+func (l *authListener) authenticate(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	if err := handshake(tlsConn); err != nil {
+		recordRejection(l.receiverName, conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		tlsConn.Close()
+	}
+}
+
+func handshake(tlsConn *tls.Conn) error {
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	return tlsConn.Handshake()
+}
+
+func serverConfig() (*tls.Config, error) {
+	p2pId, err := getIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS13,
+		Certificates:          []tls.Certificate{p2pId.certificate},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: p2pId.verifyRawCertificates,
+	}, nil
+}
+
+func clientConfig() (*tls.Config, error) {
+	p2pId, err := getIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{p2pId.certificate},
+
+		// The receiver certificate is verified against the P2P key instead of a certificate authority.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: p2pId.verifyRawCertificates,
+	}, nil
+}
+
+// Returns the identity for the current shared key, deriving it if needed.
+func getIdentity() (*p2pIdentity, error) {
+	identityMutex.Lock()
+	defer identityMutex.Unlock()
+	if identity != nil && identity.key == sharedKey {
+		return identity, nil
+	}
+	p2pId, err := deriveIdentity(sharedKey)
+	if err != nil {
+		return nil, err
+	}
+	identity = p2pId
+	return identity, nil
+}
+
+// Derives a self-signed ed25519 certificate from the shared key. All agents with the same key derive the same
+// key pair, so presenting the certificate proves knowledge of the key.
+func deriveIdentity(key string) (*p2pIdentity, error) {
+	privateKey := ed25519.NewKeyFromSeed(deriveBytes(key, "p2p identity"))
+	commonName := hex.EncodeToString(deriveBytes(key, "p2p name")[:8])
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &p2pIdentity{
+		key: key,
+		certificate: tls.Certificate{
+			Certificate: [][]byte{certBytes},
+			PrivateKey:  privateKey,
+		},
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+		commonName: commonName,
+	}, nil
+}
+
+func deriveBytes(key string, label string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func (p *p2pIdentity) verifyRawCertificates(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer did not present a P2P certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	return p.verifyCertificate(cert)
+}
+
+func (p *p2pIdentity) verifyCertificate(cert *x509.Certificate) error {
+	if publicKey, ok := cert.PublicKey.(ed25519.PublicKey); !ok || !publicKey.Equal(p.publicKey) {
+		return errors.New("peer certificate does not match the P2P key")
+	}
+	return nil
+}
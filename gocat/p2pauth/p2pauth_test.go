@@ -0,0 +1,200 @@
+package p2pauth_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/p2pauth"
+)
+
+func setKey(t *testing.T, key string) {
+	p2pauth.SetKey(key)
+	t.Cleanup(func() { p2pauth.SetKey("") })
+}
+
+// Starts an authenticating listener that echoes back the first five bytes of each connection.
+func startEchoReceiver(t *testing.T, receiverName string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err = p2pauth.WrapListener(listener, receiverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					conn.Write(buf)
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+// Connects to the receiver with the current key and returns the echoed data.
+func sendEcho(address string) (string, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return "", err
+	}
+	conn, err = p2pauth.ClientConn(conn)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	return string(buf), err
+}
+
+// Waits for the receiver to record a rejection, since the client may give up before the receiver does.
+func hasRejection(receiverName string) bool {
+	for attempt := 0; attempt < 100; attempt++ {
+		for _, rejection := range p2pauth.GetRejections() {
+			if rejection["receiver"] == receiverName {
+				return true
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestAuthenticatedPeers(t *testing.T) {
+	setKey(t, "shared-secret")
+	listener := startEchoReceiver(t, "AUTH_OK")
+	if echo, err := sendEcho(listener.Addr().String()); err != nil || echo != "hello" {
+		t.Fatalf("expected authenticated echo, got %q: %v", echo, err)
+	}
+	for _, rejection := range p2pauth.GetRejections() {
+		if rejection["receiver"] == "AUTH_OK" {
+			t.Errorf("expected no rejections for authenticated client, got %v", rejection)
+		}
+	}
+}
+
+func TestRejectsClientWithWrongKey(t *testing.T) {
+	setKey(t, "shared-secret")
+	listener := startEchoReceiver(t, "AUTH_WRONG_KEY")
+	p2pauth.SetKey("other-secret")
+	if _, err := sendEcho(listener.Addr().String()); err == nil {
+		t.Fatalf("expected client with wrong key to be rejected")
+	}
+	if !hasRejection("AUTH_WRONG_KEY") {
+		t.Errorf("expected rejection to be recorded, got %v", p2pauth.GetRejections())
+	}
+}
+
+func TestRejectsUnauthenticatedClient(t *testing.T) {
+	setKey(t, "shared-secret")
+	listener := startEchoReceiver(t, "AUTH_PLAIN")
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if _, err = io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	if !hasRejection("AUTH_PLAIN") {
+		t.Errorf("expected rejection to be recorded, got %v", p2pauth.GetRejections())
+	}
+}
+
+func TestAuthenticationDisabled(t *testing.T) {
+	if p2pauth.Enabled() {
+		t.Fatalf("expected authentication to be disabled without a key")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if wrapped, err := p2pauth.WrapListener(listener, "AUTH_DISABLED"); err != nil || wrapped != listener {
+		t.Errorf("expected listener to be returned as is")
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	if conn, err := p2pauth.ClientConn(clientConn); err != nil || conn != clientConn {
+		t.Errorf("expected connection to be returned as is")
+	}
+}
+
+func TestHttpClientAuthentication(t *testing.T) {
+	setKey(t, "shared-secret")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err = p2pauth.WrapListener(listener, "AUTH_HTTP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("ok"))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+	url := "https://" + listener.Addr().String()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if err = p2pauth.ConfigureHttpClient(tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("expected authenticated HTTP request to succeed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("unexpected response body: %s", body)
+	}
+
+	// Clients without the P2P certificate are rejected.
+	unauthenticated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if resp, err = unauthenticated.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected unauthenticated HTTP request to fail")
+	}
+	if !hasRejection("AUTH_HTTP") {
+		t.Errorf("expected rejection to be recorded, got %v", p2pauth.GetRejections())
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	if fingerprint := p2pauth.KeyFingerprint(); fingerprint != "" {
+		t.Errorf("expected no key fingerprint without a key, got %s", fingerprint)
+	}
+	defer p2pauth.SetKey("")
+	p2pauth.SetKey("shared-secret")
+	fingerprint := p2pauth.KeyFingerprint()
+	if len(fingerprint) == 0 || strings.Contains(fingerprint, "shared-secret") {
+		t.Errorf("unexpected key fingerprint %q", fingerprint)
+	}
+	p2pauth.SetKey("other-secret")
+	if p2pauth.KeyFingerprint() == fingerprint {
+		t.Errorf("expected different keys to have different fingerprints")
+	}
+}
@@ -0,0 +1,63 @@
+package pivot
+
+import (
+	"sort"
+	"sync"
+)
+
+// Pivot defines required functions for services that the agent runs to let operators reach into the target network.
+type Pivot interface {
+	GetStatus() map[string]interface{} // reported in the beacon profile
+	Stop()
+}
+
+var (
+	// Maps pivot names to the pivots currently running on the agent.
+	activePivots = map[string]Pivot{}
+	pivotMutex   sync.Mutex
+)
+
+// Tracks a running pivot so that its status is reported and it is stopped when the agent terminates.
+func RegisterPivot(name string, pivot Pivot) {
+	pivotMutex.Lock()
+	defer pivotMutex.Unlock()
+	activePivots[name] = pivot
+}
+
+// Stops tracking the pivot and returns it, if it was registered.
+func UnregisterPivot(name string) (Pivot, bool) {
+	pivotMutex.Lock()
+	defer pivotMutex.Unlock()
+	pivot, ok := activePivots[name]
+	delete(activePivots, name)
+	return pivot, ok
+}
+
+// Returns the status of each running pivot, ordered by pivot name.
+func GetPivotStatuses() []map[string]interface{} {
+	pivotMutex.Lock()
+	defer pivotMutex.Unlock()
+	names := make([]string, 0, len(activePivots))
+	for name := range activePivots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	statuses := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		status := activePivots[name].GetStatus()
+		status["name"] = name
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Stops and unregisters all running pivots.
+func StopPivots() {
+	pivotMutex.Lock()
+	pivots := activePivots
+	activePivots = map[string]Pivot{}
+	pivotMutex.Unlock()
+	for _, pivot := range pivots {
+		pivot.Stop()
+	}
+}
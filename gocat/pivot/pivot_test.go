@@ -0,0 +1,44 @@
+package pivot_test
+
+import (
+	"testing"
+
+	"github.com/mitre/gocat/pivot"
+)
+
+type testPivot struct {
+	stopped bool
+}
+
+func (p *testPivot) GetStatus() map[string]interface{} {
+	return map[string]interface{}{"stopped": p.stopped}
+}
+
+func (p *testPivot) Stop() {
+	p.stopped = true
+}
+
+func TestPivotRegistry(t *testing.T) {
+	first := &testPivot{}
+	second := &testPivot{}
+	pivot.RegisterPivot("socks5:127.0.0.1:1081", second)
+	pivot.RegisterPivot("socks5:127.0.0.1:1080", first)
+	statuses := pivot.GetPivotStatuses()
+	if len(statuses) != 2 || statuses[0]["name"] != "socks5:127.0.0.1:1080" || statuses[1]["name"] != "socks5:127.0.0.1:1081" {
+		t.Fatalf("expected statuses ordered by pivot name, got %v", statuses)
+	}
+
+	if unregistered, ok := pivot.UnregisterPivot("socks5:127.0.0.1:1081"); !ok || unregistered != second {
+		t.Errorf("expected to unregister the second pivot")
+	}
+	if _, ok := pivot.UnregisterPivot("socks5:127.0.0.1:1081"); ok {
+		t.Errorf("expected pivot to be unregistered only once")
+	}
+	pivot.StopPivots()
+	if !first.stopped || second.stopped {
+		t.Errorf("expected only registered pivots to be stopped")
+	}
+	if statuses := pivot.GetPivotStatuses(); len(statuses) != 0 {
+		t.Errorf("expected no pivots after stopping all, got %v", statuses)
+	}
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Settings for discovering peer receivers over mDNS and for advertising local receivers. Agents browse for the
+ * configured service on startup and periodically afterwards, and receivers that support advertising register
+ * themselves under the same service with TXT records describing how to reach them.
+ */
+
+// Keys of the TXT records that describe an advertised receiver.
+const (
+	ServiceTextProtocol       = "protocol"
+	ServiceTextCertificate    = "sha256"
+	ServiceTextKeyFingerprint = "key"
+	ServiceTextHops           = "hops"
+)
+
+// DiscoveryConfig contains the mDNS discovery and advertising settings. See ParseDiscoveryConfig for the settings.
+type DiscoveryConfig struct {
+	DiscoveryEnabled   bool
+	AdvertisingEnabled bool
+	Service            string
+	Domain             string
+	Timeout            time.Duration // how long to browse for peers
+	Interfaces         []string      // names of the network interfaces to use. Uses all multicast interfaces if empty.
+}
+
+var (
+	discoveryConfig = DiscoveryConfig{
+		DiscoveryEnabled:   true,
+		AdvertisingEnabled: true,
+		Service:            "_service._comms",
+		Domain:             "local.",
+		Timeout:            time.Second,
+	}
+	discoveryMutex sync.Mutex
+
+	// Number of peers between this agent and the C2 server, or -1 if unknown. Advertised to peers over mDNS.
+	agentHopCount = -1
+
+	// Closed and replaced whenever the hop count changes, so that advertised receivers can update their TXT records.
+	agentHopCountChanged = make(chan struct{})
+)
+
+// GetDiscoveryConfig returns the current mDNS discovery and advertising settings.
+func GetDiscoveryConfig() DiscoveryConfig {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	return discoveryConfig
+}
+
+// SetDiscoveryConfig replaces the mDNS discovery and advertising settings.
+func SetDiscoveryConfig(config DiscoveryConfig) {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	discoveryConfig = config
+}
+
+// GetAgentHopCount returns the number of peers between this agent and the C2 server, or -1 if unknown.
+func GetAgentHopCount() int {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	return agentHopCount
+}
+
+// WatchAgentHopCount returns the current hop count and a channel that is closed once the hop count changes.
+func WatchAgentHopCount() (int, <-chan struct{}) {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	return agentHopCount, agentHopCountChanged
+}
+
+// SetAgentHopCount sets the number of peers between this agent and the C2 server. Use -1 if unknown.
+func SetAgentHopCount(hops int) {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	if hops == agentHopCount {
+		return
+	}
+	agentHopCount = hops
+	close(agentHopCountChanged)
+	agentHopCountChanged = make(chan struct{})
+}
+
+// ParseDiscoveryConfig applies the settings "discover", "advertise", "service", "domain", "timeout" (a duration
+// such as 1s) and "interfaces" (comma-separated interface names) to the current settings. Missing settings keep
+// their current values.
+func ParseDiscoveryConfig(settings map[string]string) (DiscoveryConfig, error) {
+	config := GetDiscoveryConfig()
+	for setting, value := range settings {
+		switch setting {
+		case "discover", "advertise":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return DiscoveryConfig{}, errors.New(fmt.Sprintf("Invalid mDNS %s setting %s", setting, value))
+			}
+			if setting == "discover" {
+				config.DiscoveryEnabled = enabled
+			} else {
+				config.AdvertisingEnabled = enabled
+			}
+		case "service":
+			if len(value) == 0 {
+				return DiscoveryConfig{}, errors.New("mDNS service name cannot be empty")
+			}
+			config.Service = value
+		case "domain":
+			if len(value) == 0 {
+				return DiscoveryConfig{}, errors.New("mDNS domain cannot be empty")
+			}
+			config.Domain = value
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return DiscoveryConfig{}, errors.New(fmt.Sprintf("Invalid mDNS timeout %s", value))
+			}
+			config.Timeout = timeout
+		case "interfaces":
+			config.Interfaces = nil
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); len(name) > 0 {
+					config.Interfaces = append(config.Interfaces, name)
+				}
+			}
+		default:
+			return DiscoveryConfig{}, errors.New(fmt.Sprintf("Unsupported mDNS setting %s", setting))
+		}
+	}
+	return config, nil
+}
+
+// GetInterfaces returns the configured network interfaces, or nil to use all multicast interfaces.
+func (d DiscoveryConfig) GetInterfaces() ([]net.Interface, error) {
+	var ifaces []net.Interface
+	for _, name := range d.Interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid mDNS interface %s: %s", name, err.Error()))
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	return ifaces, nil
+}
+
+// BuildServiceText returns the TXT records to advertise a receiver with. The first record is the bare protocol name,
+// for peers that predate the key=value records. Empty values and unknown hop counts are left out.
+func BuildServiceText(protocol string, certFingerprint string, keyFingerprint string, hops int) []string {
+	text := []string{protocol, ServiceTextProtocol + "=" + protocol}
+	if len(certFingerprint) > 0 {
+		text = append(text, ServiceTextCertificate+"="+certFingerprint)
+	}
+	if len(keyFingerprint) > 0 {
+		text = append(text, ServiceTextKeyFingerprint+"="+keyFingerprint)
+	}
+	if hops >= 0 {
+		text = append(text, ServiceTextHops+"="+strconv.Itoa(hops))
+	}
+	return text
+}
+
+// ParseServiceText returns the key=value TXT records of an advertised receiver. The protocol falls back to the first
+// bare record for receivers that do not advertise it as a key=value record.
+func ParseServiceText(text []string) map[string]string {
+	records := make(map[string]string)
+	for _, record := range text {
+		if keyVal := strings.SplitN(record, "=", 2); len(keyVal) == 2 {
+			records[keyVal[0]] = keyVal[1]
+		}
+	}
+	if _, ok := records[ServiceTextProtocol]; !ok && len(text) > 0 && !strings.Contains(text[0], "=") {
+		records[ServiceTextProtocol] = text[0]
+	}
+	return records
+}
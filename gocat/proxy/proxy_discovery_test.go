@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseDiscoveryConfig(t *testing.T) {
+	settings := map[string]string{
+		"discover":   "false",
+		"advertise":  "true",
+		"service":    "_peers._tcp",
+		"domain":     "corp.",
+		"timeout":    "3s",
+		"interfaces": "eth0, eth1",
+	}
+	config, err := ParseDiscoveryConfig(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DiscoveryConfig{
+		AdvertisingEnabled: true,
+		Service:            "_peers._tcp",
+		Domain:             "corp.",
+		Timeout:            3 * time.Second,
+		Interfaces:         []string{"eth0", "eth1"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected %+v, got %+v", expected, config)
+	}
+	if config, err = ParseDiscoveryConfig(nil); err != nil || !reflect.DeepEqual(config, GetDiscoveryConfig()) {
+		t.Errorf("expected current config without settings, got %+v: %v", config, err)
+	}
+	invalidSettings := []map[string]string{
+		{"discover": "maybe"},
+		{"service": ""},
+		{"timeout": "soon"},
+		{"timeout": "-1s"},
+		{"port": "5353"},
+	}
+	for _, invalid := range invalidSettings {
+		if _, err = ParseDiscoveryConfig(invalid); err == nil {
+			t.Errorf("expected error for mDNS settings %v", invalid)
+		}
+	}
+	if _, err = (DiscoveryConfig{Interfaces: []string{"no-such-interface0"}}).GetInterfaces(); err == nil {
+		t.Errorf("expected error for unknown interface")
+	}
+}
+
+func TestServiceText(t *testing.T) {
+	text := BuildServiceText("HTTP", "abcd", "", -1)
+	if !reflect.DeepEqual(text, []string{"HTTP", "protocol=HTTP", "sha256=abcd"}) {
+		t.Errorf("unexpected service text %v", text)
+	}
+	records := ParseServiceText(BuildServiceText("HTTP", "", "1234", 2))
+	if records[ServiceTextProtocol] != "HTTP" || records[ServiceTextKeyFingerprint] != "1234" || records[ServiceTextHops] != "2" || len(records) != 3 {
+		t.Errorf("unexpected service records %v", records)
+	}
+	if records = ParseServiceText([]string{"HTTP", "sha256=abcd"}); records[ServiceTextProtocol] != "HTTP" {
+		t.Errorf("expected protocol from bare record, got %v", records)
+	}
+	if records = ParseServiceText(nil); len(records) != 0 {
+		t.Errorf("expected no records, got %v", records)
+	}
+}
+
+func TestWatchAgentHopCount(t *testing.T) {
+	defer SetAgentHopCount(-1)
+	SetAgentHopCount(1)
+	hops, hopsChanged := WatchAgentHopCount()
+	if hops != 1 {
+		t.Errorf("expected hop count 1, got %d", hops)
+	}
+	SetAgentHopCount(1)
+	select {
+	case <-hopsChanged:
+		t.Errorf("expected no change signal when the hop count stays the same")
+	default:
+	}
+	SetAgentHopCount(2)
+	select {
+	case <-hopsChanged:
+	default:
+		t.Fatalf("expected change signal when the hop count changes")
+	}
+	if hops, _ = WatchAgentHopCount(); hops != 2 {
+		t.Errorf("expected hop count 2, got %d", hops)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum number of downstream peers tracked per receiver. The least recently seen peer is dropped beyond this.
+const maxTrackedPeers = 50
+
+// PeerReporter is implemented by P2P receivers that track the downstream peers relaying through them.
+type PeerReporter interface {
+	GetPeers() []map[string]interface{}
+}
+
+// Statistics for a downstream peer that sent requests to a receiver.
+type peerStats struct {
+	paw           string
+	address       string // remote address of the most recent request
+	lastSeen      time.Time
+	bytesReceived int
+	bytesSent     int
+	requests      map[string]int // request counts by request type
+	errors        int
+	lastError     string
+}
+
+// Tracks downstream peer statistics for a receiver. The zero value is ready to use.
+type peerTracker struct {
+	peers map[string]*peerStats // keyed by peer paw, or by remote address for requests without a paw
+	mutex sync.Mutex
+}
+
+// Returns the request type name used in the peer statistics for the receiver-bound P2P message type.
+func getPeerRequestType(messageType int) string {
+	switch messageType {
+	case GET_INSTRUCTIONS:
+		return "beacon"
+	case GET_PAYLOAD_BYTES:
+		return "payload"
+	case SEND_EXECUTION_RESULTS:
+		return "results"
+	case SEND_FILE_UPLOAD_BYTES:
+		return "upload"
+	default:
+		return "unknown"
+	}
+}
+
+// Records a request relayed for the downstream peer. A non-nil err counts as a failed request.
+func (p *peerTracker) recordRequest(paw string, address string, requestType string, bytesReceived int, bytesSent int, err error) {
+	key := paw
+	if len(key) == 0 {
+		key = address
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.peers == nil {
+		p.peers = make(map[string]*peerStats)
+	}
+	peer, ok := p.peers[key]
+	if !ok {
+		if len(p.peers) >= maxTrackedPeers {
+			p.dropOldestPeer()
+		}
+		peer = &peerStats{paw: paw, requests: make(map[string]int)}
+		p.peers[key] = peer
+	}
+	peer.address = address
+	peer.lastSeen = time.Now()
+	peer.bytesReceived += bytesReceived
+	peer.bytesSent += bytesSent
+	peer.requests[requestType]++
+	if err != nil {
+		peer.errors++
+		peer.lastError = err.Error()
+	}
+}
+
+// Removes the least recently seen peer. Must be called with the mutex held.
+func (p *peerTracker) dropOldestPeer() {
+	var oldestKey string
+	var oldest time.Time
+	for key, peer := range p.peers {
+		if len(oldestKey) == 0 || peer.lastSeen.Before(oldest) {
+			oldestKey, oldest = key, peer.lastSeen
+		}
+	}
+	delete(p.peers, oldestKey)
+}
+
+// Returns a summary of each tracked downstream peer, most recently seen first.
+func (p *peerTracker) GetPeers() []map[string]interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	peerList := make([]*peerStats, 0, len(p.peers))
+	for _, peer := range p.peers {
+		peerList = append(peerList, peer)
+	}
+	sort.Slice(peerList, func(i, j int) bool { return peerList[i].lastSeen.After(peerList[j].lastSeen) })
+	summaries := make([]map[string]interface{}, 0, len(peerList))
+	for _, peer := range peerList {
+		requests := make(map[string]int, len(peer.requests))
+		for requestType, count := range peer.requests {
+			requests[requestType] = count
+		}
+		summary := map[string]interface{}{
+			"paw":            peer.paw,
+			"address":        peer.address,
+			"last_seen":      peer.lastSeen.UTC().Format(time.RFC3339),
+			"bytes_received": peer.bytesReceived,
+			"bytes_sent":     peer.bytesSent,
+			"requests":       requests,
+			"errors":         peer.errors,
+		}
+		if len(peer.lastError) > 0 {
+			summary["last_error"] = peer.lastError
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPeerTracker(t *testing.T) {
+	var tracker peerTracker
+	if peers := tracker.GetPeers(); len(peers) != 0 {
+		t.Errorf("expected no peers for new tracker, got %v", peers)
+	}
+	tracker.recordRequest("clientpaw", "10.0.0.5:50000", getPeerRequestType(GET_INSTRUCTIONS), 100, 200, nil)
+	tracker.recordRequest("clientpaw", "10.0.0.5:50001", getPeerRequestType(SEND_FILE_UPLOAD_BYTES), 50, 10, errors.New("upload failed"))
+	tracker.recordRequest("", "10.0.0.6:50000", getPeerRequestType(99), 5, 0, errors.New("invalid message"))
+
+	peers := tracker.GetPeers()
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers, got %v", peers)
+	}
+	if peers[0]["address"] != "10.0.0.6:50000" || peers[0]["paw"] != "" || peers[0]["requests"].(map[string]int)["unknown"] != 1 {
+		t.Errorf("expected most recent peer without paw to be tracked by address, got %v", peers[0])
+	}
+	client := peers[1]
+	requests := client["requests"].(map[string]int)
+	if client["address"] != "10.0.0.5:50001" || requests["beacon"] != 1 || requests["upload"] != 1 {
+		t.Errorf("unexpected client peer requests: %v", client)
+	}
+	if client["bytes_received"] != 150 || client["bytes_sent"] != 210 || client["errors"] != 1 || client["last_error"] != "upload failed" {
+		t.Errorf("unexpected client peer statistics: %v", client)
+	}
+}
+
+func TestPeerTrackerLimit(t *testing.T) {
+	var tracker peerTracker
+	for i := 0; i < maxTrackedPeers; i++ {
+		tracker.recordRequest("paw"+strconv.Itoa(i), "10.0.0.5:50000", "beacon", 0, 0, nil)
+	}
+	tracker.peers["paw0"].lastSeen = time.Now().Add(-time.Hour)
+	tracker.recordRequest("newpaw", "10.0.0.5:50000", "beacon", 0, 0, nil)
+	peers := tracker.GetPeers()
+	if len(peers) != maxTrackedPeers {
+		t.Fatalf("expected %d tracked peers, got %d", maxTrackedPeers, len(peers))
+	}
+	for _, peer := range peers {
+		if peer["paw"] == "paw0" {
+			t.Errorf("expected least recently seen peer to be dropped")
+		}
+	}
+}
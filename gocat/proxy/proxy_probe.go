@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitre/gocat/p2pauth"
+)
+
+// ErrProbeUnsupported is returned for peer receiver addresses that cannot be probed, such as SMB pipes.
+var ErrProbeUnsupported = errors.New("Probing is not supported for this peer receiver address")
+
+// ProbePeerReceiver connects to the peer receiver to check that it is reachable, and returns how long connecting took.
+// If the agent was compiled with a P2P key, the probe also completes the P2P handshake, so that only peers sharing
+// the key are reachable and probes are not rejected by them.
+func ProbePeerReceiver(protocol string, address string, timeout time.Duration) (time.Duration, error) {
+	return probe(protocol, address, timeout, true)
+}
+
+// ProbeServer connects to the C2 server to check that it is reachable, and returns how long connecting took. The
+// server does not take part in the P2P handshake, so only the connection is checked.
+func ProbeServer(protocol string, address string, timeout time.Duration) (time.Duration, error) {
+	return probe(protocol, address, timeout, false)
+}
+
+func probe(protocol string, address string, timeout time.Duration, handshake bool) (time.Duration, error) {
+	network, dialAddress, err := getProbeAddress(protocol, address)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout(network, dialAddress, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if handshake {
+		// The handshake sets its own deadline, so the connection is closed if the probe times out first.
+		rawConn := conn
+		timer := time.AfterFunc(timeout-time.Since(start), func() { rawConn.Close() })
+		conn, err = p2pauth.ClientConn(rawConn)
+		timer.Stop()
+		if err != nil {
+			return 0, err
+		}
+	}
+	latency := time.Since(start)
+	conn.Close()
+	return latency, nil
+}
+
+// Returns the network and address to dial to reach the peer receiver.
+func getProbeAddress(protocol string, address string) (string, string, error) {
+	switch protocol {
+	case "HTTP":
+		receiverUrl, err := url.Parse(address)
+		if err != nil {
+			return "", "", err
+		}
+		if len(receiverUrl.Port()) > 0 {
+			return "tcp", receiverUrl.Host, nil
+		}
+		if receiverUrl.Scheme == "https" {
+			return "tcp", net.JoinHostPort(receiverUrl.Hostname(), "443"), nil
+		}
+		return "tcp", net.JoinHostPort(receiverUrl.Hostname(), "80"), nil
+	case "TCP":
+		hostPort := strings.TrimPrefix(address, "tcp://")
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			return "", "", errors.New(fmt.Sprintf("Invalid TCP receiver address %s", address))
+		}
+		return "tcp", hostPort, nil
+	case "UnixSocket":
+		// Socket paths calculated from a hostname depend on the client settings.
+		if filepath.IsAbs(address) {
+			return "unix", address, nil
+		}
+	}
+	return "", "", ErrProbeUnsupported
+}
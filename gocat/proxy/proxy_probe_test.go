@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbePeerReceiver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	for _, receiver := range [][]string{{"TCP", address}, {"TCP", "tcp://" + address}, {"HTTP", "http://" + address + "#sha256=abcd"}} {
+		if _, err = ProbePeerReceiver(receiver[0], receiver[1], time.Second); err != nil {
+			t.Errorf("expected %s receiver %s to be reachable: %v", receiver[0], receiver[1], err)
+		}
+	}
+	listener.Close()
+	if _, err = ProbePeerReceiver("TCP", address, time.Second); err == nil {
+		t.Errorf("expected closed receiver to be unreachable")
+	}
+	for _, receiver := range [][]string{{"SmbPipe", `\\host\pipe\name`}, {"UnixSocket", "hostname"}} {
+		if _, err = ProbePeerReceiver(receiver[0], receiver[1], time.Second); err != ErrProbeUnsupported {
+			t.Errorf("expected probing %s receiver %s to be unsupported, got %v", receiver[0], receiver[1], err)
+		}
+	}
+}
+
+func TestProbeAddress(t *testing.T) {
+	network, address, err := getProbeAddress("HTTP", "https://10.0.0.5")
+	if err != nil || network != "tcp" || address != "10.0.0.5:443" {
+		t.Errorf("expected default HTTPS port, got %s %s %v", network, address, err)
+	}
+	if _, _, err = getProbeAddress("TCP", "10.0.0.5"); err == nil {
+		t.Errorf("expected error for TCP address without port")
+	}
+	if network, address, _ = getProbeAddress("UnixSocket", "/tmp/peer.sock"); network != "unix" || address != "/tmp/peer.sock" {
+		t.Errorf("unexpected Unix socket probe address %s %s", network, address)
+	}
+}
@@ -0,0 +1,408 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+)
+
+/*
+ * Store-and-forward queue for relayed requests. While the upstream destination is unreachable, receivers queue the
+ * execution results and file uploads sent by downstream peers on disk instead of dropping them, and acknowledge them
+ * to the peers as queued. Execution results that fail to reach the upstream destination are queued as well, for
+ * contacts that report delivery failures. New requests are queued as well while older ones are still queued, so that
+ * requests reach the upstream destination in order. The queue is flushed upstream once a relayed beacon succeeds
+ * again, and a flush stops at the first request that fails, so that the rest stay queued.
+ *
+ * Queued requests are encrypted with a key that only lives in memory, so requests left on disk by an agent that exited
+ * cannot be read. The queue directory is removed once the queue is empty and when the agent terminates. The total size
+ * of the queued requests is capped, and requests beyond the cap are rejected.
+ */
+
+var (
+	relayQueueDir     = ""         // parent directory for the queue. Uses the temp directory if empty. Set at compile time.
+	relayQueueMaxSize = "33554432" // maximum total size in bytes of the queued requests. Set at compile time.
+)
+
+const (
+	queuedResultsRequest = "results"
+	queuedUploadRequest  = "upload"
+
+	// Number of times a queued request is sent before it is dropped, so that requests rejected upstream do not hold
+	// up the rest of the queue. Only failures while the upstream destination stays reachable count as attempts.
+	maxQueuedAttempts = 3
+)
+
+// Request from a downstream peer, queued until it can be forwarded upstream.
+type queuedRequest struct {
+	RequestType string
+	Profile     map[string]interface{}
+	Result      map[string]interface{}
+	UploadName  string
+	UploadData  []byte
+}
+
+// Queued request file and its size on disk.
+type queuedEntry struct {
+	path           string
+	size           int64
+	attempts       int  // failed attempts to send the request upstream
+	failurePending bool // whether the last attempt failed, and counts once the upstream is confirmed reachable
+	failedOutages  int  // number of upstream outages when the last attempt failed
+}
+
+// On-disk queue of relayed requests. The zero value is ready to use, and sets up its directory and key on first use.
+type relayQueue struct {
+	dir      string
+	aead     cipher.AEAD
+	maxSize  int64
+	size     int64 // total size of the queued entries
+	entries  []queuedEntry
+	nextId   int
+	flushing bool
+	mutex    sync.Mutex
+}
+
+var (
+	upstreamQueue       relayQueue
+	upstreamUnreachable bool // whether the most recent beacon to the upstream destination failed
+	upstreamOutages     int  // number of times the upstream destination was reported unreachable
+	upstreamMutex       sync.Mutex
+)
+
+// SetUpstreamReachable records whether the upstream destination of the agent is reachable. Relayed execution results
+// and uploads are queued while it is unreachable.
+func SetUpstreamReachable(reachable bool) {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	upstreamUnreachable = !reachable
+	if !reachable {
+		upstreamOutages++
+	}
+}
+
+func isUpstreamReachable() bool {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	return !upstreamUnreachable
+}
+
+// Returns whether the upstream destination is reachable, and the number of times it was reported unreachable.
+func getUpstreamState() (bool, int) {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	return !upstreamUnreachable, upstreamOutages
+}
+
+// GetQueuedRequestCount returns the number of relayed requests waiting for the upstream destination to be reachable.
+func GetQueuedRequestCount() int {
+	return upstreamQueue.length()
+}
+
+// Records the response to a relayed beacon. A missing response marks the upstream destination as unreachable, and any
+// other response marks it as reachable and flushes the queued requests upstream.
+func recordUpstreamBeacon(upstream contact.Contact, response []byte) {
+	if response == nil {
+		SetUpstreamReachable(false)
+		return
+	}
+	SetUpstreamReachable(true)
+	if upstreamQueue.length() > 0 {
+		upstreamQueue.confirmFailedAttempt()
+		go upstreamQueue.flush(upstream)
+	}
+}
+
+// RemoveRelayQueue drops the queued requests and removes the queue directory. Queued requests cannot be read once the
+// agent exits, so this is called when the agent terminates.
+func RemoveRelayQueue() {
+	upstreamQueue.remove()
+}
+
+// Forwards the execution results upstream. The results are queued if the upstream destination is unreachable, if
+// older requests are still queued, or if they fail to reach it, which marks it as unreachable. Returns whether the
+// results were queued.
+func forwardExecutionResults(upstream contact.Contact, profile map[string]interface{}, result map[string]interface{}) (bool, error) {
+	if isUpstreamReachable() && upstreamQueue.length() == 0 {
+		err := deliverExecutionResults(upstream, profile, result)
+		if err == nil {
+			return false, nil
+		}
+		output.VerbosePrint(fmt.Sprintf("[!] Error forwarding execution results upstream: %s", err.Error()))
+		SetUpstreamReachable(false)
+	}
+	if err := upstreamQueue.enqueue(queuedRequest{RequestType: queuedResultsRequest, Profile: profile, Result: result}); err != nil {
+		return false, err
+	}
+	output.VerbosePrint("[*] Queued execution results for later delivery.")
+	flushIfReachable(upstream)
+	return true, nil
+}
+
+// Sends the execution results upstream. Results sent with contacts that cannot report delivery failures only count
+// as delivered if the upstream destination is still reachable afterwards.
+func deliverExecutionResults(upstream contact.Contact, profile map[string]interface{}, result map[string]interface{}) error {
+	if deliverer, ok := upstream.(contact.ResultsDeliverer); ok {
+		return deliverer.DeliverExecutionResults(profile, result)
+	}
+	upstream.SendExecutionResults(profile, result)
+	if !isUpstreamReachable() {
+		return errors.New("Upstream became unreachable while sending execution results")
+	}
+	return nil
+}
+
+// Forwards the file upload upstream. The upload is queued if the upstream destination is unreachable, if older
+// requests are still queued, or if it fails to reach it, which marks it as unreachable. Returns whether the upload
+// was queued.
+func forwardUploadBytes(upstream contact.Contact, profile map[string]interface{}, uploadName string, data []byte) (bool, error) {
+	if isUpstreamReachable() && upstreamQueue.length() == 0 {
+		err := upstream.UploadFileBytes(profile, uploadName, data)
+		if err == nil {
+			return false, nil
+		}
+		output.VerbosePrint(fmt.Sprintf("[!] Error forwarding upload of file %s upstream: %s", uploadName, err.Error()))
+		SetUpstreamReachable(false)
+	}
+	request := queuedRequest{RequestType: queuedUploadRequest, Profile: profile, UploadName: uploadName, UploadData: data}
+	if err := upstreamQueue.enqueue(request); err != nil {
+		return false, err
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Queued upload of file %s for later delivery.", uploadName))
+	flushIfReachable(upstream)
+	return true, nil
+}
+
+// Flushes the queue behind a newly queued request, unless the upstream destination is unreachable.
+func flushIfReachable(upstream contact.Contact) {
+	if isUpstreamReachable() {
+		go upstreamQueue.flush(upstream)
+	}
+}
+
+// Sets up the encryption key and size cap, and creates the queue directory if it was removed. Must be called with the
+// mutex held.
+func (q *relayQueue) initialize() error {
+	if q.aead == nil {
+		maxSize, err := strconv.ParseInt(relayQueueMaxSize, 10, 64)
+		if err != nil || maxSize < 0 {
+			return errors.New(fmt.Sprintf("Invalid relay queue size %s", relayQueueMaxSize))
+		}
+		key := make([]byte, 32)
+		if _, err = io.ReadFull(rand.Reader, key); err != nil {
+			return err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		if q.aead, err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+		q.maxSize = maxSize
+	}
+	if len(q.dir) > 0 {
+		return nil
+	}
+	parentDir := relayQueueDir
+	if len(parentDir) == 0 {
+		parentDir = os.TempDir()
+	}
+	dir, err := os.MkdirTemp(parentDir, "")
+	if err != nil {
+		return err
+	}
+	q.dir = dir
+	return nil
+}
+
+// Drops the queued requests and removes the queue directory. The directory is created again for the next request.
+func (q *relayQueue) remove() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.removeDir()
+	q.entries = nil
+	q.size = 0
+}
+
+// Removes the queue directory. Must be called with the mutex held.
+func (q *relayQueue) removeDir() {
+	if len(q.dir) == 0 {
+		return
+	}
+	if err := os.RemoveAll(q.dir); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error removing relay queue directory %s: %s", q.dir, err.Error()))
+	}
+	q.dir = ""
+}
+
+func (q *relayQueue) length() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.entries)
+}
+
+// Encrypts the request and writes it to the queue. Returns an error if the queue would exceed its size cap.
+func (q *relayQueue) enqueue(request queuedRequest) error {
+	plaintext, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err = q.initialize(); err != nil {
+		return err
+	}
+	nonce := make([]byte, q.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	ciphertext := q.aead.Seal(nonce, nonce, plaintext, nil)
+	if q.size+int64(len(ciphertext)) > q.maxSize {
+		return errors.New(fmt.Sprintf("Relay queue is full. %d of %d bytes in use", q.size, q.maxSize))
+	}
+	path := filepath.Join(q.dir, fmt.Sprintf("%d.queued", q.nextId))
+	if err = os.WriteFile(path, ciphertext, 0600); err != nil {
+		return err
+	}
+	q.nextId++
+	q.entries = append(q.entries, queuedEntry{path: path, size: int64(len(ciphertext))})
+	q.size += int64(len(ciphertext))
+	return nil
+}
+
+// Reads and decrypts the queued request.
+func (q *relayQueue) readEntry(entry queuedEntry) (queuedRequest, error) {
+	var request queuedRequest
+	ciphertext, err := os.ReadFile(entry.path)
+	if err != nil {
+		return request, err
+	}
+	nonceSize := q.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return request, errors.New("Queued request is truncated")
+	}
+	plaintext, err := q.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+	if err != nil {
+		return request, err
+	}
+	err = json.Unmarshal(plaintext, &request)
+	return request, err
+}
+
+// Removes the oldest queued request, which must be the given entry, and the queue directory once the queue is empty.
+func (q *relayQueue) removeEntry(entry queuedEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.entries) == 0 || q.entries[0].path != entry.path {
+		return
+	}
+	q.removeOldest()
+}
+
+// Removes the oldest queued request, and the queue directory once the queue is empty. Must be called with the mutex
+// held.
+func (q *relayQueue) removeOldest() {
+	entry := q.entries[0]
+	q.entries = q.entries[1:]
+	q.size -= entry.size
+	os.Remove(entry.path)
+	if len(q.entries) == 0 {
+		q.removeDir()
+	}
+}
+
+// Records a failed attempt to send the oldest queued request, which must be the given entry. The attempt is only
+// counted once the upstream destination is confirmed reachable again without an outage in between, and not at all
+// if the upstream destination was unreachable when the attempt started or failed.
+func (q *relayQueue) recordFailedAttempt(entry queuedEntry, reachableBefore bool, outagesBefore int) {
+	reachable, outages := getUpstreamState()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.entries) == 0 || q.entries[0].path != entry.path {
+		return
+	}
+	q.entries[0].failurePending = reachableBefore && reachable && outages == outagesBefore
+	q.entries[0].failedOutages = outages
+}
+
+// Counts the pending failed attempt of the oldest queued request once a relayed beacon confirms that the upstream
+// destination is reachable, and drops the request if it keeps failing.
+func (q *relayQueue) confirmFailedAttempt() {
+	_, outages := getUpstreamState()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.entries) == 0 || !q.entries[0].failurePending {
+		return
+	}
+	entry := &q.entries[0]
+	entry.failurePending = false
+	if entry.failedOutages != outages {
+		return
+	}
+	entry.attempts++
+	if entry.attempts >= maxQueuedAttempts {
+		output.VerbosePrint(fmt.Sprintf("[!] Dropping queued request after %d attempts", maxQueuedAttempts))
+		q.removeOldest()
+	}
+}
+
+// Sends the queued requests upstream in the order they were queued. Stops and keeps the remaining requests queued if
+// a request fails. Only one flush runs at a time.
+func (q *relayQueue) flush(upstream contact.Contact) {
+	q.mutex.Lock()
+	if q.flushing {
+		q.mutex.Unlock()
+		return
+	}
+	q.flushing = true
+	q.mutex.Unlock()
+	defer func() {
+		q.mutex.Lock()
+		q.flushing = false
+		q.mutex.Unlock()
+	}()
+	for {
+		q.mutex.Lock()
+		if len(q.entries) == 0 {
+			q.mutex.Unlock()
+			return
+		}
+		entry := q.entries[0]
+		q.mutex.Unlock()
+		reachableBefore, outagesBefore := getUpstreamState()
+		request, err := q.readEntry(entry)
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Dropping unreadable queued request: %s", err.Error()))
+			q.removeEntry(entry)
+			continue
+		}
+		switch request.RequestType {
+		case queuedResultsRequest:
+			output.VerbosePrint(fmt.Sprintf("[*] Forwarding queued execution results on behalf of paw %s", getPawFromProfile(request.Profile)))
+			err = deliverExecutionResults(upstream, request.Profile, request.Result)
+		case queuedUploadRequest:
+			output.VerbosePrint(fmt.Sprintf("[*] Forwarding queued upload of file %s on behalf of paw %s", request.UploadName, getPawFromProfile(request.Profile)))
+			err = upstream.UploadFileBytes(request.Profile, request.UploadName, request.UploadData)
+		default:
+			output.VerbosePrint(fmt.Sprintf("[!] Dropping queued request of unknown type %s", request.RequestType))
+		}
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error forwarding queued %s request: %s", request.RequestType, err.Error()))
+			q.recordFailedAttempt(entry, reachableBefore, outagesBefore)
+			return
+		}
+		q.removeEntry(entry)
+	}
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Upstream contact that records the relayed requests, and fails uploads and results while uploadErr and resultsErr
+// are set.
+type fakeUpstream struct {
+	requests   []string
+	uploadErr  error
+	resultsErr error
+}
+
+func (f *fakeUpstream) GetBeaconBytes(profile map[string]interface{}) []byte { return nil }
+func (f *fakeUpstream) GetPayloadBytes(profile map[string]interface{}, payload string) ([]byte, string) {
+	return nil, ""
+}
+func (f *fakeUpstream) C2RequirementsMet(profile map[string]interface{}, c2Config map[string]string) (bool, map[string]string) {
+	return true, nil
+}
+func (f *fakeUpstream) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+	f.DeliverExecutionResults(profile, result)
+}
+func (f *fakeUpstream) DeliverExecutionResults(profile map[string]interface{}, result map[string]interface{}) error {
+	if f.resultsErr != nil {
+		return f.resultsErr
+	}
+	f.requests = append(f.requests, "results:"+result["id"].(string))
+	return nil
+}
+func (f *fakeUpstream) GetName() string                             { return "FAKE" }
+func (f *fakeUpstream) SetUpstreamDestAddr(upstreamDestAddr string) {}
+func (f *fakeUpstream) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
+	if f.uploadErr != nil {
+		return f.uploadErr
+	}
+	f.requests = append(f.requests, "upload:"+uploadName)
+	return nil
+}
+func (f *fakeUpstream) SupportsContinuous() bool { return false }
+
+// Replaces the relay queue with an empty one under a temporary directory.
+func useTestRelayQueue(t *testing.T, maxSize string) string {
+	originalDir, originalSize := relayQueueDir, relayQueueMaxSize
+	relayQueueDir, relayQueueMaxSize = t.TempDir(), maxSize
+	upstreamQueue = relayQueue{}
+	SetUpstreamReachable(true)
+	t.Cleanup(func() {
+		// Wait for flushes started by relayed beacons to finish.
+		for flushing := true; flushing; time.Sleep(10 * time.Millisecond) {
+			upstreamQueue.mutex.Lock()
+			flushing = upstreamQueue.flushing
+			upstreamQueue.mutex.Unlock()
+		}
+		relayQueueDir, relayQueueMaxSize = originalDir, originalSize
+		upstreamQueue = relayQueue{}
+		SetUpstreamReachable(true)
+	})
+	return relayQueueDir
+}
+
+func TestRelayQueue(t *testing.T) {
+	queueDir := useTestRelayQueue(t, "1048576")
+	upstream := &fakeUpstream{uploadErr: errors.New("connection refused")}
+	profile := map[string]interface{}{"paw": "clientpaw"}
+
+	// Uploads that fail to reach a reachable upstream are queued, and mark the upstream as unreachable.
+	if queued, err := forwardUploadBytes(upstream, profile, "secret.txt", []byte("top secret data")); err != nil || !queued {
+		t.Fatalf("expected undelivered upload to be queued, got %v, %v", queued, err)
+	}
+	if isUpstreamReachable() {
+		t.Errorf("expected upstream to be marked unreachable")
+	}
+
+	// Requests are queued while the upstream is unreachable.
+	if queued, err := forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link1"}); err != nil || !queued {
+		t.Fatalf("expected queued results, got %v, %v", queued, err)
+	}
+	if GetQueuedRequestCount() != 2 || len(upstream.requests) != 0 {
+		t.Fatalf("expected 2 queued requests, got %d and relayed %v", GetQueuedRequestCount(), upstream.requests)
+	}
+
+	// Queued requests are encrypted on disk.
+	files, _ := filepath.Glob(filepath.Join(queueDir, "*", "*.queued"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 queue files, got %v", files)
+	}
+	for _, file := range files {
+		if data, _ := os.ReadFile(file); bytes.Contains(data, []byte("clientpaw")) || bytes.Contains(data, []byte("top secret")) {
+			t.Errorf("queue file %s is not encrypted", file)
+		}
+	}
+
+	// Uploads that still fail keep the queue intact.
+	upstreamQueue.flush(upstream)
+	if GetQueuedRequestCount() != 2 {
+		t.Errorf("expected queue to be kept while uploads fail, got %d requests", GetQueuedRequestCount())
+	}
+
+	// The queue is flushed in order once the upstream is reachable.
+	upstream.uploadErr = nil
+	SetUpstreamReachable(true)
+	upstreamQueue.flush(upstream)
+	if len(upstream.requests) != 2 || upstream.requests[0] != "upload:secret.txt" || upstream.requests[1] != "results:link1" {
+		t.Errorf("unexpected flushed requests %v", upstream.requests)
+	}
+	if files, _ = filepath.Glob(filepath.Join(queueDir, "*", "*.queued")); GetQueuedRequestCount() != 0 || len(files) != 0 {
+		t.Errorf("expected empty queue after flush, got %d requests and files %v", GetQueuedRequestCount(), files)
+	}
+
+	// Requests are relayed directly while the upstream is reachable.
+	if queued, err := forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link2"}); err != nil || queued {
+		t.Errorf("expected results to be relayed directly, got %v, %v", queued, err)
+	}
+}
+
+func TestRelayQueueSizeCap(t *testing.T) {
+	useTestRelayQueue(t, "512")
+	SetUpstreamReachable(false)
+	upstream := &fakeUpstream{}
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	if _, err := forwardUploadBytes(upstream, profile, "small.txt", []byte("data")); err != nil {
+		t.Fatalf("expected small upload to be queued: %v", err)
+	}
+	if queued, err := forwardUploadBytes(upstream, profile, "large.txt", make([]byte, 1024)); err == nil || queued {
+		t.Errorf("expected error for upload beyond the queue size cap")
+	}
+	if GetQueuedRequestCount() != 1 {
+		t.Errorf("expected 1 queued request, got %d", GetQueuedRequestCount())
+	}
+}
+
+func TestRelayQueueDropsUnreadableRequests(t *testing.T) {
+	queueDir := useTestRelayQueue(t, "1048576")
+	SetUpstreamReachable(false)
+	upstream := &fakeUpstream{}
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link1"})
+	forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link2"})
+	files, _ := filepath.Glob(filepath.Join(queueDir, "*", "0.queued"))
+	if len(files) != 1 {
+		t.Fatalf("expected first queue file, got %v", files)
+	}
+	os.WriteFile(files[0], []byte("tampered"), 0600)
+	upstreamQueue.flush(upstream)
+	if len(upstream.requests) != 1 || upstream.requests[0] != "results:link2" || GetQueuedRequestCount() != 0 {
+		t.Errorf("expected tampered request to be dropped, got %v", upstream.requests)
+	}
+}
+
+// Confirms that the upstream is reachable and flushes the queue, as a successful relayed beacon does.
+func relayQueueBeacon(upstream *fakeUpstream) {
+	upstreamQueue.confirmFailedAttempt()
+	upstreamQueue.flush(upstream)
+}
+
+func TestRelayQueueDropsRejectedUploads(t *testing.T) {
+	useTestRelayQueue(t, "1048576")
+	SetUpstreamReachable(false)
+	upstream := &fakeUpstream{uploadErr: errors.New("upload rejected")}
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	forwardUploadBytes(upstream, profile, "rejected.txt", []byte("data"))
+	forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link1"})
+	SetUpstreamReachable(true)
+	for attempt := 0; attempt < maxQueuedAttempts; attempt++ {
+		relayQueueBeacon(upstream)
+		if len(upstream.requests) != 0 || GetQueuedRequestCount() != 2 {
+			t.Fatalf("expected upload to stay queued after %d attempts", attempt+1)
+		}
+	}
+	relayQueueBeacon(upstream)
+	if len(upstream.requests) != 1 || upstream.requests[0] != "results:link1" || GetQueuedRequestCount() != 0 {
+		t.Errorf("expected rejected upload to be dropped, got %v", upstream.requests)
+	}
+}
+
+func TestRelayQueueKeepsRequestsWhileUpstreamFlaps(t *testing.T) {
+	useTestRelayQueue(t, "1048576")
+	SetUpstreamReachable(false)
+	upstream := &fakeUpstream{uploadErr: errors.New("connection refused")}
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	forwardUploadBytes(upstream, profile, "secret.txt", []byte("data"))
+
+	// Failures followed by an upstream outage do not count as attempts.
+	for attempt := 0; attempt < 2*maxQueuedAttempts; attempt++ {
+		SetUpstreamReachable(true)
+		relayQueueBeacon(upstream)
+		SetUpstreamReachable(false)
+	}
+	if GetQueuedRequestCount() != 1 {
+		t.Fatalf("expected upload to stay queued while the upstream flaps")
+	}
+	upstream.uploadErr = nil
+	SetUpstreamReachable(true)
+	relayQueueBeacon(upstream)
+	if len(upstream.requests) != 1 || upstream.requests[0] != "upload:secret.txt" {
+		t.Errorf("expected upload to be delivered once the upstream is back, got %v", upstream.requests)
+	}
+}
+
+func TestRelayQueueKeepsOrder(t *testing.T) {
+	useTestRelayQueue(t, "1048576")
+	upstream := &fakeUpstream{uploadErr: errors.New("connection refused")}
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	forwardUploadBytes(upstream, profile, "first.txt", []byte("data"))
+	upstream.uploadErr = nil
+	SetUpstreamReachable(true)
+
+	// New requests queue behind the older ones while the upstream is reachable, and the queue is flushed behind them.
+	if queued, err := forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link1"}); err != nil || !queued {
+		t.Fatalf("expected results to be queued behind older requests, got %v, %v", queued, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for GetQueuedRequestCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if GetQueuedRequestCount() != 0 || len(upstream.requests) != 2 || upstream.requests[0] != "upload:first.txt" || upstream.requests[1] != "results:link1" {
+		t.Errorf("expected requests to be delivered in order, got %v", upstream.requests)
+	}
+}
+
+func TestRelayQueueKeepsUndeliveredResults(t *testing.T) {
+	useTestRelayQueue(t, "1048576")
+	upstream := &fakeUpstream{resultsErr: errors.New("connection reset")}
+	profile := map[string]interface{}{"paw": "clientpaw"}
+
+	// Results that fail to reach a reachable upstream are queued, and mark the upstream as unreachable.
+	if queued, err := forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link1"}); err != nil || !queued {
+		t.Fatalf("expected undelivered results to be queued, got %v, %v", queued, err)
+	}
+	if isUpstreamReachable() {
+		t.Errorf("expected upstream to be marked unreachable")
+	}
+	forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link2"})
+
+	// Results that still fail keep the queue intact.
+	upstreamQueue.flush(upstream)
+	if len(upstream.requests) != 0 || GetQueuedRequestCount() != 2 {
+		t.Fatalf("expected queue to be kept while results fail, got %d requests", GetQueuedRequestCount())
+	}
+	upstream.resultsErr = nil
+	upstreamQueue.flush(upstream)
+	if len(upstream.requests) != 2 || upstream.requests[0] != "results:link1" || upstream.requests[1] != "results:link2" {
+		t.Errorf("unexpected flushed requests %v", upstream.requests)
+	}
+}
+
+func TestRelayQueueRemovesDirectory(t *testing.T) {
+	queueDir := useTestRelayQueue(t, "1048576")
+	SetUpstreamReachable(false)
+	upstream := &fakeUpstream{}
+	profile := map[string]interface{}{"paw": "clientpaw"}
+	listQueueDirs := func() []string {
+		dirs, _ := filepath.Glob(filepath.Join(queueDir, "*"))
+		return dirs
+	}
+
+	// The directory is removed once the queue is flushed.
+	forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link1"})
+	if dirs := listQueueDirs(); len(dirs) != 1 {
+		t.Fatalf("expected queue directory, got %v", dirs)
+	}
+	upstreamQueue.flush(upstream)
+	if dirs := listQueueDirs(); len(dirs) != 0 {
+		t.Errorf("expected queue directory to be removed once empty, got %v", dirs)
+	}
+
+	// The directory is created again for the next request, and removed with the queued requests on exit.
+	forwardExecutionResults(upstream, profile, map[string]interface{}{"id": "link2"})
+	if dirs := listQueueDirs(); len(dirs) != 1 || GetQueuedRequestCount() != 1 {
+		t.Fatalf("expected queue directory to be created again, got %v", dirs)
+	}
+	RemoveRelayQueue()
+	if dirs := listQueueDirs(); len(dirs) != 0 || GetQueuedRequestCount() != 0 {
+		t.Errorf("expected queue to be removed, got %d requests and directories %v", GetQueuedRequestCount(), dirs)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+
+	"github.com/mitre/gocat/output"
+)
+
+// ConfigurableP2pReceiver is implemented by P2P receivers whose listening and advertising settings can be changed at
+// runtime. The settings apply the next time the receiver is initialized. See parseReceiverConfig for the settings.
+type ConfigurableP2pReceiver interface {
+	SetReceiverConfig(config map[string]string) error
+}
+
+// Listening and advertising settings for network P2P receivers. The zero value uses the receiver defaults.
+type receiverConfig struct {
+	bindAddress         string // local IP address to listen on. Listens on all addresses if empty.
+	port                int    // port to listen on. Uses a random port if 0.
+	advertisingDisabled bool   // whether to stop announcing the receiver to peers over mDNS.
+}
+
+// Parses the receiver settings "bindAddress", "port" and "advertise". Missing settings use the receiver defaults.
+func parseReceiverConfig(config map[string]string) (receiverConfig, error) {
+	var parsed receiverConfig
+	for setting, value := range config {
+		switch setting {
+		case "bindAddress":
+			if len(value) > 0 && net.ParseIP(value) == nil {
+				return receiverConfig{}, errors.New(fmt.Sprintf("Invalid receiver bind address %s", value))
+			}
+			parsed.bindAddress = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return receiverConfig{}, errors.New(fmt.Sprintf("Invalid receiver port %s", value))
+			}
+			parsed.port = port
+		case "advertise":
+			advertise, err := strconv.ParseBool(value)
+			if err != nil {
+				return receiverConfig{}, errors.New(fmt.Sprintf("Invalid receiver advertise setting %s", value))
+			}
+			parsed.advertisingDisabled = !advertise
+		default:
+			return receiverConfig{}, errors.New(fmt.Sprintf("Unsupported receiver setting %s", setting))
+		}
+	}
+	return parsed, nil
+}
+
+// Listens on the configured port, or on a random port in [minPort, maxPort) if no port is configured.
+// Returns the listener and its port.
+func (r receiverConfig) listenTcp(minPort int, maxPort int, maxRetries int) (net.Listener, int, error) {
+	if r.port > 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort(r.bindAddress, strconv.Itoa(r.port)))
+		return listener, r.port, err
+	}
+	for retryCount := 0; retryCount < maxRetries; retryCount++ {
+		port := rand.Intn(maxPort-minPort) + minPort
+		listener, err := net.Listen("tcp", net.JoinHostPort(r.bindAddress, strconv.Itoa(port)))
+		if err == nil {
+			return listener, port, nil
+		}
+		output.VerbosePrint(fmt.Sprintf("[-] Error trying to use random port %d: %s", port, err.Error()))
+	}
+	return nil, -1, errors.New(fmt.Sprintf("Failed to find available port %d consecutive times.", maxRetries))
+}
+
+// Returns the local IP addresses that peers can use to reach a receiver listening on the configured address.
+func (r receiverConfig) getReachableHosts() ([]string, error) {
+	if bindIp := net.ParseIP(r.bindAddress); bindIp != nil && !bindIp.IsUnspecified() {
+		return []string{r.bindAddress}, nil
+	}
+	return GetLocalIPv4Addresses()
+}
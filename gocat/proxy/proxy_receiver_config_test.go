@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestParseReceiverConfig(t *testing.T) {
+	config, err := parseReceiverConfig(map[string]string{"bindAddress": "127.0.0.1", "port": "51234", "advertise": "false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.bindAddress != "127.0.0.1" || config.port != 51234 || !config.advertisingDisabled {
+		t.Errorf("unexpected receiver config: %+v", config)
+	}
+	if config, err = parseReceiverConfig(nil); err != nil || config != (receiverConfig{}) {
+		t.Errorf("expected default receiver config, got %+v: %v", config, err)
+	}
+	invalidConfigs := []map[string]string{
+		{"bindAddress": "not-an-ip"},
+		{"port": "70000"},
+		{"port": "http"},
+		{"advertise": "sometimes"},
+		{"pipeName": "foo"},
+	}
+	for _, invalidConfig := range invalidConfigs {
+		if _, err = parseReceiverConfig(invalidConfig); err == nil {
+			t.Errorf("expected error for receiver config %v", invalidConfig)
+		}
+	}
+}
+
+func TestReceiverConfigListen(t *testing.T) {
+	// Find a free port to pin the receiver to.
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	config := receiverConfig{bindAddress: "127.0.0.1", port: port}
+	listener, listenPort, err := config.listenTcp(50000, 63000, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if listenPort != port || listener.Addr().String() != "127.0.0.1:"+strconv.Itoa(port) {
+		t.Errorf("expected listener on 127.0.0.1:%d, got %s", port, listener.Addr().String())
+	}
+	if hosts, err := config.getReachableHosts(); err != nil || len(hosts) != 1 || hosts[0] != "127.0.0.1" {
+		t.Errorf("expected bind address as only reachable host, got %v: %v", hosts, err)
+	}
+
+	// Pinned ports that are in use are not replaced with a random one.
+	if _, _, err = config.listenTcp(50000, 63000, 5); err == nil {
+		t.Errorf("expected error for pinned port already in use")
+	}
+}
@@ -0,0 +1,356 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+)
+
+/*
+ * Helpers shared by the P2P clients and receivers that exchange P2pMessage frames over stream connections
+ * (e.g. TCP or Unix domain sockets). Each frame is a 4-byte big-endian length followed by the JSON marshal of
+ * the P2pMessage. Every request frame gets exactly one response frame over the same connection, including
+ * execution results, which are acknowledged with an ACK_EXECUTION_RESULTS message. The acknowledgment and the
+ * upload response indicate whether the receiver queued the request because its upstream destination is unreachable.
+ */
+
+var maxStreamFrameSize = 64 * 1024 * 1024
+
+// Receiver-side state for forwarding stream P2P requests upstream.
+type streamForwarder struct {
+	agentPaw     string  // paw of agent running the receiver
+	agentServer  *string // refers to agent's current server value
+	receiverName string
+	upstreamComs *contact.Contact
+	peerTracker  // statistics for the downstream peers served by the receiver
+}
+
+// Implemented by stream P2P clients to send a request frame and return the payload of the response frame,
+// which must be of the expected type.
+type streamRequester interface {
+	sendRequest(paw string, messageType int, payload []byte, expectedType int) ([]byte, error)
+}
+
+// Writes a length-prefixed P2pMessage frame.
+func writeStreamFrame(writer io.Writer, paw string, messageType int, payload []byte, srcAddr string) error {
+	msgData, err := buildP2pMsgBytes(paw, messageType, payload, srcAddr)
+	if err != nil {
+		return err
+	}
+	if len(msgData) > maxStreamFrameSize {
+		return errors.New(fmt.Sprintf("P2P message of %d bytes exceeds max frame size of %d bytes", len(msgData), maxStreamFrameSize))
+	}
+	frame := make([]byte, 4+len(msgData))
+	binary.BigEndian.PutUint32(frame, uint32(len(msgData)))
+	copy(frame[4:], msgData)
+	_, err = writer.Write(frame)
+	return err
+}
+
+// Reads a length-prefixed P2pMessage frame. Returns io.EOF if the connection closed between frames.
+func readStreamFrame(reader io.Reader) (P2pMessage, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return P2pMessage{}, err
+	}
+	frameSize := binary.BigEndian.Uint32(header)
+	if frameSize > uint32(maxStreamFrameSize) {
+		return P2pMessage{}, errors.New(fmt.Sprintf("P2P message frame of %d bytes exceeds max frame size of %d bytes", frameSize, maxStreamFrameSize))
+	}
+	// The frame is read incrementally, so that the buffer only grows as the announced bytes actually arrive.
+	var msgData bytes.Buffer
+	if _, err := io.CopyN(&msgData, reader, int64(frameSize)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return P2pMessage{}, err
+	}
+	return bytesToP2pMsg(msgData.Bytes())
+}
+
+// Returns the payload of the response frame for a request, which must be of the expected type.
+func getStreamResponsePayload(respMessage P2pMessage, messageType int, expectedType int) ([]byte, error) {
+	if msgIsEmpty(respMessage) {
+		return nil, errors.New("Upstream receiver sent back empty message.")
+	} else if respMessage.MessageType != expectedType {
+		return nil, errors.New(fmt.Sprintf("Upstream receiver sent invalid response type %d for request type %d", respMessage.MessageType, messageType))
+	}
+	return respMessage.Payload, nil
+}
+
+/*
+ * Receiver-side helpers
+ */
+
+// Handles the requests sent over a client connection, in order, until the connection closes.
+func (f *streamForwarder) serveConnection(conn net.Conn, receiverAddress string) {
+	for {
+		message, err := readStreamFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				output.VerbosePrint(fmt.Sprintf("[-] Error reading P2P message from %s client: %s", f.receiverName, err.Error()))
+			}
+			return
+		}
+		responseType, responsePayload, err := f.handleMessage(message, receiverAddress)
+		f.recordRequest(message.SourcePaw, conn.RemoteAddr().String(), getPeerRequestType(message.MessageType),
+			len(message.Payload), len(responsePayload), getStreamRequestError(message.MessageType, responsePayload, err))
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error handling P2P message from paw %s: %s", message.SourcePaw, err.Error()))
+			return
+		}
+		if err = writeStreamFrame(conn, "", responseType, responsePayload, ""); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error sending response to %s client: %s", f.receiverName, err.Error()))
+			return
+		}
+	}
+}
+
+// Returns the error to record in the peer statistics for the handled request. Beacons without an upstream response
+// count as failed requests, since the client cannot reach the upstream server through this receiver.
+func getStreamRequestError(messageType int, responsePayload []byte, err error) error {
+	if err == nil && messageType == GET_INSTRUCTIONS && responsePayload == nil {
+		return errors.New("No beacon response from upstream")
+	}
+	return err
+}
+
+// Forwards the client request upstream and returns the response message type and payload for the client.
+// Returns an error if the request is invalid, in which case the client connection should be closed.
+func (f *streamForwarder) handleMessage(message P2pMessage, receiverAddress string) (int, []byte, error) {
+	if msgIsEmpty(message) {
+		return 0, nil, errors.New("Downstream agent sent an empty P2P message.")
+	}
+	switch message.MessageType {
+	case GET_INSTRUCTIONS:
+		return RESPONSE_INSTRUCTIONS, f.forwardGetBeaconBytes(message, receiverAddress), nil
+	case GET_PAYLOAD_BYTES:
+		respData, err := f.forwardPayloadBytesDownload(message)
+		return RESPONSE_PAYLOAD_BYTES, respData, err
+	case SEND_EXECUTION_RESULTS:
+		respData, err := f.forwardSendExecResults(message)
+		return ACK_EXECUTION_RESULTS, respData, err
+	case SEND_FILE_UPLOAD_BYTES:
+		respData, err := f.forwardSendUploadBytes(message)
+		return RESPONSE_FILE_UPLOAD, respData, err
+	default:
+		return 0, nil, errors.New(fmt.Sprintf("Invalid message type for receiver-bound P2P message: %d", message.MessageType))
+	}
+}
+
+// Pass the beacon request to the upstream destination, and return the response.
+func (f *streamForwarder) forwardGetBeaconBytes(message P2pMessage, receiverAddress string) []byte {
+	// Message payload contains profile to send upstream
+	clientProfile := make(map[string]interface{})
+	if err := json.Unmarshal(message.Payload, &clientProfile); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error extracting client profile from p2p message: %s", err.Error()))
+		return nil
+	}
+
+	// Make sure our paw is not in the peer chain (loop scenario)
+	if isInPeerChain(clientProfile, f.agentPaw) {
+		output.VerbosePrint("[!] Error: agent paw already in proxy chain, loop detected")
+		return nil
+	}
+	clientProfile["server"] = *f.agentServer
+
+	// Update peer proxy chain information to indicate that the beacon is going through this agent.
+	updatePeerChain(clientProfile, f.agentPaw, receiverAddress, f.receiverName)
+	output.VerbosePrint(fmt.Sprintf("[*] Forwarding instructions request on behalf of paw %s", message.SourcePaw))
+	response := (*f.upstreamComs).GetBeaconBytes(clientProfile)
+	recordUpstreamBeacon(*f.upstreamComs, response)
+	return response
+}
+
+// Pass the payload bytes download request to the upstream destination, and return the response.
+func (f *streamForwarder) forwardPayloadBytesDownload(message P2pMessage) ([]byte, error) {
+	// Message payload contains client profile and requested payload name.
+	var requestInfo payloadRequestInfo
+	if err := json.Unmarshal(message.Payload, &requestInfo); err != nil {
+		return nil, err
+	}
+	if requestInfo.Profile == nil {
+		return nil, errors.New("Client did not send profile information in payload request.")
+	}
+	if len(requestInfo.PayloadName) == 0 {
+		return nil, errors.New("Client did not send payload name in payload request.")
+	}
+	requestInfo.Profile["server"] = *f.agentServer
+	output.VerbosePrint(fmt.Sprintf("[*] Forwarding payload bytes request for payload %s on behalf of paw %s", requestInfo.PayloadName, message.SourcePaw))
+	payloadData, payloadName := (*f.upstreamComs).GetPayloadBytes(requestInfo.Profile, requestInfo.PayloadName)
+	return json.Marshal(payloadResponseInfo{
+		PayloadData: payloadData,
+		PayloadName: payloadName,
+	})
+}
+
+// Forwards or queues the execution results, and returns the acknowledgment payload for the client.
+func (f *streamForwarder) forwardSendExecResults(message P2pMessage) ([]byte, error) {
+	// Message payload contains client profile and result info.
+	clientProfile := make(map[string]interface{})
+	if err := json.Unmarshal(message.Payload, &clientProfile); err != nil {
+		return nil, err
+	}
+	resultList, ok := clientProfile["results"].([]interface{})
+	if !ok || len(resultList) == 0 {
+		return nil, errors.New("Client did not include execution results.")
+	}
+	result, ok := resultList[0].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Client sent malformed execution results.")
+	}
+	delete(clientProfile, "results")
+	clientProfile["server"] = *f.agentServer
+	output.VerbosePrint(fmt.Sprintf("[*] Forwarding execution results on behalf of paw %s", message.SourcePaw))
+	queued, err := forwardExecutionResults(*f.upstreamComs, clientProfile, result)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resultsResponseInfo{Queued: queued})
+}
+
+func (f *streamForwarder) forwardSendUploadBytes(message P2pMessage) ([]byte, error) {
+	// Message payload contains client profile and file upload name/data.
+	var requestInfo uploadRequestInfo
+	if err := json.Unmarshal(message.Payload, &requestInfo); err != nil {
+		return nil, err
+	}
+	successfulUpload, queued := false, false
+	if len(requestInfo.UploadName) == 0 {
+		output.VerbosePrint("[!] Error - client did not send upload name in upload request.")
+	} else if requestInfo.UploadData == nil || requestInfo.Profile == nil {
+		output.VerbosePrint("[!] Error. Client did not include file data or profile for upload.")
+	} else {
+		requestInfo.Profile["server"] = *f.agentServer
+		output.VerbosePrint(fmt.Sprintf("[*] Forwarding upload request for file %s on behalf of paw %s", requestInfo.UploadName, message.SourcePaw))
+		var err error
+		if queued, err = forwardUploadBytes(*f.upstreamComs, requestInfo.Profile, requestInfo.UploadName, requestInfo.UploadData); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error uploading file bytes for client: %s", err.Error()))
+		} else {
+			successfulUpload = true
+		}
+	}
+	return json.Marshal(uploadResponseInfo{
+		UploadName: requestInfo.UploadName,
+		Result:     successfulUpload,
+		Queued:     queued,
+	})
+}
+
+/*
+ * Client-side helpers
+ */
+
+func getStreamBeaconBytes(requester streamRequester, profile map[string]interface{}) []byte {
+	payload, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error marshaling profile: %s", err.Error()))
+		return nil
+	}
+	respPayload, err := requester.sendRequest(getPawFromProfile(profile), GET_INSTRUCTIONS, payload, RESPONSE_INSTRUCTIONS)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error obtaining instructions from upstream receiver: %s", err.Error()))
+		return nil
+	}
+	// Message payload contains beacon bytes.
+	return respPayload
+}
+
+func getStreamPayloadBytes(requester streamRequester, profile map[string]interface{}, payload string) ([]byte, string) {
+	msgPayload, err := json.Marshal(payloadRequestInfo{
+		PayloadName: payload,
+		Profile:     profile,
+	})
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error marshalling payload request info: %s", err.Error()))
+		return nil, ""
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] P2p Client Downloading new payload: %s", payload))
+	respPayload, err := requester.sendRequest(getPawFromProfile(profile), GET_PAYLOAD_BYTES, msgPayload, RESPONSE_PAYLOAD_BYTES)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error obtaining payload from upstream receiver: %s", err.Error()))
+		return nil, ""
+	}
+
+	// Message payload contains payload bytes and true filename.
+	var responseInfo payloadResponseInfo
+	if err = json.Unmarshal(respPayload, &responseInfo); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error unmarshalling payload response info: %s", err.Error()))
+		return nil, ""
+	}
+	if len(responseInfo.PayloadName) == 0 {
+		output.VerbosePrint("[!] Error. Upstream dest did not send payload name.")
+		return nil, ""
+	}
+	return responseInfo.PayloadData, responseInfo.PayloadName
+}
+
+func sendStreamExecutionResults(requester streamRequester, profile map[string]interface{}, result map[string]interface{}) {
+	if err := deliverStreamExecutionResults(requester, profile, result); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error sending execution results upstream: %s", err.Error()))
+	}
+}
+
+// Sends the execution results and returns an error if the upstream receiver did not acknowledge them.
+func deliverStreamExecutionResults(requester streamRequester, profile map[string]interface{}, result map[string]interface{}) error {
+	// Payload will contain JSON marshal of profile, with execution results
+	profileCopy := make(map[string]interface{})
+	for k, v := range profile {
+		profileCopy[k] = v
+	}
+	results := make([]map[string]interface{}, 1)
+	results[0] = result
+	profileCopy["results"] = results
+	msgPayload, err := json.Marshal(profileCopy)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error with profile marshal: %s", err.Error()))
+	}
+	output.VerbosePrint("[*] P2p Client: sending execution results to upstream receiver")
+	respPayload, err := requester.sendRequest(getPawFromProfile(profile), SEND_EXECUTION_RESULTS, msgPayload, ACK_EXECUTION_RESULTS)
+	if err != nil {
+		return err
+	}
+
+	// Receivers that predate queueing acknowledge results without a payload.
+	var responseInfo resultsResponseInfo
+	if len(respPayload) > 0 && json.Unmarshal(respPayload, &responseInfo) == nil && responseInfo.Queued {
+		output.VerbosePrint("[*] Upstream receiver queued the execution results until its upstream is reachable")
+	}
+	return nil
+}
+
+func uploadStreamFileBytes(requester streamRequester, profile map[string]interface{}, uploadName string, data []byte) error {
+	msgPayload, err := json.Marshal(uploadRequestInfo{
+		UploadName: uploadName,
+		UploadData: data,
+		Profile:    profile,
+	})
+	if err != nil {
+		return err
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] P2p Client: uploading file %s to upstream receiver", uploadName))
+	respPayload, err := requester.sendRequest(getPawFromProfile(profile), SEND_FILE_UPLOAD_BYTES, msgPayload, RESPONSE_FILE_UPLOAD)
+	if err != nil {
+		return err
+	}
+
+	// Message payload indicates true or false for upload success.
+	var responseInfo uploadResponseInfo
+	if err = json.Unmarshal(respPayload, &responseInfo); err != nil {
+		return err
+	}
+	if !responseInfo.Result {
+		return errors.New(fmt.Sprintf("Failed upload for file %s", responseInfo.UploadName))
+	}
+	if responseInfo.Queued {
+		output.VerbosePrint(fmt.Sprintf("[*] Upstream receiver queued upload of file %s until its upstream is reachable", uploadName))
+	}
+	return nil
+}
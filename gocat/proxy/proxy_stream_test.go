@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestStreamFraming(t *testing.T) {
+	clientConn, receiverConn := net.Pipe()
+	defer clientConn.Close()
+	defer receiverConn.Close()
+	go writeStreamFrame(clientConn, "paw", GET_INSTRUCTIONS, []byte("data"), "10.0.0.2:1234")
+	message, err := readStreamFrame(receiverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.SourcePaw != "paw" || message.MessageType != GET_INSTRUCTIONS || string(message.Payload) != "data" || message.SourceAddress != "10.0.0.2:1234" {
+		t.Errorf("unexpected P2P message: %+v", message)
+	}
+
+	// Oversized frames are rejected before allocating them.
+	go clientConn.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := readStreamFrame(receiverConn); err == nil {
+		t.Errorf("expected error for oversized frame")
+	}
+}
+
+func TestStreamFrameAllocation(t *testing.T) {
+	clientConn, receiverConn := net.Pipe()
+	defer receiverConn.Close()
+
+	// Frames that announce more data than they send do not allocate the announced size.
+	go func() {
+		clientConn.Write([]byte{0x03, 0xff, 0xff, 0xff})
+		clientConn.Write([]byte("{}"))
+		clientConn.Close()
+	}()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readStreamFrame(receiverConn)
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF for truncated frame, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Errorf("expected truncated frame not to allocate the announced size, allocated %d bytes", allocated)
+	}
+}
+
+func TestStreamResponsePayload(t *testing.T) {
+	response := P2pMessage{MessageType: RESPONSE_INSTRUCTIONS, Payload: []byte("beacon"), Populated: true}
+	if payload, err := getStreamResponsePayload(response, GET_INSTRUCTIONS, RESPONSE_INSTRUCTIONS); err != nil || string(payload) != "beacon" {
+		t.Errorf("unexpected response payload %s: %v", payload, err)
+	}
+	if _, err := getStreamResponsePayload(response, GET_PAYLOAD_BYTES, RESPONSE_PAYLOAD_BYTES); err == nil {
+		t.Errorf("expected error for mismatched response type")
+	}
+	if _, err := getStreamResponsePayload(P2pMessage{}, GET_INSTRUCTIONS, RESPONSE_INSTRUCTIONS); err == nil {
+		t.Errorf("expected error for empty response")
+	}
+}
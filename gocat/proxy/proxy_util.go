@@ -6,6 +6,37 @@ import (
 	"net"
 )
 
+// Auxiliary struct that defines P2P message payload structure for an ability payload request
+type payloadRequestInfo struct {
+	PayloadName string
+	Profile map[string]interface{}
+}
+
+// Auxiliary struct that defines P2P message payload structure for an ability payload response
+type payloadResponseInfo struct {
+	PayloadName string
+	PayloadData []byte
+}
+
+// Auxiliary struct that defines P2P message payload structure for an ability upload request
+type uploadRequestInfo struct {
+	UploadName string
+	UploadData []byte
+	Profile map[string]interface{}
+}
+
+// Auxiliary struct that defines P2P message payload structure for an ability upload response
+type uploadResponseInfo struct {
+	UploadName string
+	Result bool
+	Queued bool // whether the receiver queued the upload until its upstream destination is reachable
+}
+
+// Auxiliary struct that defines P2P message payload structure for an execution results acknowledgment
+type resultsResponseInfo struct {
+	Queued bool // whether the receiver queued the results until its upstream destination is reachable
+}
+
 // Build p2p message and return the bytes of its JSON marshal.
 func buildP2pMsgBytes(sourcePaw string, messageType int, payload []byte, srcAddr string) ([]byte, error) {
 	p2pMsg := &P2pMessage{
@@ -119,3 +150,11 @@ func GetLocalIPv4Addresses() ([]string, error) {
 	}
 	return localIpList, nil
 }
+
+// Return the paw from the profile.
+func getPawFromProfile(profile map[string]interface{}) string {
+	if profile["paw"] != nil {
+		return profile["paw"].(string)
+	}
+	return ""
+}
\ No newline at end of file
@@ -8,6 +8,7 @@ import (
 
 	"github.com/mitre/gocat/contact"
 	"github.com/mitre/gocat/core"
+	"github.com/mitre/gocat/proxy"
 )
 
 /*
@@ -23,6 +24,9 @@ var (
 	c2Key     = ""
 	listenP2P = "false" // need to set as string to allow ldflags -X build-time variable change on server-side.
 	httpProxyGateway = ""
+	c2Config = "" // additional contact config entries of the form key1=value1;key2=value2
+	httpProfile = "" // malleable HTTP profile as a base64-encoded JSON/YAML blob
+	mdnsConfig = "" // mDNS peer discovery and advertising settings of the form key1=value1;key2=value2
 	userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/60.0.3112.113 Safari/537.36"
 )
 
@@ -44,21 +48,59 @@ func main() {
 	tunnelAddr := flag.String("tunnelAddr", "", "Address used to connect to or start the tunnel.")
 	tunnelUsername := flag.String("tunnelUser", "", "Username used to authenticate to the tunnel.")
 	tunnelPassword := flag.String("tunnelPassword", "", "Password used to authenticate to the tunnel.")
+	tunnelOptions := flag.String("tunnelConfig", "", "Additional tunnel settings as semicolon-separated key=value pairs")
 	userAgentFlag := flag.String("userAgent", userAgent, "User agent string to use for HTTP-based C2 communications")
+	c2ConfigFlag := flag.String("c2Config", c2Config, "Additional C2 contact settings as semicolon-separated key=value pairs")
+	httpProfileFlag := flag.String("httpProfile", httpProfile, "Malleable HTTP profile for HTTP-based C2 communications. Accepts a file path, or a base64-encoded or raw JSON/YAML profile")
+	mdnsConfigFlag := flag.String("mdnsConfig", mdnsConfig, "mDNS peer discovery and advertising settings as semicolon-separated key=value pairs")
 
 	flag.Parse()
 
 	trimmedServer := strings.TrimRight(*server, "/")
 	tunnelConfig, err := contact.BuildTunnelConfig(*tunnelProtocol, *tunnelAddr, trimmedServer, *tunnelUsername, *tunnelPassword)
-	if err != nil && *verbose {
-		fmt.Println(fmt.Sprintf("[!] Error building tunnel config: %s", err.Error()))
+	if err != nil {
+		if *verbose {
+			fmt.Println(fmt.Sprintf("[!] Error building tunnel config: %s", err.Error()))
+		}
 		return
 	}
+	if len(*tunnelOptions) > 0 {
+		if tunnelConfig.Options, err = contact.ParseContactConfig(*tunnelOptions); err != nil {
+			if *verbose {
+				fmt.Println(fmt.Sprintf("[!] Error parsing tunnel config: %s", err.Error()))
+			}
+			return
+		}
+	}
 	contactConfig := map[string]string{
 		"c2Name": *c2Protocol,
 		"c2Key": c2Key,
 		"httpProxyGateway": *httpProxyUrl,
 		"httpUserAgent": *userAgentFlag,
+		"httpProfile": *httpProfileFlag,
+	}
+	additionalConfig, err := contact.ParseContactConfig(*c2ConfigFlag)
+	if err != nil {
+		if *verbose {
+			fmt.Println(fmt.Sprintf("[!] Error parsing C2 contact config: %s", err.Error()))
+		}
+		return
+	}
+	for configKey, configVal := range additionalConfig {
+		contactConfig[configKey] = configVal
+	}
+	discoverySettings, err := contact.ParseContactConfig(*mdnsConfigFlag)
+	if err == nil {
+		var discoveryConfig proxy.DiscoveryConfig
+		if discoveryConfig, err = proxy.ParseDiscoveryConfig(discoverySettings); err == nil {
+			proxy.SetDiscoveryConfig(discoveryConfig)
+		}
+	}
+	if err != nil {
+		if *verbose {
+			fmt.Println(fmt.Sprintf("[!] Error parsing mDNS config: %s", err.Error()))
+		}
+		return
 	}
 	core.Core(trimmedServer, tunnelConfig, *group, *delay, contactConfig, *listenP2P, *verbose, *paw, *originLinkID)
 }
\ No newline at end of file
@@ -1,4 +1,4 @@
-"""Tests for contact extensions: dns_tunneling, ftp, gist, slack."""
+"""Tests for contact extensions: dns_tunneling, ftp, gist, slack, http3, pac."""
 import re
 from unittest.mock import patch, MagicMock
 
@@ -31,7 +31,7 @@ class TestDnsTunneling:
         assert isinstance(dns_ext, Extension)
 
     def test_files(self, dns_ext):
-        assert dns_ext.files == [('dns_tunneling.go', 'contact')]
+        assert dns_ext.files == [('dns_tunneling.go', 'contact'), ('dns_tunneling_util.go', 'contact')]
 
     def test_dependencies(self, dns_ext):
         assert dns_ext.dependencies == ['github.com/miekg/dns']
@@ -199,3 +199,55 @@ class TestSlack:
         data = '{SLACK_C2_CHANNEL_ID} {SLACK_C2_CHANNEL_ID}'
         result = await slack_ext.hook_set_custom_channel(data)
         assert result.count('C99') == 1
+
+
+# ========================================================================
+# HTTP/3
+# ========================================================================
+class TestHttp3:
+    @pytest.fixture
+    def http3_ext(self):
+        from app.extensions.contact.http3 import Http3
+        return Http3()
+
+    def test_load_returns_instance(self):
+        from app.extensions.contact.http3 import load, Http3
+        assert isinstance(load(), Http3)
+
+    def test_is_extension(self, http3_ext):
+        assert isinstance(http3_ext, Extension)
+
+    def test_files(self, http3_ext):
+        assert http3_ext.files == [('http3_transport.go', 'contact')]
+
+    def test_dependencies(self, http3_ext):
+        assert http3_ext.dependencies == ['github.com/quic-go/quic-go/http3']
+
+    def test_no_file_hooks(self, http3_ext):
+        assert http3_ext.file_hooks == {}
+
+
+# ========================================================================
+# PAC
+# ========================================================================
+class TestPac:
+    @pytest.fixture
+    def pac_ext(self):
+        from app.extensions.contact.pac import Pac
+        return Pac()
+
+    def test_load_returns_instance(self):
+        from app.extensions.contact.pac import load, Pac
+        assert isinstance(load(), Pac)
+
+    def test_is_extension(self, pac_ext):
+        assert isinstance(pac_ext, Extension)
+
+    def test_files(self, pac_ext):
+        assert pac_ext.files == [('pac_evaluator.go', 'contact')]
+
+    def test_dependencies(self, pac_ext):
+        assert pac_ext.dependencies == ['github.com/dop251/goja']
+
+    def test_no_file_hooks(self, pac_ext):
+        assert pac_ext.file_hooks == {}
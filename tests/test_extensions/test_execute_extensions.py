@@ -1,4 +1,4 @@
-"""Tests for execute extensions: native, native_aws, shellcode, shells."""
+"""Tests for execute extensions: native, native_aws, native_socks, shellcode, shells."""
 import pytest
 
 from plugins.sandcat.app.utility.base_extension import Extension
@@ -91,6 +91,44 @@ class TestNativeAwsExecutor:
         assert wildcard_entries[0][1] == 'execute/native/aws'
 
 
+# ========================================================================
+# Native SOCKS5 Executor
+# ========================================================================
+
+class TestNativeSocksExecutor:
+    @pytest.fixture
+    def socks_ext(self):
+        from app.extensions.execute.native.native_socks import NativeSocksExecutor
+        return NativeSocksExecutor()
+
+    @pytest.fixture
+    def socks_load(self):
+        from app.extensions.execute.native.native_socks import load
+        return load
+
+    def test_load_returns_instance(self, socks_load):
+        ext = socks_load()
+        from app.extensions.execute.native.native_socks import NativeSocksExecutor
+        assert isinstance(ext, NativeSocksExecutor)
+
+    def test_is_extension(self, socks_ext):
+        assert isinstance(socks_ext, Extension)
+
+    def test_files(self, socks_ext):
+        expected = [
+            ('native.go', 'execute/native'),
+            ('*', 'execute/native/socks'),
+            ('util.go', 'execute/native/util'),
+        ]
+        assert socks_ext.files == expected
+
+    def test_no_dependencies(self, socks_ext):
+        assert socks_ext.dependencies == []
+
+    def test_no_file_hooks(self, socks_ext):
+        assert socks_ext.file_hooks == {}
+
+
 # ========================================================================
 # Shellcode
 # ========================================================================
@@ -1,4 +1,4 @@
-"""Tests for proxy extensions: proxy_http, proxy_smb_pipe."""
+"""Tests for proxy extensions: proxy_http, proxy_smb_pipe, proxy_tcp, proxy_unix_socket."""
 import pytest
 
 from plugins.sandcat.app.utility.base_extension import Extension
@@ -72,3 +72,69 @@ class TestProxySmbPipe:
 
     def test_no_file_hooks(self, smb_ext):
         assert smb_ext.file_hooks == {}
+
+
+# ========================================================================
+# Proxy TCP
+# ========================================================================
+
+class TestProxyTcp:
+    @pytest.fixture
+    def tcp_ext(self):
+        from app.extensions.proxy.proxy_tcp import ProxyTcp
+        return ProxyTcp()
+
+    @pytest.fixture
+    def tcp_load(self):
+        from app.extensions.proxy.proxy_tcp import load
+        return load
+
+    def test_load_returns_instance(self, tcp_load):
+        ext = tcp_load()
+        from app.extensions.proxy.proxy_tcp import ProxyTcp
+        assert isinstance(ext, ProxyTcp)
+
+    def test_is_extension(self, tcp_ext):
+        assert isinstance(tcp_ext, Extension)
+
+    def test_files(self, tcp_ext):
+        assert tcp_ext.files == [('proxy_tcp.go', 'proxy')]
+
+    def test_no_dependencies(self, tcp_ext):
+        assert tcp_ext.dependencies == []
+
+    def test_no_file_hooks(self, tcp_ext):
+        assert tcp_ext.file_hooks == {}
+
+
+# ========================================================================
+# Proxy Unix Socket
+# ========================================================================
+
+class TestProxyUnixSocket:
+    @pytest.fixture
+    def unix_socket_ext(self):
+        from app.extensions.proxy.proxy_unix_socket import ProxyUnixSocket
+        return ProxyUnixSocket()
+
+    @pytest.fixture
+    def unix_socket_load(self):
+        from app.extensions.proxy.proxy_unix_socket import load
+        return load
+
+    def test_load_returns_instance(self, unix_socket_load):
+        ext = unix_socket_load()
+        from app.extensions.proxy.proxy_unix_socket import ProxyUnixSocket
+        assert isinstance(ext, ProxyUnixSocket)
+
+    def test_is_extension(self, unix_socket_ext):
+        assert isinstance(unix_socket_ext, Extension)
+
+    def test_files(self, unix_socket_ext):
+        assert unix_socket_ext.files == [('proxy_unix_socket.go', 'proxy')]
+
+    def test_no_dependencies(self, unix_socket_ext):
+        assert unix_socket_ext.dependencies == []
+
+    def test_no_file_hooks(self, unix_socket_ext):
+        assert unix_socket_ext.file_hooks == {}
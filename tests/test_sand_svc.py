@@ -26,7 +26,8 @@ class TestModuleConstants:
         assert isinstance(default_flag_params, tuple)
 
     def test_default_flag_params_contents(self):
-        expected = ('server', 'group', 'listenP2P', 'c2', 'includeProxyPeers', 'userAgent')
+        expected = ('server', 'group', 'listenP2P', 'c2', 'includeProxyPeers', 'userAgent', 'c2Config',
+                    'httpProfile', 'p2pKey', 'mdnsConfig')
         assert default_flag_params == expected
 
     def test_library_flag_params(self):
@@ -392,6 +393,33 @@ class TestCompileNewAgent:
         assert 'encodedReceivers' in ldflags
         assert 'receiverKey' in ldflags
 
+    @pytest.mark.asyncio
+    async def test_p2p_key_ldflag(self, sand_svc):
+        sand_svc._install_gocat_extensions = AsyncMock(return_value=[])
+        sand_svc._uninstall_gocat_extensions = AsyncMock()
+        headers = {'file': 'sandcat.go', 'platform': 'linux', 'p2pKey': 'secret'}
+        await sand_svc._compile_new_agent(
+            platform='linux', headers=headers,
+            compile_target_name='sandcat.go', output_name='sandcat.go',
+            compile_target_dir='gocat'
+        )
+        ldflags = sand_svc.file_svc.compile_go.call_args.kwargs['ldflags']
+        assert 'github.com/mitre/gocat/p2pauth.sharedKey=' in ldflags
+        assert 'main.p2pKey' not in ldflags
+
+    @pytest.mark.asyncio
+    async def test_mdns_config_ldflag(self, sand_svc):
+        sand_svc._install_gocat_extensions = AsyncMock(return_value=[])
+        sand_svc._uninstall_gocat_extensions = AsyncMock()
+        headers = {'file': 'sandcat.go', 'platform': 'linux', 'mdnsConfig': 'discover=false;timeout=3s'}
+        await sand_svc._compile_new_agent(
+            platform='linux', headers=headers,
+            compile_target_name='sandcat.go', output_name='sandcat.go',
+            compile_target_dir='gocat'
+        )
+        ldflags = sand_svc.file_svc.compile_go.call_args.kwargs['ldflags']
+        assert 'main.mdnsConfig=' in ldflags
+
     @pytest.mark.asyncio
     async def test_extensions_installed_and_uninstalled(self, sand_svc):
         sand_svc._install_gocat_extensions = AsyncMock(return_value=['ext1'])